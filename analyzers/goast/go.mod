@@ -0,0 +1,3 @@
+module github.com/Ankushryuga/Github-MCP-PR-Reviewer/analyzers/goast
+
+go 1.21
@@ -0,0 +1,696 @@
+// Command goast parses Go sources for the MCP server's Go analyzers.
+//
+// It reads a JSON array of {"path", "source"} objects on stdin, runs the
+// analysis named by its first argument, and writes a JSON array of results,
+// one per input file, to stdout. Parse errors are reported per file so one
+// broken file does not hide results for the others.
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/scanner"
+	"go/token"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Source is one file to analyze.
+type Source struct {
+	Path   string `json:"path"`
+	Source string `json:"source"`
+}
+
+// Decl is a package-level declaration. For exported-decls, Line and EndLine
+// span the declaration header (a function's signature, not its body), which
+// is what has to intersect the diff for the declaration to count as changed.
+// For funcs they span the whole function, and Fingerprint identifies its
+// tokens, so two versions differing only in comments or formatting match;
+// Complexity is its cyclomatic complexity. For api, Signature is the declaration as written and Fingerprint covers
+// only the part of it that code using the declaration depends on.
+type Decl struct {
+	Name        string `json:"name"`
+	Kind        string `json:"kind"`
+	Receiver    string `json:"receiver,omitempty"`
+	Line        int    `json:"line"`
+	EndLine     int    `json:"end_line"`
+	HasDoc      bool   `json:"has_doc"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Signature   string `json:"signature,omitempty"`
+	Complexity  int    `json:"complexity,omitempty"`
+}
+
+// Issue is a risky construct found by the security analysis. Rule names the
+// check, and Line and EndLine span the offending expression.
+type Issue struct {
+	Rule    string `json:"rule"`
+	Line    int    `json:"line"`
+	EndLine int    `json:"end_line"`
+	Message string `json:"message"`
+}
+
+// Result is the analysis output for one file.
+type Result struct {
+	Path    string   `json:"path"`
+	Package string   `json:"package,omitempty"`
+	Decls   []Decl   `json:"decls,omitempty"`
+	Refs    []string `json:"refs,omitempty"`
+	Issues  []Issue  `json:"issues,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// An analysis fills in a file's result from its syntax tree and source.
+type analysis func(fset *token.FileSet, file *ast.File, src []byte) Result
+
+var analyses = map[string]analysis{
+	"exported-decls": func(fset *token.FileSet, file *ast.File, _ []byte) Result {
+		return Result{Decls: exportedDecls(fset, file)}
+	},
+	"funcs": func(fset *token.FileSet, file *ast.File, src []byte) Result {
+		return Result{Package: file.Name.Name, Decls: funcs(fset, file, src)}
+	},
+	"refs": func(_ *token.FileSet, file *ast.File, _ []byte) Result {
+		return Result{Package: file.Name.Name, Refs: refs(file)}
+	},
+	"api": func(fset *token.FileSet, file *ast.File, _ []byte) Result {
+		return Result{Package: file.Name.Name, Decls: apiDecls(fset, file)}
+	},
+	"security": func(fset *token.FileSet, file *ast.File, _ []byte) Result {
+		return Result{Issues: security(fset, file)}
+	},
+}
+
+func main() {
+	if len(os.Args) != 2 || analyses[os.Args[1]] == nil {
+		fmt.Fprintln(os.Stderr, "usage: goast exported-decls|funcs|refs|api|security < sources.json")
+		os.Exit(2)
+	}
+	results, err := run(os.Stdin, analyses[os.Args[1]])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := json.NewEncoder(os.Stdout).Encode(results); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(r io.Reader, analyze analysis) ([]Result, error) {
+	var sources []Source
+	if err := json.NewDecoder(r).Decode(&sources); err != nil {
+		return nil, fmt.Errorf("decoding sources: %w", err)
+	}
+	results := make([]Result, 0, len(sources))
+	for _, src := range sources {
+		fset := token.NewFileSet()
+		file, err := parser.ParseFile(fset, src.Path, src.Source, parser.ParseComments)
+		if err != nil {
+			results = append(results, Result{Path: src.Path, Error: err.Error()})
+			continue
+		}
+		result := analyze(fset, file, []byte(src.Source))
+		result.Path = src.Path
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// exportedDecls lists exported functions, methods on exported types, types,
+// and package-level variables, noting whether each has a doc comment.
+func exportedDecls(fset *token.FileSet, file *ast.File) []Decl {
+	line := func(p token.Pos) int { return fset.Position(p).Line }
+	var decls []Decl
+	for _, d := range file.Decls {
+		switch d := d.(type) {
+		case *ast.FuncDecl:
+			if !d.Name.IsExported() || (d.Recv != nil && !exportedReceiver(d.Recv)) {
+				continue
+			}
+			kind := "func"
+			if d.Recv != nil {
+				kind = "method"
+			}
+			decls = append(decls, Decl{Name: d.Name.Name, Kind: kind, Line: line(d.Pos()), EndLine: line(d.Type.End()), HasDoc: d.Doc != nil})
+		case *ast.GenDecl:
+			if d.Tok != token.TYPE && d.Tok != token.VAR {
+				continue
+			}
+			// A doc comment on a parenthesized group documents its members
+			groupDoc := d.Doc != nil
+			for _, spec := range d.Specs {
+				switch s := spec.(type) {
+				case *ast.TypeSpec:
+					if s.Name.IsExported() {
+						decls = append(decls, Decl{Name: s.Name.Name, Kind: "type", Line: line(s.Pos()), EndLine: line(s.Name.End()), HasDoc: groupDoc || s.Doc != nil})
+					}
+				case *ast.ValueSpec:
+					for _, name := range s.Names {
+						if name.IsExported() {
+							decls = append(decls, Decl{Name: name.Name, Kind: "var", Line: line(s.Pos()), EndLine: line(s.End()), HasDoc: groupDoc || s.Doc != nil})
+						}
+					}
+				}
+			}
+		}
+	}
+	return decls
+}
+
+func exportedReceiver(recv *ast.FieldList) bool {
+	return ast.IsExported(receiverName(recv))
+}
+
+// receiverName is the type name of a method receiver, without pointer or
+// type parameters.
+func receiverName(recv *ast.FieldList) string {
+	if len(recv.List) == 0 {
+		return ""
+	}
+	t := recv.List[0].Type
+	for {
+		switch x := t.(type) {
+		case *ast.StarExpr:
+			t = x.X
+		case *ast.IndexExpr:
+			t = x.X
+		case *ast.IndexListExpr:
+			t = x.X
+		case *ast.Ident:
+			return x.Name
+		default:
+			return ""
+		}
+	}
+}
+
+// funcs lists every function and method with a body, with a fingerprint of
+// its tokens and its cyclomatic complexity.
+func funcs(fset *token.FileSet, file *ast.File, src []byte) []Decl {
+	var decls []Decl
+	for _, d := range file.Decls {
+		fn, ok := d.(*ast.FuncDecl)
+		if !ok || fn.Body == nil {
+			continue
+		}
+		decl := Decl{
+			Name:        fn.Name.Name,
+			Kind:        "func",
+			Line:        fset.Position(fn.Pos()).Line,
+			EndLine:     fset.Position(fn.End()).Line,
+			HasDoc:      fn.Doc != nil,
+			Fingerprint: fingerprint(fset, src[fset.Position(fn.Pos()).Offset:fset.Position(fn.End()).Offset]),
+			Complexity:  complexity(fn.Body),
+		}
+		if fn.Recv != nil {
+			decl.Kind, decl.Receiver = "method", receiverName(fn.Recv)
+		}
+		decls = append(decls, decl)
+	}
+	return decls
+}
+
+// complexity is the cyclomatic complexity of a function body: one, plus one
+// for every if, for and range loop, non-default case of a switch or select,
+// and && or || operator. Function literals count towards the function
+// they are written in.
+func complexity(body *ast.BlockStmt) int {
+	n := 1
+	ast.Inspect(body, func(node ast.Node) bool {
+		switch x := node.(type) {
+		case *ast.IfStmt, *ast.ForStmt, *ast.RangeStmt:
+			n++
+		case *ast.CaseClause:
+			if x.List != nil {
+				n++
+			}
+		case *ast.CommClause:
+			if x.Comm != nil {
+				n++
+			}
+		case *ast.BinaryExpr:
+			if x.Op == token.LAND || x.Op == token.LOR {
+				n++
+			}
+		}
+		return true
+	})
+	return n
+}
+
+// fingerprint hashes the tokens of src, leaving out comments and
+// semicolons, so reformatting or re-commenting code does not change it.
+func fingerprint(fset *token.FileSet, src []byte) string {
+	var s scanner.Scanner
+	s.Init(fset.AddFile("", -1, len(src)), src, nil, 0)
+	h := sha256.New()
+	for {
+		_, tok, lit := s.Scan()
+		if tok == token.EOF {
+			break
+		}
+		if tok == token.SEMICOLON {
+			continue
+		}
+		fmt.Fprintf(h, "%d %s\n", tok, lit)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// refs lists the distinct identifiers a file uses, such as the functions
+// and methods its tests call.
+func refs(file *ast.File) []string {
+	seen := map[string]bool{}
+	ast.Inspect(file, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok {
+			seen[id.Name] = true
+		}
+		return true
+	})
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// apiCollector gathers the exported API one file declares.
+type apiCollector struct {
+	fset  *token.FileSet
+	decls []Decl
+}
+
+// apiDecls lists the exported API of a file: exported functions, types,
+// variables and constants, the methods of exported types, and the exported
+// fields, methods and embedded elements of exported structs and interfaces.
+// Receiver is the type a method, field or element belongs to. Parameter
+// names, struct tags and constant values are left out of fingerprints, so
+// only changes that can break code using the API change them.
+func apiDecls(fset *token.FileSet, file *ast.File) []Decl {
+	c := &apiCollector{fset: fset}
+	for _, d := range file.Decls {
+		switch d := d.(type) {
+		case *ast.FuncDecl:
+			if !d.Name.IsExported() || (d.Recv != nil && !exportedReceiver(d.Recv)) {
+				continue
+			}
+			header := *d
+			header.Doc, header.Body = nil, nil
+			if d.Recv == nil {
+				c.add(Decl{Name: d.Name.Name, Kind: "func"}, &header, c.print(&header), c.print(unnamed(d.Type)))
+				continue
+			}
+			recv := receiverName(d.Recv)
+			c.add(Decl{Name: recv + "." + d.Name.Name, Kind: "method", Receiver: recv}, &header, c.print(&header),
+				c.print(d.Recv.List[0].Type)+" "+c.print(unnamed(d.Type)))
+		case *ast.GenDecl:
+			// A constant without a type or value repeats the previous one's
+			var implicit ast.Expr
+			for _, spec := range d.Specs {
+				switch s := spec.(type) {
+				case *ast.TypeSpec:
+					if s.Name.IsExported() {
+						c.typeSpec(s)
+					}
+				case *ast.ValueSpec:
+					typ := s.Type
+					if d.Tok == token.CONST {
+						if s.Type != nil || len(s.Values) > 0 {
+							implicit = s.Type
+						}
+						typ = implicit
+					}
+					key := ""
+					if typ != nil {
+						key = c.print(typ)
+					}
+					for _, name := range s.Names {
+						if name.IsExported() {
+							shown := &ast.GenDecl{Tok: d.Tok, Specs: []ast.Spec{&ast.ValueSpec{Names: []*ast.Ident{name}, Type: typ}}}
+							c.add(Decl{Name: name.Name, Kind: d.Tok.String()}, s, c.print(shown), key)
+						}
+					}
+				}
+			}
+		}
+	}
+	return c.decls
+}
+
+// typeSpec adds an exported type and the members of a struct or
+// interface. The fingerprint of a struct or interface type itself covers
+// only its name, type parameters and kind; its members have their own.
+func (c *apiCollector) typeSpec(s *ast.TypeSpec) {
+	name := s.Name.Name
+	full := *s
+	full.Doc, full.Comment = nil, nil
+	shape := full
+	switch t := s.Type.(type) {
+	case *ast.StructType:
+		shape.Type = &ast.StructType{Fields: &ast.FieldList{}}
+		c.add(Decl{Name: name, Kind: "type"}, s, "type "+c.print(&full), c.print(&shape))
+		for _, f := range t.Fields.List {
+			names := make([]string, 0, len(f.Names))
+			for _, n := range f.Names {
+				names = append(names, n.Name)
+			}
+			shown := strings.TrimSpace(strings.Join(names, ", ") + " " + c.print(f.Type))
+			if len(names) == 0 {
+				names = []string{embeddedName(f.Type)}
+			}
+			for _, n := range names {
+				if ast.IsExported(n) {
+					c.add(Decl{Name: name + "." + n, Kind: "field", Receiver: name}, f, shown, c.print(f.Type))
+				}
+			}
+		}
+	case *ast.InterfaceType:
+		shape.Type = &ast.InterfaceType{Methods: &ast.FieldList{}}
+		c.add(Decl{Name: name, Kind: "type"}, s, "type "+c.print(&full), c.print(&shape))
+		for _, m := range t.Methods.List {
+			ft, ok := m.Type.(*ast.FuncType)
+			if !ok {
+				// An embedded interface or a type set element such as ~int | ~string
+				elem := c.print(m.Type)
+				c.add(Decl{Name: name + "." + elem, Kind: "embedded", Receiver: name}, m, elem, elem)
+				continue
+			}
+			// Unexported methods count too: adding one stops other packages implementing the interface
+			for _, n := range m.Names {
+				c.add(Decl{Name: name + "." + n.Name, Kind: "interface-method", Receiver: name}, m,
+					n.Name+strings.TrimPrefix(c.print(ft), "func"), c.print(unnamed(ft)))
+			}
+		}
+	default:
+		c.add(Decl{Name: name, Kind: "type"}, s, "type "+c.print(&full), c.print(&full))
+	}
+}
+
+// add records an API declaration spanning node, shown as signature. Its
+// fingerprint covers its kind and key.
+func (c *apiCollector) add(d Decl, node ast.Node, signature, key string) {
+	d.Line, d.EndLine = c.fset.Position(node.Pos()).Line, c.fset.Position(node.End()).Line
+	d.Signature = signature
+	d.Fingerprint = fingerprint(token.NewFileSet(), []byte(d.Kind+" "+key))
+	c.decls = append(c.decls, d)
+}
+
+func (c *apiCollector) print(node ast.Node) string {
+	var buf bytes.Buffer
+	if err := printer.Fprint(&buf, c.fset, node); err != nil {
+		return fmt.Sprintf("<%v>", err)
+	}
+	return buf.String()
+}
+
+// unnamed is a function type without its parameter and result names, which
+// callers do not depend on.
+func unnamed(ft *ast.FuncType) *ast.FuncType {
+	strip := func(fields *ast.FieldList) *ast.FieldList {
+		if fields == nil {
+			return nil
+		}
+		out := &ast.FieldList{}
+		for _, f := range fields.List {
+			for i := 0; i < max(1, len(f.Names)); i++ {
+				out.List = append(out.List, &ast.Field{Type: f.Type})
+			}
+		}
+		return out
+	}
+	return &ast.FuncType{TypeParams: ft.TypeParams, Params: strip(ft.Params), Results: strip(ft.Results)}
+}
+
+// embeddedName is the field name of an embedded struct field: its type
+// name without pointer, package or type arguments.
+func embeddedName(t ast.Expr) string {
+	for {
+		switch x := t.(type) {
+		case *ast.StarExpr:
+			t = x.X
+		case *ast.IndexExpr:
+			t = x.X
+		case *ast.IndexListExpr:
+			t = x.X
+		case *ast.SelectorExpr:
+			return x.Sel.Name
+		case *ast.Ident:
+			return x.Name
+		default:
+			return ""
+		}
+	}
+}
+
+// Identifiers that suggest a value has to be unpredictable
+var secretName = regexp.MustCompile(`(?i)token|secret|key|passw(or)?d|nonce|salt|otp|credential`)
+
+// Methods that run the SQL query given as their first argument, or their
+// second for the context-taking variants
+var sqlMethods = map[string]int{
+	"Query": 0, "QueryRow": 0, "Exec": 0, "Prepare": 0,
+	"QueryContext": 1, "QueryRowContext": 1, "ExecContext": 1, "PrepareContext": 1,
+}
+
+// securityScan gathers the security issues of one file.
+type securityScan struct {
+	fset    *token.FileSet
+	imports map[string]string
+	consts  map[string]bool
+	issues  []Issue
+	seen    map[token.Pos]bool
+}
+
+// security reports risky constructs: commands or SQL queries built from
+// non-constant strings, math/rand values stored in secret-sounding names,
+// plain-HTTP servers, disabled TLS verification, and package unsafe. It
+// works on the syntax tree alone, so text in comments and strings never
+// matches, and it errs towards reporting when a value's origin is unclear.
+func security(fset *token.FileSet, file *ast.File) []Issue {
+	s := &securityScan{fset: fset, imports: importNames(file), consts: map[string]bool{}, seen: map[token.Pos]bool{}}
+	ast.Inspect(file, func(n ast.Node) bool {
+		if d, ok := n.(*ast.GenDecl); ok && d.Tok == token.CONST {
+			for _, spec := range d.Specs {
+				for _, name := range spec.(*ast.ValueSpec).Names {
+					s.consts[name.Name] = true
+				}
+			}
+		}
+		return true
+	})
+	for _, imp := range file.Imports {
+		if path, _ := strconv.Unquote(imp.Path.Value); path == "unsafe" {
+			s.report("unsafe", imp, "imports package unsafe")
+		}
+	}
+	for _, d := range file.Decls {
+		if fn, ok := d.(*ast.FuncDecl); ok {
+			s.scan(fn, fn.Name.Name)
+			continue
+		}
+		s.scan(d, "")
+	}
+	return s.issues
+}
+
+// scan checks one top-level declaration; fn is the function's name, if it is one.
+func (s *securityScan) scan(decl ast.Node, fn string) {
+	// Variables holding queries built with Sprintf or concatenation
+	built := map[string]bool{}
+	assigned := func(name string, value ast.Expr) {
+		built[name] = s.buildsString(value, built)
+		if secretName.MatchString(name) {
+			s.weakRandom(value)
+		}
+	}
+	ast.Inspect(decl, func(n ast.Node) bool {
+		switch x := n.(type) {
+		case *ast.AssignStmt:
+			if len(x.Lhs) != len(x.Rhs) {
+				break
+			}
+			for i, lhs := range x.Lhs {
+				switch l := lhs.(type) {
+				case *ast.Ident:
+					assigned(l.Name, x.Rhs[i])
+				case *ast.SelectorExpr:
+					if l.Sel.Name == "InsecureSkipVerify" && isTrue(x.Rhs[i]) {
+						s.report("insecure-tls", x, "sets InsecureSkipVerify, turning off TLS certificate verification")
+					}
+				}
+			}
+		case *ast.ValueSpec:
+			for i, name := range x.Names {
+				if i < len(x.Values) {
+					assigned(name.Name, x.Values[i])
+				}
+			}
+		case *ast.KeyValueExpr:
+			if key, ok := x.Key.(*ast.Ident); ok && key.Name == "InsecureSkipVerify" && isTrue(x.Value) {
+				s.report("insecure-tls", x, "sets InsecureSkipVerify, turning off TLS certificate verification")
+			}
+		case *ast.SelectorExpr:
+			if s.packageOf(x) == "unsafe" {
+				s.report("unsafe", x, "uses unsafe.%s", x.Sel.Name)
+			}
+		case *ast.CallExpr:
+			s.call(x, built)
+		}
+		return true
+	})
+	if secretName.MatchString(fn) {
+		s.weakRandom(decl)
+	}
+}
+
+func (s *securityScan) call(call *ast.CallExpr, built map[string]bool) {
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok {
+		return
+	}
+	switch pkg, name := s.packageOf(sel), sel.Sel.Name; {
+	case pkg == "os/exec" && (name == "Command" || name == "CommandContext"):
+		args := call.Args
+		if name == "CommandContext" && len(args) > 0 {
+			args = args[1:]
+		}
+		for _, arg := range args {
+			if call.Ellipsis.IsValid() || !s.constant(arg) {
+				s.report("command-injection", call, "exec.%s runs a command built from non-constant arguments", name)
+				return
+			}
+		}
+	case pkg == "net/http" && name == "ListenAndServe":
+		if len(call.Args) > 0 {
+			if lit, ok := call.Args[0].(*ast.BasicLit); ok {
+				addr, _ := strconv.Unquote(lit.Value)
+				if strings.HasPrefix(addr, "localhost:") || strings.HasPrefix(addr, "127.0.0.1:") {
+					return
+				}
+			}
+		}
+		s.report("insecure-listen", call, "http.ListenAndServe serves plain HTTP without TLS")
+	case pkg == "":
+		if i, ok := sqlMethods[name]; ok && i < len(call.Args) && s.buildsString(call.Args[i], built) {
+			s.report("sql-injection", call, "%s runs a query built with fmt.Sprintf or string concatenation", name)
+		}
+	}
+}
+
+// weakRandom reports math/rand calls within node.
+func (s *securityScan) weakRandom(node ast.Node) {
+	ast.Inspect(node, func(n ast.Node) bool {
+		if call, ok := n.(*ast.CallExpr); ok {
+			if sel, ok := call.Fun.(*ast.SelectorExpr); ok {
+				if pkg := s.packageOf(sel); pkg == "math/rand" || pkg == "math/rand/v2" {
+					s.report("weak-random", call, "rand.%s from %s produces a security-sensitive value", sel.Sel.Name, pkg)
+				}
+			}
+		}
+		return true
+	})
+}
+
+// buildsString tells whether e formats or concatenates a string from
+// non-constant parts, directly or through a variable in built.
+func (s *securityScan) buildsString(e ast.Expr, built map[string]bool) bool {
+	switch x := e.(type) {
+	case *ast.ParenExpr:
+		return s.buildsString(x.X, built)
+	case *ast.Ident:
+		return built[x.Name]
+	case *ast.CallExpr:
+		sel, ok := x.Fun.(*ast.SelectorExpr)
+		return ok && s.packageOf(sel) == "fmt" && sel.Sel.Name == "Sprintf"
+	case *ast.BinaryExpr:
+		return x.Op == token.ADD && (hasStringLit(x) || s.buildsString(x.X, built) || s.buildsString(x.Y, built)) && !s.constant(x)
+	}
+	return false
+}
+
+// constant tells whether e is built only from literals and constants.
+func (s *securityScan) constant(e ast.Expr) bool {
+	switch x := e.(type) {
+	case *ast.BasicLit:
+		return true
+	case *ast.Ident:
+		return s.consts[x.Name]
+	case *ast.ParenExpr:
+		return s.constant(x.X)
+	case *ast.BinaryExpr:
+		return s.constant(x.X) && s.constant(x.Y)
+	}
+	return false
+}
+
+// packageOf is the import path of the package a selector refers to, or ""
+// when it selects from a value.
+func (s *securityScan) packageOf(sel *ast.SelectorExpr) string {
+	id, ok := sel.X.(*ast.Ident)
+	if !ok || id.Obj != nil {
+		return ""
+	}
+	return s.imports[id.Name]
+}
+
+func (s *securityScan) report(rule string, node ast.Node, format string, args ...any) {
+	if s.seen[node.Pos()] {
+		return
+	}
+	s.seen[node.Pos()] = true
+	s.issues = append(s.issues, Issue{
+		Rule:    rule,
+		Line:    s.fset.Position(node.Pos()).Line,
+		EndLine: s.fset.Position(node.End()).Line,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+var majorVersion = regexp.MustCompile(`^v[0-9]+$`)
+
+// importNames maps the names a file refers to its imports by to their
+// paths. A path ending in a major version (math/rand/v2) is named by the
+// element before it.
+func importNames(file *ast.File) map[string]string {
+	names := map[string]string{}
+	for _, imp := range file.Imports {
+		path, _ := strconv.Unquote(imp.Path.Value)
+		parts := strings.Split(path, "/")
+		name := parts[len(parts)-1]
+		if len(parts) > 1 && majorVersion.MatchString(name) {
+			name = parts[len(parts)-2]
+		}
+		if imp.Name != nil {
+			name = imp.Name.Name
+		}
+		names[name] = path
+	}
+	return names
+}
+
+func hasStringLit(e ast.Expr) bool {
+	found := false
+	ast.Inspect(e, func(n ast.Node) bool {
+		if lit, ok := n.(*ast.BasicLit); ok && lit.Kind == token.STRING {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+func isTrue(e ast.Expr) bool {
+	id, ok := e.(*ast.Ident)
+	return ok && id.Name == "true"
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+const sample = `package p
+
+// Documented does things.
+func Documented() {}
+
+func Undocumented(
+	a int,
+) {
+	_ = a
+}
+
+func unexported() {}
+
+type T struct{}
+
+func (T) Method() {}
+
+func (t *hidden) Skipped() {}
+
+type hidden struct{}
+
+// Group docs cover every member.
+var (
+	A = 1
+	B = 2
+)
+
+var Lone, lower = 3, 4
+`
+
+func TestExportedDecls(t *testing.T) {
+	input, _ := json.Marshal([]Source{{Path: "p.go", Source: sample}})
+	results, err := run(strings.NewReader(string(input)), analyses["exported-decls"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]Decl{}
+	for _, d := range results[0].Decls {
+		got[d.Name] = d
+	}
+	tests := []struct {
+		name    string
+		kind    string
+		line    int
+		endLine int
+		hasDoc  bool
+	}{
+		{"Documented", "func", 4, 4, true},
+		{"Undocumented", "func", 6, 8, false},
+		{"T", "type", 14, 14, false},
+		{"Method", "method", 16, 16, false},
+		{"A", "var", 24, 24, true},
+		{"Lone", "var", 28, 28, false},
+	}
+	for _, tt := range tests {
+		d, ok := got[tt.name]
+		if !ok {
+			t.Errorf("%s not reported", tt.name)
+			continue
+		}
+		if d.Kind != tt.kind || d.Line != tt.line || d.EndLine != tt.endLine || d.HasDoc != tt.hasDoc {
+			t.Errorf("%s = %+v, want kind %s lines %d-%d doc %v", tt.name, d, tt.kind, tt.line, tt.endLine, tt.hasDoc)
+		}
+	}
+	for _, name := range []string{"unexported", "Skipped", "hidden", "lower"} {
+		if _, ok := got[name]; ok {
+			t.Errorf("%s should not be reported", name)
+		}
+	}
+}
+
+func TestParseErrorPerFile(t *testing.T) {
+	results, err := run(strings.NewReader(`[{"path":"bad.go","source":"package"},{"path":"ok.go","source":"package p\nvar X = 1\n"}]`), analyses["exported-decls"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Error == "" {
+		t.Error("expected a parse error for bad.go")
+	}
+	if len(results[1].Decls) != 1 {
+		t.Errorf("ok.go decls = %v, want one", results[1].Decls)
+	}
+}
+
+func runFuncs(t *testing.T, sources ...string) []Result {
+	t.Helper()
+	var input []Source
+	for i, src := range sources {
+		input = append(input, Source{Path: fmt.Sprintf("f%d.go", i), Source: src})
+	}
+	data, _ := json.Marshal(input)
+	results, err := run(strings.NewReader(string(data)), analyses["funcs"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return results
+}
+
+func TestFuncsFingerprint(t *testing.T) {
+	results := runFuncs(t,
+		"package p\n\nfunc Add(a, b int) int { return a + b }\n\nfunc (s *Set[T]) Len() int {\n\treturn len(s.items)\n}\n",
+		"package p\n\n// Add sums its arguments.\nfunc Add(a, b int) int {\n\t// Overflow is the caller's problem.\n\treturn a + b\n}\n",
+		"package p\n\nfunc Add(a, b int) int { return a - b }\n",
+	)
+	old, reformatted, changed := results[0].Decls[0], results[1].Decls[0], results[2].Decls[0]
+	if old.Fingerprint != reformatted.Fingerprint {
+		t.Error("comments and formatting changed the fingerprint")
+	}
+	if old.Fingerprint == changed.Fingerprint {
+		t.Error("a body change kept the fingerprint")
+	}
+	if reformatted.Line != 4 || reformatted.EndLine != 7 {
+		t.Errorf("Add spans lines %d-%d, want 4-7", reformatted.Line, reformatted.EndLine)
+	}
+	method := results[0].Decls[1]
+	if method.Kind != "method" || method.Receiver != "Set" || results[0].Package != "p" {
+		t.Errorf("Len = %+v in package %q, want a method on Set in p", method, results[0].Package)
+	}
+}
+
+func TestRefs(t *testing.T) {
+	input := `[{"path":"p_test.go","source":"package p_test\nimport \"testing\"\nfunc TestAdd(t *testing.T) { _ = p.Add(1, 2) }\n"}]`
+	results, err := run(strings.NewReader(input), analyses["refs"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Join(results[0].Refs, " ")
+	if results[0].Package != "p_test" || !strings.Contains(got, "Add") || !strings.Contains(got, "TestAdd") {
+		t.Errorf("refs = %q in %q, want Add and TestAdd in p_test", got, results[0].Package)
+	}
+}
+
+func apiOf(t *testing.T, src string) map[string]Decl {
+	t.Helper()
+	data, _ := json.Marshal([]Source{{Path: "api.go", Source: src}})
+	results, err := run(strings.NewReader(string(data)), analyses["api"])
+	if err != nil || results[0].Error != "" {
+		t.Fatal(err, results[0].Error)
+	}
+	decls := map[string]Decl{}
+	for _, d := range results[0].Decls {
+		decls[d.Name] = d
+	}
+	return decls
+}
+
+func TestAPIFingerprints(t *testing.T) {
+	base := apiOf(t, "package p\n\nfunc F(a, b int) error { return nil }\n\ntype S struct {\n\tName string\n\tpriv int\n}\n\nfunc (s *S) M() {}\n\ntype I interface{ Do() }\n\nconst (\n\tA Kind = iota\n\tB\n)\n")
+	tests := []struct {
+		name, src string
+		changed   []string
+	}{
+		{"renamed parameters and reordered members", "package p\n\n// F is documented now.\nfunc F(x, y int) (err error) { return nil }\n\ntype S struct {\n\tpriv  int\n\tName  string `json:\"name\"`\n\tExtra bool\n}\n\nfunc (self *S) M() { println() }\n\ntype I interface{ Do() }\n\nconst (\n\tA Kind = 5\n\tB\n)\n", nil},
+		{"signatures and field types", "package p\n\nfunc F(a int, b int64) error { return nil }\n\ntype S struct{ Name []byte }\n\nfunc (s S) M() {}\n\ntype I interface{ Do() }\n\nconst (\n\tA = iota\n\tB\n)\n", []string{"A", "B", "F", "S.M", "S.Name"}},
+		{"kinds", "package p\n\nvar F = func(a, b int) error { return nil }\n\ntype S interface{ Name() string }\n\ntype I struct{}\n\nconst (\n\tA Kind = iota\n\tB\n)\n", []string{"F", "I", "S", "S.Name"}},
+	}
+	for _, tt := range tests {
+		head := apiOf(t, tt.src)
+		var changed []string
+		for name, d := range base {
+			if h, ok := head[name]; ok && h.Fingerprint != d.Fingerprint {
+				changed = append(changed, name)
+			}
+		}
+		sort.Strings(changed)
+		if strings.Join(changed, " ") != strings.Join(tt.changed, " ") {
+			t.Errorf("%s: changed = %v, want %v", tt.name, changed, tt.changed)
+		}
+	}
+	if _, ok := base["S.priv"]; ok {
+		t.Error("unexported field S.priv reported")
+	}
+	if got := base["S.M"]; got.Signature != "func (s *S) M()" || got.Receiver != "S" || got.Line != 10 {
+		t.Errorf("S.M = %+v", got)
+	}
+	if got := base["B"].Signature; got != "const B Kind" {
+		t.Errorf("B signature = %q, want the type repeated from A", got)
+	}
+}
+
+func TestComplexity(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"straight line", "x := 1\n_ = x", 1},
+		{"if else", "if a {\n} else if b {\n} else {\n}", 3},
+		{"loops", "for i := 0; i < 3; i++ {\n}\nfor range xs {\n}\nfor {\nbreak\n}", 4},
+		{"switch with default", "switch x {\ncase 1, 2:\ncase 3:\ndefault:\n}", 3},
+		{"select", "select {\ncase <-ch:\ncase ch <- 1:\ndefault:\n}", 3},
+		{"boolean operators", "if a && b || c {\n}", 4},
+		{"function literal", "f := func() {\nif a {\n}\n}\nf()", 2},
+	}
+	for _, tt := range tests {
+		src := "package p\n\nvar a, b, c bool\nvar x int\nvar xs []int\nvar ch chan int\n\nfunc F() {\n" + tt.body + "\n}\n"
+		results := runFuncs(t, src)
+		if results[0].Error != "" {
+			t.Fatalf("%s: %s", tt.name, results[0].Error)
+		}
+		if got := results[0].Decls[0].Complexity; got != tt.want {
+			t.Errorf("%s: complexity = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+const risky = `package p
+
+import (
+	"crypto/tls"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os/exec"
+	"unsafe"
+)
+
+const tool = "git"
+
+func Run(db *sql.DB, name, id string) {
+	exec.Command(tool, "status").Run()
+	exec.Command("git", "checkout", name).Run()
+	db.Query("SELECT * FROM users WHERE id = ?", id)
+	q := fmt.Sprintf("SELECT * FROM users WHERE name = '%s'", name)
+	db.Query(q)
+	db.Exec("DELETE FROM users WHERE id = " + id)
+	// InsecureSkipVerify: true in a comment is fine
+	_ = &tls.Config{InsecureSkipVerify: true}
+	_ = "InsecureSkipVerify: true"
+	http.ListenAndServe("localhost:8080", nil)
+	http.ListenAndServe(":8080", nil)
+	sessionToken := rand.Int63()
+	retries := rand.Intn(3)
+	_, _ = sessionToken, retries
+	_ = unsafe.Sizeof(id)
+}
+
+func newAPIKey() string {
+	return fmt.Sprint(rand.Int())
+}
+`
+
+func TestSecurity(t *testing.T) {
+	data, _ := json.Marshal([]Source{{Path: "risky.go", Source: risky}})
+	results, err := run(strings.NewReader(string(data)), analyses["security"])
+	if err != nil || results[0].Error != "" {
+		t.Fatal(err, results[0].Error)
+	}
+	var got []string
+	for _, issue := range results[0].Issues {
+		got = append(got, fmt.Sprintf("%s:%d", issue.Rule, issue.Line))
+	}
+	want := []string{
+		"unsafe:10",
+		"command-injection:17",
+		"sql-injection:20",
+		"sql-injection:21",
+		"insecure-tls:23",
+		"insecure-listen:26",
+		"weak-random:27",
+		"unsafe:30",
+		"weak-random:34",
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("issues = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,519 @@
+"""
+Fake GitHub for end-to-end tests of the server's tool calls.
+
+FakeGitHub answers the subset of the GitHub REST and GraphQL APIs the
+server uses, from a scenario directory under testdata/scenarios, through an
+httpx.MockTransport. So a test can run create_review or get_pr_diff the way
+a client would call them, with diff parsing, line mapping and posting all
+real, and then check the write requests the fake received:
+
+    fake = FakeGitHub.load("incremental-review")
+    with fake.serving():
+        asyncio.run(create_review(CreateReviewInput(...)))
+    fake.assert_one_review(comments=2, anchors=[("main.go", 22), ("main.go", 3)])
+
+Like GitHub, the fake refuses a review comment anchored outside the diff
+with a 422, keeps what is posted (a second call sees the first call's
+review), and serves lists a page at a time with Link headers.
+
+A scenario directory holds:
+
+    pr.json              The pull request, as GET /repos/{owner}/{repo}/pulls/{number}
+                         returns it; owner and repo come from base.repo.full_name
+    files.json           Changed files, as GET .../pulls/{number}/files lists them,
+                         without their patches
+    patches/<path>.patch The patch of each changed file, by its path in the PR
+    reviews.json         Reviews already on the PR (optional)
+    comments.json        Review comments already on the PR (optional)
+    issue_comments.json  Conversation comments already on the PR (optional)
+    commits.json         The PR's commits (optional)
+    compare.json         Comparisons by "base...head", each as GET .../compare
+                         returns it without patches (optional); a comparison of
+                         a commit with itself is always served as identical
+    compare/<path>.patch The patch of a file in a comparison, when it differs
+                         from the file's in patches/
+    contents/<path>      File contents served for any ref (optional)
+    scenario.json        Options (optional): "login", the authenticated account
+                         (default "review-bot"), and "page_size", the most
+                         entries served per page whatever per_page asks for
+"""
+
+import base64
+import json
+import re
+from contextlib import contextmanager
+from dataclasses import dataclass, field
+from pathlib import Path
+from typing import Any, Dict, Iterator, List, Optional, Set, Tuple
+from urllib.parse import unquote, urlsplit
+
+import httpx
+
+from github_pr_mcp import GitHubClient, github_transport
+
+SCENARIOS_DIR = Path(__file__).parent / "testdata" / "scenarios"
+
+HUNK_HEADER = re.compile(r"@@ -(\d+)(?:,\d+)? \+(\d+)(?:,\d+)? @@")
+
+
+@dataclass
+class RecordedRequest:
+    """One request the fake received, with its path relative to the API base."""
+    
+    method: str
+    path: str
+    params: Dict[str, str]
+    body: Any = None
+    
+    @property
+    def is_write(self) -> bool:
+        if isinstance(self.body, dict) and "query" in self.body:
+            # GraphQL reads are POSTs too
+            return self.body["query"].lstrip().startswith("mutation")
+        return self.method not in ("GET", "HEAD")
+
+
+REVIEW_STATES = {"COMMENT": "COMMENTED", "APPROVE": "APPROVED", "REQUEST_CHANGES": "CHANGES_REQUESTED"}
+
+
+@dataclass
+class Review:
+    """A review posted to the fake: the payload sent, the review served back and its comments."""
+    
+    payload: Dict[str, Any]
+    data: Dict[str, Any]
+    comments: List[Dict[str, Any]] = field(default_factory=list)
+    
+    @property
+    def id(self) -> int:
+        return self.data["id"]
+    
+    @property
+    def state(self) -> str:
+        return self.data["state"]
+    
+    @property
+    def event(self) -> Optional[str]:
+        return self.payload.get("event")
+    
+    @property
+    def anchors(self) -> List[Tuple[str, int, str]]:
+        return [(c["path"], c["line"], c["side"]) for c in self.comments]
+
+
+def _read_json(path: Path, default: Any = None) -> Any:
+    return json.loads(path.read_text()) if path.exists() else default
+
+
+def _diff_lines(patch: str) -> Tuple[Dict[int, int], Dict[int, int]]:
+    """The hunk of each line a comment can anchor to, for the LEFT and the RIGHT side."""
+    left: Dict[int, int] = {}
+    right: Dict[int, int] = {}
+    hunk, old, new = -1, 0, 0
+    for line in patch.splitlines():
+        header = HUNK_HEADER.match(line)
+        if header:
+            hunk, old, new = hunk + 1, int(header.group(1)), int(header.group(2))
+        elif hunk < 0 or line.startswith("\\"):
+            continue
+        elif line.startswith("+"):
+            right[new], new = hunk, new + 1
+        elif line.startswith("-"):
+            left[old], old = hunk, old + 1
+        else:
+            left[old], right[new] = hunk, hunk
+            old, new = old + 1, new + 1
+    return left, right
+
+
+def _git_diff(files: List[Dict[str, Any]]) -> str:
+    """The unified diff GitHub serves for the diff media type, built from file entries."""
+    sections = []
+    for entry in files:
+        path = entry["filename"]
+        old = entry.get("previous_filename", path)
+        status = entry.get("status", "modified")
+        header = [f"diff --git a/{old} b/{path}"]
+        if status == "renamed":
+            header += [f"rename from {old}", f"rename to {path}"]
+        if "patch" not in entry:
+            header.append(f"Binary files a/{old} and b/{path} differ")
+        else:
+            header.append("--- /dev/null" if status == "added" else f"--- a/{old}")
+            header.append("+++ /dev/null" if status == "removed" else f"+++ b/{path}")
+            header.append(entry["patch"])
+        sections.append("\n".join(header) + "\n")
+    return "".join(sections)
+
+
+class FakeGitHub:
+    """
+    An in-memory GitHub serving one pull request of a scenario.
+    
+    Calling the instance handles one httpx request, so it is the handler of
+    an httpx.MockTransport; serving() points the server's clients at it.
+    """
+    
+    def __init__(self, directory: Path, api_url: Optional[str] = None):
+        """
+        Args:
+            directory (Path): Scenario directory
+            api_url (Optional[str]): API base URL the server is configured
+                with, e.g. an Enterprise Server instance's (default github.com)
+        """
+        self.directory = directory
+        self.api_url = api_url
+        options = _read_json(directory / "scenario.json", {})
+        self.login = options.get("login", "review-bot")
+        self.page_size = options.get("page_size")
+        
+        self.pr = _read_json(directory / "pr.json")
+        self.owner, self.repo = self.pr["base"]["repo"]["full_name"].split("/")
+        self.number = self.pr["number"]
+        self.files = [self._with_patch(entry, directory / "patches")
+                      for entry in _read_json(directory / "files.json", [])]
+        self.reviews: List[Dict[str, Any]] = _read_json(directory / "reviews.json", [])
+        self.comments: List[Dict[str, Any]] = _read_json(directory / "comments.json", [])
+        self.issue_comments: List[Dict[str, Any]] = _read_json(directory / "issue_comments.json", [])
+        self.commits: List[Dict[str, Any]] = _read_json(directory / "commits.json", [])
+        self.comparisons = {
+            refs: {**compare, "files": [self._with_patch(entry, directory / "compare", directory / "patches")
+                                        for entry in compare.get("files", [])]}
+            for refs, compare in _read_json(directory / "compare.json", {}).items()
+        }
+        
+        self.requests: List[RecordedRequest] = []
+        # Requests the fake had no answer for but a 404, e.g. for an optional config file
+        self.unhandled: List[RecordedRequest] = []
+        self.posted: List[Review] = []
+        # Node IDs of the review threads resolved, each named after its first comment
+        self.resolved: Set[str] = set()
+        # (method, path) of writes that take effect but get a 502, as when the response is lost
+        self.dropped: Set[Tuple[str, str]] = set()
+        self._next_id = 1000
+        
+        client = GitHubClient(token="t", base_url=api_url)
+        self.host = urlsplit(client.api_base).hostname
+        self.api_prefix = urlsplit(client.api_base).path
+        self.graphql_path = urlsplit(client.graphql_url).path
+    
+    @classmethod
+    def load(cls, name: str, api_url: Optional[str] = None) -> "FakeGitHub":
+        """Load the scenario testdata/scenarios/<name>."""
+        return cls(SCENARIOS_DIR / name, api_url)
+    
+    @staticmethod
+    def _with_patch(entry: Dict[str, Any], *directories: Path) -> Dict[str, Any]:
+        """The file entry with the patch of the first directory that has one, if any does."""
+        for directory in directories:
+            patch_file = directory / f"{entry['filename']}.patch"
+            if patch_file.exists():
+                return {**entry, "patch": patch_file.read_text().rstrip("\n")}
+        return entry
+    
+    @property
+    def transport(self) -> httpx.MockTransport:
+        return httpx.MockTransport(self)
+    
+    @contextmanager
+    def serving(self) -> Iterator["FakeGitHub"]:
+        """Answer every GitHub request the server makes while the block runs."""
+        with github_transport(self.transport, self.api_url):
+            yield self
+    
+    @property
+    def head_sha(self) -> str:
+        return self.pr["head"]["sha"]
+    
+    def _id(self) -> int:
+        self._next_id += 1
+        return self._next_id
+    
+    def _user(self) -> Dict[str, Any]:
+        return {"login": self.login, "type": "Bot" if self.login.endswith("[bot]") else "User"}
+    
+    def _html_url(self, anchor: str) -> str:
+        return f"https://github.com/{self.owner}/{self.repo}/pull/{self.number}#{anchor}"
+    
+    def __call__(self, request: httpx.Request) -> httpx.Response:
+        url = request.url
+        path = unquote(url.path)
+        try:
+            body = json.loads(request.content) if request.content else None
+        except ValueError:
+            body = request.content.decode(errors="replace")
+        recorded = RecordedRequest(request.method, path, dict(url.params), body)
+        if url.host != self.host:
+            self.requests.append(recorded)
+            self.unhandled.append(recorded)
+            return httpx.Response(404, json={"message": "Not Found"})
+        if path == self.graphql_path:
+            self.requests.append(recorded)
+            return self._graphql(body or {})
+        if path.startswith(self.api_prefix):
+            recorded.path = path = path[len(self.api_prefix):] or "/"
+        self.requests.append(recorded)
+        
+        diff = request.headers.get("accept") == "application/vnd.github.v3.diff"
+        response = self._route(request.method, path, recorded.params, body, diff)
+        if response is None:
+            self.unhandled.append(recorded)
+            return httpx.Response(404, json={"message": "Not Found"})
+        if (request.method, path) in self.dropped:
+            self.dropped.discard((request.method, path))
+            return httpx.Response(502, json={"message": "Bad Gateway"})
+        return response
+    
+    def _route(self, method: str, path: str, params: Dict[str, str], body: Any, diff: bool) -> Optional[httpx.Response]:
+        """The answer to a request for path, relative to the API base, or None for a 404."""
+        if path == "/user":
+            return httpx.Response(200, json=self._user())
+        repo = f"/repos/{self.owner}/{self.repo}"
+        if not path.startswith(repo):
+            return None
+        rest = path[len(repo):]
+        if rest == "":
+            return httpx.Response(200, headers={"X-OAuth-Scopes": "repo"}, json={
+                "full_name": f"{self.owner}/{self.repo}", "default_branch": self.pr["base"].get("ref", "main"),
+                "private": False, "permissions": {"admin": False, "push": True, "pull": True},
+            })
+        pull = f"/pulls/{self.number}"
+        if rest == pull and method == "GET":
+            if diff:
+                return httpx.Response(200, text=_git_diff(self.files))
+            return httpx.Response(200, json=self.pr)
+        if rest == f"{pull}/files":
+            return self._page(path, params, self.files)
+        if rest == f"{pull}/commits":
+            return self._page(path, params, self.commits)
+        if rest == f"{pull}/reviews":
+            if method == "POST":
+                return self._post_review(body)
+            return self._page(path, params, self.reviews)
+        if rest == f"{pull}/comments":
+            if method == "POST":
+                return self._post_comment(body)
+            return self._page(path, params, self.comments)
+        match = re.fullmatch(rf"{pull}/reviews/(\d+)(/comments|/events)?", rest)
+        if match:
+            return self._review_resource(method, int(match.group(1)), match.group(2), path, params, body)
+        if rest == f"/issues/{self.number}/comments":
+            if method == "POST":
+                comment = {"id": self._id(), "user": self._user(), "body": body["body"]}
+                comment["html_url"] = self._html_url(f"issuecomment-{comment['id']}")
+                self.issue_comments.append(comment)
+                return httpx.Response(201, json=comment)
+            return self._page(path, params, self.issue_comments)
+        match = re.fullmatch(r"/issues/comments/(\d+)", rest)
+        if match:
+            return self._issue_comment(method, int(match.group(1)), body)
+        match = re.fullmatch(r"/compare/(.+)", rest)
+        if match:
+            base, _, head = match.group(1).partition("...")
+            compare = self.comparisons.get(match.group(1))
+            if compare is None and base == head:
+                compare = {"status": "identical", "ahead_by": 0, "behind_by": 0, "commits": [], "files": []}
+            if compare is None:
+                return None
+            if diff:
+                return httpx.Response(200, text=_git_diff(compare["files"]))
+            return httpx.Response(200, json=compare)
+        match = re.fullmatch(r"/contents/(.+)", rest)
+        if match and (self.directory / "contents" / match.group(1)).is_file():
+            content = (self.directory / "contents" / match.group(1)).read_bytes()
+            return httpx.Response(200, json={
+                "type": "file", "path": match.group(1), "size": len(content), "encoding": "base64",
+                "content": base64.b64encode(content).decode(),
+            })
+        return None
+    
+    def _page(self, path: str, params: Dict[str, str], entries: List[Any]) -> httpx.Response:
+        """One page of a list, with the Link header GitHub sends when there are more."""
+        per_page = int(params.get("per_page", 30))
+        if self.page_size:
+            per_page = min(per_page, self.page_size)
+        page = int(params.get("page", 1))
+        last = max(1, -(-len(entries) // per_page))
+        links = []
+        base = f"https://{self.host}{self.api_prefix}{path}?per_page={per_page}"
+        if page < last:
+            links.append(f'<{base}&page={page + 1}>; rel="next"')
+            links.append(f'<{base}&page={last}>; rel="last"')
+        headers = {"Link": ", ".join(links)} if links else {}
+        return httpx.Response(200, headers=headers, json=entries[(page - 1) * per_page:page * per_page])
+    
+    def _anchor_error(self, comment: Dict[str, Any]) -> Optional[str]:
+        """Why GitHub would refuse a comment's anchor, or None if the diff has its lines."""
+        entry = next((f for f in self.files if f["filename"] == comment.get("path")), None)
+        if entry is None or "patch" not in entry:
+            return "Path could not be resolved"
+        left, right = _diff_lines(entry["patch"])
+        lines = left if comment.get("side", "RIGHT") == "LEFT" else right
+        if comment.get("line") not in lines:
+            return "Line could not be resolved"
+        if "start_line" in comment:
+            start_lines = left if comment.get("start_side", comment.get("side", "RIGHT")) == "LEFT" else right
+            if start_lines.get(comment["start_line"], -1) != lines[comment["line"]]:
+                return "Start line could not be resolved"
+        return None
+    
+    def _review_comment(self, review_id: int, comment: Dict[str, Any]) -> Dict[str, Any]:
+        posted = {
+            "id": self._id(), "pull_request_review_id": review_id, "user": self._user(),
+            "commit_id": self.head_sha, "original_commit_id": self.head_sha,
+            "side": "RIGHT", **comment,
+        }
+        posted["original_line"] = posted["line"]
+        posted["html_url"] = self._html_url(f"discussion_r{posted['id']}")
+        return posted
+    
+    def _post_review(self, payload: Dict[str, Any]) -> httpx.Response:
+        comments = payload.get("comments", [])
+        errors = [error for error in map(self._anchor_error, comments) if error]
+        if errors:
+            return httpx.Response(422, json={"message": "Unprocessable Entity", "errors": errors[:1]})
+        review_id = self._id()
+        review = Review(payload, {
+            "id": review_id, "node_id": f"PRR_{review_id}", "user": self._user(),
+            "body": payload.get("body", ""), "state": REVIEW_STATES.get(payload.get("event"), "PENDING"),
+            "commit_id": payload.get("commit_id") or self.head_sha,
+            "html_url": self._html_url(f"pullrequestreview-{review_id}"),
+        })
+        review.comments = [self._review_comment(review_id, c) for c in comments]
+        self.reviews.append(review.data)
+        self.posted.append(review)
+        if review.state != "PENDING":
+            self.comments.extend(review.comments)
+        return httpx.Response(200, json=review.data)
+    
+    def _review_resource(self, method: str, review_id: int, sub: Optional[str], path: str,
+                         params: Dict[str, str], body: Any) -> Optional[httpx.Response]:
+        data = next((r for r in self.reviews if r["id"] == review_id), None)
+        if data is None:
+            return None
+        posted = next((r for r in self.posted if r.data is data), None)
+        if sub == "/comments":
+            if posted is not None and posted.state == "PENDING":
+                return self._page(path, params, posted.comments)
+            return self._page(path, params, [c for c in self.comments if c.get("pull_request_review_id") == review_id])
+        if sub == "/events" and method == "POST" and posted is not None and posted.state == "PENDING":
+            posted.payload = {**posted.payload, **body}
+            data.update(state=REVIEW_STATES[body["event"]], body=body.get("body", ""))
+            self.comments.extend(posted.comments)
+            return httpx.Response(200, json=data)
+        if sub is None and method == "DELETE" and posted is not None and posted.state == "PENDING":
+            self.reviews.remove(data)
+            self.posted.remove(posted)
+            return httpx.Response(200, json=data)
+        if sub is None and method == "GET":
+            return httpx.Response(200, json=data)
+        return None
+    
+    def _post_comment(self, payload: Dict[str, Any]) -> httpx.Response:
+        if "in_reply_to" in payload:
+            parent = next((c for c in self.comments if c["id"] == payload["in_reply_to"]), None)
+            if parent is None:
+                return httpx.Response(404, json={"message": "Not Found"})
+            comment = {key: parent[key] for key in ("path", "line", "side")}
+            comment.update(body=payload["body"], in_reply_to_id=parent["id"])
+        else:
+            error = self._anchor_error(payload)
+            if error:
+                return httpx.Response(422, json={"message": "Unprocessable Entity", "errors": [error]})
+            comment = {key: value for key, value in payload.items() if key != "commit_id"}
+        posted = self._review_comment(self._id(), comment)
+        self.comments.append(posted)
+        return httpx.Response(201, json=posted)
+    
+    def _issue_comment(self, method: str, comment_id: int, body: Any) -> Optional[httpx.Response]:
+        comment = next((c for c in self.issue_comments if c["id"] == comment_id), None)
+        if comment is None:
+            return None
+        if method == "PATCH":
+            comment["body"] = body["body"]
+        elif method == "DELETE":
+            self.issue_comments.remove(comment)
+            return httpx.Response(204)
+        return httpx.Response(200, json=comment)
+    
+    def _graphql(self, body: Dict[str, Any]) -> httpx.Response:
+        query = body.get("query", "")
+        variables = body.get("variables") or {}
+        if "addPullRequestReviewThread" in query:
+            thread = variables["input"]
+            review = next((r for r in self.posted if r.data["node_id"] == thread["pullRequestReviewId"]), None)
+            comment = {"path": thread["path"], "line": thread["line"], "side": thread["side"], "body": thread["body"]}
+            if "startLine" in thread:
+                comment.update(start_line=thread["startLine"], start_side=thread["startSide"])
+            error = self._anchor_error(comment)
+            if review is None or error:
+                return httpx.Response(200, json={"errors": [{"message": error or "Could not resolve to a node"}]})
+            review.comments.append(self._review_comment(review.id, comment))
+            return httpx.Response(200, json={"data": {"addPullRequestReviewThread": {"thread": {"id": f"PRRT_{self._id()}"}}}})
+        if "resolveReviewThread" in query or "unresolveReviewThread" in query:
+            thread_id = variables["threadId"]
+            resolved = "unresolveReviewThread" not in query
+            (self.resolved.add if resolved else self.resolved.discard)(thread_id)
+            name = "resolveReviewThread" if resolved else "unresolveReviewThread"
+            return httpx.Response(200, json={"data": {name: {"thread": {"id": thread_id, "isResolved": resolved}}}})
+        if "reviewThreads(" in query and "pullRequest(" in query:
+            threads = {"pageInfo": {"hasNextPage": False, "endCursor": None}, "nodes": self._review_threads()}
+            return httpx.Response(200, json={"data": {"repository": {"pullRequest": {"reviewThreads": threads}}}})
+        return httpx.Response(200, json={"errors": [{"message": "not served by the fake GitHub"}]})
+    
+    def _review_threads(self) -> List[Dict[str, Any]]:
+        """The PR's review comments grouped into threads, as GraphQL's reviewThreads lists them."""
+        threads: Dict[int, Dict[str, Any]] = {}
+        for comment in self.comments:
+            node = {"databaseId": comment["id"], "body": comment["body"],
+                    "author": {"login": comment["user"]["login"].removesuffix("[bot]")}}
+            if comment.get("in_reply_to_id") in threads:
+                threads[comment["in_reply_to_id"]]["comments"]["nodes"].append(node)
+                continue
+            thread_id = f"PRRT_{comment['id']}"
+            threads[comment["id"]] = {
+                "id": thread_id, "isResolved": thread_id in self.resolved, "isOutdated": False,
+                "path": comment["path"], "line": comment.get("line"),
+                "comments": {"pageInfo": {"hasNextPage": False, "endCursor": None}, "nodes": [node]},
+            }
+        return list(threads.values())
+    
+    @property
+    def writes(self) -> List[RecordedRequest]:
+        """The POST, PATCH, PUT and DELETE requests received, in order."""
+        return [r for r in self.requests if r.is_write]
+    
+    def requested(self, method: str, path: str) -> bool:
+        """Whether a request for path, relative to the API base, was received."""
+        return any(r.method == method and r.path == path for r in self.requests)
+    
+    def submitted_reviews(self) -> List[Review]:
+        """The reviews posted and not left pending or deleted."""
+        return [r for r in self.posted if r.state != "PENDING"]
+    
+    def assert_one_review(self, comments: Optional[int] = None, anchors: Optional[List[Tuple]] = None,
+                          event: Optional[str] = None) -> Review:
+        """
+        Check exactly one review was submitted, and return it.
+        
+        Args:
+            comments (Optional[int]): Number of comments it must carry
+            anchors (Optional[List[Tuple]]): Its comments' (path, line) or
+                (path, line, side) anchors, in order; side defaults to RIGHT
+            event (Optional[str]): COMMENT, APPROVE or REQUEST_CHANGES
+        """
+        reviews = self.submitted_reviews()
+        assert len(reviews) == 1, f"expected one review posted, got {len(reviews)}: {[r.payload for r in reviews]}"
+        review = reviews[0]
+        if comments is not None:
+            assert len(review.comments) == comments, f"expected {comments} comments, got {review.anchors}"
+        if anchors is not None:
+            expected = [(path, line, *(side or ["RIGHT"])) for path, line, *side in anchors]
+            assert review.anchors == expected, f"expected comments at {expected}, got {review.anchors}"
+        if event is not None:
+            assert review.event == event, f"expected a {event} review, got {review.event}"
+        return review
+    
+    def assert_no_writes(self) -> None:
+        """Check nothing was posted, edited or deleted."""
+        assert not self.writes, f"expected no writes, got {[(r.method, r.path) for r in self.writes]}"
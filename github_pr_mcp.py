@@ -12,22 +12,268 @@ This MCP server provides tools for automated Go code review, including:
 
 import os
 import json
+import time
+import logging
 import subprocess
 import asyncio
-from typing import Optional, List, Dict, Any, Literal
+import argparse
+import re
+import math
+import base64
+import gzip
+import tempfile
+import weakref
+import hmac
+import hashlib
+import shlex
+import threading
+import functools
+import inspect
+import contextvars
+import uuid
+import signal
+import ssl
+import socket
+import ipaddress
+import random
+import string
+import difflib
+import posixpath
+import sys
+import urllib.request
+import sqlite3
+from collections import Counter, OrderedDict
+from contextlib import aclosing, contextmanager
+from urllib.parse import urlsplit, quote, unquote
+from dataclasses import dataclass, field, asdict, replace
+from datetime import datetime, timezone, timedelta
+from typing import Optional, List, Dict, Any, Literal, Union, Callable, Tuple, ClassVar, Annotated, Awaitable, AsyncIterator, Iterator
 from enum import Enum
 from pathlib import Path
 
-from mcp.server.fastmcp import FastMCP
-from pydantic import BaseModel, Field, ConfigDict
+from mcp.server.fastmcp import FastMCP, Context
+from pydantic import (
+    AnyUrl, BaseModel, Field, ConfigDict, PrivateAttr, StringConstraints, ValidationError,
+    model_validator, field_validator
+)
 import httpx
+import jwt
+import yaml
 
 # Initialize MCP server
 mcp = FastMCP("github_pr_mcp")
+logger = logging.getLogger("github_pr_mcp")
+
+# Transport defaults (overridable on the command line)
+DEFAULT_HTTP_HOST = "127.0.0.1"
+DEFAULT_HTTP_PORT = 8000
+# Seconds to let in-flight tool calls finish after SIGTERM in HTTP mode
+DEFAULT_SHUTDOWN_TIMEOUT = 30.0
+# Webhook mode: reviews run in the background, at most this many at once
+DEFAULT_WEBHOOK_CONCURRENCY = 2
+# Delivery IDs remembered for deduplicating GitHub's webhook redeliveries
+WEBHOOK_DELIVERY_CACHE_SIZE = 1000
+# Metrics label of the credentials configured from the environment rather than GITHUB_ACCOUNTS
+DEFAULT_ACCOUNT = "default"
 
 # Configuration
 GITHUB_TOKEN = os.environ.get("GITHUB_TOKEN", "")
+GITHUB_APP_ID = os.environ.get("GITHUB_APP_ID", "")
+GITHUB_APP_INSTALLATION_ID = os.environ.get("GITHUB_APP_INSTALLATION_ID", "")
+# Either the PEM contents or a path to the PEM file
+GITHUB_APP_PRIVATE_KEY = os.environ.get("GITHUB_APP_PRIVATE_KEY", "")
+# Command printing a token (bare, or JSON with "token" and "expires_at"), for
+# short-lived tokens from e.g. Vault; takes precedence over GITHUB_TOKEN
+GITHUB_TOKEN_COMMAND = os.environ.get("GITHUB_TOKEN_COMMAND", "")
+# Seconds a command token without an expiry is reused before running the command again
+GITHUB_TOKEN_COMMAND_TTL = float(os.environ.get("GITHUB_TOKEN_COMMAND_TTL", "300"))
+# Credentials per repository owner, for serving several orgs or users from one
+# process: a YAML/JSON file path or inline JSON mapping each owner to a token,
+# token_env, token_command or App credentials (see GitHubAccount)
+GITHUB_ACCOUNTS = os.environ.get("GITHUB_ACCOUNTS", "")
+# OAuth device flow sign-in: the OAuth App or GitHub App client ID, used when
+# no token, token command or App credentials are configured
+GITHUB_OAUTH_CLIENT_ID = os.environ.get("GITHUB_OAUTH_CLIENT_ID", "")
+# Only needed to refresh expiring user tokens when the app requires its secret
+GITHUB_OAUTH_CLIENT_SECRET = os.environ.get("GITHUB_OAUTH_CLIENT_SECRET", "")
+# Scopes requested by an OAuth App (GitHub Apps ignore them in favour of their permissions)
+GITHUB_OAUTH_SCOPES = os.environ.get("GITHUB_OAUTH_SCOPES", "repo")
+# Where the signed-in token is saved; defaults to the per-user config directory
+GITHUB_OAUTH_TOKEN_PATH = os.environ.get("GITHUB_OAUTH_TOKEN_PATH", "")
+# Webhook mode: HMAC secret configured on the GitHub webhook
+GITHUB_WEBHOOK_SECRET = os.environ.get("GITHUB_WEBHOOK_SECRET", "")
+# Webhook mode: "comprehensive" runs github_pr_comprehensive_review; "command"
+# runs GITHUB_WEBHOOK_COMMAND with the rendered prompt on stdin (e.g. an agent CLI)
+GITHUB_WEBHOOK_BACKEND = os.environ.get("GITHUB_WEBHOOK_BACKEND", "comprehensive")
+GITHUB_WEBHOOK_COMMAND = os.environ.get("GITHUB_WEBHOOK_COMMAND", "")
+GITHUB_WEBHOOK_COMMAND_TIMEOUT = float(os.environ.get("GITHUB_WEBHOOK_COMMAND_TIMEOUT", "1800"))
+GITHUB_WEBHOOK_PROMPT = os.environ.get(
+    "GITHUB_WEBHOOK_PROMPT",
+    "Review pull request {owner}/{repo}#{pr_number} at commit {head_sha} with the github_pr tools "
+    "and post a single review with your findings."
+)
+# Webhook mode: approve and label PRs that github_pr_classify_pr finds trivial instead of reviewing them
+GITHUB_WEBHOOK_AUTO_APPROVE_TRIVIAL = os.environ.get("GITHUB_WEBHOOK_AUTO_APPROVE_TRIVIAL", "").lower() in ("1", "true", "yes")
+# Webhook mode: also review draft PRs (as comments only); by default the first review waits for ready_for_review
+GITHUB_WEBHOOK_REVIEW_DRAFTS = os.environ.get("GITHUB_WEBHOOK_REVIEW_DRAFTS", "").lower() in ("1", "true", "yes")
+# Webhook mode: seconds without a new push before a PR's review starts, so a burst of pushes is reviewed once
+GITHUB_WEBHOOK_DEBOUNCE = float(os.environ.get("GITHUB_WEBHOOK_DEBOUNCE", "30"))
+TRIVIAL_LABEL = os.environ.get("TRIVIAL_LABEL", "trivial")
+# Logging: level name and "text" or "json" lines (overridable on the command line)
+LOG_LEVEL = os.environ.get("LOG_LEVEL", "INFO").upper()
+LOG_FORMAT = os.environ.get("LOG_FORMAT", "text")
 GITHUB_API_BASE = "https://api.github.com"
+GITHUB_UPLOAD_BASE = "https://uploads.github.com"
+# Attempts (including the first) for GET/HEAD requests that hit 5xx or network errors
+GITHUB_RETRY_MAX_ATTEMPTS = max(1, int(os.environ.get("GITHUB_RETRY_MAX_ATTEMPTS", "3")))
+# GitHub Enterprise Server: the instance URL, or its API/upload endpoints
+GITHUB_API_URL = os.environ.get("GITHUB_API_URL", "")
+GITHUB_UPLOAD_URL = os.environ.get("GITHUB_UPLOAD_URL", "")
+# How a PR's metadata, reviews, threads, labels and checks are fetched together: "graphql" (one
+# request for most PRs, falling back to REST on errors) or "rest" (one request per part)
+GITHUB_BULK_FETCH = os.environ.get("GITHUB_BULK_FETCH", "graphql").lower()
+# Proxy for every outbound GitHub request; HTTPS_PROXY, HTTP_PROXY and NO_PROXY apply when unset
+GITHUB_PROXY = os.environ.get("GITHUB_PROXY", "")
+# PEM bundle of CAs trusted in addition to the system ones, e.g. an internal CA
+GITHUB_CA_BUNDLE = os.environ.get("GITHUB_CA_BUNDLE", "")
+# Client certificate for mutual TLS, and its key when it is not in the same PEM file
+GITHUB_CLIENT_CERT = os.environ.get("GITHUB_CLIENT_CERT", "")
+GITHUB_CLIENT_KEY = os.environ.get("GITHUB_CLIENT_KEY", "")
+# Lab environments only: accept any TLS certificate
+GITHUB_INSECURE_SKIP_VERIFY = os.environ.get("GITHUB_INSECURE_SKIP_VERIFY", "").lower() in ("1", "true", "yes")
+# Longest total time (seconds) a request may spend waiting out rate limits
+GITHUB_RATE_LIMIT_MAX_WAIT = float(os.environ.get("GITHUB_RATE_LIMIT_MAX_WAIT", "120"))
+# Expensive tools (diff, analyzers) refuse to start a multi-page fetch with fewer requests left than this
+GITHUB_RATE_LIMIT_FLOOR = int(os.environ.get("GITHUB_RATE_LIMIT_FLOOR", "100"))
+# GitHub rejects search text longer than this (qualifiers do not count)
+SEARCH_QUERY_MAX_LENGTH = 256
+# Length of the body excerpt used as a search result snippet when GitHub returns no text match
+SEARCH_SNIPPET_LENGTH = 200
+# The search API has its own limit (30 requests a minute); longest total wait for one search request
+GITHUB_SEARCH_RATE_LIMIT_MAX_WAIT = float(os.environ.get("GITHUB_SEARCH_RATE_LIMIT_MAX_WAIT", "60"))
+# Longest a single GitHub request may take (seconds; overridable on the command line)
+GITHUB_REQUEST_TIMEOUT = float(os.environ.get("GITHUB_REQUEST_TIMEOUT", "30"))
+# Mutating tools only report the requests they would send (overridable on the command line with --read-only)
+GITHUB_READ_ONLY = os.environ.get("GITHUB_READ_ONLY", "").lower() in ("1", "true", "yes")
+# Deadline for a whole tool call (seconds; 0 disables); expensive tools take a per-call timeout_seconds
+TOOL_CALL_TIMEOUT = float(os.environ.get("TOOL_CALL_TIMEOUT", "300"))
+GITHUB_PER_PAGE = 100
+# The pull request files endpoint stops returning entries after this many files.
+GITHUB_PR_FILES_LIMIT = 3000
+# GitHub rejects commit status descriptions longer than this
+GITHUB_STATUS_DESCRIPTION_LIMIT = 140
+# Character budget for diffs returned by github_pr_get_diff (roughly 4 characters per token); 0 disables
+GITHUB_DIFF_MAX_CHARS = int(os.environ.get("GITHUB_DIFF_MAX_CHARS", "200000"))
+DEFAULT_DIFF_CHUNK_CHARS = 50000
+# Over the HTTP transports, github_pr_get_diff answers with a chunk manifest instead of the diff
+# when the diff is larger than this many bytes; 0 disables. stdio always returns the diff itself.
+GITHUB_DIFF_STREAM_THRESHOLD = int(os.environ.get("GITHUB_DIFF_STREAM_THRESHOLD", str(1024 * 1024)))
+# Most bytes in one chunk of a streamed diff
+DIFF_STREAM_CHUNK_BYTES = 50000
+# Streamed diffs kept in temporary files for their chunks to be read back; the least recently read go first
+DIFF_STREAM_SPOOLS = 4
+# Files whose patch is over this many bytes, or that change more lines, are listed
+# instead of reviewed unless a call names them in include_large_files; 0 disables a limit
+GITHUB_LARGE_FILE_MAX_BYTES = int(os.environ.get("GITHUB_LARGE_FILE_MAX_BYTES", str(512 * 1024)))
+GITHUB_LARGE_FILE_MAX_LINES = int(os.environ.get("GITHUB_LARGE_FILE_MAX_LINES", "5000"))
+# Largest file github_pr_get_file_context will download
+GITHUB_FILE_CONTEXT_MAX_BYTES = int(os.environ.get("GITHUB_FILE_CONTEXT_MAX_BYTES", str(1024 * 1024)))
+# Project files github_pr_get_repo_context reads from the base branch, and the characters kept of each
+REPO_CONTEXT_FILES = [p for p in os.environ.get(
+    "REPO_CONTEXT_FILES", "README.md,CONTRIBUTING.md,docs/style.md,.golangci.yml"
+).replace(" ", "").split(",") if p]
+REPO_CONTEXT_MAX_CHARS = int(os.environ.get("REPO_CONTEXT_MAX_CHARS", "8000"))
+# Blob contents kept in memory (bytes), and the largest single blob worth keeping
+BLOB_CACHE_MAX_BYTES = int(os.environ.get("BLOB_CACHE_MAX_BYTES", str(64 * 1024 * 1024)))
+BLOB_CACHE_MAX_ENTRY_BYTES = int(os.environ.get("BLOB_CACHE_MAX_ENTRY_BYTES", str(1024 * 1024)))
+# File contents downloaded at once when analyzers fetch many files
+GITHUB_FETCH_CONCURRENCY = max(1, int(os.environ.get("GITHUB_FETCH_CONCURRENCY", "8")))
+# Failed check summaries and annotations are cut to this many characters by default
+DEFAULT_CHECK_OUTPUT_CHARS = 2000
+# Comment markers reported when added without an issue reference, and the fewest
+# consecutive added comment lines reading as code that count as commented-out code (0 disables)
+REVIEW_MARKERS = [m for m in os.environ.get("REVIEW_MARKERS", "TODO,FIXME,XXX,HACK").replace(" ", "").split(",") if m]
+COMMENTED_CODE_MIN_LINES = int(os.environ.get("COMMENTED_CODE_MIN_LINES", "5"))
+# Most pairs of matching windows github_pr_check_duplicates compares before it stops and reports truncated
+DUPLICATE_MAX_COMPARISONS = int(os.environ.get("DUPLICATE_MAX_COMPARISONS", "100000"))
+# github_pr_check_docs external link checks: seconds each link may take to answer, links
+# checked at once, and the most distinct links checked per call
+DOC_LINK_TIMEOUT = float(os.environ.get("DOC_LINK_TIMEOUT", "5"))
+DOC_LINK_CONCURRENCY = max(1, int(os.environ.get("DOC_LINK_CONCURRENCY", "4")))
+DOC_LINK_MAX = int(os.environ.get("DOC_LINK_MAX", "50"))
+# github_pr_check_complexity limits: cyclomatic complexity and length (lines) of a changed
+# Go function, and the complexity one PR may add to a function (0 disables a limit)
+GO_MAX_COMPLEXITY = int(os.environ.get("GO_MAX_COMPLEXITY", "15"))
+GO_MAX_FUNCTION_LINES = int(os.environ.get("GO_MAX_FUNCTION_LINES", "80"))
+GO_MAX_COMPLEXITY_INCREASE = int(os.environ.get("GO_MAX_COMPLEXITY_INCREASE", "5"))
+# github_pr_classify_pr: globs of files that never need a review (commas inside {} belong to
+# the glob), and the most added plus deleted lines a trivial PR may have (0 disables the limit)
+TRIVIAL_PATHS = [g for g in re.split(r",(?![^{]*\})", os.environ.get(
+    "TRIVIAL_PATHS", "**/*.md,**/*.txt,docs/**/*.{png,jpg,jpeg,gif,svg,webp}"
+).replace(" ", "")) if g]
+TRIVIAL_MAX_CHANGED_LINES = int(os.environ.get("TRIVIAL_MAX_CHANGED_LINES", "200"))
+# Directories (or globs) this server instance reviews, e.g. "services/payments" in a monorepo;
+# files elsewhere are invisible to the diff, file, analyzer and review tools. Empty reviews everything
+REVIEW_PATH_SCOPE = [p for p in re.split(r",(?![^{]*\})", os.environ.get("REVIEW_PATH_SCOPE", "").replace(" ", "")) if p]
+# Analyzers that run gofmt/go vet on PR code are off unless explicitly enabled
+GO_TOOLCHAIN_ANALYZERS = os.environ.get("GO_TOOLCHAIN_ANALYZERS", "").lower() in ("1", "true", "yes")
+# Hidden marker appended to every inline comment so later runs can recognise their own comments
+REVIEW_COMMENT_MARKER = "<!-- github-pr-mcp -->"
+# Hidden markers carrying JSON: each inline finding's severity and rule, and each review's
+# head SHA, verdict and finding counts, so github_pr_get_review_history can recover them
+FINDING_DATA_MARKER = "github-pr-mcp:finding"
+REVIEW_DATA_MARKER = "github-pr-mcp:review"
+# An earlier comment still counts as the same finding if the line moved by at most this much
+DUPLICATE_LINE_DRIFT = 3
+# Longest suggestion patch attached to a review summary; GitHub caps a review body at 65536 characters
+SUGGESTION_PATCH_MAX_CHARS = 50000
+# Re-anchoring after a force-push: lines searched either side of where a commented line should
+# now be, lines of surrounding context compared to choose between repeats, and the similarity
+# (0-1) above which a changed line is reported as possibly the same code
+REANCHOR_WINDOW = 10
+REANCHOR_CONTEXT = 2
+REANCHOR_FUZZY_RATIO = 0.8
+# Linked issues resolved for PR metadata, and the characters of each issue's description kept
+LINKED_ISSUES_MAX = 25
+LINKED_ISSUE_BODY_CHARS = 2000
+# Longest chain of stacked PRs followed from one PR, counting it
+PR_STACK_MAX_DEPTH = 20
+# Seconds an author's merged PR count in a repository is reused before searching again
+AUTHOR_MERGED_PRS_TTL = 3600
+# author_association values of someone with no earlier commits in the repository
+FIRST_TIME_ASSOCIATIONS = ("FIRST_TIME_CONTRIBUTOR", "FIRST_TIMER", "NONE")
+# Delimits the generated summary inside a PR description; text outside it belongs to the author
+PR_SUMMARY_START = "<!-- pr-reviewer:summary -->"
+PR_SUMMARY_END = "<!-- /pr-reviewer:summary -->"
+# Marks the bot's single summary comment in the PR conversation, and its history of earlier runs
+SUMMARY_COMMENT_MARKER = "<!-- pr-reviewer:summary:v1 -->"
+SUMMARY_HISTORY_MARKER = "<!-- pr-reviewer:summary-history -->"
+SUMMARY_RUN_MARKER = "<!-- pr-reviewer:summary-run -->"
+SUMMARY_HEAD_MARKER = "pr-reviewer:summary-head"
+MAX_SUMMARY_HISTORY = 20
+# Finding severities, least severe first
+FINDING_SEVERITIES = ("info", "warning", "error", "blocking")
+# SARIF result level for each finding severity
+SARIF_LEVELS = {"blocking": "error", "error": "error", "warning": "warning", "info": "note"}
+# Churn summaries count at most this many commits per file
+CHURN_MAX_COMMITS = 100
+# Risk scores (out of 100) at or above which a PR is rated high or medium risk
+RISK_LEVELS = (("high", 60), ("medium", 30))
+# Longest a tool waits for GitHub to finish an asynchronous PR update (seconds)
+DEFAULT_PR_POLL_TIMEOUT = 30.0
+# Review policy read from each repository's default branch
+REVIEW_POLICY_PATH = ".github/pr-reviewer.yml"
+# Policy file (same format) used for repositories without their own
+PR_REVIEWER_DEFAULT_POLICY = os.environ.get("PR_REVIEWER_DEFAULT_POLICY", "")
+# Paginated tool results: items per page by default, and how long a cursor stays valid (seconds)
+DEFAULT_RESULT_PAGE_SIZE = 100
+RESULT_CURSOR_TTL_SECONDS = float(os.environ.get("RESULT_CURSOR_TTL_SECONDS", "900"))
+# Directory of user prompt templates that add to or replace the built-in ones
+PR_REVIEWER_PROMPTS_DIR = os.environ.get("PR_REVIEWER_PROMPTS_DIR", "")
+# Directory of .tmpl files replacing the built-in templates of comments, reviews and replies
+PR_REVIEWER_TEMPLATES_DIR = os.environ.get("PR_REVIEWER_TEMPLATES_DIR", "")
+# SQLite file keeping what was posted on each PR across restarts; empty keeps it in memory
+PR_REVIEWER_STATE_PATH = os.environ.get("PR_REVIEWER_STATE_PATH", "")
 
 
 # ============================================================================
@@ -96,10 +342,106 @@ class GetPRDiffInput(BaseModel):
         validate_assignment=True,
         extra='forbid'
     )
+    CALL_DEADLINE_FIELD: ClassVar[Optional[str]] = "timeout_seconds"
+    EXPENSIVE_CALL: ClassVar[bool] = True
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    path: Optional[str] = Field(
+        default=None,
+        description="Return only this file's full patch, e.g. one listed in omitted_files"
+    )
+    max_diff_chars: Optional[int] = Field(
+        default=None,
+        description="Character budget for the diff (default GITHUB_DIFF_MAX_CHARS; 0 for no limit)",
+        ge=0
+    )
+    prioritize: List[str] = Field(
+        default_factory=list,
+        description="Glob patterns of files to include first when the diff exceeds the budget"
+    )
+    since_last_review: bool = Field(
+        default=False,
+        description="Only diff the commits pushed since this server's most recent review (full diff if none)"
+    )
+    timeout_seconds: Optional[float] = Field(
+        default=None,
+        description="Deadline for this call, replacing the server's tool timeout",
+        gt=0,
+        le=3600
+    )
+    include: List[str] = Field(
+        default_factory=list,
+        description="Only consider files matching these globs ('**' spans directories)"
+    )
+    exclude: List[str] = Field(
+        default_factory=list,
+        description="Ignore files matching these globs, e.g. 'vendor/**' or '**/*.pb.go'; wins over include"
+    )
+    path_scope: Optional[List[str]] = Field(
+        default=None,
+        description="Only look at files under these directories or globs, e.g. 'services/payments' "
+                    "(default: REVIEW_PATH_SCOPE; [] for the whole repository)"
+    )
+    include_large_files: List[str] = Field(
+        default_factory=list,
+        description="Review files matching these globs even when they are over the large file limits"
+    )
+    include_generated: bool = Field(
+        default=False,
+        description="Also review generated, vendored and lock files, which are skipped by default"
+    )
+    response_format: ResponseFormat = Field(
+        default=ResponseFormat.MARKDOWN,
+        description="Output format"
+    )
+
+
+class PaginatedInput(BaseModel):
+    """
+    Base for inputs of tools whose results are returned a page at a time.
+    
+    The first call fetches and snapshots the full result; passing the
+    returned next_cursor reads the following page from that snapshot.
+    """
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    
+    cursor: Optional[str] = Field(
+        default=None,
+        description="next_cursor from the previous page; omit to start a new listing"
+    )
+    page_size: int = Field(
+        default=DEFAULT_RESULT_PAGE_SIZE,
+        description="Items per page",
+        ge=1,
+        le=1000
+    )
+
+
+class ListPRFilesInput(PaginatedInput):
+    """Input for listing the files changed in a GitHub PR."""
     
     owner: str = Field(..., description="Repository owner", min_length=1)
     repo: str = Field(..., description="Repository name", min_length=1)
     pr_number: int = Field(..., description="Pull request number", ge=1)
+    include: List[str] = Field(
+        default_factory=list,
+        description="Only consider files matching these globs ('**' spans directories)"
+    )
+    exclude: List[str] = Field(
+        default_factory=list,
+        description="Ignore files matching these globs, e.g. 'vendor/**' or '**/*.pb.go'; wins over include"
+    )
+    path_scope: Optional[List[str]] = Field(
+        default=None,
+        description="Only look at files under these directories or globs, e.g. 'services/payments' "
+                    "(default: REVIEW_PATH_SCOPE; [] for the whole repository)"
+    )
     response_format: ResponseFormat = Field(
         default=ResponseFormat.MARKDOWN,
         description="Output format"
@@ -113,6 +455,7 @@ class PostReviewCommentInput(BaseModel):
         validate_assignment=True,
         extra='forbid'
     )
+    REQUIRED_PERMISSION: ClassVar[Optional[Tuple[str, str]]] = ("pull_requests", "write")
     
     owner: str = Field(..., description="Repository owner", min_length=1)
     repo: str = Field(..., description="Repository name", min_length=1)
@@ -126,317 +469,17132 @@ class PostReviewCommentInput(BaseModel):
         default=None,
         description="Specific commit ID to review (latest if not provided)"
     )
+    dry_run: bool = Field(
+        default=False,
+        description="Validate and render everything, but return the requests that would be sent instead of sending them"
+    )
 
 
-class AnalyzePRInput(BaseModel):
-    """Input for comprehensive PR analysis."""
+class ReviewFinding(BaseModel):
+    """
+    A single review comment anchored to a line of the PR diff, or to one of its commits.
+    
+    Commit findings, such as a malformed commit message, have a commit SHA
+    instead of a path and line and are listed in the review summary.
+    """
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        extra='forbid'
+    )
+    
+    path: Optional[str] = Field(default=None, description="File path relative to the repository root", min_length=1)
+    line: Optional[int] = Field(default=None, description="Line number in the file on the given side of the diff", ge=1)
+    side: Literal["LEFT", "RIGHT"] = Field(
+        default="RIGHT",
+        description="Diff side: 'RIGHT' for the new version (added/context lines), 'LEFT' for removed lines"
+    )
+    start_line: Optional[int] = Field(
+        default=None,
+        description="First line of a multi-line comment; 'line' is then the last line of the range",
+        ge=1
+    )
+    start_side: Optional[Literal["LEFT", "RIGHT"]] = Field(
+        default=None,
+        description="Diff side of 'start_line' (defaults to 'side')"
+    )
+    body: str = Field(..., description="Comment text (markdown)", min_length=1)
+    # Kept verbatim: leading indentation is part of the replacement code
+    suggestion: Optional[Annotated[str, StringConstraints(strip_whitespace=False)]] = Field(
+        default=None,
+        description="Replacement code for the anchored line(s), rendered as a GitHub suggestion block"
+    )
+    severity: Literal["info", "warning", "error", "blocking"] = Field(
+        default="warning",
+        description="How serious the finding is; 'blocking' means it must be fixed before merging"
+    )
+    category: Optional[str] = Field(
+        default=None,
+        description="Kind of problem, e.g. 'correctness', 'security', 'performance', 'style', 'documentation'"
+    )
+    rule: Optional[str] = Field(
+        default=None,
+        description="Identifier of the check that produced the finding, e.g. 'go-vet' or 'secrets/github-token'"
+    )
+    commit: Optional[str] = Field(
+        default=None,
+        description="SHA of the PR commit the finding is about, instead of a path and line",
+        pattern=r"^[0-9a-f]{7,40}$"
+    )
+    
+    @model_validator(mode="after")
+    def has_anchor(self) -> "ReviewFinding":
+        if self.commit is None:
+            if self.path is None or self.line is None:
+                raise ValueError("a finding needs a path and line, or a commit")
+        elif self.path is not None or self.line is not None or self.start_line is not None or self.suggestion is not None:
+            raise ValueError("a commit finding has no path, line or suggestion")
+        return self
+
+
+class FindingsBatchInput(BaseModel):
+    """
+    Base for inputs carrying a batch of findings.
+    
+    Malformed findings are set aside with per-item errors instead of failing
+    the whole call; they are available as rejected_findings.
+    """
+    _rejected_findings: List[Dict[str, Any]] = PrivateAttr(default_factory=list)
+    
+    @model_validator(mode="wrap")
+    @classmethod
+    def _set_aside_malformed_findings(cls, data: Any, handler: Callable[[Any], Any]) -> Any:
+        rejected = []
+        if isinstance(data, dict) and isinstance(data.get("findings"), list):
+            valid = []
+            for index, item in enumerate(data["findings"]):
+                try:
+                    valid.append(ReviewFinding.model_validate(item))
+                except ValidationError as e:
+                    rejected.append({
+                        "index": index,
+                        "path": item.get("path") if isinstance(item, dict) else None,
+                        "errors": [
+                            f"{'.'.join(str(part) for part in err['loc']) or 'finding'}: {err['msg']}"
+                            for err in e.errors()
+                        ],
+                    })
+            if rejected and not valid:
+                raise ValueError(f"Every finding is malformed: {json.dumps(rejected)}")
+            data = {**data, "findings": valid}
+        model = handler(data)
+        model._rejected_findings = rejected
+        return model
+    
+    @property
+    def rejected_findings(self) -> List[Dict[str, Any]]:
+        return self._rejected_findings
+
+
+class CreateReviewInput(FindingsBatchInput):
+    """Input for posting a batch of findings as a single PR review."""
     model_config = ConfigDict(
         str_strip_whitespace=True,
         validate_assignment=True,
         extra='forbid'
     )
+    REQUIRED_PERMISSION: ClassVar[Optional[Tuple[str, str]]] = ("pull_requests", "write")
     
     owner: str = Field(..., description="Repository owner", min_length=1)
     repo: str = Field(..., description="Repository name", min_length=1)
     pr_number: int = Field(..., description="Pull request number", ge=1)
-    local_path: Optional[str] = Field(
+    summary: str = Field(..., description="Review summary body", min_length=1)
+    event: Literal["COMMENT", "APPROVE", "REQUEST_CHANGES", "AUTO"] = Field(
+        default="COMMENT",
+        description="Review event type; AUTO, or leaving it unset, derives it from the findings' severities "
+                    "(the policy's review_events, COMMENT otherwise, APPROVE when there are none). "
+                    "An explicit event laxer than the policy's is raised to it, with policy_event in the result"
+    )
+    findings: List[ReviewFinding] = Field(
+        default_factory=list,
+        description="Inline findings to post as review comments"
+    )
+    dry_run: bool = Field(
+        default=False,
+        description="Validate and render everything, but return the requests that would be sent instead of sending them"
+    )
+    fallback_to_output: bool = Field(
+        default=False,
+        description="When the credentials may not post reviews on the repository, return the review "
+                    "as a dry run with missing_permission set instead of failing"
+    )
+    
+    @field_validator("event", mode="before")
+    @classmethod
+    def _upper_event(cls, value: Any) -> Any:
+        return value.strip().upper() if isinstance(value, str) else value
+    request_changes_at: Optional[Literal["info", "warning", "error", "blocking"]] = Field(
         default=None,
-        description="Local path to cloned repository (if analyzing locally)"
+        description="Post the review as REQUEST_CHANGES when any finding is at least this severe; "
+                    "by default the repository policy's review_events decide (REQUEST_CHANGES on blocking)"
     )
-    run_tests: bool = Field(
+    commit_id: Optional[str] = Field(
+        default=None,
+        description="Specific commit ID to review (latest if not provided)"
+    )
+    skip_duplicates: bool = Field(
         default=True,
-        description="Run automated tests"
+        description="Drop findings that repeat an unresolved comment this server already posted"
     )
-    post_comments: bool = Field(
+    path_scope: Optional[List[str]] = Field(
+        default=None,
+        description="Drop findings outside these directories or globs and post nothing if the PR "
+                    "changes no file there (default: REVIEW_PATH_SCOPE; [] for the whole repository)"
+    )
+    run_id: Optional[str] = Field(
+        default=None,
+        description="Identifier of this posting, embedded in the review; a review already carrying it "
+                    "is returned instead of posting again (default: derived from the head SHA and findings)",
+        max_length=64
+    )
+    patch: bool = Field(
         default=False,
-        description="Automatically post review comments to GitHub"
+        description="Also assemble the findings' suggestions into one unified diff for git apply, "
+                    "returned as patch and attached to the review summary in a collapsed block"
     )
+
+
+class ListReviewThreadsInput(PaginatedInput):
+    """Input for listing the review conversation threads of a PR."""
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
     response_format: ResponseFormat = Field(
         default=ResponseFormat.MARKDOWN,
         description="Output format"
     )
 
 
-# ============================================================================
-# Helper Functions
-# ============================================================================
-
-def _run_command(cmd: List[str], cwd: Optional[str] = None) -> Dict[str, Any]:
-    """Execute a shell command and return results."""
-    try:
-        result = subprocess.run(
-            cmd,
-            cwd=cwd,
-            capture_output=True,
-            text=True,
-            timeout=300  # 5 minute timeout
-        )
-        return {
-            "stdout": result.stdout,
-            "stderr": result.stderr,
-            "returncode": result.returncode,
-            "success": result.returncode == 0
-        }
-    except subprocess.TimeoutExpired:
-        return {
-            "stdout": "",
-            "stderr": "Command timed out after 5 minutes",
-            "returncode": -1,
-            "success": False
-        }
-    except Exception as e:
-        return {
-            "stdout": "",
-            "stderr": str(e),
-            "returncode": -1,
-            "success": False
-        }
-
-
-def _format_markdown_analysis(results: Dict[str, Any]) -> str:
-    """Format analysis results as markdown."""
-    sections = []
-    
-    if "lint" in results:
-        sections.append("## Linting Results (golangci-lint)\n")
-        if results["lint"]["success"]:
-            sections.append("✅ No linting issues found!\n")
-        else:
-            sections.append(f"❌ Linting issues detected:\n\n```\n{results['lint']['stdout']}\n```\n")
-    
-    if "fmt" in results:
-        sections.append("## Formatting Check (gofmt)\n")
-        if results["fmt"]["success"] and not results["fmt"]["stdout"]:
-            sections.append("✅ Code is properly formatted!\n")
-        else:
-            sections.append(f"⚠️ Formatting issues found:\n\n```\n{results['fmt']['stdout']}\n```\n")
+class ResolveThreadInput(BaseModel):
+    """Input for resolving or unresolving a review conversation thread."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    REQUIRED_PERMISSION: ClassVar[Optional[Tuple[str, str]]] = ("pull_requests", "write")
     
-    if "vet" in results:
-        sections.append("## Go Vet Analysis\n")
-        if results["vet"]["success"]:
-            sections.append("✅ No issues found by go vet!\n")
-        else:
-            sections.append(f"❌ Issues detected:\n\n```\n{results['vet']['stderr']}\n```\n")
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    thread_id: Optional[str] = Field(
+        default=None,
+        description="GraphQL node ID of the review thread (e.g. 'PRRT_kwDO...')"
+    )
+    comment_id: Optional[int] = Field(
+        default=None,
+        description="REST ID of any review comment in the thread",
+        ge=1
+    )
+    dry_run: bool = Field(
+        default=False,
+        description="Validate and render everything, but return the requests that would be sent instead of sending them"
+    )
     
-    return "\n".join(sections)
+    @model_validator(mode="after")
+    def _one_target(self) -> "ResolveThreadInput":
+        if (self.thread_id is None) == (self.comment_id is None):
+            raise ValueError("Provide exactly one of thread_id or comment_id")
+        return self
 
 
-def _format_test_results_markdown(result: Dict[str, Any], coverage: bool) -> str:
-    """Format test results as markdown."""
-    sections = ["# Test Results\n"]
-    
-    if result["success"]:
-        sections.append("✅ **All tests passed!**\n")
-    else:
-        sections.append("❌ **Tests failed!**\n")
-    
-    sections.append("## Output\n")
-    sections.append(f"```\n{result['stdout']}\n```\n")
-    
-    if result["stderr"]:
-        sections.append("## Errors\n")
-        sections.append(f"```\n{result['stderr']}\n```\n")
-    
-    if coverage and "coverage" in result:
-        sections.append(f"\n## Coverage\n{result['coverage']}\n")
+class StartPendingReviewInput(BaseModel):
+    """Input for starting a pending (draft) review."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    REQUIRED_PERMISSION: ClassVar[Optional[Tuple[str, str]]] = ("pull_requests", "write")
     
-    return "\n".join(sections)
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    commit_id: Optional[str] = Field(
+        default=None,
+        description="Specific commit ID to review (latest if not provided)"
+    )
+    dry_run: bool = Field(
+        default=False,
+        description="Validate and render everything, but return the requests that would be sent instead of sending them"
+    )
 
 
-async def _github_api_request(
-    method: str,
-    endpoint: str,
-    data: Optional[Dict] = None
-) -> Dict[str, Any]:
-    """
-    Make authenticated GitHub API request.
-    
-    FIXED: Added follow_redirects=True to handle API redirects (302) correctly.
-    """
-    if not GITHUB_TOKEN:
-        raise ValueError("GITHUB_TOKEN environment variable not set")
-    
-    headers = {
-        "Authorization": f"Bearer {GITHUB_TOKEN}",
-        "Accept": "application/vnd.github+json",
-        "X-GitHub-Api-Version": "2022-11-28"
-    }
+class AddPendingCommentInput(FindingsBatchInput):
+    """Input for adding comments to the session's pending review."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    REQUIRED_PERMISSION: ClassVar[Optional[Tuple[str, str]]] = ("pull_requests", "write")
     
-    url = f"{GITHUB_API_BASE}{endpoint}"
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    findings: List[ReviewFinding] = Field(
+        ...,
+        description="Inline comments to add to the pending review",
+        min_length=1
+    )
+    path_scope: Optional[List[str]] = Field(
+        default=None,
+        description="Drop comments outside these directories or globs (default: REVIEW_PATH_SCOPE; [] for the whole repository)"
+    )
+    dry_run: bool = Field(
+        default=False,
+        description="Validate and render everything, but return the requests that would be sent instead of sending them"
+    )
+
+
+class SubmitPendingReviewInput(BaseModel):
+    """Input for submitting the session's pending review."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    REQUIRED_PERMISSION: ClassVar[Optional[Tuple[str, str]]] = ("pull_requests", "write")
     
-    # Enable follow_redirects to handle GitHub API redirection behaviors
-    async with httpx.AsyncClient(timeout=30.0, follow_redirects=True) as client:
-        if method.upper() == "GET":
-            response = await client.get(url, headers=headers)
-        elif method.upper() == "POST":
-            response = await client.post(url, headers=headers, json=data)
-        else:
-            raise ValueError(f"Unsupported HTTP method: {method}")
-        
-        response.raise_for_status()
-        return response.json()
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    body: str = Field(..., description="Review summary body", min_length=1)
+    event: Literal["COMMENT", "APPROVE", "REQUEST_CHANGES"] = Field(
+        default="COMMENT",
+        description="Review event type"
+    )
+    dry_run: bool = Field(
+        default=False,
+        description="Validate and render everything, but return the requests that would be sent instead of sending them"
+    )
 
 
-def _parse_diff_for_go_files(diff_text: str) -> List[str]:
-    """Extract list of changed Go files from git diff."""
-    go_files = []
-    for line in diff_text.split('\n'):
+class DiscardPendingReviewInput(BaseModel):
+    """Input for abandoning the session's pending review."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    REQUIRED_PERMISSION: ClassVar[Optional[Tuple[str, str]]] = ("pull_requests", "write")
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    dry_run: bool = Field(
+        default=False,
+        description="Validate and render everything, but return the requests that would be sent instead of sending them"
+    )
+
+
+class DismissReviewInput(BaseModel):
+    """Input for dismissing the bot's earlier change requests on a PR."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    REQUIRED_PERMISSION: ClassVar[Optional[Tuple[str, str]]] = ("pull_requests", "write")
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    message: str = Field(..., description="Dismissal message shown on the PR", min_length=1)
+    dry_run: bool = Field(
+        default=False,
+        description="Validate and render everything, but return the requests that would be sent instead of sending them"
+    )
+
+
+class CleanupBotCommentsInput(BaseModel):
+    """Input for removing or hiding everything the bot posted on a PR."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    REQUIRED_PERMISSION: ClassVar[Optional[Tuple[str, str]]] = ("pull_requests", "write")
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    mode: Literal["delete", "minimize"] = Field(
+        default="delete",
+        description="Delete the comments, or minimize (hide) them so they can still be expanded"
+    )
+    reason: Literal["OUTDATED", "RESOLVED", "DUPLICATE", "OFF_TOPIC", "SPAM", "ABUSE"] = Field(
+        default="OUTDATED",
+        description="Reason shown on minimized comments"
+    )
+    posted_after: Optional[str] = Field(
+        default=None,
+        description="Only clean up what was posted at or after this ISO 8601 timestamp, e.g. a bad run's start"
+    )
+    include_unmarked: bool = Field(
+        default=False,
+        description="Also clean up the bot account's comments without this server's hidden markers"
+    )
+    dismiss_message: str = Field(
+        default="Withdrawn: this review was cleaned up by the reviewer bot.",
+        description="Message for dismissing the bot's approvals and change requests, which cannot be deleted",
+        min_length=1
+    )
+    dry_run: bool = Field(
+        default=False,
+        description="List what would be cleaned up without changing anything"
+    )
+    
+    @field_validator("posted_after")
+    @classmethod
+    def _iso_timestamp(cls, value: Optional[str]) -> Optional[str]:
+        if value is not None:
+            try:
+                datetime.fromisoformat(value.replace("Z", "+00:00"))
+            except ValueError:
+                raise ValueError(f"posted_after must be an ISO 8601 timestamp, got {value!r}")
+        return value
+
+
+class SweepResolvedFindingsInput(BaseModel):
+    """Input for resolving the bot's threads whose findings later pushes fixed."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    REQUIRED_PERMISSION: ClassVar[Optional[Tuple[str, str]]] = ("pull_requests", "write")
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    line_drift: int = Field(
+        default=DUPLICATE_LINE_DRIFT,
+        description="A finding of the same rule this many lines from the thread's line still counts as open",
+        ge=0,
+        le=50
+    )
+    message: Optional[str] = Field(
+        default=None,
+        description=(
+            "Reply posted before resolving a thread, instead of the sweep_reply template; "
+            "{sha} is the head's short SHA"
+        ),
+        min_length=1
+    )
+    dry_run: bool = Field(
+        default=False,
+        description="Re-run the analyzers and report the replies and resolutions without sending them"
+    )
+    response_format: ResponseFormat = Field(
+        default=ResponseFormat.MARKDOWN,
+        description="Output format"
+    )
+
+
+class ReanchorCommentsInput(BaseModel):
+    """Input for mapping the bot's review comments onto a force-pushed head."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    REQUIRED_PERMISSION: ClassVar[Optional[Tuple[str, str]]] = ("pull_requests", "write")
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    old_sha: str = Field(..., description="Head commit before the force-push", min_length=7, max_length=40)
+    new_sha: str = Field(..., description="Head commit after the force-push", min_length=7, max_length=40)
+    repost: bool = Field(
+        default=False,
+        description="Post the comments that still apply again at their new lines, in one review "
+                    "(new_sha must be the PR's current head)"
+    )
+    resolve_orphaned: bool = Field(
+        default=False,
+        description="Resolve the old threads of the comments that were posted again"
+    )
+    dry_run: bool = Field(
+        default=False,
+        description="Report the mapping and the requests that would be sent without sending them"
+    )
+    response_format: ResponseFormat = Field(
+        default=ResponseFormat.MARKDOWN,
+        description="Output format"
+    )
+
+
+class RequestReviewersInput(BaseModel):
+    """Input for requesting reviews from users and teams."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    REQUIRED_PERMISSION: ClassVar[Optional[Tuple[str, str]]] = ("pull_requests", "write")
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    reviewers: List[str] = Field(default_factory=list, description="User logins to request reviews from")
+    team_reviewers: List[str] = Field(
+        default_factory=list,
+        description="Team slugs in the repository's organization ('slug' or 'org/slug')"
+    )
+    re_request_previous: bool = Field(
+        default=False,
+        description="Also re-request users whose latest review is of an older revision of the PR"
+    )
+    dry_run: bool = Field(
+        default=False,
+        description="Validate and render everything, but return the requests that would be sent instead of sending them"
+    )
+    
+    @model_validator(mode="after")
+    def _has_reviewers(self) -> "RequestReviewersInput":
+        if not (self.reviewers or self.team_reviewers or self.re_request_previous):
+            raise ValueError("Provide reviewers, team_reviewers, or re_request_previous")
+        return self
+
+
+class RemoveRequestedReviewersInput(BaseModel):
+    """Input for withdrawing review requests."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    REQUIRED_PERMISSION: ClassVar[Optional[Tuple[str, str]]] = ("pull_requests", "write")
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    reviewers: List[str] = Field(default_factory=list, description="User logins to remove")
+    team_reviewers: List[str] = Field(default_factory=list, description="Team slugs to remove")
+    dry_run: bool = Field(
+        default=False,
+        description="Validate and render everything, but return the requests that would be sent instead of sending them"
+    )
+    
+    @model_validator(mode="after")
+    def _has_reviewers(self) -> "RemoveRequestedReviewersInput":
+        if not (self.reviewers or self.team_reviewers):
+            raise ValueError("Provide reviewers or team_reviewers")
+        return self
+
+
+class SuggestOwnersInput(BaseModel):
+    """Input for suggesting code owners of a PR's changed files."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+
+
+class GetFileContextInput(BaseModel):
+    """Input for fetching lines of a file around a diff hunk."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    path: str = Field(..., description="File path relative to the repository root", min_length=1)
+    start_line: int = Field(..., description="First line to return (1-based)", ge=1)
+    end_line: int = Field(..., description="Last line to return (inclusive)", ge=1)
+    ref: Optional[str] = Field(default=None, description="Commit SHA or branch (defaults to the PR head)")
+    fallback_to_base: bool = Field(
+        default=False,
+        description="Read the file from the PR base when it does not exist at ref (e.g. deleted in the PR)"
+    )
+    response_format: ResponseFormat = Field(
+        default=ResponseFormat.MARKDOWN,
+        description="Output format"
+    )
+    
+    @model_validator(mode="after")
+    def _ordered_range(self) -> "GetFileContextInput":
+        if self.end_line < self.start_line:
+            raise ValueError("end_line must not be before start_line")
+        return self
+
+
+class GetRepoContextInput(BaseModel):
+    """Input for reading a repository's README, contributing guide and style files for a review."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    paths: Optional[List[str]] = Field(
+        default=None,
+        description="Files to read, relative to the repository root (default: REPO_CONTEXT_FILES)",
+        max_length=50
+    )
+    max_chars_per_file: Optional[int] = Field(
+        default=None,
+        description="Characters kept of each file (default: REPO_CONTEXT_MAX_CHARS)",
+        ge=100
+    )
+    response_format: ResponseFormat = Field(
+        default=ResponseFormat.MARKDOWN,
+        description="Output format"
+    )
+
+
+class GetDiffChunksInput(BaseModel):
+    """Input for splitting a PR diff into per-language chunks."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    EXPENSIVE_CALL: ClassVar[bool] = True
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    max_chunk_chars: int = Field(
+        default=DEFAULT_DIFF_CHUNK_CHARS,
+        description="Approximate size limit of one chunk, in characters",
+        ge=1000
+    )
+    include: List[str] = Field(
+        default_factory=list,
+        description="Only consider files matching these globs ('**' spans directories)"
+    )
+    exclude: List[str] = Field(
+        default_factory=list,
+        description="Ignore files matching these globs, e.g. 'vendor/**' or '**/*.pb.go'; wins over include"
+    )
+    path_scope: Optional[List[str]] = Field(
+        default=None,
+        description="Only look at files under these directories or globs, e.g. 'services/payments' "
+                    "(default: REVIEW_PATH_SCOPE; [] for the whole repository)"
+    )
+
+
+class GetDiffChunkInput(BaseModel):
+    """Input for fetching one chunk from github_pr_get_diff_chunks."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    chunk_id: str = Field(..., description="Chunk ID from the chunk index, e.g. 'go-1'", min_length=1)
+
+
+class GoAnalyzerInput(PaginatedInput):
+    """Input for the built-in Go analyzers that read a PR's changed files."""
+    CALL_DEADLINE_FIELD: ClassVar[Optional[str]] = "timeout_seconds"
+    EXPENSIVE_CALL: ClassVar[bool] = True
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    include: List[str] = Field(
+        default_factory=list,
+        description="Only consider files matching these globs ('**' spans directories)"
+    )
+    exclude: List[str] = Field(
+        default_factory=list,
+        description="Ignore files matching these globs, e.g. 'vendor/**' or '**/*.pb.go'; wins over include"
+    )
+    path_scope: Optional[List[str]] = Field(
+        default=None,
+        description="Only look at files under these directories or globs, e.g. 'services/payments' "
+                    "(default: REVIEW_PATH_SCOPE; [] for the whole repository)"
+    )
+    include_large_files: List[str] = Field(
+        default_factory=list,
+        description="Review files matching these globs even when they are over the large file limits"
+    )
+    include_generated: bool = Field(
+        default=False,
+        description="Also review generated, vendored and lock files, which are skipped by default"
+    )
+    timeout_seconds: Optional[float] = Field(
+        default=None,
+        description="Deadline for this call, replacing the server's tool timeout",
+        gt=0,
+        le=3600
+    )
+
+
+class ComplexityInput(GoAnalyzerInput):
+    """Input for checking the complexity and length of the Go functions a PR changes."""
+    
+    max_complexity: Optional[int] = Field(
+        default=None, description="Highest cyclomatic complexity allowed (default: GO_MAX_COMPLEXITY; 0 disables)", ge=0
+    )
+    max_function_lines: Optional[int] = Field(
+        default=None, description="Longest function allowed, in lines (default: GO_MAX_FUNCTION_LINES; 0 disables)", ge=0
+    )
+    max_complexity_increase: Optional[int] = Field(
+        default=None,
+        description="Most complexity the PR may add to one function (default: GO_MAX_COMPLEXITY_INCREASE; 0 disables)",
+        ge=0
+    )
+
+
+class GoToolchainInput(GoAnalyzerInput):
+    """Input for running gofmt and go vet on a PR's changed packages."""
+    # timeout_seconds bounds each command here, so the call keeps the server's deadline
+    CALL_DEADLINE_FIELD: ClassVar[Optional[str]] = None
+    
+    timeout_seconds: int = Field(
+        default=120,
+        description="Time limit for each toolchain command, at most the server's tool timeout",
+        ge=5,
+        le=600
+    )
+    
+    @field_validator("timeout_seconds")
+    @classmethod
+    def _within_call_deadline(cls, value: int) -> int:
+        # The call itself is still cut off at TOOL_CALL_TIMEOUT, so a longer command limit could never apply
+        if TOOL_CALL_TIMEOUT and value > TOOL_CALL_TIMEOUT:
+            raise ValueError(
+                f"timeout_seconds ({value}) exceeds the server's tool timeout of {TOOL_CALL_TIMEOUT:g} seconds"
+            )
+        return value
+
+
+class SecretPattern(BaseModel):
+    """A custom secret detector: a name and a regular expression."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        extra='forbid'
+    )
+    
+    name: str = Field(..., description="Detector name reported in findings", min_length=1)
+    regex: str = Field(
+        ...,
+        description="Python regular expression; group 1, if present, is the secret to redact",
+        min_length=1
+    )
+    
+    @field_validator("regex")
+    @classmethod
+    def _compiles(cls, value: str) -> str:
+        try:
+            re.compile(value)
+        except re.error as e:
+            raise ValueError(f"Invalid regex: {e}")
+        return value
+
+
+class ScanSecretsInput(GoAnalyzerInput):
+    """Input for scanning a PR's added lines for secrets."""
+    
+    custom_patterns: List[SecretPattern] = Field(
+        default_factory=list,
+        description="Extra detectors to run alongside the built-in ones"
+    )
+
+
+class CommentMarkersInput(GoAnalyzerInput):
+    """Input for flagging TODO-style markers and commented-out code a PR adds."""
+    
+    markers: Optional[List[str]] = Field(
+        default=None,
+        description="Markers to report when added without an issue reference (default: REVIEW_MARKERS, e.g. TODO, FIXME)"
+    )
+    min_commented_code_lines: Optional[int] = Field(
+        default=None,
+        description="Fewest consecutive commented-out code lines to report (default: COMMENTED_CODE_MIN_LINES; 0 disables)",
+        ge=0
+    )
+
+
+class ConfigFilesInput(GoAnalyzerInput):
+    """Input for validating the YAML and JSON files a PR changes."""
+    
+    schemas: bool = Field(
+        default=True,
+        description="Also check GitHub Actions workflows and Compose files against their bundled schemas"
+    )
+
+
+class DocsCheckInput(GoAnalyzerInput):
+    """Input for spell and link checks on the documentation lines a PR adds."""
+    
+    check_external_links: bool = Field(
+        default=False,
+        description="Also send a HEAD request to each added http(s) link; off by default because it "
+                    "makes network calls outside GitHub"
+    )
+    link_timeout: float = Field(
+        default=DOC_LINK_TIMEOUT,
+        description="Seconds each external link may take to answer before it is left unverified",
+        gt=0,
+        le=30
+    )
+
+
+class GetChecksInput(BaseModel):
+    """Input for fetching CI results for a PR's head commit."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    max_output_chars: int = Field(
+        default=DEFAULT_CHECK_OUTPUT_CHARS,
+        description="Truncate failed-run summaries and annotation messages to this many characters",
+        ge=100
+    )
+    response_format: ResponseFormat = Field(
+        default=ResponseFormat.MARKDOWN,
+        description="Output format"
+    )
+
+
+class SetCommitStatusInput(BaseModel):
+    """Input for posting a commit status on the reviewed PR head."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    REQUIRED_PERMISSION: ClassVar[Optional[Tuple[str, str]]] = ("statuses", "write")
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    state: Literal["error", "failure", "pending", "success"] = Field(..., description="Status state")
+    context: str = Field(default="pr-reviewer/verdict", description="Status context shown on the PR", min_length=1)
+    description: Optional[str] = Field(
+        default=None,
+        description="Short description (truncated to GitHub's 140-character limit)"
+    )
+    target_url: Optional[str] = Field(default=None, description="Link shown next to the status")
+    dry_run: bool = Field(
+        default=False,
+        description="Validate and render everything, but return the requests that would be sent instead of sending them"
+    )
+
+
+class ListPRCommitsInput(BaseModel):
+    """Input for listing the commits of a PR."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    check_conventional_commits: bool = Field(
+        default=False,
+        description="Report commit messages that do not follow Conventional Commits"
+    )
+
+
+class CommitMessagesInput(PaginatedInput):
+    """Input for checking a PR's commit messages against the repository's commit conventions."""
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    include_title: Optional[bool] = Field(
+        default=None,
+        description="Also check the PR title, for squash-merge repositories (default: the policy's check_pr_title)"
+    )
+
+
+class GetPRStackInput(BaseModel):
+    """Input for listing the stacked PRs a PR belongs to."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    response_format: ResponseFormat = Field(
+        default=ResponseFormat.MARKDOWN,
+        description="Output format"
+    )
+
+
+class ListOpenPRsInput(PaginatedInput):
+    """Input for listing a repository's open PRs and whether each needs a review."""
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    base: Optional[str] = Field(default=None, description="Only PRs targeting this branch, e.g. 'main'")
+    labels: List[str] = Field(default_factory=list, description="Only PRs carrying all of these labels")
+    updated_since: Optional[str] = Field(
+        default=None,
+        description="Only PRs updated at or after this ISO 8601 timestamp, e.g. '2025-01-31T00:00:00Z'"
+    )
+    include_drafts: bool = Field(default=False, description="Also list draft PRs")
+    response_format: ResponseFormat = Field(
+        default=ResponseFormat.MARKDOWN,
+        description="Output format"
+    )
+    
+    @field_validator("updated_since")
+    @classmethod
+    def _iso_timestamp(cls, value: Optional[str]) -> Optional[str]:
+        if value is not None:
+            try:
+                datetime.fromisoformat(value.replace("Z", "+00:00"))
+            except ValueError:
+                raise ValueError(f"updated_since must be an ISO 8601 timestamp, got {value!r}")
+        return value
+
+
+class LoginInput(BaseModel):
+    """Input for signing in with the OAuth device flow."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    
+    force: bool = Field(
+        default=False,
+        description="Start a new sign-in even if a token is saved or a sign-in is already waiting"
+    )
+
+
+class GetRateLimitInput(BaseModel):
+    """Input for reporting the GitHub API quota left."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    
+    owner: Optional[str] = Field(
+        default=None,
+        description="Report the quota of this owner's GITHUB_ACCOUNTS credentials instead of the default ones",
+        min_length=1
+    )
+    response_format: ResponseFormat = Field(
+        default=ResponseFormat.MARKDOWN,
+        description="Output format"
+    )
+
+
+class CheckPermissionsInput(BaseModel):
+    """Input for checking what the credentials may do in a repository."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    refresh: bool = Field(
+        default=False,
+        description="Check again instead of reusing the result cached for the repository"
+    )
+    response_format: ResponseFormat = Field(
+        default=ResponseFormat.MARKDOWN,
+        description="Output format"
+    )
+
+
+class SearchInput(PaginatedInput):
+    """Input for searching issues and pull requests."""
+    
+    query: Optional[str] = Field(
+        default=None,
+        description="Free text to search titles, bodies and comments for; raw qualifiers such as 'in:title' also work",
+        max_length=SEARCH_QUERY_MAX_LENGTH
+    )
+    owner: Optional[str] = Field(default=None, description="Only issues and PRs of this user or organization", min_length=1)
+    repo: Optional[str] = Field(default=None, description="Only this repository of owner", min_length=1)
+    type: Literal["pr", "issue", "any"] = Field(default="pr", description="Search pull requests, issues or both")
+    state: Optional[Literal["open", "closed", "merged"]] = Field(
+        default=None,
+        description="Only open, closed or merged ones ('merged' implies type 'pr')"
+    )
+    author: Optional[str] = Field(default=None, description="Only those opened by this login", min_length=1)
+    labels: List[str] = Field(default_factory=list, description="Only those carrying all of these labels")
+    sort: Optional[Literal["created", "updated", "comments"]] = Field(
+        default=None,
+        description="Sort newest first by this field instead of by best match"
+    )
+    max_results: int = Field(
+        default=50,
+        description="Maximum results to fetch (GitHub returns at most 1000)",
+        ge=1,
+        le=1000
+    )
+    response_format: ResponseFormat = Field(
+        default=ResponseFormat.MARKDOWN,
+        description="Output format"
+    )
+    
+    @model_validator(mode="after")
+    def _consistent(self) -> "SearchInput":
+        if self.repo and not self.owner:
+            raise ValueError("repo needs owner")
+        if self.state == "merged" and self.type == "issue":
+            raise ValueError("state 'merged' only applies to pull requests")
+        if not (self.query or self.owner or self.author or self.labels):
+            raise ValueError("Pass a query or at least one of owner, author and labels")
+        return self
+
+
+class QueueReviewsInput(BaseModel):
+    """Input for queueing background reviews of several PRs."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    REQUIRED_PERMISSION: ClassVar[Optional[Tuple[str, str]]] = ("pull_requests", "write")
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_numbers: List[int] = Field(
+        ...,
+        description="PRs to review, e.g. those github_pr_list_open_prs reports as review_needed",
+        min_length=1,
+        max_length=100
+    )
+    force: bool = Field(
+        default=False,
+        description="Also review PRs whose head this server has already reviewed"
+    )
+    dry_run: bool = Field(
+        default=False,
+        description="List the PRs that would be queued without queueing them"
+    )
+
+
+class GetCommitDiffInput(BaseModel):
+    """Input for fetching the diff of one commit in a PR."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    sha: str = Field(..., description="Commit SHA from github_pr_list_commits", min_length=7)
+    include: List[str] = Field(
+        default_factory=list,
+        description="Only consider files matching these globs ('**' spans directories)"
+    )
+    exclude: List[str] = Field(
+        default_factory=list,
+        description="Ignore files matching these globs, e.g. 'vendor/**' or '**/*.pb.go'; wins over include"
+    )
+    path_scope: Optional[List[str]] = Field(
+        default=None,
+        description="Only look at files under these directories or globs, e.g. 'services/payments' "
+                    "(default: REVIEW_PATH_SCOPE; [] for the whole repository)"
+    )
+
+
+class ListIssueCommentsInput(PaginatedInput):
+    """Input for listing the general conversation comments of a PR."""
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    since: Optional[str] = Field(
+        default=None,
+        description="Only comments updated at or after this ISO 8601 timestamp, e.g. '2025-01-31T12:00:00Z'"
+    )
+    response_format: ResponseFormat = Field(
+        default=ResponseFormat.MARKDOWN,
+        description="Output format"
+    )
+    
+    @field_validator("since")
+    @classmethod
+    def _iso_timestamp(cls, value: Optional[str]) -> Optional[str]:
+        if value is not None:
+            try:
+                datetime.fromisoformat(value.replace("Z", "+00:00"))
+            except ValueError:
+                raise ValueError(f"since must be an ISO 8601 timestamp, got {value!r}")
+        return value
+
+
+class CreateIssueCommentInput(BaseModel):
+    """Input for posting a comment on a PR's conversation."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    REQUIRED_PERMISSION: ClassVar[Optional[Tuple[str, str]]] = ("pull_requests", "write")
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    body: str = Field(..., description="Comment text (markdown)", min_length=1)
+    dry_run: bool = Field(
+        default=False,
+        description="Validate and render everything, but return the requests that would be sent instead of sending them"
+    )
+
+
+class ReplyToReviewCommentInput(BaseModel):
+    """Input for replying inside an existing inline review thread."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    REQUIRED_PERMISSION: ClassVar[Optional[Tuple[str, str]]] = ("pull_requests", "write")
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    comment_id: int = Field(..., description="ID of any review comment in the thread", ge=1)
+    body: str = Field(..., description="Reply text (markdown)", min_length=1)
+    dry_run: bool = Field(
+        default=False,
+        description="Validate and render everything, but return the requests that would be sent instead of sending them"
+    )
+
+
+class ListLabelsInput(BaseModel):
+    """Input for listing the labels on a PR."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+
+
+class AddLabelsInput(BaseModel):
+    """Input for adding labels to a PR, e.g. to record the review outcome."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    REQUIRED_PERMISSION: ClassVar[Optional[Tuple[str, str]]] = ("pull_requests", "write")
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    labels: List[str] = Field(..., description="Label names, e.g. ['needs-changes']", min_length=1)
+    create_if_missing: bool = Field(
+        default=False,
+        description="Create labels that do not exist in the repository yet"
+    )
+    color: str = Field(
+        default="ededed",
+        description="Hex color (without '#') for created labels",
+        pattern=r"^[0-9a-fA-F]{6}$"
+    )
+    description: Optional[str] = Field(
+        default=None,
+        description="Description for created labels",
+        max_length=100
+    )
+    dry_run: bool = Field(
+        default=False,
+        description="Validate and render everything, but return the requests that would be sent instead of sending them"
+    )
+
+
+class RemoveLabelsInput(BaseModel):
+    """Input for removing labels from a PR."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    REQUIRED_PERMISSION: ClassVar[Optional[Tuple[str, str]]] = ("pull_requests", "write")
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    labels: List[str] = Field(..., description="Label names to remove", min_length=1)
+    dry_run: bool = Field(
+        default=False,
+        description="Validate and render everything, but return the requests that would be sent instead of sending them"
+    )
+
+
+class SetMilestoneInput(BaseModel):
+    """Input for setting or clearing a PR's milestone."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    REQUIRED_PERMISSION: ClassVar[Optional[Tuple[str, str]]] = ("pull_requests", "write")
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    milestone: Optional[int] = Field(
+        ...,
+        description="Milestone number (not its title, e.g. 3 from /milestone/3); null removes the milestone",
+        ge=1
+    )
+    dry_run: bool = Field(
+        default=False,
+        description="Validate and render everything, but return the requests that would be sent instead of sending them"
+    )
+
+
+class AddAssigneesInput(BaseModel):
+    """Input for assigning users to a PR."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    REQUIRED_PERMISSION: ClassVar[Optional[Tuple[str, str]]] = ("pull_requests", "write")
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    assignees: List[str] = Field(..., description="Logins to assign, e.g. ['octocat']", min_length=1, max_length=10)
+    dry_run: bool = Field(
+        default=False,
+        description="Validate and render everything, but return the requests that would be sent instead of sending them"
+    )
+
+
+class MergePRInput(BaseModel):
+    """Input for merging a reviewed PR."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    REQUIRED_PERMISSION: ClassVar[Optional[Tuple[str, str]]] = ("pull_requests", "write")
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    expected_head_sha: str = Field(
+        ...,
+        description="Full SHA of the head that was reviewed; the merge fails if the PR head differs",
+        pattern=r"^[0-9a-f]{40}$"
+    )
+    merge_method: Literal["merge", "squash", "rebase"] = Field(
+        default="merge",
+        description="How to merge"
+    )
+    commit_title: Optional[str] = Field(
+        default=None,
+        description="Title of the merge or squash commit (GitHub's default if not provided)"
+    )
+    commit_message: Optional[str] = Field(
+        default=None,
+        description="Body of the merge or squash commit"
+    )
+    dry_run: bool = Field(
+        default=False,
+        description="Validate and render everything, but return the requests that would be sent instead of sending them"
+    )
+    
+    @model_validator(mode="after")
+    def _no_message_for_rebase(self) -> "MergePRInput":
+        if self.merge_method == "rebase" and (self.commit_title or self.commit_message):
+            raise ValueError("commit_title and commit_message do not apply to rebase merges")
+        return self
+
+
+class UpdateBranchInput(BaseModel):
+    """Input for merging the base branch into a PR's head branch."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    REQUIRED_PERMISSION: ClassVar[Optional[Tuple[str, str]]] = ("pull_requests", "write")
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    expected_head_sha: Optional[str] = Field(
+        default=None,
+        description="Only update if the PR head is still this SHA (defaults to the current head)"
+    )
+    timeout_seconds: float = Field(
+        default=DEFAULT_PR_POLL_TIMEOUT,
+        description="How long to wait for GitHub to report the new head",
+        ge=1,
+        le=300
+    )
+    dry_run: bool = Field(
+        default=False,
+        description="Validate and render everything, but return the requests that would be sent instead of sending them"
+    )
+
+
+class GetMergeabilityInput(BaseModel):
+    """Input for reporting whether a PR can be merged cleanly."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    timeout_seconds: float = Field(
+        default=DEFAULT_PR_POLL_TIMEOUT,
+        description="How long to wait for GitHub to compute mergeability",
+        ge=1,
+        le=300
+    )
+
+
+class GetBranchProtectionInput(BaseModel):
+    """Input for reading the protection rules of a PR's base branch."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    response_format: ResponseFormat = Field(
+        default=ResponseFormat.MARKDOWN,
+        description="Output format"
+    )
+
+
+class GetMergeReadinessInput(BaseModel):
+    """Input for checking a PR against its base branch's merge requirements."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    timeout_seconds: float = Field(
+        default=DEFAULT_PR_POLL_TIMEOUT,
+        description="How long to wait for GitHub to compute mergeability",
+        ge=1,
+        le=300
+    )
+    response_format: ResponseFormat = Field(
+        default=ResponseFormat.MARKDOWN,
+        description="Output format"
+    )
+
+
+class GetOverviewInput(BaseModel):
+    """Input for summarizing a PR's review, thread and check status."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    response_format: ResponseFormat = Field(
+        default=ResponseFormat.MARKDOWN,
+        description="Output format: 'markdown' for human-readable or 'json' for machine-readable"
+    )
+
+
+class UpdatePRDescriptionInput(BaseModel):
+    """Input for writing a generated summary into a PR description."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    REQUIRED_PERMISSION: ClassVar[Optional[Tuple[str, str]]] = ("pull_requests", "write")
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    content: str = Field(
+        ...,
+        description="Generated markdown, e.g. summary, change list and testing notes",
+        min_length=1
+    )
+    mode: Literal["section", "replace"] = Field(
+        default="section",
+        description="'section' updates only the marked summary section; 'replace' overwrites the whole body"
+    )
+    dry_run: bool = Field(
+        default=False,
+        description="Validate and render everything, but return the requests that would be sent instead of sending them"
+    )
+
+
+class ExportSarifInput(BaseModel):
+    """Input for exporting findings as SARIF, optionally uploading them to code scanning."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    findings: List[ReviewFinding] = Field(default_factory=list, description="Findings to export")
+    tool_name: str = Field(default="github-pr-mcp", description="SARIF tool driver name", min_length=1)
+    upload: bool = Field(default=False, description="Upload the document to GitHub code scanning")
+    commit_sha: Optional[str] = Field(
+        default=None,
+        description="Commit the results belong to (defaults to the PR head)"
+    )
+    ref: Optional[str] = Field(
+        default=None,
+        description="Git ref for the upload (defaults to refs/pull/<number>/head)"
+    )
+    dry_run: bool = Field(
+        default=False,
+        description="Validate and render everything, but return the requests that would be sent instead of sending them"
+    )
+
+
+class ClassifyPRInput(BaseModel):
+    """Input for deciding whether a PR is trivial enough to skip a full review."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    EXPENSIVE_CALL: ClassVar[bool] = True
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    trivial_paths: Optional[List[str]] = Field(
+        default=None,
+        description="Globs of files that are always trivial (default: TRIVIAL_PATHS, e.g. **/*.md)"
+    )
+    max_changed_lines: Optional[int] = Field(
+        default=None,
+        description="Most added plus deleted lines of a trivial PR (default: TRIVIAL_MAX_CHANGED_LINES; 0 disables)",
+        ge=0
+    )
+    response_format: ResponseFormat = Field(
+        default=ResponseFormat.MARKDOWN,
+        description="Output format"
+    )
+
+
+class GetReviewPolicyInput(BaseModel):
+    """Input for showing the review policy that applies to a repository."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: Optional[int] = Field(
+        default=None,
+        description="Also check this PR against the policy's size and test requirements",
+        ge=1
+    )
+    response_format: ResponseFormat = Field(
+        default=ResponseFormat.MARKDOWN,
+        description="Output format"
+    )
+
+
+class RenderPreviewInput(BaseModel):
+    """Input for rendering the review templates against sample data."""
+    # Not stripped: whitespace is part of a template
+    model_config = ConfigDict(
+        validate_assignment=True,
+        extra='forbid'
+    )
+    
+    owner: Optional[str] = Field(
+        default=None,
+        description="Repository owner; with repo, the repository's templates and policy are used",
+        min_length=1
+    )
+    repo: Optional[str] = Field(default=None, description="Repository name", min_length=1)
+    templates: Dict[str, str] = Field(
+        default_factory=dict,
+        description="Template text by name (e.g. 'inline_comment'), tried on top of the others without committing it"
+    )
+    name: Optional[str] = Field(default=None, description="Render only this template")
+    event: Literal["APPROVE", "REQUEST_CHANGES", "COMMENT"] = Field(
+        default="COMMENT",
+        description="Review event whose review template is rendered"
+    )
+    response_format: ResponseFormat = Field(
+        default=ResponseFormat.MARKDOWN,
+        description="Output format"
+    )
+    
+    @model_validator(mode="after")
+    def _known_target(self) -> "RenderPreviewInput":
+        if (self.owner is None) != (self.repo is None):
+            raise ValueError("Provide both owner and repo, or neither")
+        if self.name is not None and self.name not in REVIEW_TEMPLATE_NAMES:
+            raise ValueError(f"Unknown template {self.name!r}; use one of {', '.join(REVIEW_TEMPLATE_NAMES)}")
+        return self
+
+
+class LineRange(BaseModel):
+    """An inclusive range of line numbers."""
+    model_config = ConfigDict(extra='forbid')
+    
+    start: int = Field(..., description="First line", ge=1)
+    end: int = Field(..., description="Last line (inclusive)", ge=1)
+    
+    @model_validator(mode="after")
+    def ordered(self) -> "LineRange":
+        if self.end < self.start:
+            raise ValueError("end must not be before start")
+        return self
+
+
+class GetBlameInput(BaseModel):
+    """Input for attributing lines of a changed file to the commits that last touched them."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    path: str = Field(..., description="File path as shown in the PR diff", min_length=1)
+    ranges: List[LineRange] = Field(
+        default_factory=list,
+        description="Base-side line ranges to blame; empty means the lines the PR modifies or deletes",
+        max_length=50
+    )
+
+
+class GetFileHistoryInput(BaseModel):
+    """Input for listing the recent commits that touched a file."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request whose base the history is read from", ge=1)
+    path: str = Field(..., description="File path as shown in the PR diff", min_length=1)
+    max_commits: int = Field(default=10, description="How many commits to list, newest first", ge=1, le=50)
+
+
+class GetChurnInput(BaseModel):
+    """Input for summarizing how often a PR's files changed recently."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    days: int = Field(default=90, description="Look-back window in days", ge=1, le=365)
+    hot_threshold: int = Field(
+        default=5,
+        description="Call out files changed at least this many times in the window",
+        ge=1
+    )
+    max_files: int = Field(default=50, description="Check at most this many changed files", ge=1, le=300)
+
+
+class GetStatsInput(BaseModel):
+    """Input for a PR's diff statistics and risk score."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    top_files: int = Field(default=10, description="How many of the largest files to list", ge=1, le=100)
+    include_churn: bool = Field(
+        default=True,
+        description="Read the recent history of the changed files for the churn factor, one request per file"
+    )
+    churn_max_files: int = Field(
+        default=20,
+        description="Check the history of at most this many of the largest modified files",
+        ge=1,
+        le=100
+    )
+    response_format: ResponseFormat = Field(
+        default=ResponseFormat.MARKDOWN,
+        description="Output format"
+    )
+
+
+class CompareRefsInput(BaseModel):
+    """Input for diffing two arbitrary refs of a repository."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    base: str = Field(..., description="Base branch, tag or SHA, e.g. 'v1.4.0'", min_length=1)
+    head: str = Field(..., description="Head branch, tag or SHA, e.g. 'main'", min_length=1)
+    max_diff_chars: Optional[int] = Field(
+        default=None,
+        description="Character budget for the diff (default GITHUB_DIFF_MAX_CHARS; 0 for no limit)",
+        ge=0
+    )
+    prioritize: List[str] = Field(
+        default_factory=list,
+        description="Glob patterns of files to include first when the diff exceeds the budget"
+    )
+    include: List[str] = Field(
+        default_factory=list,
+        description="Only consider files matching these globs ('**' spans directories)"
+    )
+    exclude: List[str] = Field(
+        default_factory=list,
+        description="Ignore files matching these globs, e.g. 'vendor/**' or '**/*.pb.go'; wins over include"
+    )
+    path_scope: Optional[List[str]] = Field(
+        default=None,
+        description="Only look at files under these directories or globs, e.g. 'services/payments' "
+                    "(default: REVIEW_PATH_SCOPE; [] for the whole repository)"
+    )
+    response_format: ResponseFormat = Field(
+        default=ResponseFormat.MARKDOWN,
+        description="Output format"
+    )
+
+
+class UpsertSummaryCommentInput(BaseModel):
+    """Input for posting or updating the bot's summary comment on a PR."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    REQUIRED_PERMISSION: ClassVar[Optional[Tuple[str, str]]] = ("pull_requests", "write")
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    body: str = Field(..., description="Summary text (markdown)", min_length=1)
+    history_limit: int = Field(
+        default=0,
+        description="Keep this many earlier summaries in a collapsed 'Previous runs' block (0 keeps none)",
+        ge=0,
+        le=MAX_SUMMARY_HISTORY
+    )
+    head_sha: Optional[str] = Field(
+        default=None,
+        description="Head commit the summary reviews, recorded for github_pr_get_review_history"
+    )
+    dry_run: bool = Field(
+        default=False,
+        description="Validate and render everything, but return the requests that would be sent instead of sending them"
+    )
+
+
+class GetReviewHistoryInput(PaginatedInput):
+    """Input for listing everything the bot has posted on a PR."""
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    response_format: ResponseFormat = Field(
+        default=ResponseFormat.MARKDOWN,
+        description="Output format"
+    )
+
+
+class GetCommentReactionsInput(BaseModel):
+    """Input for tallying the reactions to the bot's review comments on a PR."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    response_format: ResponseFormat = Field(
+        default=ResponseFormat.MARKDOWN,
+        description="Output format"
+    )
+
+
+class AddReactionInput(BaseModel):
+    """Input for reacting to a comment on a PR, e.g. to acknowledge an author's reply."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    REQUIRED_PERMISSION: ClassVar[Optional[Tuple[str, str]]] = ("pull_requests", "write")
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    comment_id: int = Field(..., description="ID of the comment to react to", ge=1)
+    comment_type: Literal["review", "issue"] = Field(
+        default="review",
+        description="'review' for an inline review comment, 'issue' for a comment on the PR conversation"
+    )
+    content: Literal["+1", "-1", "laugh", "confused", "heart", "hooray", "rocket", "eyes"] = Field(
+        default="+1",
+        description="Reaction to add"
+    )
+    dry_run: bool = Field(
+        default=False,
+        description="Validate and render everything, but return the requests that would be sent instead of sending them"
+    )
+
+
+class AnalyzePRInput(BaseModel):
+    """Input for comprehensive PR analysis."""
+    model_config = ConfigDict(
+        str_strip_whitespace=True,
+        validate_assignment=True,
+        extra='forbid'
+    )
+    EXPENSIVE_CALL: ClassVar[bool] = True
+    
+    owner: str = Field(..., description="Repository owner", min_length=1)
+    repo: str = Field(..., description="Repository name", min_length=1)
+    pr_number: int = Field(..., description="Pull request number", ge=1)
+    local_path: Optional[str] = Field(
+        default=None,
+        description="Local path to cloned repository (if analyzing locally)"
+    )
+    run_tests: bool = Field(
+        default=True,
+        description="Run automated tests"
+    )
+    post_comments: bool = Field(
+        default=False,
+        description="Automatically post review comments to GitHub"
+    )
+    summary_history: int = Field(
+        default=0,
+        description="When posting, keep this many earlier summaries in the summary comment's history",
+        ge=0,
+        le=MAX_SUMMARY_HISTORY
+    )
+    include: List[str] = Field(
+        default_factory=list,
+        description="Only consider files matching these globs ('**' spans directories)"
+    )
+    exclude: List[str] = Field(
+        default_factory=list,
+        description="Ignore files matching these globs, e.g. 'vendor/**' or '**/*.pb.go'; wins over include"
+    )
+    path_scope: Optional[List[str]] = Field(
+        default=None,
+        description="Only look at files under these directories or globs, e.g. 'services/payments' "
+                    "(default: REVIEW_PATH_SCOPE; [] for the whole repository)"
+    )
+    include_large_files: List[str] = Field(
+        default_factory=list,
+        description="Review files matching these globs even when they are over the large file limits"
+    )
+    include_generated: bool = Field(
+        default=False,
+        description="Also review generated, vendored and lock files, which are skipped by default"
+    )
+    response_format: ResponseFormat = Field(
+        default=ResponseFormat.MARKDOWN,
+        description="Output format"
+    )
+    dry_run: bool = Field(
+        default=False,
+        description="With post_comments, return the summary comment that would be posted instead of posting it"
+    )
+
+
+# ============================================================================
+# Logging
+# ============================================================================
+
+# Correlation ID of the MCP tool call or webhook delivery being handled.
+# asyncio tasks copy the context, so work started on its behalf inherits it.
+_correlation_id: contextvars.ContextVar[str] = contextvars.ContextVar("correlation_id", default="-")
+
+REDACTED = "[REDACTED]"
+# Secrets shorter than this are not substituted, so a short value can't mangle unrelated text
+MIN_REDACTED_SECRET_LENGTH = 8
+_known_secrets: set = set()
+_REDACTION_PATTERNS = [
+    # Authorization headers, whether logged as "Authorization: Bearer x" or {'authorization': 'token x'}
+    re.compile(r"(?i)(authorization['\"]?\s*[:=]\s*['\"]?)(?:(?:bearer|token|basic)\s+)?[^\s'\",}]+"),
+    re.compile(r"(?i)(\b(?:bearer|token)\s+)[\w.=-]{16,}"),
+    # Personal access, OAuth, App installation and refresh tokens, and JWTs
+    re.compile(r"()\b(?:gh[pousr]_[A-Za-z0-9]{20,}|github_pat_\w{20,}|eyJ[\w-]+\.[\w-]+\.[\w-]+)"),
+]
+
+
+def _new_correlation_id() -> str:
+    return uuid.uuid4().hex[:12]
+
+
+def _register_secret(value: Optional[str]) -> None:
+    """Make _scrub_secrets() remove this exact value wherever it appears."""
+    if value and len(value) >= MIN_REDACTED_SECRET_LENGTH:
+        _known_secrets.add(value)
+
+
+def _scrub_secrets(text: str) -> str:
+    """Remove tokens, Authorization header values and registered secrets from text."""
+    for secret in sorted(_known_secrets, key=len, reverse=True):
+        text = text.replace(secret, REDACTED)
+    for pattern in _REDACTION_PATTERNS:
+        text = pattern.sub(lambda m: m.group(1) + REDACTED, text)
+    return text
+
+
+class _CorrelationFilter(logging.Filter):
+    """Stamp each record with the current correlation ID."""
+    
+    def filter(self, record: logging.LogRecord) -> bool:
+        record.correlation_id = _correlation_id.get()
+        return True
+
+
+class RedactingFormatter(logging.Formatter):
+    """Text log lines, with secrets removed after formatting."""
+    
+    def format(self, record: logging.LogRecord) -> str:
+        return _scrub_secrets(super().format(record))
+
+
+class JSONLogFormatter(logging.Formatter):
+    """One JSON object per line, with secrets removed from every field."""
+    
+    def format(self, record: logging.LogRecord) -> str:
+        entry = {
+            "time": self.formatTime(record),
+            "level": record.levelname,
+            "logger": record.name,
+            "correlation_id": getattr(record, "correlation_id", "-"),
+            "message": record.getMessage(),
+        }
+        if record.exc_info:
+            entry["exception"] = self.formatException(record.exc_info)
+        return json.dumps({key: _scrub_secrets(value) for key, value in entry.items()})
+
+
+def _configure_logging(level: str = LOG_LEVEL, log_format: str = LOG_FORMAT, stream=None) -> logging.Handler:
+    """
+    Send all log output through one redacting handler on the root logger.
+    
+    Replaces any handler installed earlier (FastMCP installs its own). Logs go
+    to stderr by default, which keeps stdout free for the stdio transport.
+    """
+    handler = logging.StreamHandler(stream)
+    if log_format == "json":
+        handler.setFormatter(JSONLogFormatter())
+    else:
+        handler.setFormatter(RedactingFormatter("%(asctime)s %(levelname)s %(name)s [%(correlation_id)s] %(message)s"))
+    handler.addFilter(_CorrelationFilter())
+    logging.basicConfig(level=level.upper(), handlers=[handler], force=True)
+    return handler
+
+
+def _with_correlation_id(result: Any, correlation_id: str) -> Any:
+    """Attach the correlation ID to a tool result: a JSON field, or a closing markdown line."""
+    if not isinstance(result, str):
+        return result
+    if result.startswith("{"):
+        try:
+            data = json.loads(result)
+        except ValueError:
+            return result
+        data["correlation_id"] = correlation_id
+        return json.dumps(data, indent=2)
+    return f"{result}\n\n_Correlation ID: {correlation_id}_"
+
+
+_register_secret(GITHUB_TOKEN)
+_register_secret(GITHUB_OAUTH_CLIENT_SECRET)
+_register_secret(GITHUB_WEBHOOK_SECRET)
+
+
+# ============================================================================
+# Call Deadlines
+# ============================================================================
+
+# After its deadline a call gets this long to return the partial data it has before it is cut off
+DEADLINE_GRACE_SECONDS = 5.0
+
+
+@dataclass
+class CallDeadline:
+    """When the tool call being handled must finish, and whether work was cut short for it."""
+    expires_at: float
+    timed_out: bool = False
+    
+    def remaining(self) -> float:
+        return self.expires_at - time.monotonic()
+
+
+_call_deadline: "contextvars.ContextVar[Optional[CallDeadline]]" = contextvars.ContextVar(
+    "call_deadline", default=None
+)
+
+
+@dataclass
+class CallRateLimits:
+    """The rate limits seen by the expensive tool call being handled, and the fetch refused for a low quota."""
+    seen: Dict[str, Dict[str, int]] = field(default_factory=dict)
+    refused: Optional["QuotaLowError"] = None
+
+
+_call_rate_limits: "contextvars.ContextVar[Optional[CallRateLimits]]" = contextvars.ContextVar(
+    "call_rate_limits", default=None
+)
+
+
+def _call_timeout(args: Tuple[Any, ...], kwargs: Dict[str, Any]) -> Optional[float]:
+    """
+    Seconds a tool call may run: the input's per-call override, else TOOL_CALL_TIMEOUT.
+    
+    Inputs opt in by naming their override field in CALL_DEADLINE_FIELD.
+    Returns None when no deadline applies.
+    """
+    for value in (*args, *kwargs.values()):
+        field_name = getattr(type(value), "CALL_DEADLINE_FIELD", None) if isinstance(value, BaseModel) else None
+        if field_name and getattr(value, field_name) is not None:
+            return float(getattr(value, field_name))
+    return TOOL_CALL_TIMEOUT or None
+
+
+def _call_owner(args: Tuple[Any, ...], kwargs: Dict[str, Any]) -> Optional[str]:
+    """The repository owner a tool call's input names, which picks its GITHUB_ACCOUNTS credentials."""
+    for value in (*args, *kwargs.values()):
+        owner = getattr(value, "owner", None) if isinstance(value, BaseModel) else None
+        if isinstance(owner, str) and owner:
+            return owner
+    return None
+
+
+def _call_write(args: Tuple[Any, ...], kwargs: Dict[str, Any]) -> Optional[Tuple[str, str, str, str]]:
+    """
+    The repository and REQUIRED_PERMISSION of a tool call that writes to GitHub, as (owner, repo, permission, level).
+    
+    None for read-only tools, dry runs, and reviews that fall back to
+    returning their output, which check for themselves.
+    """
+    for value in (*args, *kwargs.values()):
+        required = getattr(type(value), "REQUIRED_PERMISSION", None) if isinstance(value, BaseModel) else None
+        if required is None or _dry_run(value) or getattr(value, "fallback_to_output", False):
+            continue
+        return (value.owner, value.repo, *required)
+    return None
+
+
+def _expensive_call(args: Tuple[Any, ...], kwargs: Dict[str, Any]) -> bool:
+    """Whether a tool call's input marks it EXPENSIVE_CALL: it pages through diffs or files and gets quota checks."""
+    return any(getattr(type(value), "EXPENSIVE_CALL", False) for value in (*args, *kwargs.values()))
+
+
+def _with_rate_limit(result: Any, usage: CallRateLimits) -> Any:
+    """Add the lowest rate limit the call saw to a JSON object result."""
+    if not usage.seen or not isinstance(result, str) or not result.startswith("{"):
+        return result
+    try:
+        data = json.loads(result)
+    except ValueError:
+        return result
+    resource, status = min(usage.seen.items(), key=lambda item: item[1]["remaining"])
+    data["rate_limit"] = {
+        "resource": resource,
+        "remaining": status["remaining"],
+        "reset_at": datetime.fromtimestamp(status["reset"], timezone.utc).isoformat(),
+    }
+    return json.dumps(data, indent=2)
+
+
+def _with_timed_out(result: Any) -> Any:
+    """Flag a tool result built from data cut short by the deadline: a JSON field, or a markdown warning."""
+    if not isinstance(result, str):
+        return result
+    if result.startswith("{"):
+        try:
+            data = json.loads(result)
+        except ValueError:
+            return result
+        data["timed_out"] = True
+        return json.dumps(data, indent=2)
+    return f"{result}\n\n⚠️ _Timed out: this result is incomplete._"
+
+
+# ============================================================================
+# Progress Notifications
+# ============================================================================
+
+# Least time between two progress notifications of one call; the end of a step is always sent
+PROGRESS_MIN_INTERVAL = 0.5
+
+
+def _progress_token(ctx: Any) -> Optional[Any]:
+    """Return the progress token the client sent with this request, if any."""
+    try:
+        meta = ctx.request_context.meta
+    except (AttributeError, ValueError):
+        # ValueError: a Context used outside of a request
+        return None
+    return getattr(meta, "progressToken", None) if meta is not None else None
+
+
+def _accepts_argument(fn: Callable[..., Any], name: str) -> bool:
+    """Return whether fn takes a keyword argument called name; report_progress gained message after mcp 1.8."""
+    try:
+        params = inspect.signature(fn).parameters.values()
+    except (TypeError, ValueError):
+        return False
+    return any(p.name == name or p.kind is inspect.Parameter.VAR_KEYWORD for p in params)
+
+
+class ProgressReporter:
+    """
+    Throttled progress notifications for the tool call being handled.
+    
+    Work is reported in steps ("fetched 40/127 files"); a step ends when its
+    current count reaches its total. MCP requires progress to increase, so
+    each step's counts are offset by the totals of the steps before it.
+    """
+    
+    def __init__(self, ctx: Context, min_interval: Optional[float] = None, clock: Callable[[], float] = time.monotonic):
+        self._ctx = ctx
+        self._min_interval = PROGRESS_MIN_INTERVAL if min_interval is None else min_interval
+        self._clock = clock
+        self._offset = 0.0
+        self._sent = 0.0
+        self._last_at: Optional[float] = None
+        self._with_message = _accepts_argument(ctx.report_progress, "message")
+    
+    async def update(self, current: float, total: float, message: str) -> None:
+        """Report that current of total units of the current step are done."""
+        progress, done = self._offset + current, current >= total
+        if done:
+            self._offset += total
+        now = self._clock()
+        throttled = self._last_at is not None and now - self._last_at < self._min_interval
+        if progress <= self._sent or (throttled and not done):
+            return
+        self._sent, self._last_at = progress, now
+        extra = {"message": message} if self._with_message else {}
+        try:
+            await self._ctx.report_progress(progress, self._offset if done else self._offset + total, **extra)
+        except Exception:
+            # Progress is advisory; a failed notification must not fail the call
+            logger.debug("Could not send a progress notification", exc_info=True)
+
+
+_call_progress: "contextvars.ContextVar[Optional[ProgressReporter]]" = contextvars.ContextVar(
+    "call_progress", default=None
+)
+
+
+def _call_progress_reporter(args: Tuple[Any, ...], kwargs: Dict[str, Any]) -> Optional[ProgressReporter]:
+    """Return a reporter if the call has an MCP context carrying a progress token."""
+    for value in (*args, *kwargs.values()):
+        if isinstance(value, Context) and _progress_token(value) is not None:
+            return ProgressReporter(value)
+    return None
+
+
+async def _report_progress(current: float, total: float, message: str) -> None:
+    """Report progress of the current tool call; a no-op unless the client asked for it."""
+    reporter = _call_progress.get()
+    if reporter is not None:
+        await reporter.update(current, total, message)
+
+
+# ============================================================================
+# Metrics
+# ============================================================================
+
+DURATION_BUCKETS = (0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300)
+REVIEW_DURATION_BUCKETS = (5, 15, 30, 60, 120, 300, 600, 1200, 1800, 3600)
+
+
+def _escape_label(value: str) -> str:
+    return value.replace("\\", "\\\\").replace('"', '\\"').replace("\n", "\\n")
+
+
+class MetricsRegistry:
+    """
+    Counters, gauges and histograms rendered in the Prometheus text format.
+    
+    Updates come from the event loop while scrapes are served from another
+    thread, so every access holds a lock.
+    """
+    
+    def __init__(self):
+        self._lock = threading.Lock()
+        self._metrics: Dict[str, Dict[str, Any]] = {}
+    
+    def define(self, name: str, kind: str, help_text: str, buckets: Optional[Tuple[float, ...]] = None) -> None:
+        self._metrics[name] = {"kind": kind, "help": help_text, "buckets": buckets, "series": {}}
+    
+    @staticmethod
+    def _key(labels: Optional[Dict[str, str]]) -> Tuple[Tuple[str, str], ...]:
+        return tuple(sorted((labels or {}).items()))
+    
+    def inc(self, name: str, labels: Optional[Dict[str, str]] = None, value: float = 1.0) -> None:
+        with self._lock:
+            series = self._metrics[name]["series"]
+            key = self._key(labels)
+            series[key] = series.get(key, 0.0) + value
+    
+    def set(self, name: str, labels: Optional[Dict[str, str]], value: float) -> None:
+        with self._lock:
+            self._metrics[name]["series"][self._key(labels)] = float(value)
+    
+    def observe(self, name: str, labels: Optional[Dict[str, str]], value: float) -> None:
+        with self._lock:
+            metric = self._metrics[name]
+            state = metric["series"].setdefault(
+                self._key(labels), {"buckets": [0] * len(metric["buckets"]), "sum": 0.0, "count": 0}
+            )
+            for i, bound in enumerate(metric["buckets"]):
+                if value <= bound:
+                    state["buckets"][i] += 1
+            state["sum"] += value
+            state["count"] += 1
+    
+    def value(self, name: str, labels: Optional[Dict[str, str]] = None) -> float:
+        """Return a counter or gauge value, or a histogram's observation count."""
+        with self._lock:
+            current = self._metrics[name]["series"].get(self._key(labels), 0.0)
+            return current["count"] if isinstance(current, dict) else current
+    
+    def render(self) -> str:
+        lines = []
+        with self._lock:
+            for name, metric in self._metrics.items():
+                lines.append(f"# HELP {name} {metric['help']}")
+                lines.append(f"# TYPE {name} {metric['kind']}")
+                for key, current in sorted(metric["series"].items()):
+                    labels = [f'{k}="{_escape_label(v)}"' for k, v in key]
+                    if metric["kind"] != "histogram":
+                        suffix = "{" + ",".join(labels) + "}" if labels else ""
+                        lines.append(f"{name}{suffix} {current:g}")
+                        continue
+                    bounds = [f"{bound:g}" for bound in metric["buckets"]] + ["+Inf"]
+                    counts = current["buckets"] + [current["count"]]
+                    for bound, count in zip(bounds, counts):
+                        bucket_labels = ",".join(labels + [f'le="{bound}"'])
+                        lines.append(f"{name}_bucket{{{bucket_labels}}} {count}")
+                    suffix = "{" + ",".join(labels) + "}" if labels else ""
+                    lines.append(f"{name}_sum{suffix} {current['sum']:g}")
+                    lines.append(f"{name}_count{suffix} {current['count']}")
+        return "\n".join(lines) + "\n"
+
+
+METRICS = MetricsRegistry()
+METRICS.define("github_pr_mcp_tool_calls_total", "counter", "MCP tool calls by tool and outcome")
+METRICS.define("github_pr_mcp_tool_duration_seconds", "histogram", "MCP tool call duration", DURATION_BUCKETS)
+METRICS.define("github_pr_mcp_github_requests_total", "counter", "GitHub API requests by method, endpoint and status")
+METRICS.define("github_pr_mcp_github_rate_limit_remaining", "gauge", "Requests left in the current GitHub rate limit window")
+METRICS.define(
+    "github_pr_mcp_review_duration_seconds", "histogram",
+    "Time from fetching a PR diff to posting its review", REVIEW_DURATION_BUCKETS
+)
+METRICS.define("github_pr_mcp_review_queue_depth", "gauge", "Background reviews waiting out the debounce or for a free slot")
+METRICS.define("github_pr_mcp_reviews_superseded_total", "counter", "Background reviews replaced by a newer job for the same PR")
+METRICS.define("github_pr_mcp_comments_posted_total", "counter", "Comments posted to GitHub by tool")
+METRICS.define("github_pr_mcp_blob_cache_lookups_total", "counter", "Blob content cache lookups by result (hit or miss)")
+METRICS.define("github_pr_mcp_blob_cache_bytes", "gauge", "Bytes of blob content held in the cache")
+
+_ENDPOINT_TEMPLATES = [
+    (re.compile(r"/repos/[^/]+/[^/]+"), "/repos/{owner}/{repo}"),
+    (re.compile(r"/orgs/[^/]+"), "/orgs/{org}"),
+    (re.compile(r"/teams/[^/]+"), "/teams/{team}"),
+    (re.compile(r"/contents/.*$"), "/contents/{path}"),
+    (re.compile(r"/compare/[^/]+$"), "/compare/{basehead}"),
+    (re.compile(r"/labels/[^/]+$"), "/labels/{name}"),
+    (re.compile(r"/(?:[0-9a-f]{40}|[0-9a-f]{64})(?=/|$)"), "/{sha}"),
+    (re.compile(r"/\d+(?=/|$)"), "/{number}"),
+]
+
+
+def _endpoint_template(path: str) -> str:
+    """Collapse IDs, names and SHAs in an API path so metric labels stay bounded."""
+    for pattern, replacement in _ENDPOINT_TEMPLATES:
+        path = pattern.sub(replacement, path)
+    return path
+
+
+class MetricsTransport(httpx.AsyncBaseTransport):
+    """HTTP transport that logs and counts GitHub API requests and tracks the rate limit left."""
+    
+    def __init__(
+        self,
+        transport: httpx.AsyncBaseTransport,
+        rate_limits: Optional[Dict[str, Dict[str, int]]] = None,
+        account: str = DEFAULT_ACCOUNT
+    ):
+        """
+        Args:
+            transport (httpx.AsyncBaseTransport): Transport that sends the requests
+            rate_limits (Optional[Dict[str, Dict[str, int]]]): Updated with the latest
+                limit, remaining and reset seen for each rate limit resource
+            account (str): Metrics label of the credentials sending the requests
+        """
+        self.transport = transport
+        self.rate_limits = rate_limits if rate_limits is not None else {}
+        self.account = account
+    
+    async def handle_async_request(self, request: httpx.Request) -> httpx.Response:
+        started = time.monotonic()
+        response = await self.transport.handle_async_request(request)
+        logger.debug(
+            "GitHub %s %s -> %d in %.2fs", request.method, request.url.path,
+            response.status_code, time.monotonic() - started
+        )
+        METRICS.inc("github_pr_mcp_github_requests_total", {
+            "account": self.account,
+            "method": request.method,
+            "endpoint": _endpoint_template(request.url.path),
+            "status": str(response.status_code),
+        })
+        remaining = response.headers.get("x-ratelimit-remaining")
+        if remaining is not None:
+            resource = response.headers.get("x-ratelimit-resource", "core")
+            METRICS.set(
+                "github_pr_mcp_github_rate_limit_remaining",
+                {"account": self.account, "resource": resource},
+                float(remaining)
+            )
+            status = {
+                "limit": int(response.headers.get("x-ratelimit-limit", 0)),
+                "remaining": int(remaining),
+                "reset": int(response.headers.get("x-ratelimit-reset", 0)),
+            }
+            self.rate_limits[resource] = status
+            usage = _call_rate_limits.get()
+            if usage is not None:
+                usage.seen[resource] = status
+        return response
+    
+    async def aclose(self) -> None:
+        await self.transport.aclose()
+
+
+def _tool_outcome(result: Any) -> str:
+    """Classify a tool result; tools report failures as JSON with success: false."""
+    if isinstance(result, str) and result.startswith("{"):
+        try:
+            if json.loads(result).get("success") is False:
+                return "error"
+        except ValueError:
+            pass
+    return "success"
+
+
+def _instrument_tool(name: str, fn: Callable[..., Any]) -> Callable[..., Any]:
+    """Wrap a tool function so each call is counted, timed and given a correlation ID."""
+    @functools.wraps(fn)
+    async def instrumented(*args, **kwargs):
+        started = time.monotonic()
+        outcome = "error"
+        correlation_id = _new_correlation_id()
+        reset = _correlation_id.set(correlation_id)
+        timeout = _call_timeout(args, kwargs)
+        deadline = CallDeadline(started + timeout) if timeout else None
+        reset_deadline = _call_deadline.set(deadline)
+        reset_progress = _call_progress.set(_call_progress_reporter(args, kwargs))
+        usage = CallRateLimits() if _expensive_call(args, kwargs) else None
+        reset_rate_limits = _call_rate_limits.set(usage)
+        reset_account = _call_account.set(_call_owner(args, kwargs))
+        logger.info("Tool %s started", name)
+        try:
+            refused = _unknown_account(_call_account.get())
+            if refused is None and usage is not None and _existing_github_client() is not None:
+                refused = _quota_low("core")
+            write = _call_write(args, kwargs) if refused is None else None
+            if write is not None:
+                # Better to refuse up front than with a bare 403 half way through the call
+                refused = await _missing_permission(*write)
+            if refused is not None:
+                result = refused.response()
+            elif deadline is None:
+                result = await fn(*args, **kwargs)
+            else:
+                try:
+                    result = await asyncio.wait_for(fn(*args, **kwargs), timeout + DEADLINE_GRACE_SECONDS)
+                except asyncio.TimeoutError:
+                    result = json.dumps({
+                        "error": f"Tool call timed out after {timeout:g} seconds",
+                        "error_code": "timeout",
+                        "timed_out": True,
+                        "success": False
+                    })
+                else:
+                    if deadline.timed_out:
+                        result = _with_timed_out(result)
+            if usage is not None:
+                # A fetch refused part way is reported as such, whatever the tool made of the exception
+                result = _with_rate_limit(usage.refused.response() if usage.refused else result, usage)
+            outcome = _tool_outcome(result)
+            return _with_correlation_id(result, correlation_id)
+        except asyncio.CancelledError:
+            # The client cancelled or went away: let the cancellation reach the
+            # MCP layer rather than returning whatever had been gathered so far
+            outcome = "cancelled"
+            raise
+        finally:
+            elapsed = time.monotonic() - started
+            logger.log(
+                logging.WARNING if outcome == "error" else logging.INFO,
+                "Tool %s finished: %s in %.2fs", name, outcome, elapsed
+            )
+            _correlation_id.reset(reset)
+            _call_deadline.reset(reset_deadline)
+            _call_progress.reset(reset_progress)
+            _call_rate_limits.reset(reset_rate_limits)
+            _call_account.reset(reset_account)
+            METRICS.inc("github_pr_mcp_tool_calls_total", {"tool": name, "outcome": outcome})
+            METRICS.observe("github_pr_mcp_tool_duration_seconds", {"tool": name}, elapsed)
+    return instrumented
+
+
+def _instrumented_tool_decorator(register: Callable[..., Any]) -> Callable[..., Any]:
+    """
+    Wrap FastMCP.tool so every registered tool is instrumented.
+    
+    The registered handler is the instrumented wrapper, while the module keeps
+    the plain function; calls between tools are therefore not double-counted.
+    """
+    def tool(*args, **kwargs):
+        decorator = register(*args, **kwargs)
+        
+        def wrap(fn):
+            decorator(_instrument_tool(kwargs.get("name") or fn.__name__, fn))
+            return fn
+        return wrap
+    return tool
+
+
+mcp.tool = _instrumented_tool_decorator(mcp.tool)
+
+
+def _start_metrics_server(host: str, port: int):
+    """Serve METRICS at /metrics from a background thread; returns the server."""
+    from http.server import BaseHTTPRequestHandler, ThreadingHTTPServer
+    
+    class Handler(BaseHTTPRequestHandler):
+        def do_GET(self):
+            if self.path.split("?", 1)[0] != "/metrics":
+                self.send_error(404)
+                return
+            body = METRICS.render().encode()
+            self.send_response(200)
+            self.send_header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+            self.send_header("Content-Length", str(len(body)))
+            self.end_headers()
+            self.wfile.write(body)
+        
+        def log_message(self, format, *args):
+            logger.debug("metrics: " + format, *args)
+    
+    server = ThreadingHTTPServer((host, port), Handler)
+    threading.Thread(target=server.serve_forever, name="metrics", daemon=True).start()
+    return server
+
+
+# ============================================================================
+# GitHub API Client
+# ============================================================================
+
+@dataclass
+class TransportOptions:
+    """Proxy and TLS settings shared by every outbound connection to GitHub."""
+    proxy: Optional[str] = None
+    ca_bundle: Optional[str] = None
+    client_cert: Optional[str] = None
+    client_key: Optional[str] = None
+    insecure_skip_verify: bool = False
+    # Honor HTTPS_PROXY, HTTP_PROXY and NO_PROXY when no proxy is given
+    trust_env: bool = True
+    _ssl_context: Optional[ssl.SSLContext] = field(default=None, repr=False, compare=False)
+    
+    @classmethod
+    def from_env(cls) -> "TransportOptions":
+        return cls(
+            proxy=GITHUB_PROXY or None,
+            ca_bundle=GITHUB_CA_BUNDLE or None,
+            client_cert=GITHUB_CLIENT_CERT or None,
+            client_key=GITHUB_CLIENT_KEY or None,
+            insecure_skip_verify=GITHUB_INSECURE_SKIP_VERIFY
+        )
+    
+    def ssl_context(self) -> ssl.SSLContext:
+        """The system trust store plus ca_bundle, with the client certificate loaded; built once."""
+        if self._ssl_context is None:
+            context = ssl.create_default_context()
+            if self.ca_bundle:
+                context.load_verify_locations(cafile=str(Path(self.ca_bundle).expanduser()))
+            if self.client_cert:
+                context.load_cert_chain(
+                    str(Path(self.client_cert).expanduser()),
+                    str(Path(self.client_key).expanduser()) if self.client_key else None
+                )
+            if self.insecure_skip_verify:
+                logger.warning(
+                    "TLS certificate verification is DISABLED for GitHub requests "
+                    "(GITHUB_INSECURE_SKIP_VERIFY); connections can be intercepted"
+                )
+                context.check_hostname = False
+                context.verify_mode = ssl.CERT_NONE
+            self._ssl_context = context
+        return self._ssl_context
+    
+    def proxy_for(self, url: str) -> Optional[str]:
+        """The proxy to reach url through, or None to connect directly."""
+        if self.proxy or not self.trust_env:
+            return self.proxy
+        parts = urlsplit(url)
+        if urllib.request.proxy_bypass(parts.hostname or ""):
+            return None
+        proxies = urllib.request.getproxies()
+        return proxies.get(parts.scheme) or proxies.get("all")
+
+
+def _outbound_transport(url: str, options: TransportOptions) -> httpx.AsyncHTTPTransport:
+    """
+    The network transport for requests to url's host.
+    
+    Every GitHub connection (REST, GraphQL, uploads, blob downloads and the
+    device flow) is built here, so proxy and TLS settings apply to all of them.
+    """
+    return httpx.AsyncHTTPTransport(verify=options.ssl_context(), proxy=options.proxy_for(url))
+
+
+# Installation tokens are refreshed when they are this close to expiring.
+APP_TOKEN_REFRESH_MARGIN = 60
+
+
+class GitHubAppAuth:
+    """
+    Installation access tokens for a GitHub App.
+    
+    A short-lived JWT signed with the App's private key is exchanged for an
+    installation token, which is cached and transparently refreshed shortly
+    before it expires so long reviews never run with a stale token.
+    """
+    
+    def __init__(
+        self,
+        app_id: str,
+        installation_id: str,
+        private_key: Union[str, bytes],
+        clock: Callable[[], float] = time.time
+    ):
+        """
+        Args:
+            app_id (str): GitHub App ID (the JWT issuer)
+            installation_id (str): Installation to request tokens for
+            private_key (Union[str, bytes]): PEM contents, or a path to the PEM file
+            clock (Callable[[], float]): Source of the current UNIX time
+        """
+        self.app_id = str(app_id)
+        self.installation_id = str(installation_id)
+        self.private_key = self._load_private_key(private_key)
+        self._clock = clock
+        self._token: Optional[str] = None
+        self._expires_at = 0.0
+        self._lock = asyncio.Lock()
+        # Permission levels the installation grants, as reported with its latest token
+        self.permissions: Optional[Dict[str, str]] = None
+    
+    def invalidate(self, token: str) -> None:
+        """Forget the cached installation token if it is the one GitHub rejected."""
+        if self._token == token:
+            self._token = None
+    
+    @staticmethod
+    def _load_private_key(private_key: Union[str, bytes]) -> bytes:
+        """Return PEM bytes from raw key material or a key file path."""
+        if isinstance(private_key, bytes):
+            return private_key
+        if "-----BEGIN" in private_key:
+            return private_key.encode()
+        return Path(private_key).expanduser().read_bytes()
+    
+    def app_jwt(self) -> str:
+        """Create the JWT that authenticates as the App itself."""
+        now = int(self._clock())
+        payload = {
+            # Backdate to tolerate clock drift between us and GitHub
+            "iat": now - 60,
+            "exp": now + 9 * 60,
+            "iss": self.app_id,
+        }
+        return jwt.encode(payload, self.private_key, algorithm="RS256")
+    
+    def _needs_refresh(self) -> bool:
+        return self._token is None or self._expires_at - self._clock() <= APP_TOKEN_REFRESH_MARGIN
+    
+    async def token(self, http: httpx.AsyncClient, api_base: str) -> str:
+        """
+        Return a valid installation token, exchanging a new JWT when needed.
+        
+        Args:
+            http (httpx.AsyncClient): Client used for the token exchange
+            api_base (str): GitHub API base URL
+        
+        Returns:
+            str: Installation access token
+        """
+        async with self._lock:
+            if self._needs_refresh():
+                response = await http.post(
+                    f"{api_base}/app/installations/{self.installation_id}/access_tokens",
+                    headers={
+                        "Authorization": f"Bearer {self.app_jwt()}",
+                        "Accept": "application/vnd.github+json",
+                        "X-GitHub-Api-Version": "2022-11-28"
+                    }
+                )
+                response.raise_for_status()
+                data = response.json()
+                self._token = data["token"]
+                _register_secret(self._token)
+                self.permissions = data.get("permissions")
+                expires_at = data["expires_at"].replace("Z", "+00:00")
+                self._expires_at = datetime.fromisoformat(expires_at).timestamp()
+            return self._token
+
+
+# Tokens from a token source are fetched again when this close to expiring.
+TOKEN_SOURCE_REFRESH_MARGIN = 60
+# Seconds GITHUB_TOKEN_COMMAND may take to print a token
+TOKEN_COMMAND_TIMEOUT = 30.0
+
+
+class TokenSource:
+    """
+    Supplier of the bearer token sent with each request.
+    
+    token() returns the token and the UNIX time it expires at, or None when
+    the source cannot tell. GitHubClient reuses a token with an expiry until
+    shortly before it, asks again on every request otherwise, and asks again
+    straight away when GitHub rejects the token with a 401.
+    """
+    
+    async def token(self) -> Tuple[str, Optional[float]]:
+        raise NotImplementedError
+
+
+class StaticTokenSource(TokenSource):
+    """A fixed token, such as a personal access token."""
+    
+    def __init__(self, token: str):
+        self._token = token
+        _register_secret(token)
+    
+    async def token(self) -> Tuple[str, Optional[float]]:
+        if not self._token:
+            raise ValueError("GITHUB_TOKEN environment variable not set")
+        return self._token, None
+
+
+class EnvTokenSource(TokenSource):
+    """A token read from an environment variable on every request, so rotations are picked up."""
+    
+    def __init__(self, name: str = "GITHUB_TOKEN"):
+        self.name = name
+    
+    async def token(self) -> Tuple[str, Optional[float]]:
+        token = os.environ.get(self.name, "")
+        if not token:
+            raise ValueError(f"{self.name} environment variable not set")
+        _register_secret(token)
+        return token, None
+
+
+class CommandTokenSource(TokenSource):
+    """
+    A token printed by an external command, e.g. "vault read -field=token secret/github".
+    
+    The command prints either the bare token or a JSON object with "token"
+    and an optional "expires_at" (ISO 8601 or UNIX seconds). Tokens without
+    an expiry are treated as valid for ttl seconds.
+    """
+    
+    def __init__(
+        self,
+        command: str,
+        ttl: float = GITHUB_TOKEN_COMMAND_TTL,
+        timeout: float = TOKEN_COMMAND_TIMEOUT,
+        clock: Callable[[], float] = time.time
+    ):
+        self.command = command
+        self.ttl = ttl
+        self.timeout = timeout
+        self._clock = clock
+    
+    async def token(self) -> Tuple[str, Optional[float]]:
+        result = await _run_command_async(shlex.split(self.command), timeout=self.timeout)
+        if not result["success"]:
+            raise ValueError(f"Token command failed: {result['stderr'].strip() or 'exit status ' + str(result['returncode'])}")
+        output = result["stdout"].strip()
+        expires_at: Optional[float] = None
+        if output.startswith("{"):
+            try:
+                data = json.loads(output)
+                token = str(data["token"])
+                expires = data.get("expires_at")
+                if isinstance(expires, (int, float)):
+                    expires_at = float(expires)
+                elif expires:
+                    expires_at = _parse_timestamp(str(expires)).timestamp()
+            except (ValueError, KeyError, TypeError) as e:
+                raise ValueError(f"Token command printed malformed JSON: {e}") from None
+        else:
+            token = output.splitlines()[0].strip() if output else ""
+        if not token:
+            raise ValueError("Token command printed no token")
+        _register_secret(token)
+        return token, expires_at if expires_at is not None else self._clock() + self.ttl
+
+
+def _user_config_dir() -> Path:
+    """The per-user configuration directory for this server on the current OS."""
+    if sys.platform == "win32":
+        base = os.environ.get("APPDATA") or str(Path.home() / "AppData" / "Roaming")
+    elif sys.platform == "darwin":
+        base = str(Path.home() / "Library" / "Application Support")
+    else:
+        base = os.environ.get("XDG_CONFIG_HOME") or str(Path.home() / ".config")
+    return Path(base) / "github-pr-mcp"
+
+
+class DeviceFlowAuth(TokenSource):
+    """
+    User tokens from GitHub's OAuth device flow, saved for reuse across runs.
+    
+    start() requests a device and user code, poll() waits for the user to
+    enter the code at the verification URL, and the resulting token is saved
+    with 0600 permissions. Apps with expiring user tokens also return a
+    refresh token, which token() uses to renew the access token shortly
+    before it expires.
+    """
+    
+    def __init__(
+        self,
+        client_id: str,
+        web_base: str = "https://github.com",
+        token_path: Optional[Union[str, Path]] = None,
+        scopes: str = GITHUB_OAUTH_SCOPES,
+        client_secret: Optional[str] = None,
+        transport: Optional[httpx.AsyncBaseTransport] = None,
+        clock: Callable[[], float] = time.time,
+        sleep: Callable[[float], Any] = asyncio.sleep,
+        transport_options: Optional[TransportOptions] = None
+    ):
+        """
+        Args:
+            client_id (str): OAuth App or GitHub App client ID
+            web_base (str): GitHub web URL, e.g. "https://ghe.example.com"
+            token_path (Optional[Union[str, Path]]): Saved token file
+                (default: token.json in the per-user config directory)
+            scopes (str): Space-separated scopes requested by an OAuth App
+            client_secret (Optional[str]): Sent with refresh requests when set
+            transport (Optional[httpx.AsyncBaseTransport]): Custom HTTP transport (used by tests)
+            clock (Callable[[], float]): Source of the current UNIX time
+            sleep (Callable[[float], Any]): Awaitable sleep between polls
+            transport_options (Optional[TransportOptions]): Proxy and TLS
+                settings (default from the environment)
+        """
+        self.client_id = client_id
+        self.web_base = web_base.rstrip("/")
+        self.token_path = Path(token_path).expanduser() if token_path else _user_config_dir() / "token.json"
+        self.scopes = scopes
+        self.client_secret = client_secret
+        self.transport = transport
+        self._clock = clock
+        self._sleep = sleep
+        self.transport_options = transport_options or TransportOptions.from_env()
+        self._lock = asyncio.Lock()
+    
+    def load(self) -> Optional[Dict[str, Any]]:
+        """Return the saved token, or None when nobody has signed in."""
+        try:
+            saved = json.loads(self.token_path.read_text())
+        except (OSError, ValueError):
+            return None
+        if not isinstance(saved, dict) or not saved.get("access_token"):
+            return None
+        _register_secret(saved["access_token"])
+        _register_secret(saved.get("refresh_token"))
+        return saved
+    
+    def save(self, saved: Dict[str, Any]) -> None:
+        """Write the token file readable by the current user only."""
+        self.token_path.parent.mkdir(parents=True, exist_ok=True, mode=0o700)
+        fd = os.open(self.token_path, os.O_WRONLY | os.O_CREAT | os.O_TRUNC, 0o600)
+        with os.fdopen(fd, "w") as f:
+            json.dump(saved, f)
+        # O_CREAT's mode does not apply to a file that already existed
+        os.chmod(self.token_path, 0o600)
+    
+    async def _post(self, path: str, form: Dict[str, str]) -> Dict[str, Any]:
+        transport = self.transport or _outbound_transport(self.web_base, self.transport_options)
+        async with httpx.AsyncClient(timeout=GITHUB_REQUEST_TIMEOUT, transport=transport) as http:
+            response = await http.post(f"{self.web_base}{path}", data=form, headers={"Accept": "application/json"})
+            response.raise_for_status()
+            return response.json()
+    
+    async def start(self) -> Dict[str, Any]:
+        """
+        Request a device code.
+        
+        Returns:
+            Dict[str, Any]: device_code, user_code, verification_uri,
+            expires_in and interval, as GitHub returned them
+        """
+        device = await self._post("/login/device/code", {"client_id": self.client_id, "scope": self.scopes})
+        if "error" in device:
+            raise ValueError(f"Device flow sign-in failed: {device.get('error_description') or device['error']}")
+        return device
+    
+    async def poll(self, device: Dict[str, Any]) -> Dict[str, Any]:
+        """
+        Wait until the user authorizes the device code, then save and return the token.
+        
+        Polls at GitHub's interval, backing off when told to slow down, and
+        gives up when the device code expires.
+        """
+        interval = float(device.get("interval", 5))
+        deadline = self._clock() + float(device.get("expires_in", 900))
+        while True:
+            await self._sleep(interval)
+            if self._clock() >= deadline:
+                raise ValueError("The device code expired before it was authorized; sign in again")
+            payload = await self._post("/login/oauth/access_token", {
+                "client_id": self.client_id,
+                "device_code": device["device_code"],
+                "grant_type": "urn:ietf:params:oauth:grant-type:device_code",
+            })
+            error = payload.get("error")
+            if error == "authorization_pending":
+                continue
+            if error == "slow_down":
+                interval = float(payload.get("interval", interval + 5))
+                continue
+            if error == "expired_token":
+                raise ValueError("The device code expired before it was authorized; sign in again")
+            if error == "access_denied":
+                raise ValueError("Sign-in was cancelled")
+            if error:
+                raise ValueError(f"Device flow sign-in failed: {payload.get('error_description') or error}")
+            return self._store(payload)
+    
+    def _store(self, payload: Dict[str, Any]) -> Dict[str, Any]:
+        now = self._clock()
+        saved = {
+            "access_token": payload["access_token"],
+            "token_type": payload.get("token_type", "bearer"),
+            "scope": payload.get("scope", ""),
+        }
+        if payload.get("expires_in"):
+            saved["expires_at"] = now + float(payload["expires_in"])
+        if payload.get("refresh_token"):
+            saved["refresh_token"] = payload["refresh_token"]
+            if payload.get("refresh_token_expires_in"):
+                saved["refresh_token_expires_at"] = now + float(payload["refresh_token_expires_in"])
+        _register_secret(saved["access_token"])
+        _register_secret(saved.get("refresh_token"))
+        self.save(saved)
+        return saved
+    
+    async def refresh(self, saved: Dict[str, Any]) -> Dict[str, Any]:
+        """Exchange the saved refresh token for a new access token."""
+        form = {
+            "client_id": self.client_id,
+            "grant_type": "refresh_token",
+            "refresh_token": saved["refresh_token"],
+        }
+        if self.client_secret:
+            form["client_secret"] = self.client_secret
+        payload = await self._post("/login/oauth/access_token", form)
+        if "error" in payload:
+            raise ValueError(
+                f"Refreshing the GitHub token failed ({payload.get('error_description') or payload['error']}); sign in again"
+            )
+        return self._store(payload)
+    
+    async def token(self) -> Tuple[str, Optional[float]]:
+        async with self._lock:
+            saved = self.load()
+            if saved is None:
+                raise ValueError("Not signed in to GitHub: run the server with --login or call github_pr_login")
+            expires_at = saved.get("expires_at")
+            if expires_at is not None and expires_at - self._clock() <= TOKEN_SOURCE_REFRESH_MARGIN:
+                refresh_expires_at = saved.get("refresh_token_expires_at")
+                if not saved.get("refresh_token") or (
+                    refresh_expires_at is not None and refresh_expires_at <= self._clock()
+                ):
+                    raise ValueError("The saved GitHub token has expired: sign in again with --login or github_pr_login")
+                saved = await self.refresh(saved)
+                expires_at = saved.get("expires_at")
+            return saved["access_token"], expires_at
+
+
+_device_flow: Optional[DeviceFlowAuth] = None
+
+
+def _get_device_flow() -> Optional[DeviceFlowAuth]:
+    """Return the device flow configured from the environment, or None without a client ID."""
+    global _device_flow
+    if _device_flow is None and GITHUB_OAUTH_CLIENT_ID:
+        _device_flow = DeviceFlowAuth(
+            GITHUB_OAUTH_CLIENT_ID,
+            web_base=f"https://{_github_web_host()}",
+            token_path=GITHUB_OAUTH_TOKEN_PATH or None,
+            client_secret=GITHUB_OAUTH_CLIENT_SECRET or None
+        )
+    return _device_flow
+
+
+# GitHub asks clients to wait at least a minute after a secondary rate limit
+# response that carries no Retry-After header.
+SECONDARY_RATE_LIMIT_WAIT = 60.0
+
+
+class RateLimitPause:
+    """
+    Rate limit wait in progress, shared by every request of one GitHubClient.
+    
+    A client builds a fresh transport stack per request, so the pause lives
+    on the client and is handed to each RateLimitTransport.
+    """
+    
+    def __init__(self):
+        # Set while some request is waiting out a rate limit
+        self.resumed: Optional[asyncio.Event] = None
+
+
+class RateLimitTransport(httpx.AsyncBaseTransport):
+    """
+    HTTP transport that waits out GitHub primary and secondary rate limits.
+    
+    403/429 responses are retried when they carry `Retry-After`, an exhausted
+    `X-RateLimit-Remaining`, or the secondary rate limit message. Other 403s
+    (missing permissions, etc.) are returned unchanged. Waiting uses
+    asyncio.sleep, so a cancelled tool call stops immediately.
+    
+    The wait is shared through a RateLimitPause: while one request waits out
+    a limit, every other request using the same pause holds off too, instead
+    of each concurrent fetch hitting the limit and sleeping on its own.
+    Search requests count against a separate, much lower limit, so they wait
+    on their own pause and budget and never hold up other requests.
+    """
+    
+    def __init__(
+        self,
+        transport: httpx.AsyncBaseTransport,
+        max_wait: float = GITHUB_RATE_LIMIT_MAX_WAIT,
+        sleep: Callable[[float], Any] = asyncio.sleep,
+        clock: Callable[[], float] = time.time,
+        pause: Optional[RateLimitPause] = None,
+        search_pause: Optional[RateLimitPause] = None,
+        search_max_wait: float = GITHUB_SEARCH_RATE_LIMIT_MAX_WAIT
+    ):
+        """
+        Args:
+            transport (httpx.AsyncBaseTransport): Transport that sends the requests
+            max_wait (float): Maximum total seconds to wait for one request
+            sleep (Callable[[float], Any]): Coroutine function used to wait
+            clock (Callable[[], float]): Source of the current UNIX time
+            pause (Optional[RateLimitPause]): Wait shared with other transports;
+                private to this transport by default
+            search_pause (Optional[RateLimitPause]): The same for search API requests
+            search_max_wait (float): Maximum total seconds to wait for one search request
+        """
+        self.transport = transport
+        self.max_wait = max_wait
+        self.search_max_wait = search_max_wait
+        self._sleep = sleep
+        self._clock = clock
+        self._pause = pause or RateLimitPause()
+        self._search_pause = search_pause or RateLimitPause()
+    
+    def _limit(self, request: httpx.Request) -> Tuple[RateLimitPause, float]:
+        """The pause and wait budget of the rate limit a request counts against."""
+        if "/search/" in request.url.path:
+            return self._search_pause, self.search_max_wait
+        return self._pause, self.max_wait
+    
+    async def _retry_delay(self, response: httpx.Response) -> Optional[float]:
+        """Return how long to wait before retrying, or None if this is not a rate limit."""
+        if response.status_code not in (403, 429):
+            return None
+        
+        retry_after = response.headers.get("retry-after")
+        if retry_after is not None:
+            try:
+                return max(float(retry_after), 0.0)
+            except ValueError:
+                return SECONDARY_RATE_LIMIT_WAIT
+        
+        if response.headers.get("x-ratelimit-remaining") == "0":
+            reset = float(response.headers.get("x-ratelimit-reset", self._clock()))
+            # One extra second absorbs clock skew around the reset instant
+            return max(reset - self._clock(), 0.0) + 1.0
+        
+        if response.status_code == 429:
+            return SECONDARY_RATE_LIMIT_WAIT
+        
+        await response.aread()
+        if "secondary rate limit" in response.text.lower():
+            return SECONDARY_RATE_LIMIT_WAIT
+        return None
+    
+    async def handle_async_request(self, request: httpx.Request) -> httpx.Response:
+        pause, max_wait = self._limit(request)
+        waited = 0.0
+        while True:
+            while pause.resumed is not None:
+                await pause.resumed.wait()
+            response = await self.transport.handle_async_request(request)
+            delay = await self._retry_delay(response)
+            if delay is None:
+                return response
+            if waited + delay > max_wait:
+                logger.warning(
+                    "GitHub rate limit on %s %s requires %.0fs wait, over the %.0fs budget; giving up",
+                    request.method, request.url.path, delay, max_wait
+                )
+                return response
+            
+            logger.warning(
+                "GitHub rate limit on %s %s (status %d, remaining %s); retrying in %.1fs",
+                request.method, request.url.path, response.status_code,
+                response.headers.get("x-ratelimit-remaining", "unknown"), delay
+            )
+            await response.aclose()
+            if pause.resumed is not None:
+                # A concurrent request is already waiting; retry once it is done
+                continue
+            resumed = pause.resumed = asyncio.Event()
+            try:
+                await self._sleep(delay)
+            finally:
+                pause.resumed = None
+                resumed.set()
+            waited += delay
+    
+    async def aclose(self) -> None:
+        await self.transport.aclose()
+
+
+# Server errors worth retrying: the request most likely never reached a handler
+RETRYABLE_STATUS_CODES = frozenset({500, 502, 503, 504})
+IDEMPOTENT_METHODS = frozenset({"GET", "HEAD"})
+
+
+class RetryableError(Exception):
+    """
+    A non-idempotent request failed in a way a retry might fix.
+    
+    Raised instead of retrying: whether e.g. a review was already posted
+    before the connection dropped is unknown, so the caller decides.
+    """
+    
+    def __init__(self, request: httpx.Request, status_code: Optional[int] = None, cause: Optional[Exception] = None):
+        self.request = request
+        self.status_code = status_code
+        reason = f"status {status_code}" if status_code is not None else f"{type(cause).__name__}: {cause}"
+        super().__init__(
+            f"GitHub {request.method} {request.url.path} failed with {reason}; "
+            "it may or may not have been applied, so it was not retried"
+        )
+
+
+class QuotaLowError(Exception):
+    """An expensive tool call would start a multi-page fetch with the rate limit below GITHUB_RATE_LIMIT_FLOOR."""
+    
+    def __init__(self, resource: str, remaining: int, reset: int):
+        self.resource = resource
+        self.remaining = remaining
+        self.reset = reset
+        self.reset_at = datetime.fromtimestamp(reset, timezone.utc).isoformat()
+        super().__init__(
+            f"GitHub {resource} API quota is low ({remaining} requests left, floor {GITHUB_RATE_LIMIT_FLOOR}); "
+            f"retry after {self.reset_at}"
+        )
+    
+    def response(self) -> str:
+        """The tool result reporting the refusal."""
+        return json.dumps({
+            "error": str(self),
+            "error_code": "quota_low",
+            "resource": self.resource,
+            "remaining": self.remaining,
+            "reset_at": self.reset_at,
+            "retry_after": max(0, math.ceil(self.reset - time.time())),
+            "success": False
+        })
+
+
+def _quota_low(resource: str) -> Optional[QuotaLowError]:
+    """The error to refuse an expensive fetch with, if the resource's last seen quota is below the floor."""
+    status = _get_github_client().rate_limits.get(resource)
+    if status is None or status["remaining"] >= GITHUB_RATE_LIMIT_FLOOR or status["reset"] <= time.time():
+        return None
+    return QuotaLowError(resource, status["remaining"], status["reset"])
+
+
+class RetryTransport(httpx.AsyncBaseTransport):
+    """
+    HTTP transport that retries GET/HEAD requests on 5xx responses and network errors.
+    
+    Delays grow exponentially from base_delay up to max_delay, with full
+    jitter so concurrent fetches do not retry in lockstep. Other methods are
+    sent once; a transient failure raises RetryableError. Waiting uses
+    asyncio.sleep, so a cancelled tool call stops immediately.
+    """
+    
+    def __init__(
+        self,
+        transport: httpx.AsyncBaseTransport,
+        max_attempts: int = GITHUB_RETRY_MAX_ATTEMPTS,
+        base_delay: float = 0.5,
+        max_delay: float = 8.0,
+        sleep: Callable[[float], Any] = asyncio.sleep,
+        jitter: Callable[[], float] = random.random
+    ):
+        """
+        Args:
+            transport (httpx.AsyncBaseTransport): Transport that sends the requests
+            max_attempts (int): Attempts per request, including the first
+            base_delay (float): Upper bound of the first retry delay, in seconds
+            max_delay (float): Upper bound of any retry delay, in seconds
+            sleep (Callable[[float], Any]): Coroutine function used to wait
+            jitter (Callable[[], float]): Source of fractions in [0, 1)
+        """
+        self.transport = transport
+        self.max_attempts = max_attempts
+        self.base_delay = base_delay
+        self.max_delay = max_delay
+        self._sleep = sleep
+        self._jitter = jitter
+    
+    def _delay(self, attempt: int) -> float:
+        return self._jitter() * min(self.max_delay, self.base_delay * 2 ** attempt)
+    
+    async def handle_async_request(self, request: httpx.Request) -> httpx.Response:
+        idempotent = request.method in IDEMPOTENT_METHODS
+        attempt = 0
+        while True:
+            try:
+                response = await self.transport.handle_async_request(request)
+            except httpx.TransportError as e:
+                if not idempotent:
+                    raise RetryableError(request, cause=e) from e
+                if attempt + 1 >= self.max_attempts:
+                    raise
+                failure = f"{type(e).__name__}: {e}"
+            else:
+                if response.status_code not in RETRYABLE_STATUS_CODES:
+                    return response
+                if not idempotent:
+                    await response.aclose()
+                    raise RetryableError(request, status_code=response.status_code)
+                if attempt + 1 >= self.max_attempts:
+                    return response
+                failure = f"status {response.status_code}"
+                await response.aclose()
+            
+            delay = self._delay(attempt)
+            attempt += 1
+            logger.warning(
+                "GitHub %s %s failed with %s; retry %d of %d in %.1fs",
+                request.method, request.url.path, failure, attempt, self.max_attempts - 1, delay
+            )
+            await self._sleep(delay)
+    
+    async def aclose(self) -> None:
+        await self.transport.aclose()
+
+
+@dataclass
+class CachedResponse:
+    """A GET response stored for revalidation with If-None-Match."""
+    etag: str
+    status_code: int
+    headers: List[Tuple[str, str]]
+    content: bytes
+
+
+class ResponseCache:
+    """
+    Storage interface for the conditional request cache.
+    
+    Keys are (URL, Accept header) pairs. Implementations may persist entries
+    anywhere; the default keeps them in memory for the life of the process.
+    """
+    
+    def get(self, key: Tuple[str, str]) -> Optional[CachedResponse]:
+        raise NotImplementedError
+    
+    def set(self, key: Tuple[str, str], entry: CachedResponse) -> None:
+        raise NotImplementedError
+    
+    def invalidate(self, predicate: Callable[[Tuple[str, str]], bool]) -> int:
+        """Remove every entry whose key matches; return how many were removed."""
+        raise NotImplementedError
+
+
+class InMemoryResponseCache(ResponseCache):
+    """Least-recently-used in-memory ResponseCache."""
+    
+    def __init__(self, max_entries: int = 1024):
+        self.max_entries = max_entries
+        self._entries: "OrderedDict[Tuple[str, str], CachedResponse]" = OrderedDict()
+    
+    def get(self, key: Tuple[str, str]) -> Optional[CachedResponse]:
+        entry = self._entries.get(key)
+        if entry is not None:
+            self._entries.move_to_end(key)
+        return entry
+    
+    def set(self, key: Tuple[str, str], entry: CachedResponse) -> None:
+        self._entries[key] = entry
+        self._entries.move_to_end(key)
+        while len(self._entries) > self.max_entries:
+            self._entries.popitem(last=False)
+    
+    def invalidate(self, predicate: Callable[[Tuple[str, str]], bool]) -> int:
+        stale = [key for key in self._entries if predicate(key)]
+        for key in stale:
+            del self._entries[key]
+        return len(stale)
+
+
+_COMMIT_SHA = re.compile(r"^(?:[0-9a-f]{40}|[0-9a-f]{64})$")
+
+
+class BlobCache:
+    """
+    Byte-bounded LRU cache of file contents keyed by git blob SHA.
+    
+    Blob contents never change, so entries are served without revalidation.
+    Files looked up at a commit SHA also remember which blob the path held,
+    so asking again for the same file at the same commit needs no request at
+    all. Blobs over max_entry_bytes are not kept.
+    """
+    
+    # Path-to-blob entries are small; this only stops the index growing forever
+    MAX_PATHS = 100_000
+    
+    def __init__(self, max_bytes: int = BLOB_CACHE_MAX_BYTES, max_entry_bytes: int = BLOB_CACHE_MAX_ENTRY_BYTES):
+        self.max_bytes = max_bytes
+        self.max_entry_bytes = max_entry_bytes
+        self.size = 0
+        self._blobs: "OrderedDict[str, bytes]" = OrderedDict()
+        self._paths: "OrderedDict[Tuple[str, str, str, str], str]" = OrderedDict()
+    
+    def get(self, sha: str) -> Optional[bytes]:
+        content = self._blobs.get(sha)
+        METRICS.inc("github_pr_mcp_blob_cache_lookups_total", {"result": "miss" if content is None else "hit"})
+        if content is not None:
+            self._blobs.move_to_end(sha)
+        return content
+    
+    def put(self, sha: str, content: bytes) -> None:
+        if len(content) > self.max_entry_bytes or sha in self._blobs:
+            return
+        self._blobs[sha] = content
+        self.size += len(content)
+        while self.size > self.max_bytes:
+            _, evicted = self._blobs.popitem(last=False)
+            self.size -= len(evicted)
+        METRICS.set("github_pr_mcp_blob_cache_bytes", None, self.size)
+    
+    def blob_at(self, owner: str, repo: str, commit: str, path: str) -> Optional[str]:
+        """The blob SHA a path was found to hold at a commit, if it has been fetched before."""
+        return self._paths.get((owner, repo, commit, path))
+    
+    def remember_path(self, owner: str, repo: str, commit: str, path: str, sha: str) -> None:
+        if not _COMMIT_SHA.match(commit):
+            # Branch names and tags move, so only commit SHAs pin a path to a blob
+            return
+        self._paths[(owner, repo, commit, path)] = sha
+        while len(self._paths) > self.MAX_PATHS:
+            self._paths.popitem(last=False)
+
+
+class ETagCacheTransport(httpx.AsyncBaseTransport):
+    """
+    HTTP transport that revalidates cached GET responses with If-None-Match.
+    
+    A 304 Not Modified is answered from the cache as the original 200
+    response, so callers never see the difference, and GitHub does not
+    count 304s against the rate limit.
+    """
+    
+    def __init__(self, transport: httpx.AsyncBaseTransport, cache: ResponseCache):
+        self.transport = transport
+        self.cache = cache
+    
+    async def handle_async_request(self, request: httpx.Request) -> httpx.Response:
+        if request.method != "GET":
+            return await self.transport.handle_async_request(request)
+        
+        key = (str(request.url), request.headers.get("accept", ""))
+        cached = self.cache.get(key)
+        if cached is not None:
+            request.headers["If-None-Match"] = cached.etag
+        
+        response = await self.transport.handle_async_request(request)
+        if response.status_code == 304 and cached is not None:
+            await response.aclose()
+            fresh = httpx.Response(
+                cached.status_code, headers=cached.headers, content=cached.content, request=request
+            )
+            fresh.extensions["from_cache"] = True
+            return fresh
+        
+        etag = response.headers.get("etag")
+        if response.status_code == 200 and etag:
+            content = await response.aread()
+            self.cache.set(key, CachedResponse(etag, 200, list(response.headers.items()), content))
+        return response
+    
+    async def aclose(self) -> None:
+        await self.transport.aclose()
+
+
+def _normalize_base_url(url: Optional[str], default: str, enterprise_suffix: str) -> str:
+    """
+    Normalize a GitHub API or upload base URL.
+    
+    Trailing slashes are removed, and GitHub Enterprise Server instance URLs
+    get the path their REST endpoints live under (e.g. "/api/v3").
+    
+    Args:
+        url (Optional[str]): Configured URL, or None/empty for github.com
+        default (str): github.com URL to use when nothing is configured
+        enterprise_suffix (str): Path appended to Enterprise Server hosts
+    
+    Returns:
+        str: Base URL without a trailing slash
+    """
+    if not url:
+        return default
+    url = url.rstrip("/")
+    parts = urlsplit(url)
+    if parts.hostname in ("api.github.com", "uploads.github.com"):
+        return url
+    if not parts.path.endswith(enterprise_suffix):
+        url += enterprise_suffix
+    return url
+
+
+class GitHubClient:
+    """
+    Authenticated access to the GitHub REST API.
+    
+    The auth mode is chosen from the supplied options: a GitHub App
+    installation when an App ID, installation ID and private key are given,
+    otherwise a token source (a plain string is a static personal access
+    token). A request rejected with a 401 is retried once with a freshly
+    fetched token.
+    """
+    
+    def __init__(
+        self,
+        token: Optional[Union[str, TokenSource]] = None,
+        app_id: Optional[str] = None,
+        installation_id: Optional[str] = None,
+        private_key: Optional[Union[str, bytes]] = None,
+        base_url: Optional[str] = None,
+        upload_url: Optional[str] = None,
+        transport: Optional[httpx.AsyncBaseTransport] = None,
+        rate_limit_max_wait: float = GITHUB_RATE_LIMIT_MAX_WAIT,
+        cache: Optional[ResponseCache] = None,
+        clock: Callable[[], float] = time.time,
+        blob_cache: Optional[BlobCache] = None,
+        retry_max_attempts: int = GITHUB_RETRY_MAX_ATTEMPTS,
+        request_timeout: Optional[float] = None,
+        transport_options: Optional[TransportOptions] = None,
+        bulk_fetch: str = GITHUB_BULK_FETCH,
+        account: str = DEFAULT_ACCOUNT
+    ):
+        """
+        Args:
+            token (Optional[Union[str, TokenSource]]): Personal access token, or
+                a source fetching one per request
+            app_id (Optional[str]): GitHub App ID
+            installation_id (Optional[str]): GitHub App installation ID
+            private_key (Optional[Union[str, bytes]]): App private key PEM or path
+            base_url (Optional[str]): API base URL; a GitHub Enterprise Server
+                instance URL gets "/api/v3" appended
+            upload_url (Optional[str]): Upload base URL; defaults to the
+                instance's "/api/uploads" on Enterprise Server
+            transport (Optional[httpx.AsyncBaseTransport]): Custom HTTP transport (used by tests)
+            rate_limit_max_wait (float): Maximum seconds to wait out rate limits per request
+            cache (Optional[ResponseCache]): Conditional request cache (in-memory by default)
+            clock (Callable[[], float]): Source of the current UNIX time
+            blob_cache (Optional[BlobCache]): File contents by blob SHA (in-memory by default)
+            retry_max_attempts (int): Attempts for GET/HEAD requests that fail transiently
+            request_timeout (Optional[float]): Seconds one request may take
+                (default GITHUB_REQUEST_TIMEOUT)
+            transport_options (Optional[TransportOptions]): Proxy and TLS
+                settings (default from the environment)
+            bulk_fetch (str): "graphql" or "rest", the API gathering PR
+                snapshots (see _fetch_pr_snapshot)
+            account (str): Metrics label of these credentials, the owner of a
+                GITHUB_ACCOUNTS entry
+        """
+        if bulk_fetch not in ("graphql", "rest"):
+            raise ValueError(f'bulk_fetch must be "graphql" or "rest", not "{bulk_fetch}"')
+        app_options = [app_id, installation_id, private_key]
+        if any(app_options) and not all(app_options):
+            raise ValueError(
+                "GitHub App authentication requires an App ID, installation ID and private key"
+            )
+        
+        self.token_source = token if isinstance(token, TokenSource) else StaticTokenSource(token or "")
+        self._cached_token: Optional[str] = None
+        self._cached_token_expires_at = 0.0
+        self._token_lock = asyncio.Lock()
+        self.app_auth = GitHubAppAuth(app_id, installation_id, private_key, clock) if all(app_options) else None
+        self.api_base = _normalize_base_url(base_url, GITHUB_API_BASE, "/api/v3")
+        if upload_url is None and base_url and self.api_base != GITHUB_API_BASE:
+            # Enterprise Server serves uploads from the same host
+            upload_url = self.api_base[:-len("/api/v3")] if self.api_base.endswith("/api/v3") else self.api_base
+        self.upload_base = _normalize_base_url(upload_url, GITHUB_UPLOAD_BASE, "/api/uploads")
+        self.transport = transport
+        self.transport_options = transport_options or TransportOptions.from_env()
+        self.rate_limit_max_wait = rate_limit_max_wait
+        self.bulk_fetch = bulk_fetch
+        self.account = account
+        self.retry_max_attempts = retry_max_attempts
+        self.request_timeout = request_timeout or GITHUB_REQUEST_TIMEOUT
+        self.cache = cache if cache is not None else InMemoryResponseCache()
+        self.blobs = blob_cache if blob_cache is not None else BlobCache()
+        self._pr_heads: Dict[str, str] = {}
+        self._login: Optional[str] = None
+        # What these credentials may do per "owner/repo", see _repo_permissions
+        self.repo_permissions: Dict[str, "RepoPermissions"] = {}
+        # Rules of the .gitattributes file per (owner/repo, commit, directory), [] where there is none
+        self.gitattributes: Dict[Tuple[str, str, str], List["GitAttributeRule"]] = {}
+        self._clock = clock
+        self._rate_limit_pause = RateLimitPause()
+        self._search_rate_limit_pause = RateLimitPause()
+        # Latest limit, remaining and reset (UNIX time) seen per rate limit resource
+        self.rate_limits: Dict[str, Dict[str, int]] = {}
+    
+    @property
+    def graphql_url(self) -> str:
+        """GraphQL endpoint; Enterprise Server serves it at /api/graphql."""
+        if self.api_base.endswith("/api/v3"):
+            return self.api_base[:-len("/v3")] + "/graphql"
+        return f"{self.api_base}/graphql"
+    
+    @property
+    def auth_mode(self) -> str:
+        """Return "app" or "token" depending on the configured credentials."""
+        return "app" if self.app_auth else "token"
+    
+    def http_client(self, cached: bool = True) -> httpx.AsyncClient:
+        """
+        Create an HTTP client for a single request/response exchange.
+        
+        Args:
+            cached (bool): Revalidate GET responses through the ETag cache;
+                streamed bodies skip it, since caching them means reading them whole
+        """
+        transport = RateLimitTransport(
+            RetryTransport(
+                # Innermost, so retries and revalidations count as the requests they are
+                MetricsTransport(
+                    self.transport or _outbound_transport(self.api_base, self.transport_options),
+                    self.rate_limits,
+                    self.account
+                ),
+                max_attempts=self.retry_max_attempts
+            ),
+            max_wait=self.rate_limit_max_wait,
+            clock=self._clock,
+            pause=self._rate_limit_pause,
+            search_pause=self._search_rate_limit_pause
+        )
+        if cached:
+            transport = ETagCacheTransport(transport, self.cache)
+        # Enable follow_redirects to handle GitHub API redirection behaviors
+        return httpx.AsyncClient(timeout=self.request_timeout, follow_redirects=True, transport=transport)
+    
+    def track_pr_head(self, owner: str, repo: str, pr_number: int, head_sha: str) -> bool:
+        """
+        Record a PR's head SHA, dropping cached PR sub-resources when it moves.
+        
+        Args:
+            owner (str): Repository owner
+            repo (str): Repository name
+            pr_number (int): Pull request number
+            head_sha (str): Head commit SHA from the PR metadata just fetched
+        
+        Returns:
+            bool: True if the head moved since it was last recorded
+        """
+        pr_url = f"{self.api_base}/repos/{owner}/{repo}/pulls/{pr_number}"
+        previous = self._pr_heads.get(pr_url)
+        self._pr_heads[pr_url] = head_sha
+        if previous is None or previous == head_sha:
+            return False
+        
+        def stale(key: Tuple[str, str]) -> bool:
+            url, accept = key
+            if url == pr_url or url.startswith(pr_url + "?"):
+                # Keep the PR metadata that reported the new head
+                return accept != "application/vnd.github+json"
+            return url.startswith(pr_url + "/")
+        
+        self.cache.invalidate(stale)
+        return True
+    
+    async def authenticated_login(self) -> str:
+        """
+        Return the login the client acts as.
+        
+        For a GitHub App this is the App's bot account ("<slug>[bot]"), which
+        is what reviews and comments posted with installation tokens show.
+        """
+        if self._login is None:
+            if self.app_auth:
+                async with self.http_client() as http:
+                    response = await http.get(f"{self.api_base}/app", headers={
+                        "Authorization": f"Bearer {self.app_auth.app_jwt()}",
+                        "Accept": "application/vnd.github+json",
+                        "X-GitHub-Api-Version": "2022-11-28"
+                    })
+                    response.raise_for_status()
+                    self._login = f"{response.json()['slug']}[bot]"
+            else:
+                self._login = (await self.response("GET", "/user")).json()["login"]
+        return self._login
+    
+    async def installation_permissions(self) -> Optional[Dict[str, str]]:
+        """
+        Return the permission levels of the App installation the client acts for.
+        
+        GitHub reports them with each installation token, so this may
+        exchange one. None for token credentials, and for Enterprise Server
+        versions that leave the list out.
+        """
+        if not self.app_auth:
+            return None
+        async with self.http_client() as http:
+            await self.app_auth.token(http, self.api_base)
+        return self.app_auth.permissions
+    
+    async def _token(self, http: httpx.AsyncClient) -> str:
+        if self.app_auth:
+            return await self.app_auth.token(http, self.api_base)
+        async with self._token_lock:
+            if self._cached_token and self._cached_token_expires_at - self._clock() > TOKEN_SOURCE_REFRESH_MARGIN:
+                return self._cached_token
+            token, expires_at = await self.token_source.token()
+            self._cached_token = token if expires_at is not None else None
+            self._cached_token_expires_at = expires_at or 0.0
+            return token
+    
+    def _invalidate_token(self, token: str) -> None:
+        """Drop a rejected token so the next request fetches a fresh one."""
+        if self.app_auth:
+            self.app_auth.invalidate(token)
+        elif self._cached_token == token:
+            self._cached_token = None
+    
+    async def response(
+        self,
+        method: str,
+        endpoint: str,
+        data: Optional[Dict] = None,
+        params: Optional[Dict[str, Any]] = None,
+        headers: Optional[Dict[str, str]] = None
+    ) -> httpx.Response:
+        """
+        Make an authenticated request and return the successful raw response.
+        
+        Args:
+            method (str): HTTP method
+            endpoint (str): API path (e.g. "/repos/o/r/pulls/1") or an absolute URL
+            data (Optional[Dict]): JSON body for non-GET requests
+            params (Optional[Dict[str, Any]]): Query string parameters
+            headers (Optional[Dict[str, str]]): Extra headers, e.g. a different
+                Accept media type
+        
+        Returns:
+            httpx.Response: The successful response
+        """
+        url = endpoint if endpoint.startswith(("http://", "https://")) else f"{self.api_base}{endpoint}"
+        
+        method = method.upper()
+        if method not in ("GET", "POST", "PUT", "PATCH", "DELETE"):
+            raise ValueError(f"Unsupported HTTP method: {method}")
+        
+        async with self.http_client() as client:
+            for attempt in range(2):
+                token = await self._token(client)
+                request_headers = {
+                    "Authorization": f"Bearer {token}",
+                    "Accept": "application/vnd.github+json",
+                    "X-GitHub-Api-Version": "2022-11-28"
+                }
+                request_headers.update(headers or {})
+                response = await client.request(
+                    method, url, headers=request_headers, params=params,
+                    json=data if method != "GET" else None
+                )
+                if response.status_code != 401 or attempt:
+                    break
+                # The token may have expired or been revoked early; a 401 means
+                # the request was not processed, so retrying cannot duplicate it
+                logger.info("GitHub rejected the token; retrying with a fresh one")
+                self._invalidate_token(token)
+            
+            response.raise_for_status()
+            return response
+    
+    async def stream(self, endpoint: str, headers: Optional[Dict[str, str]] = None) -> AsyncIterator[bytes]:
+        """
+        Make an authenticated GET request and yield the body as it arrives.
+        
+        Unlike response(), the body is never held whole, and the ETag cache
+        is bypassed. Closing the generator early closes the connection.
+        
+        Args:
+            endpoint (str): API path or an absolute URL
+            headers (Optional[Dict[str, str]]): Extra headers, e.g. a different
+                Accept media type
+        
+        Yields:
+            bytes: The next piece of the body, in whatever sizes the network delivers
+        """
+        url = endpoint if endpoint.startswith(("http://", "https://")) else f"{self.api_base}{endpoint}"
+        
+        async with self.http_client(cached=False) as client:
+            for attempt in range(2):
+                token = await self._token(client)
+                request_headers = {
+                    "Authorization": f"Bearer {token}",
+                    "Accept": "application/vnd.github+json",
+                    "X-GitHub-Api-Version": "2022-11-28"
+                }
+                request_headers.update(headers or {})
+                response = await client.send(client.build_request("GET", url, headers=request_headers), stream=True)
+                if response.status_code != 401 or attempt:
+                    break
+                await response.aclose()
+                logger.info("GitHub rejected the token; retrying with a fresh one")
+                self._invalidate_token(token)
+            
+            try:
+                if response.is_error:
+                    await response.aread()
+                    response.raise_for_status()
+                async for piece in response.aiter_bytes():
+                    yield piece
+            finally:
+                await response.aclose()
+
+
+class GitHubAccount(BaseModel):
+    """
+    Credentials for one owner in GITHUB_ACCOUNTS.
+    
+    The auth modes match the environment configuration: GitHub App
+    credentials, or one of a token, an environment variable holding one
+    (read on every request), or a token command.
+    """
+    model_config = ConfigDict(str_strip_whitespace=True, extra='forbid')
+    
+    token: Optional[str] = Field(default=None, description="Personal access token")
+    token_env: Optional[str] = Field(default=None, description="Environment variable holding the token")
+    token_command: Optional[str] = Field(default=None, description="Command printing a token, as GITHUB_TOKEN_COMMAND")
+    app_id: Optional[str] = Field(default=None, description="GitHub App ID")
+    installation_id: Optional[str] = Field(default=None, description="Installation ID of the App on this owner")
+    private_key: Optional[str] = Field(default=None, description="App private key PEM or path")
+    
+    @field_validator("app_id", "installation_id", mode="before")
+    @classmethod
+    def id_as_text(cls, value: Any) -> Any:
+        # YAML reads unquoted IDs as numbers
+        return str(value) if isinstance(value, int) else value
+    
+    @model_validator(mode="after")
+    def one_auth_mode(self) -> "GitHubAccount":
+        tokens = [name for name in ("token", "token_env", "token_command") if getattr(self, name)]
+        if len(tokens) > 1:
+            raise ValueError(f"set only one of {', '.join(tokens)}")
+        if not tokens and not self.app_id:
+            raise ValueError("needs a token, token_env, token_command or App credentials")
+        return self
+    
+    def client(self, owner: str) -> GitHubClient:
+        if self.token_command:
+            token: Optional[Union[str, TokenSource]] = CommandTokenSource(self.token_command)
+        elif self.token_env:
+            token = EnvTokenSource(self.token_env)
+        else:
+            token = self.token
+        return GitHubClient(
+            token=token,
+            app_id=self.app_id,
+            installation_id=self.installation_id,
+            private_key=self.private_key,
+            base_url=GITHUB_API_URL or None,
+            upload_url=GITHUB_UPLOAD_URL or None,
+            account=owner
+        )
+
+
+class UnknownAccountError(ValueError):
+    """A call for an owner without credentials while GITHUB_ACCOUNTS is set."""
+    
+    def __init__(self, owner: str, configured: List[str]):
+        self.owner = owner
+        self.configured = configured
+        super().__init__(
+            f"No GitHub credentials are configured for {owner}; "
+            f"GITHUB_ACCOUNTS has {', '.join(configured)}"
+        )
+    
+    def response(self) -> str:
+        """The tool result reporting the refusal."""
+        return json.dumps({
+            "error": str(self),
+            "error_code": "unknown_account",
+            "owner": self.owner,
+            "configured_owners": self.configured,
+            "success": False
+        })
+
+
+def _parse_github_accounts(value: str) -> Dict[str, GitHubAccount]:
+    """
+    Parse GITHUB_ACCOUNTS: inline JSON, or the path of a YAML or JSON file.
+    
+    Owners are matched case-insensitively, as GitHub logins are.
+    """
+    text = value
+    if not value.lstrip().startswith("{"):
+        try:
+            with open(os.path.expanduser(value), encoding="utf-8") as f:
+                text = f.read()
+        except OSError as e:
+            raise ValueError(f"cannot read {value}: {e.strerror}") from e
+    try:
+        data = yaml.safe_load(text)
+    except yaml.YAMLError as e:
+        raise ValueError(f"not valid YAML or JSON: {e}") from e
+    if not isinstance(data, dict) or not data:
+        raise ValueError("must map each owner to its credentials")
+    accounts = {}
+    for owner, entry in data.items():
+        try:
+            accounts[str(owner).lower()] = GitHubAccount.model_validate(entry or {})
+        except ValidationError as e:
+            problems = "; ".join(error["msg"].removeprefix("Value error, ") for error in e.errors())
+            raise ValueError(f"{owner}: {problems}") from e
+    return accounts
+
+
+# Owner whose credentials serve the tool call or queued review being handled
+_call_account: "contextvars.ContextVar[Optional[str]]" = contextvars.ContextVar("call_account", default=None)
+
+_github_client: Optional[GitHubClient] = None
+_github_accounts_config: Optional[Dict[str, GitHubAccount]] = None
+# One client per GITHUB_ACCOUNTS owner, each with its own rate limit state and caches
+_account_clients: Dict[str, GitHubClient] = {}
+# GitHubClient options replacing the configured credentials and endpoints, see github_transport
+_injected_client_options: Optional[Dict[str, Any]] = None
+
+
+@contextmanager
+def github_transport(
+    transport: httpx.AsyncBaseTransport, api_url: Optional[str] = None, token: str = "test-token"
+) -> Iterator[None]:
+    """
+    Send every GitHub request the server makes through transport.
+    
+    While the block runs, clients are built afresh with token against
+    api_url, the shared client and GITHUB_ACCOUNTS clients alike, whatever
+    credentials and GITHUB_API_URL are configured. So a fake GitHub, such
+    as the test suite's, can serve whole tool calls. The clients from before
+    are restored on exit.
+    
+    Args:
+        transport (httpx.AsyncBaseTransport): Transport answering the requests
+        api_url (Optional[str]): API base URL (default github.com's); others
+            are taken for Enterprise Server instances, as with GITHUB_API_URL
+        token (str): Token the clients send
+    """
+    global _github_client, _account_clients, _injected_client_options
+    saved = _github_client, _account_clients, _injected_client_options
+    _github_client, _account_clients = None, {}
+    _injected_client_options = {"token": token, "base_url": api_url, "transport": transport}
+    try:
+        yield
+    finally:
+        _github_client, _account_clients, _injected_client_options = saved
+
+
+def _configured_api_url() -> str:
+    """The API base URL clients are built with: GITHUB_API_URL, unless github_transport replaced it."""
+    if _injected_client_options is not None:
+        return _injected_client_options["base_url"] or ""
+    return GITHUB_API_URL
+
+
+def _github_accounts() -> Dict[str, GitHubAccount]:
+    """The parsed GITHUB_ACCOUNTS entries by lowercased owner; empty when it is not set."""
+    global _github_accounts_config
+    if _github_accounts_config is None:
+        _github_accounts_config = _parse_github_accounts(GITHUB_ACCOUNTS) if GITHUB_ACCOUNTS else {}
+    return _github_accounts_config
+
+
+def _unknown_account(owner: Optional[str]) -> Optional[UnknownAccountError]:
+    """The error for a call on owner, if GITHUB_ACCOUNTS is set and has no entry for it."""
+    accounts = _github_accounts()
+    if not owner or not accounts or owner.lower() in accounts:
+        return None
+    return UnknownAccountError(owner, sorted(accounts))
+
+
+def _existing_github_client() -> Optional[GitHubClient]:
+    """The client serving the current call if it has been created, without creating it."""
+    owner = _call_account.get()
+    if owner and _github_accounts():
+        return _account_clients.get(owner.lower())
+    return _github_client
+
+
+def _get_github_client(owner: Optional[str] = None) -> GitHubClient:
+    """
+    Return the GitHub client for owner, by default the owner of the current call.
+    
+    With GITHUB_ACCOUNTS set, an owner gets the client of its entry, and an
+    owner without one raises UnknownAccountError; calls naming no owner, and
+    every call without GITHUB_ACCOUNTS, share the client configured from the
+    environment.
+    """
+    global _github_client
+    owner = owner or _call_account.get()
+    if owner and _github_accounts():
+        error = _unknown_account(owner)
+        if error is not None:
+            raise error
+        key = owner.lower()
+        if key not in _account_clients and _injected_client_options is not None:
+            _account_clients[key] = GitHubClient(account=key, **_injected_client_options)
+        elif key not in _account_clients:
+            _account_clients[key] = _github_accounts()[key].client(key)
+        return _account_clients[key]
+    if _github_client is None and _injected_client_options is not None:
+        _github_client = GitHubClient(**_injected_client_options)
+    elif _github_client is None:
+        if GITHUB_TOKEN_COMMAND:
+            token_source: TokenSource = CommandTokenSource(GITHUB_TOKEN_COMMAND)
+        elif not GITHUB_TOKEN and _get_device_flow():
+            token_source = _get_device_flow()
+        else:
+            token_source = EnvTokenSource("GITHUB_TOKEN")
+        _github_client = GitHubClient(
+            token=token_source,
+            app_id=GITHUB_APP_ID or None,
+            installation_id=GITHUB_APP_INSTALLATION_ID or None,
+            private_key=GITHUB_APP_PRIVATE_KEY or None,
+            base_url=GITHUB_API_URL or None,
+            upload_url=GITHUB_UPLOAD_URL or None
+        )
+    return _github_client
+
+
+# ============================================================================
+# Token Permissions
+# ============================================================================
+
+# Permissions the review tools use, with the level they need
+REVIEW_PERMISSIONS: Tuple[Tuple[str, str], ...] = (
+    ("contents", "read"),
+    ("pull_requests", "write"),
+    ("checks", "read"),
+    ("statuses", "write"),
+)
+PERMISSION_LEVELS = {"none": 0, "read": 1, "write": 2, "admin": 3}
+# Seconds the permissions found for a repository are reused before they are checked again
+PERMISSIONS_CACHE_TTL = 600.0
+# Commit SHA the statuses write probe posts to; the empty body is rejected before it is looked up
+PROBE_SHA = "0" * 40
+
+
+@dataclass
+class RepoPermissions:
+    """
+    The level of each REVIEW_PERMISSIONS permission the credentials have in a repository.
+    
+    source says how they were found: "installation" (the App installation's
+    permission list), "token_scopes" (a classic token's OAuth scopes with the
+    user's role on the repository) or "probe" (cheap requests, for
+    fine-grained tokens). A permission missing from levels could not be
+    determined and counts as granted, so an inconclusive check never blocks
+    a call GitHub would allow; unchecked lists those left out on purpose,
+    such as the write probes skipped in read-only mode.
+    """
+    owner: str
+    repo: str
+    source: str
+    levels: Dict[str, str]
+    unchecked: Tuple[str, ...] = ()
+    checked_at: float = field(default_factory=time.monotonic)
+    
+    def grants(self, permission: str, level: str) -> bool:
+        granted = self.levels.get(permission)
+        return granted is None or PERMISSION_LEVELS.get(granted, 0) >= PERMISSION_LEVELS[level]
+    
+    def missing(self) -> List[str]:
+        """The REVIEW_PERMISSIONS not granted, as "permission:level"."""
+        return [f"{name}:{level}" for name, level in REVIEW_PERMISSIONS if not self.grants(name, level)]
+
+
+class MissingPermissionError(Exception):
+    """A write tool called with credentials that lack the permission its requests need on the repository."""
+    
+    def __init__(self, owner: str, repo: str, permission: str, level: str, granted: str, source: str):
+        self.owner = owner
+        self.repo = repo
+        self.permission = permission
+        self.level = level
+        self.granted = granted
+        self.source = source
+        super().__init__(
+            f"The GitHub credentials have {granted} access to {permission} on {owner}/{repo}, "
+            f"and this tool needs {level}; grant {permission}:{level} or run it with dry_run"
+        )
+    
+    def response(self) -> str:
+        """The tool result reporting the refusal."""
+        return json.dumps({
+            "error": str(self),
+            "error_code": "missing_permission",
+            "owner": self.owner,
+            "repo": self.repo,
+            "permission": self.permission,
+            "required_level": self.level,
+            "granted_level": self.granted,
+            "source": self.source,
+            "success": False
+        })
+
+
+def _capped_level(level: str, ceiling: str) -> str:
+    """The lower of two permission levels."""
+    return min(level, ceiling, key=lambda name: PERMISSION_LEVELS.get(name, 0))
+
+
+async def _probe_granted(
+    client: GitHubClient,
+    method: str,
+    endpoint: str,
+    data: Optional[Dict[str, Any]] = None,
+    params: Optional[Dict[str, Any]] = None
+) -> bool:
+    """
+    Whether the credentials may make a request, judged by how GitHub answers it.
+    
+    Only a 403, or a 404 to a GET, means no: write probes send bodies GitHub
+    rejects with a 422 once the permission check has passed, so they never
+    create anything.
+    """
+    try:
+        await client.response(method, endpoint, data, params)
+    except httpx.HTTPStatusError as e:
+        status = e.response.status_code
+        return not (status == 403 or (status == 404 and method == "GET"))
+    return True
+
+
+async def _probe_permissions(client: GitHubClient, owner: str, repo: str) -> RepoPermissions:
+    """Find the credentials' REVIEW_PERMISSIONS levels on a repository; see RepoPermissions for how."""
+    base = f"/repos/{owner}/{repo}"
+    try:
+        response = await client.response("GET", base)
+    except httpx.HTTPStatusError as e:
+        if e.response.status_code not in (403, 404):
+            raise
+        # The repository is not visible to these credentials at all
+        return RepoPermissions(owner, repo, "probe", {name: "none" for name, _ in REVIEW_PERMISSIONS})
+    metadata = response.json()
+    installation = await client.installation_permissions()
+    if installation is not None:
+        levels = {name: installation.get(name, "none") for name, _ in REVIEW_PERMISSIONS}
+        return RepoPermissions(owner, repo, "installation", levels)
+    
+    # The user's role caps what any token of theirs can do; without one, assume nothing is capped.
+    # Anyone may review a public repository, so there it does not cap pull_requests.
+    role = metadata.get("permissions")
+    ceiling = "write" if not role or role.get("push") else "read" if role.get("pull") else "none"
+    public = not metadata.get("private")
+    
+    def cap(levels: Dict[str, str]) -> Dict[str, str]:
+        return {
+            name: level if public and name == "pull_requests" else _capped_level(level, ceiling)
+            for name, level in levels.items()
+        }
+    
+    scopes = response.headers.get("x-oauth-scopes")
+    if scopes is not None:
+        granted = {scope.strip() for scope in scopes.split(",")}
+        writes = "repo" in granted or ("public_repo" in granted and not metadata.get("private"))
+        levels = {name: "write" if writes else "read" for name, _ in REVIEW_PERMISSIONS}
+        if "repo:status" in granted:
+            levels["statuses"] = "write"
+        return RepoPermissions(owner, repo, "token_scopes", cap(levels))
+    
+    # Fine-grained tokens report no scopes, so each permission is tried
+    ref = metadata.get("default_branch") or "HEAD"
+    levels = {
+        "contents": "read" if await _probe_granted(client, "GET", f"{base}/commits", params={"per_page": 1}) else "none",
+        "checks": "read" if await _probe_granted(
+            client, "GET", f"{base}/commits/{ref}/check-runs", params={"per_page": 1}
+        ) else "none",
+    }
+    # In read-only mode nothing is posted, not even a probe, so the write permissions stay unchecked
+    if GITHUB_READ_ONLY:
+        return RepoPermissions(owner, repo, "probe", cap(levels), ("pull_requests", "statuses"))
+    if await _probe_granted(client, "POST", f"{base}/pulls", {}):
+        levels["pull_requests"] = "write"
+    else:
+        readable = await _probe_granted(client, "GET", f"{base}/pulls", params={"per_page": 1})
+        levels["pull_requests"] = "read" if readable else "none"
+    if await _probe_granted(client, "POST", f"{base}/statuses/{PROBE_SHA}", {}):
+        levels["statuses"] = "write"
+    else:
+        levels["statuses"] = "read" if await _probe_granted(client, "GET", f"{base}/commits/{ref}/status") else "none"
+    return RepoPermissions(owner, repo, "probe", cap(levels))
+
+
+async def _repo_permissions(owner: str, repo: str, refresh: bool = False) -> RepoPermissions:
+    """The credentials' permissions on owner/repo, cached on the client for PERMISSIONS_CACHE_TTL seconds."""
+    client = _get_github_client(owner)
+    key = f"{owner}/{repo}".lower()
+    permissions = client.repo_permissions.get(key)
+    if refresh or permissions is None or time.monotonic() - permissions.checked_at >= PERMISSIONS_CACHE_TTL:
+        permissions = await _probe_permissions(client, owner, repo)
+        client.repo_permissions[key] = permissions
+    return permissions
+
+
+async def _missing_permission(owner: str, repo: str, permission: str, level: str) -> Optional[MissingPermissionError]:
+    """
+    The error to refuse a write with, if the credentials lack permission on owner/repo.
+    
+    A check that itself fails lets the call go ahead; GitHub still has the
+    final say on the request.
+    """
+    try:
+        permissions = await _repo_permissions(owner, repo)
+    except Exception as e:
+        logger.warning("Could not check the permissions on %s/%s: %s", owner, repo, e)
+        return None
+    if permissions.grants(permission, level):
+        return None
+    return MissingPermissionError(
+        owner, repo, permission, level, permissions.levels.get(permission, "none"), permissions.source
+    )
+
+
+# ============================================================================
+# Session State
+# ============================================================================
+
+# Per-client state, keyed by the MCP session so that concurrent HTTP clients
+# reviewing different PRs never see each other's data. Entries disappear with
+# their session.
+_session_states: "weakref.WeakKeyDictionary[Any, Dict[str, Any]]" = weakref.WeakKeyDictionary()
+
+
+class _LocalSession:
+    """Stand-in session for tool calls made without an MCP context."""
+
+
+_LOCAL_SESSION = _LocalSession()
+
+
+def _session_state(ctx: Optional[Context]) -> Dict[str, Any]:
+    """
+    Return the mutable state dictionary belonging to the caller's MCP session.
+    
+    Args:
+        ctx (Optional[Context]): Tool call context; None (direct calls from
+            other tools or tests) maps to a shared process-level state
+    
+    Returns:
+        Dict[str, Any]: State for this session
+    """
+    session = ctx.session if ctx is not None else _LOCAL_SESSION
+    if session not in _session_states:
+        _session_states[session] = {}
+    return _session_states[session]
+
+
+def _record_reviewed_head(ctx: Optional[Context], owner: str, repo: str, pr_number: int, head_sha: Optional[str]) -> None:
+    """Remember which head SHA this session last fetched the diff of, and when its review began."""
+    if head_sha:
+        state = _session_state(ctx)
+        state.setdefault("reviewed_heads", {})[(owner, repo, pr_number)] = head_sha
+        state.setdefault("review_started", {}).setdefault((owner, repo, pr_number), time.monotonic())
+
+
+# ============================================================================
+# Review State
+# ============================================================================
+
+# Seconds a write to the state file waits for another process holding it
+REVIEW_STATE_BUSY_TIMEOUT = 5.0
+
+
+@dataclass
+class ReviewState:
+    """
+    What this server last posted on a PR, kept so later runs need not parse it back out of comments.
+    
+    head_sha is the commit of the last review posted, finding_ids the
+    finding IDs of every inline comment posted, and summary_comment_id the
+    summary comment. None means not known, which sends the lookup back to
+    the markers on the PR. finding_ids is only set once it holds every
+    finding posted, so state started part way never passes for complete.
+    """
+    head_sha: Optional[str] = None
+    finding_ids: Optional[List[str]] = None
+    summary_comment_id: Optional[int] = None
+    
+    @classmethod
+    def from_json(cls, text: str) -> "ReviewState":
+        """Decode a stored state, raising ValueError for anything but a well-formed one."""
+        data = json.loads(text)
+        if not isinstance(data, dict):
+            raise ValueError("not an object")
+        head_sha, finding_ids, comment_id = data.get("head_sha"), data.get("finding_ids"), data.get("summary_comment_id")
+        if head_sha is not None and not isinstance(head_sha, str):
+            raise ValueError("head_sha is not a string")
+        if finding_ids is not None and not (isinstance(finding_ids, list) and all(isinstance(i, str) for i in finding_ids)):
+            raise ValueError("finding_ids is not a list of strings")
+        if comment_id is not None and (not isinstance(comment_id, int) or isinstance(comment_id, bool)):
+            raise ValueError("summary_comment_id is not an integer")
+        return cls(head_sha, finding_ids, comment_id)
+
+
+class ReviewStore:
+    """
+    Storage interface for ReviewState, keyed by (owner, repo, PR number).
+    
+    Owners and repositories arrive lowercased. Implementations must be safe
+    to use from concurrent review tasks and threads; update() is the
+    read-modify-write they go through, so two runs on one PR never lose
+    each other's changes.
+    """
+    
+    def get(self, key: Tuple[str, str, int]) -> Optional[ReviewState]:
+        raise NotImplementedError
+    
+    def put(self, key: Tuple[str, str, int], state: ReviewState) -> None:
+        raise NotImplementedError
+    
+    def update(self, key: Tuple[str, str, int], change: Callable[[ReviewState], ReviewState]) -> ReviewState:
+        """Replace the state of key (empty if there is none) with change(state) atomically, returning it."""
+        raise NotImplementedError
+
+
+class InMemoryReviewStore(ReviewStore):
+    """ReviewStore for the life of the process; the default."""
+    
+    def __init__(self):
+        self._states: Dict[Tuple[str, str, int], ReviewState] = {}
+        self._lock = threading.Lock()
+    
+    def get(self, key: Tuple[str, str, int]) -> Optional[ReviewState]:
+        with self._lock:
+            state = self._states.get(key)
+        # A copy, so a caller changing it does not change the store
+        return replace(state, finding_ids=list(state.finding_ids)) if state and state.finding_ids else state
+    
+    def put(self, key: Tuple[str, str, int], state: ReviewState) -> None:
+        with self._lock:
+            self._states[key] = replace(state)
+    
+    def update(self, key: Tuple[str, str, int], change: Callable[[ReviewState], ReviewState]) -> ReviewState:
+        with self._lock:
+            state = change(self._states.get(key) or ReviewState())
+            self._states[key] = state
+            return state
+
+
+class SQLiteReviewStore(ReviewStore):
+    """
+    ReviewStore in a single SQLite file, so state survives restarts and can be shared by processes.
+    
+    A file that is not a sound database with the expected table is moved
+    aside as <path>.corrupt-<time> and started afresh, at startup or when a
+    query finds it damaged later. A row that cannot be decoded reads as
+    unknown. Either way lookups fall back to the PR's comment markers
+    instead of the server failing.
+    """
+    
+    SCHEMA = (
+        "CREATE TABLE IF NOT EXISTS review_state ("
+        "owner TEXT NOT NULL, repo TEXT NOT NULL, pr_number INTEGER NOT NULL, "
+        "state TEXT NOT NULL, updated_at REAL NOT NULL, PRIMARY KEY (owner, repo, pr_number))"
+    )
+    COLUMNS = ["owner", "repo", "pr_number", "state", "updated_at"]
+    
+    def __init__(self, path: str):
+        self.path = os.path.expanduser(path)
+        self._lock = threading.Lock()
+        directory = os.path.dirname(self.path)
+        if directory:
+            os.makedirs(directory, exist_ok=True)
+        self._db = self._open()
+    
+    def _connect(self) -> sqlite3.Connection:
+        # Autocommit, with explicit transactions around each read-modify-write
+        db = sqlite3.connect(self.path, timeout=REVIEW_STATE_BUSY_TIMEOUT, isolation_level=None, check_same_thread=False)
+        try:
+            check = db.execute("PRAGMA quick_check").fetchone()[0]
+            if check != "ok":
+                raise sqlite3.DatabaseError(check)
+            db.execute(self.SCHEMA)
+            columns = [row[1] for row in db.execute("PRAGMA table_info(review_state)")]
+            if columns != self.COLUMNS:
+                raise sqlite3.DatabaseError(f"review_state has columns {', '.join(columns)}")
+        except sqlite3.DatabaseError:
+            db.close()
+            raise
+        return db
+    
+    def _open(self) -> sqlite3.Connection:
+        try:
+            return self._connect()
+        except sqlite3.DatabaseError as e:
+            # An OperationalError, such as the file being locked or unwritable, says nothing against its contents
+            if isinstance(e, sqlite3.OperationalError) or not os.path.exists(self.path):
+                raise
+            aside = f"{self.path}.corrupt-{int(time.time())}"
+            logger.warning("Review state %s is unreadable (%s); moving it to %s and starting afresh", self.path, e, aside)
+            for suffix in ("", "-wal", "-shm", "-journal"):
+                if os.path.exists(self.path + suffix):
+                    os.replace(self.path + suffix, aside + suffix)
+            return self._connect()
+    
+    def _recover(self, error: sqlite3.DatabaseError) -> None:
+        """Reopen the file after a failed query, rebuilding it if it turns out to be damaged."""
+        if isinstance(error, sqlite3.OperationalError):
+            raise error
+        logger.warning("Review state query on %s failed: %s", self.path, error)
+        self._db.close()
+        self._db = self._open()
+    
+    def _read(self, key: Tuple[str, str, int]) -> Optional[ReviewState]:
+        row = self._db.execute(
+            "SELECT state FROM review_state WHERE owner = ? AND repo = ? AND pr_number = ?", key
+        ).fetchone()
+        if row is None:
+            return None
+        try:
+            return ReviewState.from_json(row[0])
+        except ValueError as e:
+            logger.warning("Ignoring undecodable review state of %s/%s#%d: %s", *key, e)
+            return None
+    
+    def _write(self, key: Tuple[str, str, int], state: ReviewState) -> None:
+        self._db.execute(
+            "INSERT OR REPLACE INTO review_state (owner, repo, pr_number, state, updated_at) VALUES (?, ?, ?, ?, ?)",
+            (*key, json.dumps(asdict(state)), time.time())
+        )
+    
+    def get(self, key: Tuple[str, str, int]) -> Optional[ReviewState]:
+        with self._lock:
+            try:
+                return self._read(key)
+            except sqlite3.DatabaseError as e:
+                self._recover(e)
+                return None
+    
+    def put(self, key: Tuple[str, str, int], state: ReviewState) -> None:
+        self.update(key, lambda _: state)
+    
+    def update(self, key: Tuple[str, str, int], change: Callable[[ReviewState], ReviewState]) -> ReviewState:
+        with self._lock:
+            for attempt in range(2):
+                try:
+                    # IMMEDIATE takes the write lock up front, so another process cannot slip in between
+                    self._db.execute("BEGIN IMMEDIATE")
+                    try:
+                        state = change(self._read(key) or ReviewState())
+                        self._write(key, state)
+                    except BaseException:
+                        self._db.execute("ROLLBACK")
+                        raise
+                    self._db.execute("COMMIT")
+                    return state
+                except sqlite3.DatabaseError as e:
+                    if attempt:
+                        raise
+                    self._recover(e)
+    
+    def close(self) -> None:
+        with self._lock:
+            self._db.close()
+
+
+# Where review state is kept; --state-path swaps in a SQLiteReviewStore
+_review_store: ReviewStore = InMemoryReviewStore()
+
+
+def _review_key(owner: str, repo: str, pr_number: int) -> Tuple[str, str, int]:
+    return owner.lower(), repo.lower(), pr_number
+
+
+def _review_state(owner: str, repo: str, pr_number: int) -> ReviewState:
+    """The stored state of a PR, empty when nothing is known or the store cannot be read."""
+    try:
+        return _review_store.get(_review_key(owner, repo, pr_number)) or ReviewState()
+    except Exception as e:
+        logger.warning("Could not read the review state of %s/%s#%d: %s", owner, repo, pr_number, e)
+        return ReviewState()
+
+
+def _update_review_state(owner: str, repo: str, pr_number: int, change: Callable[[ReviewState], ReviewState]) -> None:
+    """Apply change to a PR's stored state; if the store fails, the next run reads the markers instead."""
+    try:
+        _review_store.update(_review_key(owner, repo, pr_number), change)
+    except Exception as e:
+        logger.warning("Could not save the review state of %s/%s#%d: %s", owner, repo, pr_number, e)
+
+
+def _with_finding_ids(state: ReviewState, finding_ids: Any) -> ReviewState:
+    """state with finding_ids added, if it has a complete list to add them to."""
+    if state.finding_ids is None:
+        return state
+    return replace(state, finding_ids=sorted({*state.finding_ids, *finding_ids}))
+
+
+# ============================================================================
+# Result Pagination
+# ============================================================================
+
+class CursorError(ValueError):
+    """A pagination cursor that is unknown, expired, or from a different listing."""
+
+
+@dataclass
+class _ResultCursor:
+    """Where the next page of a snapshotted result starts."""
+    listing: str
+    snapshot: Dict[str, Any]
+    offset: int
+    expires_at: float
+
+
+def _listing_key(tool: str, params: PaginatedInput) -> str:
+    """Identify a listing by its tool and arguments, ignoring paging, deadline and output format."""
+    ignored = {"cursor", "page_size", "response_format", getattr(type(params), "CALL_DEADLINE_FIELD", None)}
+    args = params.model_dump(mode="json", exclude=ignored - {None})
+    return tool + ":" + json.dumps(args, sort_keys=True)
+
+
+async def _paginate_result(
+    ctx: Optional[Context],
+    tool: str,
+    params: PaginatedInput,
+    build: Callable[[], Any],
+    keys: Tuple[str, ...]
+) -> Dict[str, Any]:
+    """
+    Return one page of a tool result, snapshotting it so later pages stay consistent.
+    
+    Without a cursor, build() computes the full result. The lists under keys
+    (all the same length) are sliced to the page and next_cursor is set when
+    more remain; following pages come from the session's snapshot even if
+    the PR changed meanwhile. Raises CursorError for cursors this session did
+    not issue, that expired, or that belong to another listing.
+    """
+    cursors: Dict[str, _ResultCursor] = _session_state(ctx).setdefault("result_cursors", {})
+    now = time.monotonic()
+    for token in [t for t, c in cursors.items() if c.expires_at <= now]:
+        del cursors[token]
+    
+    listing = _listing_key(tool, params)
+    if params.cursor is None:
+        snapshot, offset = await build(), 0
+    else:
+        entry = cursors.get(params.cursor)
+        if entry is None or entry.listing != listing:
+            raise CursorError(
+                "Unknown or expired cursor; restart the listing without a cursor"
+            )
+        snapshot, offset = entry.snapshot, entry.offset
+    
+    end = offset + params.page_size
+    page = dict(snapshot)
+    for key in keys:
+        page[key] = snapshot[key][offset:end]
+    page["next_cursor"] = None
+    if end < len(snapshot[keys[0]]):
+        page["next_cursor"] = uuid.uuid4().hex
+        cursors[page["next_cursor"]] = _ResultCursor(listing, snapshot, end, now + RESULT_CURSOR_TTL_SECONDS)
+    return page
+
+
+def _cursor_error_response(error: CursorError) -> str:
+    return json.dumps({"error": str(error), "error_code": "invalid_cursor", "success": False})
+
+
+def _next_page_note(page: Dict[str, Any]) -> str:
+    """Markdown footer telling the client how to fetch the next page, if there is one."""
+    if not page["next_cursor"]:
+        return ""
+    return f"\n_More results: call again with cursor `{page['next_cursor']}`._\n"
+
+
+# ============================================================================
+# Helper Functions
+# ============================================================================
+
+def _retryable_error_response(error: RetryableError) -> str:
+    """Tool error for a post that failed transiently; retrying may duplicate it if it did land."""
+    return json.dumps({"error": str(error), "error_code": "retryable", "success": False})
+
+
+def _run_command(
+    cmd: List[str],
+    cwd: Optional[str] = None,
+    input_text: Optional[str] = None,
+    timeout: float = 300,
+    env: Optional[Dict[str, str]] = None
+) -> Dict[str, Any]:
+    """Execute a shell command and return results."""
+    logger.debug("Running %s", shlex.join(cmd))
+    try:
+        result = subprocess.run(
+            cmd,
+            cwd=cwd,
+            input=input_text,
+            capture_output=True,
+            text=True,
+            timeout=timeout,
+            env={**os.environ, **env} if env else None
+        )
+        return {
+            "stdout": result.stdout,
+            "stderr": result.stderr,
+            "returncode": result.returncode,
+            "success": result.returncode == 0
+        }
+    except subprocess.TimeoutExpired:
+        return _command_failure(f"Command timed out after {timeout:g} seconds")
+    except Exception as e:
+        return _command_failure(str(e))
+
+
+def _command_failure(message: str) -> Dict[str, Any]:
+    return {"stdout": "", "stderr": message, "returncode": -1, "success": False}
+
+
+async def _run_command_async(
+    cmd: List[str],
+    cwd: Optional[str] = None,
+    input_text: Optional[str] = None,
+    timeout: float = 300,
+    env: Optional[Dict[str, str]] = None
+) -> Dict[str, Any]:
+    """
+    Execute a command without blocking the event loop; results match _run_command.
+    
+    If the awaiting tool call is cancelled the child process is killed
+    before the cancellation propagates, so nothing keeps running on behalf
+    of a client that has gone away. stdin is never inherited, since in
+    stdio mode it carries the MCP stream.
+    """
+    logger.debug("Running %s", shlex.join(cmd))
+    try:
+        process = await asyncio.create_subprocess_exec(
+            *cmd,
+            cwd=cwd,
+            stdin=subprocess.PIPE if input_text is not None else subprocess.DEVNULL,
+            stdout=subprocess.PIPE,
+            stderr=subprocess.PIPE,
+            env={**os.environ, **env} if env else None
+        )
+    except Exception as e:
+        return _command_failure(str(e))
+    try:
+        stdout, stderr = await asyncio.wait_for(
+            process.communicate(input_text.encode() if input_text is not None else None), timeout
+        )
+    except asyncio.TimeoutError:
+        return _command_failure(f"Command timed out after {timeout:g} seconds")
+    finally:
+        if process.returncode is None:
+            process.kill()
+            await asyncio.shield(process.wait())
+    return {
+        "stdout": stdout.decode("utf-8", errors="replace"),
+        "stderr": stderr.decode("utf-8", errors="replace"),
+        "returncode": process.returncode,
+        "success": process.returncode == 0
+    }
+
+
+async def _map_bounded(
+    fn: Callable[[Any], Any],
+    items: List[Any],
+    limit: Optional[int] = None,
+    progress: Optional[str] = None
+) -> List[Any]:
+    """
+    Await fn(item) for every item with at most limit (default GITHUB_FETCH_CONCURRENCY) running at once.
+    
+    Results are in the order of items. If one call raises, the rest are
+    cancelled and the exception propagates, so fn should turn per-item
+    failures into values itself. With a progress noun ("files"), each
+    completion is reported as "fetched 3/8 files".
+    """
+    semaphore = asyncio.Semaphore(limit or GITHUB_FETCH_CONCURRENCY)
+    completed = 0
+    
+    async def run(item):
+        nonlocal completed
+        async with semaphore:
+            result = await fn(item)
+        if progress:
+            completed += 1
+            await _report_progress(completed, len(items), f"fetched {completed}/{len(items)} {progress}")
+        return result
+    
+    tasks = [asyncio.ensure_future(run(item)) for item in items]
+    try:
+        return await asyncio.gather(*tasks)
+    finally:
+        for task in tasks:
+            task.cancel()
+
+
+def _format_markdown_analysis(results: Dict[str, Any]) -> str:
+    """Format analysis results as markdown."""
+    sections = []
+    
+    if "lint" in results:
+        sections.append("## Linting Results (golangci-lint)\n")
+        if results["lint"]["success"]:
+            sections.append("✅ No linting issues found!\n")
+        else:
+            sections.append(f"❌ Linting issues detected:\n\n```\n{results['lint']['stdout']}\n```\n")
+    
+    if "fmt" in results:
+        sections.append("## Formatting Check (gofmt)\n")
+        if results["fmt"]["success"] and not results["fmt"]["stdout"]:
+            sections.append("✅ Code is properly formatted!\n")
+        else:
+            sections.append(f"⚠️ Formatting issues found:\n\n```\n{results['fmt']['stdout']}\n```\n")
+    
+    if "vet" in results:
+        sections.append("## Go Vet Analysis\n")
+        if results["vet"]["success"]:
+            sections.append("✅ No issues found by go vet!\n")
+        else:
+            sections.append(f"❌ Issues detected:\n\n```\n{results['vet']['stderr']}\n```\n")
+    
+    return "\n".join(sections)
+
+
+def _format_test_results_markdown(result: Dict[str, Any], coverage: bool) -> str:
+    """Format test results as markdown."""
+    sections = ["# Test Results\n"]
+    
+    if result["success"]:
+        sections.append("✅ **All tests passed!**\n")
+    else:
+        sections.append("❌ **Tests failed!**\n")
+    
+    sections.append("## Output\n")
+    sections.append(f"```\n{result['stdout']}\n```\n")
+    
+    if result["stderr"]:
+        sections.append("## Errors\n")
+        sections.append(f"```\n{result['stderr']}\n```\n")
+    
+    if coverage and "coverage" in result:
+        sections.append(f"\n## Coverage\n{result['coverage']}\n")
+    
+    return "\n".join(sections)
+
+
+async def _github_api_response(
+    method: str,
+    endpoint: str,
+    data: Optional[Dict] = None,
+    params: Optional[Dict[str, Any]] = None,
+    headers: Optional[Dict[str, str]] = None
+) -> httpx.Response:
+    """
+    Make authenticated GitHub API request and return the raw response.
+    
+    Args:
+        method (str): HTTP method
+        endpoint (str): API path (e.g. "/repos/o/r/pulls/1") or an absolute URL
+            such as the "next" link of a paginated response
+        data (Optional[Dict]): JSON body for non-GET requests
+        params (Optional[Dict[str, Any]]): Query string parameters
+        headers (Optional[Dict[str, str]]): Extra request headers
+    
+    Returns:
+        httpx.Response: The successful response
+    """
+    return await _get_github_client().response(method, endpoint, data, params, headers)
+
+
+async def _github_api_stream(endpoint: str, headers: Optional[Dict[str, str]] = None) -> AsyncIterator[bytes]:
+    """Stream the body of an authenticated GitHub GET request; see GitHubClient.stream."""
+    async with aclosing(_get_github_client().stream(endpoint, headers)) as pieces:
+        async for piece in pieces:
+            yield piece
+
+
+async def _github_api_request(
+    method: str,
+    endpoint: str,
+    data: Optional[Dict] = None
+) -> Dict[str, Any]:
+    """Make authenticated GitHub API request and return the decoded JSON body."""
+    response = await _github_api_response(method, endpoint, data)
+    # 204 No Content (e.g. deletions) has no body to decode
+    return response.json() if response.content else {}
+
+
+class GitHubGraphQLError(Exception):
+    """Raised when a GraphQL response reports errors."""
+    
+    def __init__(self, errors: List[Dict[str, Any]]):
+        self.errors = errors
+        super().__init__("; ".join(e.get("message", str(e)) for e in errors))
+
+
+async def _github_graphql(query: str, variables: Optional[Dict[str, Any]] = None) -> Dict[str, Any]:
+    """
+    Run a GitHub GraphQL query or mutation.
+    
+    Args:
+        query (str): GraphQL document
+        variables (Optional[Dict[str, Any]]): Query variables
+    
+    Returns:
+        Dict[str, Any]: The response's `data` object
+    """
+    client = _get_github_client()
+    response = await client.response("POST", client.graphql_url, {"query": query, "variables": variables or {}})
+    payload = response.json()
+    if payload.get("errors"):
+        raise GitHubGraphQLError(payload["errors"])
+    return payload["data"]
+
+
+async def _github_api_paginate(
+    endpoint: str,
+    params: Optional[Dict[str, Any]] = None,
+    max_items: Optional[int] = None,
+    items_key: Optional[str] = None
+) -> List[Dict[str, Any]]:
+    """
+    Fetch every page of a GitHub list endpoint by following the Link header.
+    
+    Args:
+        endpoint (str): API path of the list endpoint
+        params (Optional[Dict[str, Any]]): Extra query parameters for the first page
+        max_items (Optional[int]): Stop once this many items have been collected
+        items_key (Optional[str]): Key holding the items when the endpoint wraps
+            them in an object (e.g. "check_runs")
+    
+    Returns:
+        List[Dict[str, Any]]: All items across pages, in API order. If the
+            tool call's deadline passes part way, the pages fetched so far,
+            with the call marked timed out
+    """
+    query = dict(params or {})
+    query.setdefault("per_page", GITHUB_PER_PAGE)
+    deadline = _call_deadline.get()
+    usage = _call_rate_limits.get()
+    if usage is not None:
+        # Better to refuse now than to run out of quota half way through the call
+        refused = _quota_low("core")
+        if refused is not None:
+            usage.refused = refused
+            raise refused
+    
+    items: List[Dict[str, Any]] = []
+    next_url: Optional[str] = endpoint
+    pages, fetched_pages = None, 0
+    noun = endpoint.rstrip("/").rsplit("/", 1)[-1]
+    while next_url:
+        # The "next" link already carries the query string of the original request
+        request = _github_api_response("GET", next_url, params=query if next_url == endpoint else None)
+        if deadline is None or next_url == endpoint:
+            # Without a first page there is nothing to return; the call's own deadline applies
+            response = await request
+        else:
+            try:
+                response = await asyncio.wait_for(request, max(deadline.remaining(), 0))
+            except asyncio.TimeoutError:
+                logger.warning("Deadline reached paginating %s; returning %d items", endpoint, len(items))
+                deadline.timed_out = True
+                return items
+        page = response.json()
+        items.extend(page[items_key] if items_key else page)
+        fetched_pages += 1
+        if pages is None and "last" in response.links:
+            # Only pages before the last carry rel="last"
+            last_page = httpx.URL(response.links["last"]["url"]).params.get("page", "")
+            pages = int(last_page) if last_page.isdigit() else None
+        if pages:
+            await _report_progress(fetched_pages, pages, f"fetched {len(items)} {noun} (page {fetched_pages}/{pages})")
+        if max_items is not None and len(items) >= max_items:
+            return items[:max_items]
+        next_url = response.links.get("next", {}).get("url")
+    return items
+
+
+async def _fetch_pr(owner: str, repo: str, pr_number: int) -> Dict[str, Any]:
+    """Fetch pull request metadata, recording its head SHA for cache invalidation and resource updates."""
+    pr_data = await _github_api_request("GET", f"/repos/{owner}/{repo}/pulls/{pr_number}")
+    head_sha = pr_data.get("head", {}).get("sha")
+    if head_sha and _get_github_client().track_pr_head(owner, repo, pr_number, head_sha):
+        await _notify_pr_resources_updated(owner, repo, pr_number)
+    return pr_data
+
+
+@dataclass
+class PRHead:
+    """
+    A PR's head commit and the repository holding it.
+    
+    For PRs from forks that is the fork, so head contents must be read there
+    while reviews and comments still go to the base repository. owner and
+    repo are None when the fork was deleted after the PR was opened.
+    """
+    sha: str
+    owner: Optional[str]
+    repo: Optional[str]
+    is_fork: bool = False
+    
+    @property
+    def deleted(self) -> bool:
+        return self.owner is None
+
+
+def _pr_head(pr_data: Dict[str, Any], owner: str, repo: str) -> PRHead:
+    """Read the head repository from PR metadata; GitHub reports a deleted fork as repo: null."""
+    head = pr_data["head"]
+    if "repo" in head and head["repo"] is None:
+        return PRHead(sha=head["sha"], owner=None, repo=None, is_fork=True)
+    head_repo = head.get("repo") or {"owner": {"login": owner}, "name": repo}
+    head_owner, head_name = head_repo["owner"]["login"], head_repo["name"]
+    is_fork = (head_owner.lower(), head_name.lower()) != (owner.lower(), repo.lower())
+    return PRHead(sha=head["sha"], owner=head_owner, repo=head_name, is_fork=is_fork)
+
+
+def _head_location(pr_data: Dict[str, Any], owner: str, repo: str) -> Optional[Tuple[str, str]]:
+    """(owner, repo) holding the head commit of a fork PR, or None to use the base repository."""
+    if "head" not in pr_data:
+        return None
+    head = _pr_head(pr_data, owner, repo)
+    return (head.owner, head.repo) if head.is_fork and not head.deleted else None
+
+
+async def _authenticated_login() -> str:
+    """Return the login of the account the server posts as."""
+    return await _get_github_client().authenticated_login()
+
+
+def _github_error_message(error: httpx.HTTPStatusError) -> str:
+    """Extract GitHub's error message from a failed response."""
+    try:
+        return error.response.json().get("message", str(error))
+    except ValueError:
+        return str(error)
+
+
+async def _validate_team_slugs(pr_data: Dict[str, Any], teams: List[str]) -> List[str]:
+    """
+    Check that each team belongs to the PR repository's organization.
+    
+    Accepts 'slug' or 'org/slug' and returns bare slugs, raising ValueError
+    for teams outside the organization or that do not exist.
+    """
+    if not teams:
+        return []
+    repo_owner = pr_data["base"]["repo"]["owner"]
+    if repo_owner.get("type") != "Organization":
+        raise ValueError(f"Team reviewers require an organization repository; '{repo_owner['login']}' is a user")
+    org = repo_owner["login"]
+    
+    slugs = []
+    for team in teams:
+        team_org, _, slug = team.rpartition("/")
+        if team_org and team_org.lower() != org.lower():
+            raise ValueError(f"Team '{team}' does not belong to organization '{org}'")
+        try:
+            await _github_api_request("GET", f"/orgs/{org}/teams/{slug}")
+        except httpx.HTTPStatusError as e:
+            if e.response.status_code != 404:
+                raise
+            raise ValueError(f"Team '{slug}' not found in organization '{org}'")
+        slugs.append(slug)
+    return slugs
+
+
+async def _fetch_pr_files(owner: str, repo: str, pr_number: int) -> List[Dict[str, Any]]:
+    """Fetch all changed files of a pull request, up to GitHub's files limit."""
+    endpoint = f"/repos/{owner}/{repo}/pulls/{pr_number}/files"
+    return await _github_api_paginate(endpoint, max_items=GITHUB_PR_FILES_LIMIT)
+
+
+def _summarize_pr_files(
+    files: List[Dict[str, Any]],
+    total_count: int,
+    modes: Optional[Dict[str, Tuple[Optional[str], Optional[str]]]] = None
+) -> Dict[str, Any]:
+    """
+    Describe a fetched file list and whether it covers the whole PR.
+    
+    Args:
+        files (List[Dict[str, Any]]): Entries returned by the pull request files API
+        total_count (int): The PR's `changed_files` count
+        modes (Optional[Dict]): (old, new) file modes by path, added to entries
+            that are symlinks, submodules or changed mode
+    
+    Returns:
+        Dict[str, Any]: Total and returned counts, truncation flag and compact file entries
+    """
+    def mode_fields(path: str) -> Dict[str, Any]:
+        old_mode, new_mode = (modes or {}).get(path, (None, None))
+        if SYMLINK_MODE in (old_mode, new_mode):
+            return {"old_mode": old_mode, "new_mode": new_mode, "symlink": True}
+        if SUBMODULE_MODE in (old_mode, new_mode):
+            return {"old_mode": old_mode, "new_mode": new_mode, "submodule": True}
+        if old_mode and new_mode and old_mode != new_mode:
+            return {"old_mode": old_mode, "new_mode": new_mode}
+        return {}
+    
+    return {
+        "total_count": total_count,
+        "returned_count": len(files),
+        "truncated": len(files) < total_count,
+        "files": [
+            {
+                "filename": f["filename"],
+                "status": f.get("status", "modified"),
+                **({"previous_filename": f["previous_filename"]} if f.get("previous_filename") else {}),
+                "additions": f.get("additions", 0),
+                "deletions": f.get("deletions", 0),
+                "changes": f.get("changes", 0),
+                **mode_fields(f["filename"]),
+            }
+            for f in files
+        ],
+    }
+
+
+def _parse_diff_for_go_files(diff_text: str) -> List[str]:
+    """Extract list of changed Go files from git diff."""
+    go_files = []
+    for line in diff_text.split('\n'):
         if line.startswith('+++') and line.endswith('.go'):
             file_path = line.split(' ')[1][2:]  # Remove "b/" prefix
             go_files.append(file_path)
     return go_files
 
 
-# ============================================================================
-# MCP Tools
-# ============================================================================
+# ============================================================================
+# Diff Model
+# ============================================================================
+
+_HUNK_HEADER = re.compile(r"^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@")
+
+# Git file mode of a symbolic link, whose "content" is the path it points to
+SYMLINK_MODE = "120000"
+# Git file mode of a gitlink: a submodule pinned at a commit of another repository
+SUBMODULE_MODE = "160000"
+
+# The only line a gitlink's patch has on each side
+_GITLINK_LINE = re.compile(r"^Subproject commit ([0-9a-f]{40})")
+
+
+class FileStatus(str, Enum):
+    """How a PR changes a file, using GitHub's files API names."""
+    ADDED = "added"
+    MODIFIED = "modified"
+    REMOVED = "removed"
+    RENAMED = "renamed"
+    COPIED = "copied"
+    # Only the file mode changed, e.g. chmod +x
+    CHANGED = "changed"
+
+
+def _file_status(value: Optional[str]) -> FileStatus:
+    """Map a files API status to FileStatus; anything unknown (e.g. "unchanged") is MODIFIED."""
+    try:
+        return FileStatus(value)
+    except ValueError:
+        return FileStatus.MODIFIED
+
+
+@dataclass
+class DiffLine:
+    """
+    One line of a hunk: '+' added, '-' removed or ' ' context.
+    
+    position is the legacy review comment position: lines below the file's
+    first @@ header, counting later headers and "\\ No newline" markers.
+    """
+    kind: str
+    content: str
+    old_line: Optional[int] = None
+    new_line: Optional[int] = None
+    position: Optional[int] = None
+
+
+@dataclass
+class DiffHunk:
+    """A hunk of a unified diff with line numbers resolved for both sides."""
+    old_start: int
+    old_count: int
+    new_start: int
+    new_count: int
+    lines: List[DiffLine] = field(default_factory=list)
+
+
+class LineNotInDiffError(ValueError):
+    """A line and side that no commentable line of a file's diff matches."""
+    
+    def __init__(self, path: str, line: int, side: str, nearest: List[int]):
+        self.nearest = nearest
+        hint = (
+            f"; nearest commentable lines on that side: {', '.join(map(str, nearest))}" if nearest
+            else "; the diff has no commentable lines on that side"
+        )
+        super().__init__(f"{path} line {line} ({side}) is not part of the diff{hint}")
+
+
+@dataclass
+class FileDiff:
+    """The parsed changes to a single file of a pull request."""
+    path: str
+    status: FileStatus = FileStatus.MODIFIED
+    hunks: List[DiffHunk] = field(default_factory=list)
+    old_path: Optional[str] = None
+    binary: bool = False
+    # False for diffs between arbitrary refs, which have no pull request to comment on
+    comment_addressable: bool = True
+    # Git modes such as "100644" or "100755"; None where unknown (the files API has none)
+    old_mode: Optional[str] = None
+    new_mode: Optional[str] = None
+    # Lines added plus removed, and the patch's size, as far as they are known before any content fetch
+    changes: int = 0
+    patch_bytes: int = 0
+    
+    @property
+    def is_pure_rename(self) -> bool:
+        """True for a file moved or copied without content changes, which has nothing to review."""
+        return self.status in ("renamed", "copied") and not self.hunks
+    
+    @property
+    def mode_changed(self) -> bool:
+        """True when both modes are known and differ, e.g. a file made executable."""
+        return bool(self.old_mode and self.new_mode and self.old_mode != self.new_mode)
+    
+    @property
+    def is_symlink(self) -> bool:
+        return SYMLINK_MODE in (self.old_mode, self.new_mode)
+    
+    @property
+    def is_submodule(self) -> bool:
+        return SUBMODULE_MODE in (self.old_mode, self.new_mode)
+    
+    @property
+    def oversized(self) -> bool:
+        """True when the patch is over GITHUB_LARGE_FILE_MAX_BYTES or changes over GITHUB_LARGE_FILE_MAX_LINES lines."""
+        return bool(
+            (GITHUB_LARGE_FILE_MAX_BYTES and self.patch_bytes > GITHUB_LARGE_FILE_MAX_BYTES)
+            or (GITHUB_LARGE_FILE_MAX_LINES and self.changes > GITHUB_LARGE_FILE_MAX_LINES)
+        )
+    
+    @property
+    def reviewable(self) -> bool:
+        """True if the head has text content to check: not removed, binary, a symlink or a submodule."""
+        return (
+            self.status != FileStatus.REMOVED and not self.binary
+            and not self.is_symlink and not self.is_submodule
+        )
+    
+    def submodule_shas(self) -> Tuple[Optional[str], Optional[str]]:
+        """Return the (old, new) commits a submodule is pinned at, None on the side it does not exist."""
+        old = new = None
+        for hunk in self.hunks:
+            for diff_line in hunk.lines:
+                gitlink = _GITLINK_LINE.match(diff_line.content)
+                if gitlink and diff_line.kind in "- " and self.old_mode == SUBMODULE_MODE:
+                    old = gitlink.group(1)
+                if gitlink and diff_line.kind in "+ " and self.new_mode == SUBMODULE_MODE:
+                    new = gitlink.group(1)
+        return old, new
+    
+    def symlink_targets(self) -> Tuple[Optional[str], Optional[str]]:
+        """Return the (old, new) link targets of a symlink, None on the side it does not exist."""
+        old = new = None
+        for hunk in self.hunks:
+            for diff_line in hunk.lines:
+                if diff_line.kind in "- " and self.old_mode == SYMLINK_MODE:
+                    old = diff_line.content
+                if diff_line.kind in "+ " and self.new_mode == SYMLINK_MODE:
+                    new = diff_line.content
+        return old, new
+    
+    @property
+    def display_path(self) -> str:
+        return f"{self.old_path} → {self.path}" if self.old_path else self.path
+    
+    def locate(self, line: int, side: str) -> Optional[Tuple[int, int]]:
+        """Return (hunk index, line index) of a commentable line, or None if not in the diff."""
+        for hunk_index, hunk in enumerate(self.hunks):
+            for line_index, diff_line in enumerate(hunk.lines):
+                if side == "LEFT" and diff_line.kind in "- " and diff_line.old_line == line:
+                    return hunk_index, line_index
+                if side == "RIGHT" and diff_line.kind in "+ " and diff_line.new_line == line:
+                    return hunk_index, line_index
+        return None
+    
+    def commentable_lines(self, side: str) -> set:
+        """Return the line numbers GitHub accepts review comments on for a side."""
+        if side == "LEFT":
+            return {ln.old_line for h in self.hunks for ln in h.lines if ln.kind in "- "}
+        return {ln.new_line for h in self.hunks for ln in h.lines if ln.kind in "+ "}
+    
+    def nearest_commentable(self, line: int, side: str) -> List[int]:
+        """Return the closest commentable lines before and after line on a side."""
+        lines = sorted(self.commentable_lines(side))
+        return [n for n in lines if n < line][-1:] + [n for n in lines if n > line][:1]
+    
+    def anchor(self, line: int, side: str) -> Dict[str, Any]:
+        """
+        Map a file line on a diff side to the fields of a review comment.
+        
+        Context lines exist on both sides, so either side anchors them.
+        
+        Returns:
+            Dict[str, Any]: line and side for the Reviews API, and the legacy position
+        
+        Raises:
+            LineNotInDiffError: If the line is not commentable on that side, e.g.
+                it falls between two hunks
+        """
+        located = self.locate(line, side)
+        if located is None:
+            raise LineNotInDiffError(self.path, line, side, self.nearest_commentable(line, side))
+        diff_line = self.hunks[located[0]].lines[located[1]]
+        return {"line": line, "side": side, "position": diff_line.position}
+    
+    def from_position(self, position: int) -> Tuple[int, str]:
+        """
+        Map a legacy diff position back to (line, side).
+        
+        A context line maps to its RIGHT-side number, as GitHub reports it.
+        
+        Raises:
+            ValueError: If the position is a hunk header, a "\\ No newline"
+                marker, or beyond the diff
+        """
+        for hunk in self.hunks:
+            for diff_line in hunk.lines:
+                if diff_line.position == position:
+                    if diff_line.kind == "-":
+                        return diff_line.old_line, "LEFT"
+                    return diff_line.new_line, "RIGHT"
+        raise ValueError(f"Position {position} is not a line of the diff of {self.path}")
+
+
+def _parse_patch(patch: str) -> List[DiffHunk]:
+    """
+    Parse the hunks of a single file's unified diff.
+    
+    Args:
+        patch (str): The `patch` field from the PR files API (hunks only)
+    
+    Returns:
+        List[DiffHunk]: Hunks with old/new line numbers assigned to every line
+    """
+    hunks: List[DiffHunk] = []
+    old_no = new_no = 0
+    position = 0
+    for raw in patch.split("\n"):
+        header = _HUNK_HEADER.match(raw)
+        if header:
+            if hunks:
+                # Positions run on through every later hunk header
+                position += 1
+            old_start, old_count, new_start, new_count = header.groups()
+            hunk = DiffHunk(
+                old_start=int(old_start),
+                old_count=int(old_count) if old_count is not None else 1,
+                new_start=int(new_start),
+                new_count=int(new_count) if new_count is not None else 1,
+            )
+            hunks.append(hunk)
+            old_no, new_no = hunk.old_start, hunk.new_start
+            continue
+        if not hunks or not raw:
+            continue
+        position += 1
+        kind, content = raw[0], raw[1:]
+        if kind == "+":
+            hunks[-1].lines.append(DiffLine("+", content, new_line=new_no, position=position))
+            new_no += 1
+        elif kind == "-":
+            hunks[-1].lines.append(DiffLine("-", content, old_line=old_no, position=position))
+            old_no += 1
+        elif kind == " ":
+            hunks[-1].lines.append(DiffLine(" ", content, old_line=old_no, new_line=new_no, position=position))
+            old_no += 1
+            new_no += 1
+    return hunks
+
+
+# Extensions treated as binary when the API gives no other signal
+BINARY_EXTENSIONS = frozenset({
+    ".png", ".jpg", ".jpeg", ".gif", ".bmp", ".ico", ".webp", ".pdf",
+    ".zip", ".gz", ".tgz", ".tar", ".jar", ".class", ".so", ".dll", ".dylib",
+    ".exe", ".a", ".o", ".wasm", ".woff", ".woff2", ".ttf", ".otf", ".eot",
+    ".mp3", ".mp4", ".mov", ".bin", ".pyc",
+})
+
+
+def _is_binary_entry(entry: Dict[str, Any]) -> bool:
+    """
+    Guess whether a files API entry is a binary file.
+    
+    GitHub sends no `patch` and zero line changes for binaries. Pure renames,
+    mode-only changes and empty added or removed files look the same, and
+    very large text diffs also omit the patch, so those are only treated as
+    binary by extension (and a mode-only change never is).
+    """
+    if entry.get("patch") or entry.get("status") == "changed":
+        return False
+    if os.path.splitext(entry["filename"])[1].lower() in BINARY_EXTENSIONS:
+        return True
+    return entry.get("changes") == 0 and entry.get("status") not in ("renamed", "copied", "added", "removed")
+
+
+def _file_diff_from_api(entry: Dict[str, Any]) -> FileDiff:
+    """
+    Build a FileDiff from one entry of the pull request files API.
+    
+    The API reports no modes, but a gitlink is recognizable by its patch,
+    so submodules get SUBMODULE_MODE on the sides they exist.
+    """
+    patch = entry.get("patch") or ""
+    hunks = _parse_patch(patch)
+    old_mode, new_mode = _gitlink_modes(hunks)
+    return FileDiff(
+        path=entry["filename"],
+        status=_file_status(entry.get("status")),
+        hunks=hunks,
+        old_path=entry.get("previous_filename"),
+        binary=_is_binary_entry(entry),
+        old_mode=old_mode,
+        new_mode=new_mode,
+        changes=entry.get("changes", 0),
+        patch_bytes=len(patch.encode()),
+    )
+
+
+def _gitlink_modes(hunks: List[DiffHunk]) -> Tuple[Optional[str], Optional[str]]:
+    """Return SUBMODULE_MODE for each side of a patch made only of "Subproject commit" lines."""
+    lines = [ln for hunk in hunks for ln in hunk.lines]
+    if not lines or not all(_GITLINK_LINE.match(ln.content) for ln in lines):
+        return None, None
+    return (
+        SUBMODULE_MODE if any(ln.kind in "- " for ln in lines) else None,
+        SUBMODULE_MODE if any(ln.kind in "+ " for ln in lines) else None,
+    )
+
+
+def _is_binary_diff_line(line: str) -> bool:
+    return line.startswith(("Binary files ", "GIT binary patch"))
+
+
+def _strip_binary_sections(diff_text: str) -> str:
+    """Drop the per-file sections of a git diff that describe binary files."""
+    sections = re.split(r"(?m)^(?=diff --git )", diff_text)
+    return "".join(
+        section for section in sections
+        if not any(_is_binary_diff_line(line) for line in section.split("\n"))
+    )
+
+
+def _split_diff_sections(diff_text: str) -> List[Tuple[str, str]]:
+    """Split a git diff into (new path, section text) pairs, one per file."""
+    sections = []
+    for section in re.split(r"(?m)^(?=diff --git )", diff_text):
+        header = _GIT_DIFF_HEADER.match(section.split("\n", 1)[0])
+        if header:
+            sections.append((header.group(2), section))
+    return sections
+
+
+_glob_cache: Dict[str, "re.Pattern[str]"] = {}
+
+
+def _glob_match(pattern: str, path: str) -> bool:
+    """
+    Match a path against a doublestar-style glob.
+    
+    `*` and `?` stay within one path segment, `**` spans any number of
+    segments (including none), and `{a,b}` matches either alternative.
+    """
+    regex = _glob_cache.get(pattern)
+    if regex is None:
+        parts, i = [], 0
+        while i < len(pattern):
+            if pattern.startswith("**/", i):
+                parts.append("(?:.*/)?")
+                i += 3
+            elif pattern.startswith("**", i):
+                parts.append(".*")
+                i += 2
+            elif pattern[i] == "*":
+                parts.append("[^/]*")
+                i += 1
+            elif pattern[i] == "?":
+                parts.append("[^/]")
+                i += 1
+            elif pattern[i] == "{" and "}" in pattern[i:]:
+                close = pattern.index("}", i)
+                parts.append("(?:" + "|".join(re.escape(a) for a in pattern[i + 1:close].split(",")) + ")")
+                i = close + 1
+            else:
+                parts.append(re.escape(pattern[i]))
+                i += 1
+        regex = _glob_cache[pattern] = re.compile("".join(parts) + "$")
+    return regex.match(path) is not None
+
+
+_GENERATED_PATH = re.compile(
+    r"(^|/)(vendor|node_modules|third_party|dist)/"
+    r"|\.pb\.go$|_gen\.go$|\.gen\.go$|zz_generated[^/]*$|\.min\.(js|css)$"
+    r"|(^|/)(go\.sum|package-lock\.json|yarn\.lock|pnpm-lock\.yaml)$"
+)
+
+
+def _path_scope(scope: Optional[List[str]]) -> List[str]:
+    """The path scope of a call: its own, or REVIEW_PATH_SCOPE when it names none."""
+    return REVIEW_PATH_SCOPE if scope is None else scope
+
+
+def _in_scope(path: str, scope: List[str]) -> bool:
+    """True when path is under a scope entry (a directory such as 'services/payments', or a glob) or scope is empty."""
+    if not scope:
+        return True
+    for entry in scope:
+        if any(c in entry for c in "*?{"):
+            if _glob_match(entry, path):
+                return True
+        elif path == entry.rstrip("/") or path.startswith(entry.rstrip("/") + "/"):
+            return True
+    return False
+
+
+def _finding_in_scope(finding: "ReviewFinding", scope: List[str]) -> bool:
+    """True when a finding's file is in scope; commit findings concern the whole PR, so a scope leaves them out."""
+    if finding.commit is not None:
+        return not scope
+    return _in_scope(finding.path, scope)
+
+
+def _finding_location(finding: "ReviewFinding") -> Dict[str, Any]:
+    """Where a finding points: its commit, or its path, line and side."""
+    if finding.commit is not None:
+        return {"commit": finding.commit}
+    return {"path": finding.path, "line": finding.line, "side": finding.side}
+
+
+def _scope_note(scope: List[str]) -> str:
+    """Sentence telling PR authors which part of the repository a review covered."""
+    return "**Scope:** this review only covers " + ", ".join(f"`{e}`" for e in scope) + "; other files were not reviewed."
+
+
+def _path_filter(include: List[str], exclude: List[str], scope: Optional[List[str]] = None) -> Callable[[str], bool]:
+    """
+    Build a predicate for include/exclude globs within a path scope.
+    
+    A path is kept when it is in scope (see _path_scope), matches no exclude
+    pattern and, if any include patterns are given, at least one of them.
+    """
+    scope = _path_scope(scope)
+    
+    def keep(path: str) -> bool:
+        if not _in_scope(path, scope) or any(_glob_match(p, path) for p in exclude):
+            return False
+        return not include or any(_glob_match(p, path) for p in include)
+    return keep
+
+
+def _is_generated_path(path: str) -> bool:
+    """Heuristically detect vendored, generated and lock files."""
+    return _GENERATED_PATH.search(path) is not None
+
+
+def _fit_diff_to_budget(
+    sections: List[Tuple[str, str]], budget: int, prioritize: List[str]
+) -> Tuple[List[Tuple[str, str]], List[str]]:
+    """
+    Choose whole-file diff sections that fit within a character budget.
+    
+    Files matching a `prioritize` glob go first, then source code before
+    vendored or generated files, then smaller patches before larger ones
+    (path breaks ties, so the choice is deterministic). A section is either
+    included whole or omitted, never cut.
+    
+    Returns:
+        Tuple of the included sections in their original order and the
+        omitted paths in priority order
+    """
+    if not budget or sum(len(text) for _, text in sections) <= budget:
+        return sections, []
+    
+    def priority(item: Tuple[int, Tuple[str, str]]):
+        _, (path, text) = item
+        preferred = any(_glob_match(p, path) for p in prioritize)
+        return (not preferred, _is_generated_path(path), len(text), path)
+    
+    included, omitted, used = set(), [], 0
+    for index, (path, text) in sorted(enumerate(sections), key=priority):
+        if used + len(text) <= budget:
+            included.add(index)
+            used += len(text)
+        else:
+            omitted.append(path)
+    return [section for i, section in enumerate(sections) if i in included], omitted
+
+
+async def _binary_file_sizes(
+    owner: str, repo: str, diff: FileDiff, base_sha: str, head_sha: str,
+    head_repo: Optional[Tuple[str, str]] = None
+) -> Dict[str, Any]:
+    """
+    Look up a binary file's size before and after the PR via the contents API.
+    
+    head_repo is where the head commit lives when it is not the base
+    repository, e.g. a fork.
+    """
+    async def size_at(path: str, ref: str, location: Tuple[str, str]) -> int:
+        try:
+            response = await _github_api_response(
+                "GET", f"/repos/{location[0]}/{location[1]}/contents/{path}", params={"ref": ref}
+            )
+        except httpx.HTTPStatusError as e:
+            if e.response.status_code != 404:
+                raise
+            return 0
+        return response.json().get("size", 0)
+    
+    old_size = 0 if diff.status == "added" else await size_at(diff.old_path or diff.path, base_sha, (owner, repo))
+    new_size = 0 if diff.status == "removed" else await size_at(diff.path, head_sha, head_repo or (owner, repo))
+    return {
+        "path": diff.path,
+        "status": diff.status,
+        "old_size": old_size,
+        "new_size": new_size,
+        "size_delta": new_size - old_size,
+    }
+
+
+_GIT_DIFF_HEADER = re.compile(r"^diff --git a/(.+) b/(.+)$")
+
+
+def _parse_unified_diff(diff_text: str) -> List[FileDiff]:
+    """
+    Parse a multi-file git diff, such as the PR diff media type, into FileDiffs.
+    
+    `rename from`/`rename to` and `copy from`/`copy to` headers set old_path,
+    so a move shows up as one renamed file rather than a delete and an add.
+    Mode headers set old_mode and new_mode; a file whose mode alone changed
+    has status CHANGED.
+    """
+    diffs: List[FileDiff] = []
+    patch_lines: List[str] = []
+    
+    def finish():
+        if diffs:
+            diffs[-1].hunks = _parse_patch("\n".join(patch_lines))
+        patch_lines.clear()
+    
+    for raw in diff_text.split("\n"):
+        header = _GIT_DIFF_HEADER.match(raw)
+        if header:
+            finish()
+            diffs.append(FileDiff(path=header.group(2)))
+            continue
+        if not diffs:
+            continue
+        current = diffs[-1]
+        if patch_lines or raw.startswith("@@"):
+            patch_lines.append(raw)
+        elif raw.startswith(("rename from ", "copy from ")):
+            current.old_path = raw.split(" ", 2)[2]
+            current.status = FileStatus.RENAMED if raw.startswith("rename") else FileStatus.COPIED
+        elif raw.startswith(("rename to ", "copy to ")):
+            current.path = raw.split(" ", 2)[2]
+        elif raw.startswith("new file mode "):
+            current.status, current.new_mode = FileStatus.ADDED, raw.split()[-1]
+        elif raw.startswith("deleted file mode "):
+            current.status, current.old_mode = FileStatus.REMOVED, raw.split()[-1]
+        elif raw.startswith("old mode "):
+            current.old_mode = raw.split()[-1]
+        elif raw.startswith("new mode "):
+            current.new_mode = raw.split()[-1]
+        elif raw.startswith("index ") and len(raw.split()) == 3:
+            # "index abc..def 100644": the mode is unchanged
+            current.old_mode = current.new_mode = raw.split()[-1]
+        elif _is_binary_diff_line(raw):
+            current.binary = True
+    finish()
+    for diff in diffs:
+        if diff.mode_changed and diff.status == FileStatus.MODIFIED and not diff.hunks:
+            diff.status = FileStatus.CHANGED
+    return diffs
+
+
+def _may_hide_mode(entry: Dict[str, Any]) -> bool:
+    """
+    Guess whether a files API entry is a mode change, a symlink or a submodule.
+    
+    The files API reports no modes. A mode-only change has status "changed";
+    a symlink's patch is its target, one line without a trailing newline;
+    a submodule's patch is its "Subproject commit" lines.
+    """
+    if entry.get("status") == "changed":
+        return True
+    patch = entry.get("patch") or ""
+    if _gitlink_modes(_parse_patch(patch)) != (None, None):
+        return True
+    if "\\ No newline at end of file" not in patch:
+        return False
+    hunks = _parse_patch(patch)
+    return len(hunks) == 1 and all(
+        sum(1 for ln in hunks[0].lines if ln.kind == kind) <= 1 for kind in "+-"
+    ) and not any(ln.kind == " " for ln in hunks[0].lines)
+
+
+async def _fetch_file_modes(owner: str, repo: str, pr_number: int) -> Dict[str, Tuple[Optional[str], Optional[str]]]:
+    """
+    Read each file's (old, new) mode from the headers of the PR's unified diff.
+    
+    Returns an empty mapping when GitHub will not render the diff (too large).
+    """
+    try:
+        response = await _github_api_response(
+            "GET", f"/repos/{owner}/{repo}/pulls/{pr_number}", headers={"Accept": "application/vnd.github.v3.diff"}
+        )
+    except httpx.HTTPStatusError as e:
+        logger.info("No file modes for %s/%s#%d: %s", owner, repo, pr_number, _github_error_message(e))
+        return {}
+    return _diff_modes(response.text)
+
+
+def _diff_modes(diff_text: str) -> Dict[str, Tuple[Optional[str], Optional[str]]]:
+    """Return each file's (old, new) mode from a unified diff's headers."""
+    return {d.path: (d.old_mode, d.new_mode) for d in _parse_unified_diff(diff_text)}
+
+
+def _apply_file_modes(
+    diffs: Dict[str, FileDiff], modes: Dict[str, Tuple[Optional[str], Optional[str]]]
+) -> Dict[str, FileDiff]:
+    """Copy modes read from a unified diff onto files API diffs, keyed by path."""
+    for path, (old_mode, new_mode) in modes.items():
+        if path in diffs:
+            diffs[path].old_mode, diffs[path].new_mode = old_mode, new_mode
+    return diffs
+
+
+def _mode_summary(diffs: List[FileDiff]) -> Dict[str, Any]:
+    """List mode changes and symlinks, which are reported instead of reviewed as content."""
+    symlinks = []
+    for d in diffs:
+        if d.is_symlink:
+            old_target, new_target = d.symlink_targets()
+            symlinks.append({"path": d.path, "status": d.status, "old_target": old_target, "new_target": new_target})
+    return {
+        "mode_changes": [
+            {"path": d.path, "old_mode": d.old_mode, "new_mode": d.new_mode}
+            for d in diffs if d.mode_changed and not d.is_symlink and not d.is_submodule
+        ],
+        "symlinks": symlinks,
+    }
+
+
+# Commit titles listed per submodule change; the counts cover the rest
+MAX_SUBMODULE_COMMITS = 20
+
+_GITMODULES_SECTION = re.compile(r'^\[submodule\s+"(.+)"\]$')
+# https://host/owner/repo(.git), git@host:owner/repo(.git) and ssh://git@host/owner/repo(.git)
+_GIT_REMOTE_URL = re.compile(
+    r"^(?:https?://(?:[^@/]+@)?|ssh://(?:[^@/]+@)?|[^@/]+@)([^/:]+)(?::\d+)?[/:]([^/]+)/([^/]+?)(?:\.git)?/?$"
+)
+
+
+@dataclass
+class SubmoduleChange:
+    """A PR moving a submodule (gitlink) from one pinned commit to another."""
+    path: str
+    status: FileStatus
+    old_sha: Optional[str]
+    new_sha: Optional[str]
+    url: Optional[str] = None
+    # "owner/repo" when the URL names a repository on this GitHub host
+    repository: Optional[str] = None
+    # The compare API's "ahead", "behind", "diverged" or "identical";
+    # None when the submodule repository could not be read
+    compare_status: Optional[str] = None
+    ahead_by: int = 0
+    behind_by: int = 0
+    # {"sha", "title"} of the commits the bump brings in, oldest first
+    commits: List[Dict[str, str]] = field(default_factory=list)
+    
+    @property
+    def summary(self) -> str:
+        """One sentence such as "`lib` bumped 12 commits (a1b2c3d..d4e5f6a)."."""
+        def plural(count: int) -> str:
+            return f"{count} commit{'s' if count != 1 else ''}"
+        
+        if not self.old_sha:
+            return f"`{self.path}` added at {self.new_sha[:7]}."
+        if not self.new_sha:
+            return f"`{self.path}` removed (was {self.old_sha[:7]})."
+        shas = f"({self.old_sha[:7]}..{self.new_sha[:7]})"
+        if self.compare_status == "ahead":
+            return f"`{self.path}` bumped {plural(self.ahead_by)} {shas}."
+        if self.compare_status == "behind":
+            return f"`{self.path}` rolled back {plural(self.behind_by)} {shas}."
+        if self.compare_status == "diverged":
+            return (
+                f"`{self.path}` moved to an unrelated commit, {plural(self.ahead_by)} ahead "
+                f"and {self.behind_by} behind {shas}."
+            )
+        return f"`{self.path}` bumped {shas}."
+
+
+def _parse_gitmodules(text: str) -> Dict[str, str]:
+    """Map each submodule path of a .gitmodules file to its URL."""
+    modules: List[Dict[str, str]] = []
+    for raw in text.splitlines():
+        line = raw.strip()
+        section = _GITMODULES_SECTION.match(line)
+        if section:
+            modules.append({})
+        elif modules and "=" in line and not line.startswith(("#", ";")):
+            key, value = line.split("=", 1)
+            modules[-1][key.strip().lower()] = value.strip()
+    return {m["path"]: m["url"] for m in modules if "path" in m and "url" in m}
+
+
+def _github_web_host() -> str:
+    """The host repository URLs use on the configured GitHub, e.g. github.com for api.github.com."""
+    api_url = _configured_api_url()
+    host = urlsplit(api_url).hostname if api_url else None
+    return "github.com" if host in (None, "api.github.com") else host
+
+
+def _submodule_repository(url: str, owner: str, repo: str) -> Optional[Tuple[str, str]]:
+    """
+    Resolve a submodule URL to the (owner, repo) it names on this GitHub host, or None.
+    
+    Relative URLs such as "../lib.git" are relative to the superproject's
+    repository, as git resolves them.
+    """
+    if url.startswith(("./", "../")):
+        parts = [owner, repo]
+        for segment in url.split("/"):
+            if segment == "..":
+                parts = parts[:-1]
+            elif segment not in (".", ""):
+                parts.append(segment)
+        if len(parts) != 2:
+            return None
+        return parts[0], parts[1].removesuffix(".git")
+    remote = _GIT_REMOTE_URL.match(url)
+    if not remote or remote.group(1).lower() != _github_web_host():
+        return None
+    return remote.group(2), remote.group(3)
+
+
+async def _submodule_urls(
+    owner: str, repo: str, refs: List[Tuple[Tuple[str, str], Optional[str]]]
+) -> Dict[str, str]:
+    """
+    Read submodule URLs from .gitmodules at each (repository, ref), earlier refs winning.
+    
+    The head's file is read first; the base's covers submodules the PR removes.
+    """
+    urls: Dict[str, str] = {}
+    for (location_owner, location_repo), ref in refs:
+        if not ref:
+            continue
+        try:
+            text = await _fetch_file_text(location_owner, location_repo, ".gitmodules", ref)
+        except (httpx.HTTPStatusError, ValueError) as e:
+            logger.info("No .gitmodules in %s/%s at %s: %s", location_owner, location_repo, ref, e)
+            continue
+        urls = {**_parse_gitmodules(text), **urls}
+    return urls
+
+
+async def _describe_submodules(
+    owner: str,
+    repo: str,
+    diffs: List[FileDiff],
+    base_sha: Optional[str],
+    head_sha: Optional[str],
+    head_repo: Optional[Tuple[str, str]] = None
+) -> List[SubmoduleChange]:
+    """
+    Describe each submodule a PR changes, with the commits a bump brings in.
+    
+    The commit range comes from the compare API of the submodule's own
+    repository. When its URL is not on this GitHub host, or the token cannot
+    read it, only the SHAs are reported.
+    """
+    submodules = [d for d in diffs if d.is_submodule]
+    if not submodules:
+        return []
+    urls = await _submodule_urls(owner, repo, [(head_repo or (owner, repo), head_sha), ((owner, repo), base_sha)])
+    changes = []
+    for d in submodules:
+        old_sha, new_sha = d.submodule_shas()
+        change = SubmoduleChange(path=d.path, status=d.status, old_sha=old_sha, new_sha=new_sha, url=urls.get(d.path))
+        location = _submodule_repository(change.url, owner, repo) if change.url else None
+        if location:
+            change.repository = "/".join(location)
+        if location and old_sha and new_sha:
+            try:
+                comparison = await _github_api_request(
+                    "GET", f"/repos/{location[0]}/{location[1]}/compare/{old_sha}...{new_sha}"
+                )
+            except httpx.HTTPStatusError as e:
+                logger.info("Cannot compare submodule %s (%s): %s", d.path, change.repository, _github_error_message(e))
+            else:
+                change.compare_status = comparison.get("status")
+                change.ahead_by = comparison.get("ahead_by", 0)
+                change.behind_by = comparison.get("behind_by", 0)
+                change.commits = [
+                    {"sha": c["sha"], "title": c["commit"]["message"].split("\n", 1)[0]}
+                    for c in comparison.get("commits", [])[:MAX_SUBMODULE_COMMITS]
+                ]
+        changes.append(change)
+    return changes
+
+
+def _submodule_entry(change: SubmoduleChange) -> Dict[str, Any]:
+    return {**asdict(change), "summary": change.summary}
+
+
+async def _describe_changed_files(
+    owner: str,
+    repo: str,
+    files: List[Dict[str, Any]],
+    omitted_paths: List[str],
+    base_sha: Optional[str],
+    head_sha: Optional[str],
+    head_repo: Optional[Tuple[str, str]] = None,
+    modes: Optional[Dict[str, Tuple[Optional[str], Optional[str]]]] = None
+) -> Dict[str, Any]:
+    """
+    Summarize changed files the way the diff tools report them.
+    
+    Returns go_files_changed (what the analyzers should look at), renamed,
+    binary and budget-omitted files, mode changes, symlinks and submodules. head_repo
+    locates the head commit when it lives outside the repository (a fork
+    PR); modes are the file modes from the unified diff, when known.
+    """
+    file_diffs = list(_apply_file_modes({f["filename"]: _file_diff_from_api(f) for f in files}, modes or {}).values())
+    files_by_path = {f["filename"]: f for f in files}
+    # Pure renames carry no new code, so the analyzer does not need them
+    go_files = [
+        d.path for d in file_diffs
+        if d.path.endswith(".go") and d.reviewable and not d.is_pure_rename
+    ]
+    return {
+        "go_files_changed": go_files,
+        "renamed_files": [
+            {"old_path": d.old_path, "path": d.path, "pure_rename": d.is_pure_rename}
+            for d in file_diffs if d.old_path
+        ],
+        "binary_files": [
+            await _binary_file_sizes(owner, repo, d, base_sha, head_sha, head_repo)
+            for d in file_diffs if d.binary
+        ],
+        "omitted_files": [
+            {
+                "filename": path,
+                "additions": files_by_path.get(path, {}).get("additions", 0),
+                "deletions": files_by_path.get(path, {}).get("deletions", 0),
+                "changes": files_by_path.get(path, {}).get("changes", 0),
+            }
+            for path in omitted_paths
+        ],
+        **_mode_summary(file_diffs),
+        "submodules": [
+            _submodule_entry(change)
+            for change in await _describe_submodules(owner, repo, file_diffs, base_sha, head_sha, head_repo)
+        ],
+    }
+
+
+def _mode_changes_markdown(result: Dict[str, Any]) -> str:
+    """Render the mode change, symlink and submodule lists of a diff result."""
+    markdown = ""
+    if result["mode_changes"]:
+        markdown += "\n\n## Mode Changes\n"
+        markdown += "\n".join(f"- `{m['path']}`: {m['old_mode']} → {m['new_mode']}" for m in result["mode_changes"])
+    if result["symlinks"]:
+        markdown += "\n\n## Symlinks\n"
+        markdown += "\n".join(
+            f"- `{link['path']}` ({link['status']}): `{link['old_target'] or '-'}` → `{link['new_target'] or '-'}`"
+            for link in result["symlinks"]
+        )
+    if result["submodules"]:
+        markdown += "\n\n## Submodules\n"
+        markdown += "\n".join(_submodule_markdown(m) for m in result["submodules"])
+    return markdown
+
+
+def _submodule_markdown(entry: Dict[str, Any]) -> str:
+    """Render a submodule change as its summary followed by the titles of the commits it brings in."""
+    markdown = f"- {entry['summary']}"
+    for commit in entry["commits"]:
+        markdown += f"\n  - `{commit['sha'][:7]}` {commit['title']}"
+    if len(entry["commits"]) < entry["ahead_by"]:
+        markdown += f"\n  - … and {entry['ahead_by'] - len(entry['commits'])} more"
+    return markdown
+
+
+def _skip_large_files(
+    diffs: List[FileDiff], include_large_files: List[str]
+) -> Tuple[List[FileDiff], List[Dict[str, Any]]]:
+    """
+    Set aside oversized files, returning the rest and skipped_large_files entries.
+    
+    Sizes come from the diff itself, so a skipped file's contents are never
+    downloaded. Files matching include_large_files are kept regardless.
+    """
+    forced = _path_filter(include_large_files, [], []) if include_large_files else (lambda path: False)
+    kept, skipped = [], []
+    for d in diffs:
+        if d.oversized and not forced(d.path):
+            skipped.append({"filename": d.path, "status": d.status, "patch_bytes": d.patch_bytes, "changes": d.changes})
+        else:
+            kept.append(d)
+    return kept, skipped
+
+
+def _large_files_finding(skipped: List[Dict[str, Any]]) -> Optional[Dict[str, Any]]:
+    """One informational review finding asking the author to confirm the skipped large files are intended."""
+    if not skipped:
+        return None
+    listing = "\n".join(
+        f"- `{s['filename']}`: {s['patch_bytes']} byte patch, {s['changes']} changed lines" for s in skipped
+    )
+    return AnalyzerFinding(
+        analyzer="large-files", path=skipped[0]["filename"], line=1, severity="info", rule="large-files/skipped",
+        message=(
+            f"{len(skipped)} file{'s are' if len(skipped) != 1 else ' is'} too large to review and "
+            f"{'were' if len(skipped) != 1 else 'was'} skipped. Please confirm "
+            f"{'they are' if len(skipped) != 1 else 'it is'} meant to be checked in "
+            f"(not generated output or an accidental commit):\n{listing}"
+        ),
+    ).to_review_finding()
+
+
+# Go's marker for generated code (https://go.dev/s/generatedcode), looked for
+# in the first GENERATED_HEADER_LINES lines of a file
+_GO_GENERATED_HEADER = re.compile(r"^// Code generated .* DO NOT EDIT\.$")
+GENERATED_HEADER_LINES = 5
+
+
+# Built-in attribute macros; macros defined with [attr] lines are not expanded
+_GITATTRIBUTE_MACROS = {"binary": {"binary": True, "diff": False, "merge": False, "text": False}}
+
+
+@dataclass
+class GitAttributeRule:
+    """
+    One .gitattributes line: its pattern, the directory of the file holding
+    it ("" for the root), and the attribute states it sets. A state is True
+    (set), False (unset), a string value, or None ("!attr", back to
+    unspecified).
+    """
+    pattern: str
+    directory: str
+    attributes: Dict[str, Union[bool, str, None]]
+
+
+def _unquote_gitattributes_pattern(quoted: str) -> str:
+    """Decode a C-style quoted pattern, as git writes names with spaces or special characters."""
+    escapes = {"n": "\n", "t": "\t", "\\": "\\", '"': '"'}
+    return re.sub(r'\\(.)', lambda m: escapes.get(m.group(1), m.group(1)), quoted)
+
+
+def _parse_gitattributes(text: str, directory: str = "") -> List[GitAttributeRule]:
+    """
+    Parse a .gitattributes file found in directory.
+    
+    Negative patterns are not allowed in attributes files and, as git does,
+    are ignored, as are macro definitions.
+    """
+    rules = []
+    for raw in text.splitlines():
+        line = raw.strip()
+        if not line or line.startswith("#") or line.startswith("[attr]"):
+            continue
+        quoted = re.match(r'"((?:[^"\\]|\\.)*)"\s*', line)
+        if quoted:
+            pattern, fields = _unquote_gitattributes_pattern(quoted.group(1)), line[quoted.end():].split()
+        else:
+            pattern, *fields = line.split()
+        if pattern.startswith("!"):
+            logger.debug("Ignoring negative .gitattributes pattern %s", pattern)
+            continue
+        attributes: Dict[str, Union[bool, str, None]] = {}
+        for field in fields:
+            if field.startswith("-"):
+                attributes[field[1:]] = False
+            elif field.startswith("!"):
+                attributes[field[1:]] = None
+            elif "=" in field:
+                name, value = field.split("=", 1)
+                attributes[name] = value
+            else:
+                attributes.update(_GITATTRIBUTE_MACROS.get(field, {field: True}))
+        rules.append(GitAttributeRule(pattern, directory, attributes))
+    return rules
+
+
+_wildmatch_cache: Dict[str, "re.Pattern[str]"] = {}
+
+
+def _wildmatch_regex(pattern: str) -> "re.Pattern[str]":
+    """
+    Compile a gitignore-style pattern, matched against a whole path.
+    
+    `*`, `?` and `[...]` stay within one path segment. `**` spans segments
+    only as a whole segment: a leading `**/`, a trailing `/**` or a
+    `/**/` in the middle. Anywhere else it is a plain `*`.
+    """
+    regex = _wildmatch_cache.get(pattern)
+    if regex is not None:
+        return regex
+    parts, i = [], 0
+    while i < len(pattern):
+        char = pattern[i]
+        if pattern.startswith("**", i) and (i == 0 or pattern[i - 1] == "/"):
+            if i + 2 == len(pattern):
+                parts.append(".*")
+                i += 2
+                continue
+            if pattern[i + 2] == "/":
+                parts.append("(?:.*/)?")
+                i += 3
+                continue
+        if char == "*":
+            while i < len(pattern) and pattern[i] == "*":
+                i += 1
+            parts.append("[^/]*")
+            continue
+        if char == "?":
+            parts.append("[^/]")
+        elif char == "[":
+            close = pattern.find("]", i + (3 if pattern.startswith(("[!]", "[^]"), i) else 2))
+            if close == -1:
+                parts.append(re.escape(char))
+            else:
+                body = pattern[i + 1:close]
+                negated = body[:1] in ("!", "^")
+                body = body[1:] if negated else body
+                members = "".join("\\" + c if c in "\\^]" else c for c in body)
+                parts.append(f"[^/{members}]" if negated else f"(?!/)[{members}]")
+                i = close
+        elif char == "\\" and i + 1 < len(pattern):
+            i += 1
+            parts.append(re.escape(pattern[i]))
+        else:
+            parts.append(re.escape(char))
+        i += 1
+    regex = _wildmatch_cache[pattern] = re.compile("".join(parts) + r"\Z", re.DOTALL)
+    return regex
+
+
+def _gitattributes_pattern_matches(rule: GitAttributeRule, path: str) -> bool:
+    """
+    Whether a rule's pattern matches a file path (relative to the repository root).
+    
+    Patterns follow gitignore rules with one difference: a pattern matching
+    a directory does not match the files inside it, so `vendor` and
+    `vendor/` never match `vendor/lib.go` (git's documentation suggests
+    `vendor/**`). A pattern without a slash matches the file name in the
+    rule's directory or below, one with a slash the path from that
+    directory.
+    """
+    if rule.directory:
+        if not path.startswith(rule.directory + "/"):
+            return False
+        path = path[len(rule.directory) + 1:]
+    if rule.pattern.endswith("/"):
+        return False
+    if "/" not in rule.pattern:
+        return _wildmatch_regex(rule.pattern).match(path.rsplit("/", 1)[-1]) is not None
+    return _wildmatch_regex(rule.pattern.lstrip("/")).match(path) is not None
+
+
+def _gitattributes(rules: List[GitAttributeRule], path: str) -> Dict[str, Union[bool, str]]:
+    """
+    Resolve the attributes of a path.
+    
+    rules run from lowest to highest precedence: the root file first and
+    deeper directories after it, each file in line order. The last rule
+    setting an attribute wins.
+    """
+    attributes: Dict[str, Union[bool, str]] = {}
+    for rule in rules:
+        if not _gitattributes_pattern_matches(rule, path):
+            continue
+        for name, value in rule.attributes.items():
+            if value is None:
+                attributes.pop(name, None)
+            else:
+                attributes[name] = value
+    return attributes
+
+
+def _gitattributes_exclusion(attributes: Dict[str, Union[bool, str]]) -> Optional[str]:
+    """The generated_files reason for a file with these attributes, or None to review it."""
+    def linguist(name: str) -> bool:
+        value = attributes.get(name)
+        return value is True or (isinstance(value, str) and value.lower() == "true")
+    
+    if linguist("linguist-generated"):
+        return "gitattributes"
+    if linguist("linguist-vendored"):
+        return "gitattributes-vendored"
+    if attributes.get("diff") is False:
+        return "gitattributes-diff"
+    return None
+
+
+async def _fetch_gitattributes(owner: str, repo: str, ref: str, paths: List[str]) -> List[GitAttributeRule]:
+    """
+    Read the .gitattributes files at ref that can apply to paths, lowest precedence first.
+    
+    Those are the root file and one in every directory leading to a path;
+    directories without one are skipped. ref is a commit SHA, so what each
+    directory holds, a missing file included, is cached on the client.
+    """
+    directories = {""}
+    for path in paths:
+        parts = path.split("/")[:-1]
+        directories.update("/".join(parts[:n]) for n in range(1, len(parts) + 1))
+    ordered = sorted(directories, key=lambda d: (d.count("/") + bool(d), d))
+    
+    cache = _get_github_client(owner).gitattributes
+    
+    async def read(directory: str) -> List[GitAttributeRule]:
+        key = (f"{owner}/{repo}".lower(), ref, directory)
+        if key in cache:
+            return cache[key]
+        path = f"{directory}/.gitattributes" if directory else ".gitattributes"
+        try:
+            rules = _parse_gitattributes(await _fetch_file_text(owner, repo, path, ref), directory)
+        except (httpx.HTTPStatusError, ValueError) as e:
+            logger.debug("No %s in %s/%s at %s: %s", path, owner, repo, ref, e)
+            if isinstance(e, httpx.HTTPStatusError) and e.response.status_code != 404:
+                # Only a missing file is known to stay missing
+                return []
+            rules = []
+        cache[key] = rules
+        return rules
+    
+    return [rule for rules in await _map_bounded(read, ordered) for rule in rules]
+
+
+async def _generated_files(
+    owner: str, repo: str, diffs: List[FileDiff], base_sha: Optional[str], head: Optional[PRHead]
+) -> Dict[str, str]:
+    """
+    Find the generated, vendored and lock files among diffs, mapped to how each was recognized.
+    
+    "path" is a file name heuristic (go.sum, *.pb.go, vendor/...);
+    "gitattributes", "gitattributes-vendored" and "gitattributes-diff" mark
+    files that the base commit's .gitattributes files (never the PR's own,
+    so a PR cannot exempt its code) set linguist-generated,
+    linguist-vendored or -diff on; and "header" is Go's "Code generated ...
+    DO NOT EDIT." comment near the top of the head version. The header is
+    read from the patch when it shows the first lines, and otherwise from
+    the head blob.
+    """
+    # Submodules are summarized separately, wherever they are vendored
+    diffs = [d for d in diffs if not d.is_submodule]
+    generated = {d.path: "path" for d in diffs if _is_generated_path(d.path)}
+    pending = [d.path for d in diffs if d.path not in generated]
+    rules = await _fetch_gitattributes(owner, repo, base_sha, pending) if base_sha and pending else []
+    for path in pending:
+        reason = _gitattributes_exclusion(_gitattributes(rules, path)) if rules else None
+        if reason:
+            generated[path] = reason
+    
+    async def has_header(d: FileDiff) -> bool:
+        patch_lines = _patch_new_lines(d)
+        first = [patch_lines.get(n) for n in range(1, GENERATED_HEADER_LINES + 1)]
+        if any(line is not None and _GO_GENERATED_HEADER.match(line) for line in first):
+            return True
+        # An added file's patch is the whole file
+        if d.status == FileStatus.ADDED or None not in first or head is None:
+            return False
+        try:
+            text = await _fetch_head_file_text(owner, repo, head, d.path, d)
+        except (ValueError, httpx.HTTPStatusError):
+            return False
+        return any(_GO_GENERATED_HEADER.match(line) for line in text.splitlines()[:GENERATED_HEADER_LINES])
+    
+    candidates = [d for d in diffs if d.path not in generated and d.path.endswith(".go") and d.reviewable]
+    for d, is_generated in zip(candidates, await _map_bounded(has_header, candidates)):
+        if is_generated:
+            generated[d.path] = "header"
+    return generated
+
+
+def _generated_entries(generated: Dict[str, str]) -> List[Dict[str, str]]:
+    return [{"filename": path, "reason": reason} for path, reason in generated.items()]
+
+
+def _generated_files_note(generated_files: List[Dict[str, str]]) -> str:
+    count = len(generated_files)
+    return f"{count} generated file{'s' if count != 1 else ''} changed, skipped."
+
+
+async def _select_analyzed_files(
+    owner: str,
+    repo: str,
+    diffs: List[FileDiff],
+    base_sha: Optional[str],
+    head: Optional[PRHead],
+    params: "GoAnalyzerInput"
+) -> Tuple[List[FileDiff], Dict[str, List[Dict[str, Any]]]]:
+    """
+    Set aside oversized files and, unless params.include_generated, generated ones.
+    
+    Returns the files to analyze and the skipped_large_files and
+    generated_files lists for the analyzer result.
+    """
+    kept, skipped = _skip_large_files(diffs, params.include_large_files)
+    generated = {} if params.include_generated else await _generated_files(owner, repo, kept, base_sha, head)
+    return (
+        [d for d in kept if d.path not in generated],
+        {"skipped_large_files": skipped, "generated_files": _generated_entries(generated)},
+    )
+
+
+def _large_files_note(skipped: List[Dict[str, Any]]) -> str:
+    count = len(skipped)
+    return f"{count} file{'s' if count != 1 else ''} over the size limits skipped, not reviewed."
+
+
+def _binary_files_note(binary_files: List[Dict[str, Any]]) -> str:
+    count = len(binary_files)
+    return f"{count} binary file{'s' if count != 1 else ''} changed, not reviewed."
+
+
+async def _fetch_file_text(owner: str, repo: str, path: str, ref: str) -> str:
+    """
+    Download a file's contents at ref, refusing files over GITHUB_FILE_CONTEXT_MAX_BYTES.
+    
+    The contents API only inlines files up to 1 MB; larger ones are read
+    through the git blob API. Contents come from the client's BlobCache
+    when the blob has been seen before; at a commit SHA a repeated lookup
+    makes no request.
+    """
+    blobs = _get_github_client().blobs
+    known = blobs.blob_at(owner, repo, ref, path)
+    content = blobs.get(known) if known else None
+    if content is not None:
+        return content.decode("utf-8", errors="replace")
+    
+    response = await _github_api_response("GET", f"/repos/{owner}/{repo}/contents/{path}", params={"ref": ref})
+    entry = response.json()
+    if isinstance(entry, list) or entry.get("type") != "file":
+        raise ValueError(f"{path} is not a file at {ref}")
+    if entry["size"] > GITHUB_FILE_CONTEXT_MAX_BYTES:
+        raise ValueError(
+            f"{path} is {entry['size']} bytes, over the {GITHUB_FILE_CONTEXT_MAX_BYTES} byte limit"
+        )
+    content = blobs.get(entry["sha"])
+    if content is None:
+        if entry.get("encoding") != "base64" or not entry.get("content"):
+            entry = {**entry, **await _github_api_request("GET", f"/repos/{owner}/{repo}/git/blobs/{entry['sha']}")}
+        content = base64.b64decode(entry["content"])
+        blobs.put(entry["sha"], content)
+    blobs.remember_path(owner, repo, ref, path, entry["sha"])
+    return content.decode("utf-8", errors="replace")
+
+
+def _patch_new_lines(diff: FileDiff) -> Dict[int, str]:
+    """Head-side lines the patch shows (added and context), by line number."""
+    return {ln.new_line: ln.content for h in diff.hunks for ln in h.lines if ln.kind in "+ "}
+
+
+async def _fetch_head_file_text(
+    owner: str, repo: str, head: PRHead, path: str, diff: Optional[FileDiff] = None
+) -> str:
+    """
+    Download a file at the PR head from the repository that holds the head commit.
+    
+    If a fork was deleted, the patch from the files API is all that is left:
+    it holds the whole file only when the PR adds it.
+    """
+    if not head.deleted:
+        return await _fetch_file_text(head.owner, head.repo, path, head.sha)
+    if diff is not None and diff.status == "added" and diff.hunks:
+        lines = _patch_new_lines(diff)
+        return "".join(lines[n] + "\n" for n in sorted(lines))
+    raise ValueError(f"The PR's head repository was deleted, so only the diff of {path} is available")
+
+
+async def _fetch_file_diffs(owner: str, repo: str, pr_number: int) -> Dict[str, FileDiff]:
+    """Fetch and parse every changed file of a pull request, keyed by path, with modes where they matter."""
+    files = await _fetch_pr_files(owner, repo, pr_number)
+    diffs = {f["filename"]: _file_diff_from_api(f) for f in files}
+    if any(_may_hide_mode(f) for f in files):
+        _apply_file_modes(diffs, await _fetch_file_modes(owner, repo, pr_number))
+    return diffs
+
+
+def _severity_at_least(severity: str, threshold: str) -> bool:
+    """Compare two finding severities."""
+    return FINDING_SEVERITIES.index(severity) >= FINDING_SEVERITIES.index(threshold)
+
+
+# A suggestion fence; group 1 is the replacement text
+_SUGGESTION_BLOCK = re.compile(r"```suggestion[^\n]*\n(.*?)```", re.DOTALL)
+
+
+def _data_marker(kind: str, data: Dict[str, Any]) -> str:
+    """Render a hidden HTML comment carrying data for later runs."""
+    return f"<!-- {kind} {json.dumps(data, separators=(',', ':'), sort_keys=True)} -->"
+
+
+def _parse_data_marker(body: str, kind: str) -> Optional[Dict[str, Any]]:
+    """Read the data of the last hidden marker of a kind in a body, or None."""
+    matches = re.findall(rf"<!-- {re.escape(kind)} (\{{.*?\}}) -->", body or "")
+    for raw in reversed(matches):
+        try:
+            return json.loads(raw)
+        except ValueError:
+            continue
+    return None
+
+
+# Any data marker, for stripping them from comment text
+_DATA_MARKER = re.compile(r"<!-- [\w:-]+ \{.*?\} -->")
+
+
+def _finding_id(finding: ReviewFinding) -> str:
+    """A stable ID of a finding, recorded in its comment so a retry never posts it twice."""
+    return hashlib.sha256(json.dumps(finding.model_dump(mode="json"), sort_keys=True).encode()).hexdigest()[:16]
+
+
+def _render_finding_body(
+    finding: ReviewFinding,
+    run_id: Optional[str] = None,
+    templates: Optional["ReviewTemplates"] = None,
+    context: Optional[Dict[str, Any]] = None
+) -> str:
+    """Render a finding's comment body with the inline_comment template, then add its review markers."""
+    templates = templates or _server_template_set()
+    context = context or {"Run": _template_run("", "", 0, run_id=run_id), "Policy": _template_policy(None)}
+    body = templates.render("inline_comment", {**context, "Finding": _template_finding(finding)})
+    data = {
+        k: v for k, v in (
+            ("severity", finding.severity), ("category", finding.category), ("rule", finding.rule), ("run_id", run_id),
+            ("finding_id", _finding_id(finding))
+        ) if v
+    }
+    return f"{body}\n\n{_data_marker(FINDING_DATA_MARKER, data)}\n{REVIEW_COMMENT_MARKER}"
+
+
+def _review_marker(
+    event: str,
+    severities: List[str],
+    head_sha: Optional[str] = None,
+    run_id: Optional[str] = None
+) -> str:
+    """The hidden marker recording a review run's verdict, finding counts and run ID."""
+    data = {
+        "event": event,
+        "head_sha": head_sha,
+        "findings": dict(Counter(severities)),
+    }
+    if run_id:
+        data["run_id"] = run_id
+    return _data_marker(REVIEW_DATA_MARKER, data)
+
+
+def _review_run_id(head_sha: str, findings: List[ReviewFinding], draft: bool = False) -> str:
+    """
+    Derive a posting's run ID from the commit and the set of findings.
+    
+    The same findings for the same head always give the same ID, in any
+    order, so a retry from a fresh process after a crash still recognises
+    the review it posted before. A draft-stage pass gets an ID of its own,
+    so the full review once the PR is ready is not taken for a repeat.
+    """
+    # Without a commit, a finding hashes as it did before commit findings existed
+    finding_set = sorted(
+        json.dumps(f.model_dump(mode="json", exclude={"commit"} if f.commit is None else None), sort_keys=True)
+        for f in findings
+    )
+    key = [head_sha, finding_set] + (["draft"] if draft else [])
+    return hashlib.sha256(json.dumps(key).encode()).hexdigest()[:16]
+
+
+async def _review_target(owner: str, repo: str, pr_number: int, commit_id: Optional[str]) -> Tuple[str, bool]:
+    """The commit a review applies to (commit_id, else the PR's current head) and whether the PR is a draft."""
+    snapshot = await _job_snapshot(owner, repo, pr_number)
+    pr_data = snapshot.pr if snapshot else await _fetch_pr(owner, repo, pr_number)
+    return commit_id or pr_data["head"]["sha"], bool(pr_data.get("draft"))
+
+
+async def _posted_review(owner: str, repo: str, pr_number: int, run_id: str) -> Optional[Dict[str, Any]]:
+    """
+    The review this server already posted on the PR with this run ID, or None.
+    
+    A dismissed review no longer counts, so the run can post its review again.
+    """
+    login = await _authenticated_login()
+    snapshot = await _job_snapshot(owner, repo, pr_number)
+    reviews = snapshot.reviews if snapshot else await _github_api_paginate(
+        f"/repos/{owner}/{repo}/pulls/{pr_number}/reviews"
+    )
+    for review in reviews:
+        data = _parse_data_marker(review.get("body"), REVIEW_DATA_MARKER) or {}
+        if (data.get("run_id") == run_id and review.get("state") != "DISMISSED"
+                and _login_matches(review.get("user"), login)):
+            return review
+    return None
+
+
+async def _already_posted_response(owner: str, repo: str, pr_number: int, review: Dict[str, Any], run_id: str) -> str:
+    """Successful create_review result for a run whose review is already on the PR."""
+    comments = await _github_api_paginate(f"/repos/{owner}/{repo}/pulls/{pr_number}/reviews/{review['id']}/comments")
+    return json.dumps({
+        "success": True,
+        "already_posted": True,
+        "run_id": run_id,
+        "html_url": review.get("html_url"),
+        "review_id": review["id"],
+        "state": review.get("state"),
+        "comments_posted": len(comments),
+        "message": f"Review {review['id']} with run ID {run_id} is already posted; nothing was posted again",
+    }, indent=2)
+
+
+async def _posted_finding_ids(owner: str, repo: str, pr_number: int) -> set:
+    """
+    IDs of the findings this server's comments on the PR already carry, from any earlier review.
+    
+    They come from the review state when it has them, and otherwise from
+    the markers of the PR's comments, which then seed the state.
+    """
+    stored = _review_state(owner, repo, pr_number).finding_ids
+    if stored is not None:
+        return set(stored)
+    login = await _authenticated_login()
+    posted = set()
+    for comment in await _github_api_paginate(f"/repos/{owner}/{repo}/pulls/{pr_number}/comments"):
+        data = _parse_data_marker(comment.get("body"), FINDING_DATA_MARKER) or {}
+        if data.get("finding_id") and _login_matches(comment.get("user"), login):
+            posted.add(data["finding_id"])
+    # Anything a concurrent run recorded meanwhile is kept
+    _update_review_state(
+        owner, repo, pr_number, lambda state: replace(state, finding_ids=sorted(posted | set(state.finding_ids or ())))
+    )
+    return posted
+
+
+async def _review_comments(owner: str, repo: str, pr_number: int, review_id: int) -> List[Dict[str, Any]]:
+    """The inline comments of a submitted review, with their URLs."""
+    comments = await _github_api_paginate(f"/repos/{owner}/{repo}/pulls/{pr_number}/reviews/{review_id}/comments")
+    return [
+        {"id": c["id"], "path": c.get("path"), "line": c.get("line") or c.get("original_line"),
+         "html_url": c.get("html_url")}
+        for c in comments
+    ]
+
+
+def _review_thread_input(review_node_id: Optional[str], comment: Dict[str, Any]) -> Dict[str, Any]:
+    """The addPullRequestReviewThread input for one comment of a Reviews API payload."""
+    thread_input = {
+        "pullRequestReviewId": review_node_id,
+        "path": comment["path"],
+        "line": comment["line"],
+        "side": comment["side"],
+        "body": comment["body"],
+    }
+    if "start_line" in comment:
+        thread_input["startLine"] = comment["start_line"]
+        thread_input["startSide"] = comment["start_side"]
+    return thread_input
+
+
+class PendingReviewExistsError(Exception):
+    """A review that needs a pending review of its own while the account already has one open on the PR."""
+    
+    def __init__(self, owner: str, repo: str, pr_number: int, review_id: int):
+        self.owner = owner
+        self.repo = repo
+        self.pr_number = pr_number
+        self.review_id = review_id
+        super().__init__(
+            f"GitHub refused the review's comments together, and posting them one at a time needs a pending "
+            f"review, but pending review {review_id} is already open on {owner}/{repo}#{pr_number} and GitHub "
+            f"allows one per account; submit it with github_pr_submit_pending_review or discard it with "
+            f"github_pr_discard_pending_review, then post the review again"
+        )
+    
+    def response(self) -> str:
+        """The tool result reporting the refusal."""
+        return json.dumps({
+            "error": str(self),
+            "error_code": "pending_review_exists",
+            "pending_review_id": self.review_id,
+            "success": False
+        })
+
+
+async def _own_pending_review(owner: str, repo: str, pr_number: int) -> Optional[Dict[str, Any]]:
+    """The pending review the authenticated account has open on a PR, if any."""
+    login = await _authenticated_login()
+    reviews = await _github_api_paginate(f"/repos/{owner}/{repo}/pulls/{pr_number}/reviews")
+    return next((r for r in reviews if r["state"] == "PENDING" and (r.get("user") or {}).get("login") == login), None)
+
+
+async def _post_review_comments_singly(
+    owner: str, repo: str, pr_number: int, payload: Dict[str, Any]
+) -> Tuple[Dict[str, Any], List[Tuple[int, str]]]:
+    """
+    Post a review whose batch of comments GitHub refused, one comment at a time.
+    
+    GitHub answers one bad anchor with a 422 for the whole batch and does not
+    say which comment it was. So the review is created pending, each comment
+    is added as its own thread, and the review is then submitted with the
+    summary and event. A failure outside the comments deletes the pending
+    review, so either the review is posted or nothing is.
+    
+    GitHub allows one pending review per account and PR, so this fails with
+    PendingReviewExistsError while one, e.g. a session's from
+    github_pr_start_pending_review, is open. Submitting that one instead
+    would publish the session's comments with this review's.
+    
+    Returns:
+        Tuple[Dict[str, Any], List[Tuple[int, str]]]: The submitted review, and
+            the index and GitHub's error for each comment it rejected
+    """
+    endpoint = f"/repos/{owner}/{repo}/pulls/{pr_number}/reviews"
+    # Omitting "event" leaves the review in the PENDING state
+    try:
+        pending = await _github_api_request("POST", endpoint, {k: payload[k] for k in ("commit_id",) if k in payload})
+    except httpx.HTTPStatusError as e:
+        existing = await _own_pending_review(owner, repo, pr_number) if e.response.status_code == 422 else None
+        if existing is not None:
+            raise PendingReviewExistsError(owner, repo, pr_number, existing["id"]) from e
+        raise
+    rejected = []
+    try:
+        for index, comment in enumerate(payload["comments"]):
+            try:
+                await _github_graphql(_ADD_REVIEW_THREAD_MUTATION, {"input": _review_thread_input(pending["node_id"], comment)})
+            except GitHubGraphQLError as e:
+                rejected.append((index, str(e)))
+            except httpx.HTTPStatusError as e:
+                rejected.append((index, _github_error_message(e)))
+        result = await _github_api_request(
+            "POST", f"{endpoint}/{pending['id']}/events", {"body": payload["body"], "event": payload["event"]}
+        )
+    except BaseException:
+        try:
+            await _github_api_request("DELETE", f"{endpoint}/{pending['id']}")
+        except Exception as e:
+            logger.warning("Could not delete pending review %s of %s/%s#%d: %s", pending["id"], owner, repo, pr_number, e)
+        raise
+    return result, rejected
+
+
+def _suggestion_problem(finding: ReviewFinding, file_diff: FileDiff, replacement: str) -> Optional[str]:
+    """
+    Explain why GitHub would reject a suggestion on the finding's lines, or return None.
+    
+    Suggestions replace new-side lines, so every line of the range must be an
+    added or context line of one hunk, and the replacement must change them.
+    """
+    start_line = finding.start_line if finding.start_line is not None else finding.line
+    if finding.side != "RIGHT" or (finding.start_side or finding.side) != "RIGHT":
+        return "suggestions can only replace lines on the RIGHT side of the diff"
+    current = {
+        diff_line.new_line: diff_line.content
+        for diff_line in file_diff.hunks[file_diff.locate(finding.line, "RIGHT")[0]].lines
+        if diff_line.kind in "+ "
+    }
+    missing = [n for n in range(start_line, finding.line + 1) if n not in current]
+    if missing:
+        return f"line {missing[0]} of the suggested range is not an added or context line of the diff"
+    existing = "\n".join(current[n] for n in range(start_line, finding.line + 1))
+    if replacement.removesuffix("\n") == existing:
+        return "the suggestion is identical to the current code"
+    return None
+
+
+def _check_suggestions(body: str, finding: ReviewFinding, file_diff: FileDiff) -> Tuple[str, List[str]]:
+    """
+    Turn suggestion blocks GitHub would reject into plain code blocks with a note.
+    
+    Returns:
+        Tuple[str, List[str]]: The body, and why each downgraded suggestion was invalid
+    """
+    problems: List[str] = []
+    
+    def check(match: "re.Match[str]") -> str:
+        problem = _suggestion_problem(finding, file_diff, match.group(1))
+        if problem is None:
+            return match.group(0)
+        problems.append(problem)
+        code = match.group(1) if match.group(1).endswith("\n") else match.group(1) + "\n"
+        return f"```\n{code}```\n_Not offered as a suggestion: {problem}._"
+    
+    return _SUGGESTION_BLOCK.sub(check, body), problems
+
+
+def _hunk_range(hunk: DiffHunk) -> str:
+    """Describe a hunk's new-side line range for error messages."""
+    return f"{hunk.new_start}-{hunk.new_start + max(hunk.new_count, 1) - 1}"
+
+
+def _validate_finding_range(finding: ReviewFinding, file_diff: FileDiff) -> Optional[str]:
+    """
+    Check that a multi-line finding describes a range GitHub can anchor.
+    
+    Args:
+        finding (ReviewFinding): Finding with `start_line` set
+        file_diff (FileDiff): Parsed diff of the finding's file
+    
+    Returns:
+        Optional[str]: A message explaining the problem, or None when the range is valid
+    """
+    start_side = finding.start_side or finding.side
+    if start_side == "RIGHT" and finding.side == "LEFT":
+        return "a range cannot start on the RIGHT side and end on the LEFT side"
+    if start_side == finding.side and finding.start_line > finding.line:
+        return f"start_line {finding.start_line} is after line {finding.line}"
+    
+    start = file_diff.locate(finding.start_line, start_side)
+    end = file_diff.locate(finding.line, finding.side)
+    if start is None:
+        return f"start_line {finding.start_line} ({start_side}) is not part of the diff"
+    if start[0] != end[0]:
+        return (
+            f"lines {finding.start_line}-{finding.line} span two hunks "
+            f"({_hunk_range(file_diff.hunks[start[0]])} and {_hunk_range(file_diff.hunks[end[0]])}); "
+            "multi-line comments must stay within a single hunk"
+        )
+    if start[1] > end[1]:
+        return f"start_line {finding.start_line} comes after line {finding.line} in the diff"
+    return None
+
+
+def _build_review_payload(
+    summary: str,
+    event: str,
+    findings: List[ReviewFinding],
+    file_diffs: Dict[str, FileDiff],
+    commit_id: Optional[str] = None,
+    run_id: Optional[str] = None,
+    marker: str = "",
+    templates: Optional["ReviewTemplates"] = None,
+    context: Optional[Dict[str, Any]] = None
+) -> Dict[str, Any]:
+    """
+    Turn findings into a single Reviews API payload.
+    
+    Findings that cannot be anchored to a line of the diff are not dropped:
+    they are listed in the review body instead, so one bad position never
+    fails the whole review. The body comes from the review template for the
+    event, and each comment from the inline_comment template.
+    
+    Args:
+        summary (str): Review summary body
+        event (str): Review event type
+        findings (List[ReviewFinding]): Findings to post
+        file_diffs (Dict[str, FileDiff]): Parsed PR diff keyed by path
+        commit_id (Optional[str]): Commit the review applies to
+        run_id (Optional[str]): Run ID embedded in each comment's marker
+        marker (str): Hidden review marker added after the rendered body
+        templates (Optional[ReviewTemplates]): Templates to render with; the server's by default
+        context (Optional[Dict[str, Any]]): Run, Policy and Notes of the template data
+    
+    Returns:
+        Dict[str, Any]: {"payload": request body, "placed": the finding index of
+            each comment, "unplaced": findings moved to the body (including every commit
+            finding), "invalid": findings with malformed line ranges, "downgraded":
+            suggestions posted as plain code blocks instead}
+    """
+    templates = templates or _server_template_set()
+    context = context or {"Run": _template_run("", "", 0, commit_id, run_id, event), "Policy": _template_policy(None)}
+    comments = []
+    placed = []
+    unplaced = []
+    invalid = []
+    downgraded = []
+    if any(not d.comment_addressable for d in file_diffs.values()):
+        raise ValueError(
+            "This diff compares two refs rather than a pull request, so it has no review to comment on; "
+            "report the findings in a summary or open a PR for the range"
+        )
+    for index, finding in enumerate(findings):
+        if finding.commit is not None:
+            unplaced.append(finding)
+            continue
+        file_diff = file_diffs.get(finding.path)
+        try:
+            if file_diff is None:
+                raise LineNotInDiffError(finding.path, finding.line, finding.side, [])
+            anchor = file_diff.anchor(finding.line, finding.side)
+        except LineNotInDiffError:
+            unplaced.append(finding)
+            continue
+        
+        comment = {
+            "path": finding.path,
+            "line": anchor["line"],
+            "side": anchor["side"],
+            "body": _render_finding_body(finding, run_id, templates, context),
+        }
+        if finding.start_line is not None:
+            error = _validate_finding_range(finding, file_diff)
+            if error:
+                invalid.append({"index": index, "path": finding.path, "error": error})
+                continue
+            comment["start_line"] = finding.start_line
+            comment["start_side"] = finding.start_side or finding.side
+        # GitHub answers a bad suggestion with a bare 422 for the whole review
+        comment["body"], problems = _check_suggestions(comment["body"], finding, file_diff)
+        downgraded.extend(
+            {"index": index, "path": finding.path, "line": finding.line, "reason": problem} for problem in problems
+        )
+        comments.append(comment)
+        placed.append(index)
+    
+    body = templates.render(templates.review_template(event), {
+        "Notes": [],
+        **context,
+        "Summary": summary,
+        "Findings": [_template_finding(f) for f in unplaced if f.commit is None],
+        "CommitFindings": [_template_finding(f) for f in unplaced if f.commit is not None],
+    })
+    if marker:
+        body += f"\n\n{marker}"
+    
+    payload: Dict[str, Any] = {"body": body, "event": event, "comments": comments}
+    if commit_id:
+        payload["commit_id"] = commit_id
+    return {"payload": payload, "placed": placed, "unplaced": unplaced, "invalid": invalid, "downgraded": downgraded}
+
+
+# ============================================================================
+# Suggestion Patches
+# ============================================================================
+
+@dataclass
+class SuggestedEdit:
+    """A suggestion block replacing new-side lines start to end of a file."""
+    path: str
+    start: int
+    end: int
+    replacement: str
+    
+    def lines(self, eol: str) -> List[str]:
+        # An empty block deletes the lines, as it does on GitHub
+        if not self.replacement:
+            return []
+        return [line + eol for line in self.replacement.removesuffix("\n").split("\n")]
+
+
+def _suggested_edits(comments: List[Dict[str, Any]]) -> List[SuggestedEdit]:
+    """The edits of the suggestion blocks left in review comments once _check_suggestions has run."""
+    edits = []
+    for comment in comments:
+        if comment["side"] != "RIGHT":
+            continue
+        for replacement in _SUGGESTION_BLOCK.findall(comment["body"]):
+            edits.append(SuggestedEdit(comment["path"], comment.get("start_line", comment["line"]), comment["line"], replacement))
+    return edits
+
+
+def _split_conflicts(edits: List[SuggestedEdit]) -> Tuple[List[SuggestedEdit], List[Dict[str, Any]]]:
+    """Split one file's edits into those that apply cleanly and groups touching overlapping lines."""
+    groups: List[List[SuggestedEdit]] = []
+    for edit in sorted(edits, key=lambda e: (e.start, e.end)):
+        if groups and edit.start <= max(e.end for e in groups[-1]):
+            groups[-1].append(edit)
+        else:
+            groups.append([edit])
+    clean = [group[0] for group in groups if len(group) == 1]
+    conflicts = [
+        {"path": group[0].path, "lines": [[e.start, e.end] for e in group]}
+        for group in groups if len(group) > 1
+    ]
+    return clean, conflicts
+
+
+def _apply_edits(text: str, edits: List[SuggestedEdit]) -> str:
+    """Apply non-overlapping edits to a file, keeping its line endings and a missing final newline."""
+    lines = text.splitlines(keepends=True)
+    for edit in sorted(edits, key=lambda e: e.start, reverse=True):
+        old = lines[edit.start - 1:edit.end]
+        new = edit.lines("\r\n" if old[0].endswith("\r\n") else "\n")
+        if edit.end == len(lines) and not old[-1].endswith("\n") and new:
+            new[-1] = new[-1].rstrip("\r\n")
+        lines[edit.start - 1:edit.end] = new
+    return "".join(lines)
+
+
+def _unified_diff(path: str, old: str, new: str) -> str:
+    """A git-style unified diff of one file."""
+    diff = difflib.unified_diff(
+        old.splitlines(keepends=True), new.splitlines(keepends=True), f"a/{path}", f"b/{path}"
+    )
+    return f"diff --git a/{path} b/{path}\n" + "".join(
+        line if line.endswith("\n") else f"{line}\n\\ No newline at end of file\n" for line in diff
+    )
+
+
+async def _suggestion_patch(
+    owner: str, repo: str, head: PRHead, comments: List[Dict[str, Any]], file_diffs: Dict[str, FileDiff]
+) -> Dict[str, Any]:
+    """
+    Assemble the suggestions of review comments into one patch against the head commit.
+    
+    Suggestions touching overlapping lines of a file are left out of the
+    patch and reported as conflicts, as are suggestions past the end of the
+    file; either would make the patch apply wrongly or not at all. A file
+    that cannot be read is reported in errors.
+    
+    Returns:
+        Dict[str, Any]: {"patch": the diff or None, "files", "suggestions"
+            applied, "conflicts", "errors"}
+    """
+    by_path: Dict[str, List[SuggestedEdit]] = {}
+    for edit in _suggested_edits(comments):
+        by_path.setdefault(edit.path, []).append(edit)
+    
+    async def read(path: str) -> Union[str, Exception]:
+        try:
+            return await _fetch_head_file_text(owner, repo, head, path, file_diffs.get(path))
+        except Exception as e:
+            return e
+    
+    paths = sorted(by_path)
+    texts = await _map_bounded(read, paths)
+    patches, files, conflicts, errors, applied = [], [], [], [], 0
+    for path, text in zip(paths, texts):
+        if isinstance(text, Exception):
+            errors.append({"path": path, "error": str(text)})
+            continue
+        edits, clashes = _split_conflicts(by_path[path])
+        conflicts.extend(clashes)
+        line_count = len(text.splitlines())
+        conflicts.extend(
+            {"path": path, "lines": [[e.start, e.end]], "reason": f"the file has {line_count} lines at the head commit"}
+            for e in edits if e.end > line_count
+        )
+        edits = [e for e in edits if e.end <= line_count]
+        if not edits:
+            continue
+        patches.append(_unified_diff(path, text, _apply_edits(text, edits)))
+        files.append(path)
+        applied += len(edits)
+    for conflict in conflicts:
+        conflict.setdefault("reason", "suggestions touch overlapping lines")
+    return {"patch": "".join(patches) or None, "files": files, "suggestions": applied,
+            "conflicts": conflicts, "errors": errors}
+
+
+def _patch_details(patch: Dict[str, Any]) -> str:
+    """The collapsed review summary block holding a suggestion patch."""
+    noun = _plural(len(patch["files"]), "file")
+    if len(patch["patch"]) > SUGGESTION_PATCH_MAX_CHARS:
+        return (f"> ℹ️ The suggested fixes make a patch across {noun} too long for the review; "
+                "it is in the tool result.")
+    fence = "`" * max(3, max((len(run) for run in re.findall(r"`+", patch["patch"])), default=0) + 1)
+    body = (
+        f"<details>\n<summary>Suggested fixes as a patch ({_plural(patch['suggestions'], 'suggestion')}, {noun})</summary>\n\n"
+        f"Save it as `fixes.patch` and run `git apply fixes.patch` from the repository root.\n\n"
+        f"{fence}diff\n{patch['patch']}{fence}\n"
+    )
+    if patch["conflicts"]:
+        body += "\nLeft out because they overlap or no longer fit the file:\n\n" + "\n".join(
+            f"- `{c['path']}` lines " + ", ".join(f"{start}-{end}" for start, end in c["lines"]) for c in patch["conflicts"]
+        ) + "\n"
+    return body + "\n</details>"
+
+
+# ============================================================================
+# Review Threads
+# ============================================================================
+
+_REVIEW_THREADS_QUERY = """
+query($owner: String!, $repo: String!, $number: Int!, $after: String) {
+  repository(owner: $owner, name: $repo) {
+    pullRequest(number: $number) {
+      reviewThreads(first: 100, after: $after) {
+        pageInfo { hasNextPage endCursor }
+        nodes {
+          id
+          isResolved
+          isOutdated
+          path
+          line
+          comments(first: 100) {
+            pageInfo { hasNextPage endCursor }
+            nodes { databaseId body author { login } }
+          }
+        }
+      }
+    }
+  }
+}
+"""
+
+
+def _normalize_comment_body(body: str) -> str:
+    """Reduce a comment body to its finding text for duplicate matching."""
+    body = body.replace(REVIEW_COMMENT_MARKER, "")
+    body = _DATA_MARKER.sub("", body)
+    body = _SUGGESTION_BLOCK.sub("", body)
+    return " ".join(body.split()).casefold()
+
+
+def _login_matches(author: Optional[Dict[str, Any]], login: str) -> bool:
+    """Compare a GraphQL author with a REST login; GraphQL drops the '[bot]' suffix."""
+    if not author:
+        return False
+    return author.get("login", "").removesuffix("[bot]") == login.removesuffix("[bot]")
+
+
+async def _existing_bot_comments(owner: str, repo: str, pr_number: int) -> List[Dict[str, Any]]:
+    """
+    List the unresolved inline comments this server already posted on a PR.
+    
+    Only thread-opening comments by the authenticated account that carry
+    REVIEW_COMMENT_MARKER count, so human comments are never matched.
+    """
+    login = await _authenticated_login()
+    existing = []
+    for thread in await _fetch_review_threads(owner, repo, pr_number):
+        comments = thread["comments"]["nodes"]
+        if thread["isResolved"] or not comments or thread.get("line") is None:
+            continue
+        first = comments[0]
+        if REVIEW_COMMENT_MARKER not in first["body"] or not _login_matches(first.get("author"), login):
+            continue
+        existing.append({
+            "path": thread["path"],
+            "line": thread["line"],
+            "body": _normalize_comment_body(first["body"]),
+            "finding_id": (_parse_data_marker(first["body"], FINDING_DATA_MARKER) or {}).get("finding_id"),
+        })
+    return existing
+
+
+def _drop_duplicate_findings(
+    findings: List[ReviewFinding],
+    existing: List[Dict[str, Any]],
+    templates: Optional["ReviewTemplates"] = None,
+    context: Optional[Dict[str, Any]] = None
+) -> Tuple[List[ReviewFinding], int]:
+    """
+    Drop findings an existing comment already posted.
+    
+    A comment matches by the finding ID in its marker, or by path and body
+    within the line drift. Posted bodies come from the inline_comment
+    template, so the body is compared both raw and rendered with templates
+    and context.
+    """
+    kept = []
+    for finding in findings:
+        finding_id = _finding_id(finding)
+        bodies = {_normalize_comment_body(finding.body)}
+        if templates is not None:
+            rendered = templates.render("inline_comment", {**(context or {}), "Finding": _template_finding(finding)})
+            bodies.add(_normalize_comment_body(rendered))
+        if any(
+            c["path"] == finding.path and (
+                c.get("finding_id") == finding_id
+                or c["body"] in bodies and abs(c["line"] - finding.line) <= DUPLICATE_LINE_DRIFT
+            )
+            for c in existing
+        ):
+            continue
+        kept.append(finding)
+    return kept, len(findings) - len(kept)
+
+
+_RESOLVE_THREAD_MUTATION = """
+mutation($threadId: ID!) {
+  resolveReviewThread(input: {threadId: $threadId}) { thread { id isResolved } }
+}
+"""
+
+_UNRESOLVE_THREAD_MUTATION = """
+mutation($threadId: ID!) {
+  unresolveReviewThread(input: {threadId: $threadId}) { thread { id isResolved } }
+}
+"""
+
+
+async def _fetch_review_threads(owner: str, repo: str, pr_number: int) -> List[Dict[str, Any]]:
+    """Fetch every review thread of a PR with all its comments, following GraphQL cursors."""
+    threads: List[Dict[str, Any]] = []
+    after: Optional[str] = None
+    while True:
+        data = await _github_graphql(
+            _REVIEW_THREADS_QUERY,
+            {"owner": owner, "repo": repo, "number": pr_number, "after": after}
+        )
+        connection = data["repository"]["pullRequest"]["reviewThreads"]
+        threads.extend(connection["nodes"])
+        if not connection["pageInfo"]["hasNextPage"]:
+            break
+        after = connection["pageInfo"]["endCursor"]
+    for thread in threads:
+        comments = await _remaining_nodes(
+            thread["comments"], _BULK_THREAD_COMMENTS_QUERY, {"id": thread["id"]},
+            lambda page: page["node"]["comments"]
+        )
+        thread["comments"] = {"nodes": comments}
+    return threads
+
+
+def _summarize_thread(thread: Dict[str, Any]) -> Dict[str, Any]:
+    """Reduce a GraphQL review thread to the fields the model needs."""
+    comments = thread["comments"]["nodes"]
+    first = comments[0] if comments else {}
+    return {
+        "thread_id": thread["id"],
+        "is_resolved": thread["isResolved"],
+        "is_outdated": thread["isOutdated"],
+        "path": thread.get("path"),
+        "line": thread.get("line"),
+        "comment_ids": [c["databaseId"] for c in comments],
+        "first_comment": {
+            "author": (first.get("author") or {}).get("login"),
+            "body": first.get("body", ""),
+        },
+    }
+
+
+async def _set_thread_resolution(params: ResolveThreadInput, resolve: bool) -> str:
+    """Resolve or unresolve the thread identified by a thread or comment ID."""
+    try:
+        thread_id = params.thread_id
+        if thread_id is None:
+            threads = await _fetch_review_threads(params.owner, params.repo, params.pr_number)
+            owning = [
+                t for t in threads
+                if params.comment_id in [c["databaseId"] for c in t["comments"]["nodes"]]
+            ]
+            if not owning:
+                return json.dumps({
+                    "error": f"No review thread on PR #{params.pr_number} contains comment {params.comment_id}",
+                    "success": False
+                })
+            thread_id = owning[0]["id"]
+        
+        mutation = _RESOLVE_THREAD_MUTATION if resolve else _UNRESOLVE_THREAD_MUTATION
+        if _dry_run(params):
+            return _dry_run_response(
+                [_planned_request("POST", "/graphql", {"query": mutation, "variables": {"threadId": thread_id}})],
+                thread_id=thread_id
+            )
+        data = await _github_graphql(mutation, {"threadId": thread_id})
+        thread = data["resolveReviewThread" if resolve else "unresolveReviewThread"]["thread"]
+        return json.dumps({"success": True, "thread_id": thread["id"], "is_resolved": thread["isResolved"]}, indent=2)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+# ============================================================================
+# Bulk PR Data
+# ============================================================================
+
+_BULK_ACTOR_FRAGMENT = """
+fragment BulkActor on Actor { __typename login }
+"""
+
+_BULK_REVIEW_FRAGMENT = """
+fragment BulkReview on PullRequestReview {
+  databaseId state body submittedAt url
+  author { ...BulkActor }
+  commit { oid }
+}
+"""
+
+_BULK_THREAD_FRAGMENT = """
+fragment BulkThread on PullRequestReviewThread {
+  id isResolved isOutdated path line
+  comments(first: 100) {
+    pageInfo { hasNextPage endCursor }
+    nodes { ...BulkComment }
+  }
+}
+"""
+
+_BULK_COMMENT_FRAGMENT = """
+fragment BulkComment on PullRequestReviewComment { databaseId body author { login } }
+"""
+
+_BULK_CONTEXT_FRAGMENT = """
+fragment BulkContext on StatusCheckRollupContext {
+  __typename
+  ... on CheckRun { databaseId name status conclusion detailsUrl url startedAt completedAt }
+}
+"""
+
+_BULK_REPOSITORY_FIELDS = "name owner { login }"
+
+_PR_BULK_QUERY = """
+query($owner: String!, $repo: String!, $number: Int!) {
+  repository(owner: $owner, name: $repo) {
+    pullRequest(number: $number) {
+      number title body state isDraft merged mergeable url createdAt updatedAt
+      additions deletions changedFiles
+      author { ...BulkActor }
+      baseRefName baseRefOid baseRepository { %(repository)s }
+      headRefName headRefOid headRepository { %(repository)s }
+      labels(first: 100) { pageInfo { hasNextPage endCursor } nodes { name color description } }
+      reviews(first: 100) { pageInfo { hasNextPage endCursor } nodes { ...BulkReview } }
+      reviewThreads(first: 100) { pageInfo { hasNextPage endCursor } nodes { ...BulkThread } }
+      commits(last: 1) {
+        nodes {
+          commit {
+            statusCheckRollup {
+              contexts(first: 100) { pageInfo { hasNextPage endCursor } nodes { ...BulkContext } }
+            }
+          }
+        }
+      }
+    }
+  }
+}
+""" % {"repository": _BULK_REPOSITORY_FIELDS} + _BULK_ACTOR_FRAGMENT + _BULK_REVIEW_FRAGMENT + \
+    _BULK_THREAD_FRAGMENT + _BULK_COMMENT_FRAGMENT + _BULK_CONTEXT_FRAGMENT
+
+
+def _bulk_page_query(connection: str, fields: str, *fragments: str) -> str:
+    """The query fetching one later page of a PR connection left unfinished by _PR_BULK_QUERY."""
+    return """
+query($owner: String!, $repo: String!, $number: Int!, $after: String) {
+  repository(owner: $owner, name: $repo) {
+    pullRequest(number: $number) {
+      %s(first: 100, after: $after) { pageInfo { hasNextPage endCursor } nodes { %s } }
+    }
+  }
+}
+""" % (connection, fields) + "".join(fragments)
+
+
+# Later pages of the connections _PR_BULK_QUERY starts, by the path to them within a page
+_BULK_PAGE_QUERIES = {
+    "labels": _bulk_page_query("labels", "name color description"),
+    "reviews": _bulk_page_query("reviews", "...BulkReview", _BULK_ACTOR_FRAGMENT, _BULK_REVIEW_FRAGMENT),
+    "reviewThreads": _bulk_page_query(
+        "reviewThreads", "...BulkThread", _BULK_THREAD_FRAGMENT, _BULK_COMMENT_FRAGMENT
+    ),
+}
+
+_BULK_CONTEXTS_PAGE_QUERY = """
+query($owner: String!, $repo: String!, $number: Int!, $after: String) {
+  repository(owner: $owner, name: $repo) {
+    pullRequest(number: $number) {
+      commits(last: 1) {
+        nodes {
+          commit {
+            statusCheckRollup {
+              contexts(first: 100, after: $after) { pageInfo { hasNextPage endCursor } nodes { ...BulkContext } }
+            }
+          }
+        }
+      }
+    }
+  }
+}
+""" + _BULK_CONTEXT_FRAGMENT
+
+_BULK_THREAD_COMMENTS_QUERY = """
+query($id: ID!, $after: String) {
+  node(id: $id) {
+    ... on PullRequestReviewThread {
+      comments(first: 100, after: $after) { pageInfo { hasNextPage endCursor } nodes { ...BulkComment } }
+    }
+  }
+}
+""" + _BULK_COMMENT_FRAGMENT
+
+
+@dataclass
+class PRSnapshot:
+    """
+    A PR's metadata together with its reviews, review threads, labels and check runs.
+    
+    Each part has the shape the REST API returns it in (review threads the
+    shape _fetch_review_threads returns), whichever API filled it, so
+    callers need not know how it was fetched.
+    """
+    pr: Dict[str, Any]
+    reviews: List[Dict[str, Any]]
+    review_threads: List[Dict[str, Any]]
+    labels: List[Dict[str, Any]]
+    check_runs: List[Dict[str, Any]]
+    fetched_via: str = "rest"
+
+
+async def _rest_pr_snapshot(owner: str, repo: str, pr_number: int) -> PRSnapshot:
+    """Gather a PR snapshot with one REST request per part."""
+    pr_data = await _fetch_pr(owner, repo, pr_number)
+    reviews = await _github_api_paginate(f"/repos/{owner}/{repo}/pulls/{pr_number}/reviews")
+    threads = await _fetch_review_threads(owner, repo, pr_number)
+    check_runs = _latest_by(
+        await _github_api_paginate(
+            f"/repos/{owner}/{repo}/commits/{pr_data['head']['sha']}/check-runs",
+            params={"filter": "all"}, items_key="check_runs"
+        ),
+        "name", "started_at"
+    )
+    return PRSnapshot(
+        pr=pr_data, reviews=reviews, review_threads=threads,
+        labels=pr_data.get("labels", []), check_runs=check_runs
+    )
+
+
+def _rest_user(actor: Optional[Dict[str, Any]]) -> Optional[Dict[str, Any]]:
+    """A GraphQL actor as a REST user; GraphQL drops the '[bot]' suffix of App logins."""
+    if not actor:
+        return None
+    login = actor["login"]
+    if actor.get("__typename") == "Bot" and not login.endswith("[bot]"):
+        login += "[bot]"
+    return {"login": login, "type": "Bot" if actor.get("__typename") == "Bot" else "User"}
+
+
+def _rest_repository(repository: Optional[Dict[str, Any]]) -> Optional[Dict[str, Any]]:
+    """A GraphQL repository as REST reports it under a PR's base or head (None for a deleted fork)."""
+    if repository is None:
+        return None
+    owner = repository["owner"]["login"]
+    return {"name": repository["name"], "full_name": f"{owner}/{repository['name']}", "owner": {"login": owner}}
+
+
+def _rest_pull_request(pr: Dict[str, Any], labels: List[Dict[str, Any]]) -> Dict[str, Any]:
+    """Translate the GraphQL pull request fields to the REST pull request object."""
+    return {
+        "number": pr["number"],
+        "title": pr["title"],
+        "body": pr.get("body"),
+        # GraphQL has a MERGED state where REST reports closed and merged
+        "state": "open" if pr["state"] == "OPEN" else "closed",
+        "merged": pr.get("merged", False),
+        "draft": pr.get("isDraft", False),
+        "mergeable": {"MERGEABLE": True, "CONFLICTING": False}.get(pr.get("mergeable")),
+        "user": _rest_user(pr.get("author")),
+        "base": {"ref": pr["baseRefName"], "sha": pr["baseRefOid"], "repo": _rest_repository(pr.get("baseRepository"))},
+        "head": {"ref": pr["headRefName"], "sha": pr["headRefOid"], "repo": _rest_repository(pr.get("headRepository"))},
+        "labels": labels,
+        "additions": pr.get("additions"),
+        "deletions": pr.get("deletions"),
+        "changed_files": pr.get("changedFiles"),
+        "html_url": pr.get("url"),
+        "created_at": pr.get("createdAt"),
+        "updated_at": pr.get("updatedAt"),
+    }
+
+
+def _rest_review(review: Dict[str, Any]) -> Dict[str, Any]:
+    """Translate a GraphQL review to the REST review object."""
+    return {
+        "id": review["databaseId"],
+        "user": _rest_user(review.get("author")),
+        "state": review["state"],
+        "body": review.get("body") or "",
+        "commit_id": (review.get("commit") or {}).get("oid"),
+        "submitted_at": review.get("submittedAt"),
+        "html_url": review.get("url"),
+    }
+
+
+def _rest_check_run(context: Dict[str, Any]) -> Dict[str, Any]:
+    """Translate a GraphQL check run to the REST check run object; GraphQL enums are upper case."""
+    return {
+        "id": context["databaseId"],
+        "name": context["name"],
+        "status": context["status"].lower(),
+        "conclusion": context["conclusion"].lower() if context.get("conclusion") else None,
+        "details_url": context.get("detailsUrl"),
+        "html_url": context.get("url"),
+        "started_at": context.get("startedAt"),
+        "completed_at": context.get("completedAt"),
+    }
+
+
+def _rollup_contexts(pr: Dict[str, Any]) -> Optional[Dict[str, Any]]:
+    """The status check rollup contexts connection of a PR's head commit, if it has any checks."""
+    commits = pr["commits"]["nodes"]
+    rollup = commits[0]["commit"].get("statusCheckRollup") if commits else None
+    return rollup["contexts"] if rollup else None
+
+
+async def _remaining_nodes(
+    connection: Dict[str, Any],
+    query: str,
+    variables: Dict[str, Any],
+    locate: Callable[[Dict[str, Any]], Dict[str, Any]]
+) -> List[Dict[str, Any]]:
+    """Collect a connection's nodes, fetching the pages after the first by its `after` cursor."""
+    nodes = list(connection["nodes"])
+    while connection["pageInfo"]["hasNextPage"]:
+        data = await _github_graphql(query, {**variables, "after": connection["pageInfo"]["endCursor"]})
+        connection = locate(data)
+        nodes.extend(connection["nodes"])
+    return nodes
+
+
+async def _graphql_pr_snapshot(owner: str, repo: str, pr_number: int) -> PRSnapshot:
+    """
+    Gather a PR snapshot with one GraphQL query, plus one per later page.
+    
+    Every connection is fetched 100 nodes at a time, so a PR with no more
+    than that many labels, reviews, threads, comments per thread and checks
+    takes a single request.
+    """
+    variables = {"owner": owner, "repo": repo, "number": pr_number}
+    data = await _github_graphql(_PR_BULK_QUERY, variables)
+    pr = data["repository"]["pullRequest"]
+    
+    def in_pr(name: str) -> Callable[[Dict[str, Any]], Dict[str, Any]]:
+        return lambda page: page["repository"]["pullRequest"][name]
+    
+    collected = {
+        name: await _remaining_nodes(pr[name], query, variables, in_pr(name))
+        for name, query in _BULK_PAGE_QUERIES.items()
+    }
+    for thread in collected["reviewThreads"]:
+        comments = await _remaining_nodes(
+            thread["comments"], _BULK_THREAD_COMMENTS_QUERY, {"id": thread["id"]},
+            lambda page: page["node"]["comments"]
+        )
+        thread["comments"] = {"nodes": comments}
+    
+    contexts = _rollup_contexts(pr)
+    if contexts:
+        contexts = await _remaining_nodes(
+            contexts, _BULK_CONTEXTS_PAGE_QUERY, variables,
+            lambda page: _rollup_contexts(page["repository"]["pullRequest"])
+        )
+    # The rollup also holds legacy commit statuses, which are not check runs
+    check_runs = [_rest_check_run(c) for c in contexts or [] if c["__typename"] == "CheckRun"]
+    
+    pr_data = _rest_pull_request(pr, collected["labels"])
+    if _get_github_client().track_pr_head(owner, repo, pr_number, pr_data["head"]["sha"]):
+        await _notify_pr_resources_updated(owner, repo, pr_number)
+    return PRSnapshot(
+        pr=pr_data,
+        reviews=[_rest_review(r) for r in collected["reviews"]],
+        review_threads=collected["reviewThreads"],
+        labels=collected["labels"],
+        check_runs=check_runs,
+        fetched_via="graphql",
+    )
+
+
+async def _fetch_pr_snapshot(owner: str, repo: str, pr_number: int) -> PRSnapshot:
+    """
+    Fetch a PR's metadata, reviews, review threads, labels and check runs.
+    
+    The client's bulk_fetch option picks GraphQL or REST. A GraphQL query
+    that fails, including for want of token scope, is retried over REST.
+    """
+    if _get_github_client().bulk_fetch == "graphql":
+        try:
+            return await _graphql_pr_snapshot(owner, repo, pr_number)
+        except GitHubGraphQLError as e:
+            logger.warning("GraphQL bulk fetch of %s/%s#%d failed (%s); falling back to REST", owner, repo, pr_number, e)
+        except httpx.HTTPStatusError as e:
+            if e.response.status_code not in (401, 403):
+                raise
+            logger.warning(
+                "GraphQL bulk fetch of %s/%s#%d was refused (%s); falling back to REST",
+                owner, repo, pr_number, _github_error_message(e)
+            )
+    return await _rest_pr_snapshot(owner, repo, pr_number)
+
+
+# PR snapshots shared by the steps of one queued review, keyed by (owner, repo, pr_number) in lower case; None
+# outside a review job, where every step fetches what it needs
+_job_snapshots: "contextvars.ContextVar[Optional[Dict[Tuple[str, str, int], PRSnapshot]]]" = contextvars.ContextVar(
+    "job_snapshots", default=None
+)
+
+
+async def _job_snapshot(owner: str, repo: str, pr_number: int) -> Optional[PRSnapshot]:
+    """
+    The snapshot of a PR for the review job running, fetched on first use; None outside a job.
+    
+    The steps of a webhook or batch review read the PR's head, draft state
+    and reviews from it, so the whole review costs one bulk fetch (see
+    _fetch_pr_snapshot) instead of a REST request per step.
+    """
+    snapshots = _job_snapshots.get()
+    if snapshots is None:
+        return None
+    key = (owner.lower(), repo.lower(), pr_number)
+    if key not in snapshots:
+        snapshots[key] = await _fetch_pr_snapshot(owner, repo, pr_number)
+    return snapshots[key]
+
+
+def _forget_job_snapshot(owner: str, repo: str, pr_number: int) -> None:
+    """Drop a PR's job snapshot before posting a review, so what is read afterwards includes it."""
+    snapshots = _job_snapshots.get()
+    if snapshots is not None:
+        snapshots.pop((owner.lower(), repo.lower(), pr_number), None)
+
+
+# ============================================================================
+# Pending Reviews
+# ============================================================================
+
+_ADD_REVIEW_THREAD_MUTATION = """
+mutation($input: AddPullRequestReviewThreadInput!) {
+  addPullRequestReviewThread(input: $input) { thread { id } }
+}
+"""
+
+
+def _pending_reviews(ctx: Optional[Context]) -> Dict[Tuple[str, str, int], Dict[str, Any]]:
+    """Return the session's pending reviews keyed by (owner, repo, pr_number)."""
+    return _session_state(ctx).setdefault("pending_reviews", {})
+
+
+def _no_pending_review(owner: str, repo: str, pr_number: int) -> str:
+    return json.dumps({
+        "error": f"No pending review for {owner}/{repo}#{pr_number} in this session; "
+                 "call github_pr_start_pending_review first",
+        "success": False
+    })
+
+
+# ============================================================================
+# Analyzers
+# ============================================================================
+
+# Go helper that parses sources with go/parser (see analyzers/goast)
+GO_AST_TOOL_DIR = Path(__file__).resolve().parent / "analyzers" / "goast"
+
+
+@dataclass
+class AnalyzerFinding:
+    """
+    A problem reported by a built-in analyzer, anchored to a line of the PR head (or base, side LEFT).
+    
+    Findings about a commit rather than a file, such as its message, have no
+    path or line and set commit instead.
+    """
+    analyzer: str
+    path: Optional[str]
+    line: Optional[int]
+    message: str
+    symbol: Optional[str] = None
+    severity: str = "warning"
+    rule: Optional[str] = None
+    side: str = "RIGHT"
+    commit: Optional[str] = None
+    
+    def to_review_finding(self) -> Dict[str, Any]:
+        """Return the finding as a github_pr_create_review `findings` item (a ReviewFinding)."""
+        return ReviewFinding(
+            path=self.path,
+            line=self.line,
+            side=self.side,
+            body=f"**{self.analyzer}**: {self.message}",
+            severity=self.severity,
+            category=ANALYZER_CATEGORIES.get(self.analyzer),
+            rule=self.rule or self.analyzer,
+            commit=self.commit,
+        ).model_dump(exclude_none=True)
+
+
+# ReviewFinding category of each built-in analyzer's findings
+ANALYZER_CATEGORIES = {
+    "go-doc": "documentation", "gofmt": "style", "go-vet": "correctness", "secrets": "security",
+    "policy": "configuration", "large-files": "maintainability", "missing-tests": "testing",
+    "dependencies": "dependencies", "api-compat": "compatibility", "markers": "maintainability",
+    "complexity": "maintainability", "go-security": "security", "commits": "style",
+    "config": "correctness", "docs": "documentation", "duplicates": "maintainability",
+}
+
+
+# Parallel lists an analyzer result is paged over
+ANALYZER_PAGED_KEYS = ("findings", "review_findings")
+
+
+def _analyzer_result(
+    findings: List[AnalyzerFinding],
+    errors: List[Dict[str, str]],
+    skipped: Optional[Dict[str, List[Dict[str, Any]]]] = None
+) -> Dict[str, Any]:
+    """
+    Full analyzer result; blocking covers every finding, not only the returned page.
+    
+    skipped holds the lists of files set aside before analysis, such as
+    skipped_large_files.
+    """
+    return {
+        "success": True,
+        "blocking": any(f.severity == "blocking" for f in findings),
+        "findings": [asdict(f) for f in findings],
+        "review_findings": [f.to_review_finding() for f in findings],
+        "errors": errors,
+        **(skipped or {}),
+    }
+
+
+async def _run_go_ast(analysis: str, sources: List[Dict[str, str]]) -> List[Dict[str, Any]]:
+    """Run one goast analysis over {path, source} entries and return its per-file results."""
+    result = await _run_command_async(["go", "run", ".", analysis], cwd=str(GO_AST_TOOL_DIR), input_text=json.dumps(sources))
+    if not result["success"]:
+        raise RuntimeError(f"goast {analysis} failed: {result['stderr'].strip()}")
+    return json.loads(result["stdout"])
+
+
+def _added_lines(diff: FileDiff) -> set:
+    return {ln.new_line for h in diff.hunks for ln in h.lines if ln.kind == "+"}
+
+
+def _undocumented_exports(diff: FileDiff, decls: List[Dict[str, Any]]) -> List[AnalyzerFinding]:
+    """
+    Report exported declarations without doc comments whose header touches an added line.
+    
+    Declarations that were already there and only had their bodies edited,
+    or were not touched at all, are left alone.
+    """
+    added = _added_lines(diff)
+    findings = []
+    for decl in decls:
+        if decl["has_doc"]:
+            continue
+        touched = sorted(added.intersection(range(decl["line"], decl["end_line"] + 1)))
+        if touched:
+            findings.append(AnalyzerFinding(
+                analyzer="go-doc",
+                path=diff.path,
+                line=touched[0],
+                symbol=decl["name"],
+                rule="go-doc/undocumented-export",
+                message=f"Exported {decl['kind']} `{decl['name']}` should have a doc comment "
+                        f"starting with `{decl['name']}`.",
+            ))
+    return findings
+
+
+def _touched_new_lines(diff: FileDiff) -> set:
+    """
+    Head-side lines a patch changes: added lines, plus the line where each
+    run of removed lines used to be, so a pure deletion counts too.
+    """
+    touched = set()
+    for hunk in diff.hunks:
+        removed = False
+        for ln in hunk.lines:
+            if ln.kind == "-":
+                removed = True
+                continue
+            if ln.kind == "+" or removed:
+                touched.add(ln.new_line)
+            removed = False
+        if removed and hunk.new_count:
+            touched.add(hunk.new_start + hunk.new_count - 1)
+    return touched
+
+
+def _untested_changes(
+    diff: FileDiff,
+    package: str,
+    head_funcs: List[Dict[str, Any]],
+    base_funcs: List[Dict[str, Any]],
+    tested: set
+) -> List[AnalyzerFinding]:
+    """
+    Report functions whose bodies a patch changes when no changed test references them.
+    
+    head_funcs and base_funcs are goast "funcs" declarations of the two
+    versions; a function whose token fingerprint is unchanged had only its
+    comments or formatting edited and is skipped, as is package main's main.
+    tested holds the identifiers the package's changed tests use.
+    """
+    touched = _touched_new_lines(diff)
+    base = {(d.get("receiver"), d["name"]): d["fingerprint"] for d in base_funcs}
+    findings = []
+    for decl in head_funcs:
+        lines = sorted(touched.intersection(range(decl["line"], decl["end_line"] + 1)))
+        receiver = decl.get("receiver")
+        if not lines or decl["name"] in tested:
+            continue
+        if package == "main" and decl["name"] == "main" and not receiver:
+            continue
+        if base.get((receiver, decl["name"])) == decl["fingerprint"]:
+            continue
+        symbol = f"{receiver}.{decl['name']}" if receiver else decl["name"]
+        findings.append(AnalyzerFinding(
+            analyzer="missing-tests",
+            path=diff.path,
+            line=lines[0],
+            symbol=symbol,
+            rule="missing-tests/untested-change",
+            message=f"`{symbol}` in `{diff.path}` changed, but no test in its package that references it "
+                    "was added or changed.",
+        ))
+    return findings
+
+
+# Default severity and remediation hint of each goast "security" rule; a policy
+# rule on "go-security/<rule>" regrades or turns one off
+GO_SECURITY_RULES: Dict[str, Tuple[str, str]] = {
+    "command-injection": ("error", "Use a fixed command and validate or allowlist every argument that comes from input."),
+    "sql-injection": ("error", "Use placeholders (`?` or `$1`) and pass the values as query arguments."),
+    "weak-random": ("warning", "Use crypto/rand for tokens, keys and other values that must be unpredictable."),
+    "insecure-listen": ("warning", "Serve with ListenAndServeTLS, or make sure TLS is terminated in front of this server."),
+    "insecure-tls": ("error", "Keep certificate verification on; add a private CA to RootCAs instead."),
+    "unsafe": ("warning", "Avoid package unsafe unless it is needed, and document why the use is safe."),
+}
+
+
+def _security_findings(diff: FileDiff, issues: List[Dict[str, Any]]) -> List[AnalyzerFinding]:
+    """Turn goast "security" issues whose span touches an added line into findings on that line."""
+    added = _added_lines(diff)
+    findings = []
+    for issue in issues:
+        touched = sorted(added.intersection(range(issue["line"], issue["end_line"] + 1)))
+        if not touched:
+            continue
+        severity, hint = GO_SECURITY_RULES.get(issue["rule"], ("warning", ""))
+        findings.append(AnalyzerFinding(
+            analyzer="go-security", path=diff.path, line=touched[0], severity=severity,
+            rule=f"go-security/{issue['rule']}", message=f"{issue['message']}. {hint}".strip(),
+        ))
+    return findings
+
+
+def _complexity_findings(
+    diff: FileDiff,
+    head_funcs: List[Dict[str, Any]],
+    base_funcs: List[Dict[str, Any]],
+    max_complexity: int,
+    max_lines: int,
+    max_increase: int
+) -> Tuple[List[AnalyzerFinding], List[Dict[str, Any]]]:
+    """
+    Measure the functions a patch changes and report those over the limits (0 disables one).
+    
+    head_funcs and base_funcs are goast "funcs" declarations of the two
+    versions. A function is compared with the base function of the same name
+    and receiver; one whose fingerprint is unchanged only had comments or
+    formatting edited and is skipped. Returns the findings and a measurement
+    of every changed function.
+    """
+    touched = _touched_new_lines(diff)
+    base = {(d.get("receiver"), d["name"]): d for d in base_funcs}
+    findings, measured = [], []
+    
+    def change(value: int, before: Optional[int]) -> str:
+        return "new in this PR" if before is None else f"{value - before:+d} in this PR"
+    
+    for decl in head_funcs:
+        lines = sorted(touched.intersection(range(decl["line"], decl["end_line"] + 1)))
+        old = base.get((decl.get("receiver"), decl["name"]))
+        if not lines or (old is not None and old["fingerprint"] == decl["fingerprint"]):
+            continue
+        symbol = f"{decl['receiver']}.{decl['name']}" if decl.get("receiver") else decl["name"]
+        length = decl["end_line"] - decl["line"] + 1
+        base_length = old["end_line"] - old["line"] + 1 if old else None
+        complexity, base_complexity = decl["complexity"], old["complexity"] if old else None
+        measured.append({
+            "path": diff.path, "symbol": symbol, "line": decl["line"],
+            "complexity": complexity, "base_complexity": base_complexity,
+            "lines": length, "base_lines": base_length,
+        })
+        over = bool(max_complexity) and complexity > max_complexity
+        grew = bool(max_increase) and base_complexity is not None and complexity - base_complexity > max_increase
+        if over or grew:
+            limit = f"over the limit of {max_complexity}" if over else f"more than the {max_increase} one PR may add"
+            findings.append(AnalyzerFinding(
+                analyzer="complexity", path=diff.path, line=lines[0], symbol=symbol, rule="complexity/cyclomatic",
+                message=f"`{symbol}` has cyclomatic complexity {complexity}, {change(complexity, base_complexity)}; "
+                        f"{limit}. Consider splitting it into smaller functions.",
+            ))
+        if max_lines and length > max_lines:
+            findings.append(AnalyzerFinding(
+                analyzer="complexity", path=diff.path, line=lines[0], symbol=symbol, rule="complexity/function-length",
+                message=f"`{symbol}` is {length} lines long, {change(length, base_length)}; "
+                        f"over the limit of {max_lines}.",
+            ))
+    return findings, measured
+
+
+async def _fetch_changed_go_sources(
+    owner: str, repo: str, pr_number: int, keep: Callable[[str], bool], params: "GoAnalyzerInput"
+) -> Tuple[Dict[str, FileDiff], List[Dict[str, str]], List[Dict[str, str]], Dict[str, List[Dict[str, Any]]]]:
+    """
+    Fetch the PR head contents of changed, non-test Go files.
+    
+    Returns the file diffs by path, {path, source} entries, per-file errors
+    for files that could not be downloaded, and the oversized and generated
+    files that were skipped (see _select_analyzed_files).
+    """
+    pr_data = await _fetch_pr(owner, repo, pr_number)
+    head = _pr_head(pr_data, owner, repo)
+    changed, skipped = await _select_analyzed_files(owner, repo, [
+        d for d in (await _fetch_file_diffs(owner, repo, pr_number)).values()
+        if d.path.endswith(".go") and not d.path.endswith("_test.go")
+        and d.reviewable and d.hunks and keep(d.path)
+    ], pr_data.get("base", {}).get("sha"), head, params)
+    diffs = {d.path: d for d in changed}
+    
+    async def fetch(path: str) -> Dict[str, str]:
+        try:
+            return {"path": path, "source": await _fetch_head_file_text(owner, repo, head, path, diffs[path])}
+        except (ValueError, httpx.HTTPStatusError) as e:
+            return {"path": path, "error": str(e)}
+    
+    fetched = await _map_bounded(fetch, list(diffs), progress="files")
+    return diffs, [f for f in fetched if "source" in f], [f for f in fetched if "error" in f], skipped
+
+
+async def _base_go_funcs(
+    owner: str, repo: str, base_sha: Optional[str], diffs: Dict[str, FileDiff]
+) -> Dict[str, List[Dict[str, Any]]]:
+    """
+    Parse the base versions of changed Go files into goast "funcs" declarations, by head path.
+    
+    Added files and files whose base version cannot be fetched or parsed are
+    left out, so every function in them counts as new.
+    """
+    async def fetch(path: str) -> Dict[str, str]:
+        d = diffs[path]
+        try:
+            return {"path": path, "source": await _fetch_file_text(owner, repo, d.old_path or path, base_sha)}
+        except (ValueError, httpx.HTTPStatusError) as e:
+            logger.info("No base version of %s: %s", path, e)
+            return {"path": path}
+    
+    bases = [
+        b for b in await _map_bounded(fetch, [p for p in diffs if diffs[p].status != FileStatus.ADDED])
+        if "source" in b
+    ]
+    return {
+        result["path"]: result.get("decls", [])
+        for result in (await _run_go_ast("funcs", bases) if bases else []) if not result.get("error")
+    }
+
+
+_GOFMT_FILE = re.compile(r"^diff (?:-u )?(\S+?)(?:\.orig)? ")
+_VET_POSITION = re.compile(r"^(?:vet: )?(?:\./)?(\S+?\.go):(\d+)(?::\d+)?: (.+)$")
+
+
+def _parse_gofmt_diff(output: str) -> List[AnalyzerFinding]:
+    """Turn `gofmt -d` output into one finding per hunk, at its first changed line."""
+    findings = []
+    path, old_no, reported = None, 0, False
+    for raw in output.splitlines():
+        header = _GOFMT_FILE.match(raw)
+        if header:
+            path = header.group(1)
+            continue
+        hunk = _HUNK_HEADER.match(raw)
+        if hunk:
+            old_no, reported = int(hunk.group(1)), False
+            continue
+        if path is None or raw.startswith(("---", "+++")):
+            continue
+        if not raw:
+            # Some diff writers drop the space on empty context lines
+            old_no += 1
+            continue
+        if raw[0] in "-+" and not reported:
+            findings.append(AnalyzerFinding(
+                analyzer="gofmt", path=path, line=max(old_no, 1), rule="gofmt/unformatted",
+                message="Not gofmt-formatted; run `gofmt -w` on this file."
+            ))
+            reported = True
+        if raw[0] in " -":
+            old_no += 1
+    return findings
+
+
+def _parse_vet_output(output: str, returncode: int, changed: List[str]) -> List[AnalyzerFinding]:
+    """
+    Turn `go vet` output into findings on the changed files.
+    
+    When vet fails without any positioned diagnostics (typically because the
+    module does not build), its whole output becomes one finding on the first
+    changed file instead of failing the call.
+    """
+    findings = []
+    for raw in output.splitlines():
+        match = _VET_POSITION.match(raw.strip())
+        if match and match.group(1) in changed:
+            findings.append(AnalyzerFinding(
+                analyzer="go-vet", path=match.group(1), line=int(match.group(2)), message=match.group(3)
+            ))
+    if returncode != 0 and not findings and changed:
+        findings.append(AnalyzerFinding(
+            analyzer="go-vet", path=changed[0], line=1, rule="go-vet/build-failed", severity="error",
+            message=f"go vet could not check the changed packages:\n```\n{output.strip()}\n```"
+        ))
+    return findings
+
+
+async def _fetch_package_sources(
+    owner: str, repo: str, directories: List[str], ref: str
+) -> Tuple[Dict[str, str], List[Dict[str, str]]]:
+    """
+    Download every Go file in the given package directories, plus the root
+    go.mod and go.sum, so the packages can be vetted without a full clone.
+    
+    Files are fetched concurrently; one that cannot be downloaded is
+    reported in the errors instead of failing the batch.
+    """
+    async def list_directory(directory: str) -> List[str]:
+        listing = (await _github_api_response(
+            "GET", f"/repos/{owner}/{repo}/contents/{directory}", params={"ref": ref}
+        )).json()
+        return [e["path"] for e in listing if e["type"] == "file" and e["name"].endswith(".go")]
+    
+    async def fetch(path: str) -> Tuple[str, Optional[str], Optional[str]]:
+        try:
+            return path, await _fetch_file_text(owner, repo, path, ref), None
+        except httpx.HTTPStatusError as e:
+            # A module without go.sum (or at the root at all) is fine
+            if e.response.status_code == 404 and path in ("go.mod", "go.sum"):
+                return path, None, None
+            return path, None, str(e)
+        except ValueError as e:
+            return path, None, str(e)
+    
+    paths = ["go.mod", "go.sum"] + [p for ps in await _map_bounded(list_directory, directories) for p in ps]
+    sources: Dict[str, str] = {}
+    errors: List[Dict[str, str]] = []
+    for path, text, error in await _map_bounded(fetch, paths, progress="package files"):
+        if text is not None:
+            sources[path] = text
+        elif error is not None:
+            errors.append({"path": path, "error": error})
+    return sources, errors
+
+
+# go.mod tokens: quoted strings, comments, block parentheses and bare words
+_GO_MOD_TOKEN = re.compile(r'"(?:[^"\\]|\\.)*"|`[^`]*`|//.*|[()]|[^\s()"`]+')
+# Major version suffix of a module path: /v2 and up, or gopkg.in's .v1 and up
+_MODULE_MAJOR_SUFFIX = re.compile(r"(?:/v([2-9]|[1-9]\d+)|\.v(\d+))$")
+_SEMVER = re.compile(r"^v(\d+)(?:\.(\d+))?(?:\.(\d+))?(?:-([0-9A-Za-z.-]+))?(?:\+[0-9A-Za-z.-]+)?$")
+
+
+@dataclass
+class GoModFile:
+    """The directives of a go.mod file that matter when reviewing dependency changes, with their lines."""
+    module: Optional[str] = None
+    go: Optional[str] = None
+    # Module path -> (version, indirect, line)
+    requires: Dict[str, Tuple[str, bool, int]] = field(default_factory=dict)
+    # (module path, version or None for every version) -> (replacement, its version or None, line)
+    replaces: Dict[Tuple[str, Optional[str]], Tuple[str, Optional[str], int]] = field(default_factory=dict)
+    # (module path, version) -> line
+    excludes: Dict[Tuple[str, str], int] = field(default_factory=dict)
+
+
+def _go_mod_unquote(token: str) -> str:
+    if token.startswith('"'):
+        return json.loads(token)
+    if token.startswith("`"):
+        return token[1:-1]
+    return token
+
+
+def _parse_go_mod(text: str) -> GoModFile:
+    """
+    Parse the module, go, require, replace and exclude directives of a go.mod,
+    in single-line or block form ("require ( ... )").
+    
+    Other directives and malformed lines are ignored; a require line whose
+    comment starts with "indirect" is marked indirect.
+    """
+    mod = GoModFile()
+    block = None
+    for number, raw in enumerate(text.splitlines(), 1):
+        tokens = _GO_MOD_TOKEN.findall(raw)
+        comment = next((t for t in tokens if t.startswith("//")), "")
+        words = [t for t in tokens if not t.startswith("//")]
+        if not words:
+            continue
+        if block is not None:
+            if words == [")"]:
+                block = None
+                continue
+            verb, args = block, words
+        elif len(words) == 2 and words[1] == "(":
+            block = words[0]
+            continue
+        else:
+            verb, args = words[0], words[1:]
+        args = [_go_mod_unquote(a) for a in args]
+        if verb == "module" and args:
+            mod.module = args[0]
+        elif verb == "go" and args:
+            mod.go = args[0]
+        elif verb == "require" and len(args) >= 2:
+            mod.requires[args[0]] = (args[1], bool(re.match(r"//\s*indirect\b", comment)), number)
+        elif verb == "exclude" and len(args) >= 2:
+            mod.excludes[(args[0], args[1])] = number
+        elif verb == "replace" and "=>" in args:
+            arrow = args.index("=>")
+            old, new = args[:arrow], args[arrow + 1:]
+            if old and new:
+                mod.replaces[(old[0], old[1] if len(old) > 1 else None)] = (
+                    new[0], new[1] if len(new) > 1 else None, number
+                )
+    return mod
+
+
+def _semver_key(version: str) -> Optional[Tuple[Any, ...]]:
+    """
+    Sort key of a semantic version following semver precedence (build
+    metadata such as +incompatible is ignored), or None if it is not one.
+    
+    Pseudo-versions are prereleases, so they order correctly against tags.
+    """
+    match = _SEMVER.match(version)
+    if not match:
+        return None
+    prerelease = match.group(4)
+    return (
+        int(match.group(1)), int(match.group(2) or 0), int(match.group(3) or 0),
+        (1,) if prerelease is None else (0, tuple(
+            (0, int(part), "") if part.isdigit() else (1, 0, part) for part in prerelease.split(".")
+        )),
+    )
+
+
+def _module_major(path: str, version: Optional[str]) -> Optional[int]:
+    """Major version of a module: its path suffix when it has one, otherwise its version's."""
+    suffix = _MODULE_MAJOR_SUFFIX.search(path)
+    if suffix:
+        return int(suffix.group(1) or suffix.group(2))
+    key = _semver_key(version) if version else None
+    return key[0] if key else None
+
+
+def _is_local_module_path(path: str) -> bool:
+    """Whether a replacement is a directory on disk rather than a module (as go.mod defines it)."""
+    return path.startswith(("./", "../", "/")) or path in (".", "..") or bool(re.match(r"^[A-Za-z]:[\\/]", path))
+
+
+def _replace_target(replacement: Optional[Tuple[str, Optional[str], int]]) -> Optional[str]:
+    if replacement is None:
+        return None
+    return f"{replacement[0]} {replacement[1]}" if replacement[1] else replacement[0]
+
+
+def _go_mod_changes(path: str, base: Optional[GoModFile], head: Optional[GoModFile]) -> Dict[str, Any]:
+    """
+    Compare two versions of a go.mod; either may be None when the file was added or removed.
+    
+    Requirements are "added", "removed", "upgraded", "downgraded" or
+    "changed" (when a version is not semver). A module that moves to another
+    major version path (example.com/m/v2 to /v3) is one upgrade or downgrade
+    rather than a removal and an addition. major marks changes across major
+    versions.
+    """
+    base, head = base or GoModFile(), head or GoModFile()
+    requirements = []
+    for module in sorted(set(base.requires) | set(head.requires)):
+        old, new = base.requires.get(module), head.requires.get(module)
+        if old and new and old[0] == new[0]:
+            continue
+        requirements.append({
+            "module": module,
+            "change": "added" if old is None else "removed" if new is None else "changed",
+            "old_version": old[0] if old else None,
+            "new_version": new[0] if new else None,
+            "indirect": (new or old)[1],
+            "line": new[2] if new else None,
+        })
+    # A move to another major version path is one change, not a removal and an addition
+    removed = {_MODULE_MAJOR_SUFFIX.sub("", r["module"]): r for r in requirements if r["change"] == "removed"}
+    moved = set()
+    for r in requirements:
+        old = removed.pop(_MODULE_MAJOR_SUFFIX.sub("", r["module"]), None) if r["change"] == "added" else None
+        if old is not None:
+            r.update(previous_module=old["module"], old_version=old["old_version"], change="changed")
+            moved.add(old["module"])
+    requirements = [r for r in requirements if not (r["change"] == "removed" and r["module"] in moved)]
+    for r in requirements:
+        r["major"] = False
+        if r["change"] != "changed":
+            continue
+        old_major = _module_major(r.get("previous_module", r["module"]), r["old_version"])
+        new_major = _module_major(r["module"], r["new_version"])
+        old_key, new_key = _semver_key(r["old_version"]), _semver_key(r["new_version"])
+        if old_major is not None and new_major is not None and old_major != new_major:
+            r["change"] = "upgraded" if new_major > old_major else "downgraded"
+            r["major"] = True
+        elif old_key is not None and new_key is not None:
+            r["change"] = "upgraded" if new_key > old_key else "downgraded"
+    
+    replaces = []
+    for key in sorted(set(base.replaces) | set(head.replaces), key=lambda k: (k[0], k[1] or "")):
+        old, new = base.replaces.get(key), head.replaces.get(key)
+        if old and new and old[:2] == new[:2]:
+            continue
+        replaces.append({
+            "module": key[0],
+            "version": key[1],
+            "change": "added" if old is None else "removed" if new is None else "changed",
+            "old_target": _replace_target(old),
+            "new_target": _replace_target(new),
+            "local": new is not None and _is_local_module_path(new[0]),
+            "line": new[2] if new else None,
+        })
+    excludes = [
+        {"module": m, "version": v, "change": change}
+        for change, side, other in (("added", head, base), ("removed", base, head))
+        for m, v in sorted(set(side.excludes) - set(other.excludes))
+    ]
+    return {
+        "path": path,
+        "module": head.module or base.module,
+        "go_version": {"old": base.go, "new": head.go} if base.go != head.go else None,
+        "requirements": requirements,
+        "replaces": replaces,
+        "excludes": excludes,
+    }
+
+
+def _go_sum_entries(text: str) -> set:
+    """(module, version) pairs whose go.mod a go.sum has a checksum for."""
+    entries = set()
+    for line in text.splitlines():
+        fields = line.split()
+        if len(fields) == 3 and fields[1].endswith("/go.mod"):
+            entries.add((fields[0], fields[1].removesuffix("/go.mod")))
+    return entries
+
+
+def _dependency_findings(
+    changes: Dict[str, Any], head: GoModFile, go_sum_changed: bool, go_sum: Optional[str]
+) -> List[AnalyzerFinding]:
+    """
+    Findings for one go.mod's changes: downgrades, replace directives that
+    now point at a local directory, and requirements go.sum has no checksum for.
+    
+    go_sum is the head go.sum next to the go.mod, None if it is missing;
+    requirements replaced by another module or directory are not checked
+    against it, since their checksums belong to the replacement.
+    """
+    path = changes["path"]
+    findings = []
+    for r in changes["requirements"]:
+        if r["change"] == "downgraded":
+            findings.append(AnalyzerFinding(
+                analyzer="dependencies", path=path, line=r["line"], symbol=r["module"],
+                rule="dependencies/downgrade",
+                message=f"`{r['module']}` is downgraded from {r['old_version']} to {r['new_version']}.",
+            ))
+    for r in changes["replaces"]:
+        if r["local"] and (r["change"] == "added" or not _is_local_module_path(r["old_target"])):
+            findings.append(AnalyzerFinding(
+                analyzer="dependencies", path=path, line=r["line"], symbol=r["module"],
+                rule="dependencies/local-replace", severity="error",
+                message=f"`replace {r['module']} => {r['new_target']}` points at a local directory, "
+                        "so the module no longer builds outside this checkout.",
+            ))
+    updated = [
+        r for r in changes["requirements"]
+        if r["new_version"] and (r["module"], None) not in head.replaces
+        and (r["module"], r["new_version"]) not in head.replaces
+    ]
+    go_sum_path = os.path.join(os.path.dirname(path), "go.sum")
+    if updated and not go_sum_changed:
+        findings.append(AnalyzerFinding(
+            analyzer="dependencies", path=path, line=updated[0]["line"], symbol=updated[0]["module"],
+            rule="dependencies/go-sum-not-updated",
+            message=f"Requirements changed but `{go_sum_path}` did not; run `go mod tidy`.",
+        ))
+    elif updated:
+        known = _go_sum_entries(go_sum or "")
+        for r in updated:
+            if (r["module"], r["new_version"]) not in known:
+                findings.append(AnalyzerFinding(
+                    analyzer="dependencies", path=path, line=r["line"], symbol=r["module"],
+                    rule="dependencies/go-sum-missing",
+                    message=f"`{go_sum_path}` has no checksum for {r['module']} {r['new_version']}; "
+                            "run `go mod tidy`.",
+                ))
+    return findings
+
+
+# File names read, in order, when the licenses API cannot name a module's license
+LICENSE_FILE_NAMES = ("LICENSE", "LICENSE.md", "LICENSE.txt", "LICENCE", "COPYING")
+
+# SPDX IDs recognized in license file text; every pattern of an entry must match,
+# and the first matching entry wins, so the more specific texts come first
+_LICENSE_TEXT_PATTERNS: List[Tuple[str, List["re.Pattern[str]"]]] = [
+    (spdx, [re.compile(p, re.IGNORECASE) for p in patterns]) for spdx, patterns in [
+        ("AGPL-3.0", [r"GNU AFFERO GENERAL PUBLIC LICENSE"]),
+        ("LGPL-3.0", [r"GNU LESSER GENERAL PUBLIC LICENSE Version 3"]),
+        ("LGPL-2.1", [r"GNU LESSER GENERAL PUBLIC LICENSE Version 2\.1"]),
+        ("GPL-3.0", [r"GNU GENERAL PUBLIC LICENSE Version 3"]),
+        ("GPL-2.0", [r"GNU GENERAL PUBLIC LICENSE Version 2"]),
+        ("MPL-2.0", [r"Mozilla Public License,? (?:Version|v\.?) ?2\.0"]),
+        ("Apache-2.0", [r"Apache License,? Version 2\.0"]),
+        ("BSD-3-Clause", [r"Redistributions of source code must retain", r"Neither the name"]),
+        ("BSD-2-Clause", [r"Redistributions of source code must retain"]),
+        ("ISC", [r"Permission to use, copy, modify, and(?:/or)? distribute this software for any purpose"]),
+        ("MIT", [r"Permission is hereby granted, free of charge, to any person obtaining a copy"]),
+        ("Unlicense", [r"This is free and unencumbered software released into the public domain"]),
+    ]
+]
+
+# A pseudo-version names a commit by its 12-character hash prefix
+_PSEUDO_VERSION_COMMIT = re.compile(r"-(?:\d+\.)?\d{14}-([0-9a-f]{12})$")
+
+# Licenses found for module versions, by "module@version"; a version's contents never change
+_module_licenses: Dict[str, Dict[str, Any]] = {}
+
+
+def _identify_license_text(text: str) -> Optional[str]:
+    """SPDX ID of a license file's text, or None if it is none of the licenses known here."""
+    text = " ".join(text.split())
+    return next((spdx for spdx, patterns in _LICENSE_TEXT_PATTERNS if all(p.search(text) for p in patterns)), None)
+
+
+def _github_module_source(module: str, version: str) -> Optional[Tuple[str, str, str]]:
+    """
+    The (owner, repo, ref) a module version is published from on the configured
+    GitHub host, or None for modules hosted elsewhere.
+    
+    The ref is the commit of a pseudo-version, otherwise the version's tag,
+    which for a module in a subdirectory carries the directory as a prefix
+    (tools/v1.2.0). A /vN major version suffix is not a directory.
+    """
+    parts = _MODULE_MAJOR_SUFFIX.sub("", module).split("/")
+    if len(parts) < 3 or parts[0] != _github_web_host():
+        return None
+    commit = _PSEUDO_VERSION_COMMIT.search(version)
+    if commit:
+        return parts[1], parts[2], commit.group(1)
+    tag = version.split("+", 1)[0]
+    return parts[1], parts[2], "/".join(parts[3:] + [tag])
+
+
+async def _module_license(module: str, version: str) -> Dict[str, Any]:
+    """
+    Identify the license of a module version by its GitHub repository.
+    
+    A module in a subdirectory is licensed by the LICENSE_FILE_NAMES files
+    in that directory when it has one. Otherwise the licenses API is asked
+    for the repository's license; when it finds none or cannot name it
+    (NOASSERTION), the root's LICENSE_FILE_NAMES files are matched against
+    known license texts. Files are read at the version's ref. spdx_id is
+    None when nothing names one. source is None for modules not on the configured GitHub,
+    whose license cannot be checked. Failed requests raise and are not cached.
+    """
+    key = f"{module}@{version}"
+    if key in _module_licenses:
+        return _module_licenses[key]
+    location = _github_module_source(module, version)
+    if location is None:
+        return {"spdx_id": None, "source": None, "reason": f"not hosted on {_github_web_host()}"}
+    owner, repo, ref = location
+    
+    async def license_file(directory: str) -> Optional[Dict[str, Any]]:
+        for name in (posixpath.join(directory, n) for n in LICENSE_FILE_NAMES):
+            try:
+                text = await _fetch_file_text(owner, repo, name, ref)
+            except httpx.HTTPStatusError as e:
+                if e.response.status_code != 404:
+                    raise
+                continue
+            spdx = _identify_license_text(text)
+            found = {"spdx_id": spdx, "source": f"{name}@{ref}"}
+            if spdx is None:
+                found["reason"] = f"{name} at {ref} is not a license this server recognizes"
+            return found
+        return None
+    
+    subdirectory = "/".join(_MODULE_MAJOR_SUFFIX.sub("", module).split("/")[3:])
+    result = await license_file(subdirectory) if subdirectory else None
+    if result is None:
+        try:
+            response = await _github_api_response("GET", f"/repos/{owner}/{repo}/license", params={"ref": ref})
+            spdx = (response.json().get("license") or {}).get("spdx_id")
+            if spdx and spdx != "NOASSERTION":
+                result = {"spdx_id": spdx, "source": "licenses-api"}
+        except httpx.HTTPStatusError as e:
+            if e.response.status_code != 404:
+                raise
+    if result is None:
+        result = await license_file("")
+    if result is None:
+        result = {"spdx_id": None, "source": f"{owner}/{repo}@{ref}", "reason": f"no license file at {ref}"}
+    _module_licenses[key] = result
+    return result
+
+
+async def _requirement_licenses(
+    path: str, head: GoModFile, added: List[Dict[str, Any]], policy: "LicensePolicy"
+) -> List[AnalyzerFinding]:
+    """
+    Look up the license of each newly added requirement and classify it by the policy.
+    
+    Each requirement gets a license entry: spdx_id, its source, and a status
+    of "allowed", "denied", "unknown" (no license, or one not recognized) or
+    "unverified" (hosted off GitHub, replaced by a local directory, or the
+    lookup failed). A replaced module is checked as its replacement.
+    Denied and unknown licenses are error findings; unverified ones are info,
+    so they are reported rather than passed silently.
+    """
+    async def check(r: Dict[str, Any]) -> Dict[str, Any]:
+        module, version = r["module"], r["new_version"]
+        replacement = head.replaces.get((module, version)) or head.replaces.get((module, None))
+        if replacement is not None:
+            if replacement[1] is None:
+                return {"spdx_id": None, "source": None, "reason": f"replaced by the directory {replacement[0]}"}
+            module, version = replacement[0], replacement[1]
+        try:
+            return dict(await _module_license(module, version))
+        except (ValueError, httpx.HTTPError) as e:
+            return {"spdx_id": None, "source": None, "reason": f"the lookup failed: {e}"}
+    
+    findings = []
+    for r, found in zip(added, await _map_bounded(check, added, progress="module licenses")):
+        if found["source"] is None:
+            found["status"] = "unverified"
+        elif found["spdx_id"] is None:
+            found["status"] = "unknown"
+        else:
+            found["status"] = policy.status(found["spdx_id"])
+        r["license"] = found
+        name = f"`{r['module']}` {r['new_version']}"
+        if found["status"] == "denied":
+            findings.append(AnalyzerFinding(
+                analyzer="dependencies", path=path, line=r["line"], symbol=r["module"],
+                rule="dependencies/license-denied", severity="error",
+                message=f"{name} is licensed under {found['spdx_id']}, which the review policy does not allow.",
+            ))
+        elif found["status"] == "unknown":
+            findings.append(AnalyzerFinding(
+                analyzer="dependencies", path=path, line=r["line"], symbol=r["module"],
+                rule="dependencies/license-unknown", severity="error",
+                message=f"The license of {name} could not be identified ({found['reason']}); check it before merging.",
+            ))
+        elif found["status"] == "unverified":
+            findings.append(AnalyzerFinding(
+                analyzer="dependencies", path=path, line=r["line"], symbol=r["module"],
+                rule="dependencies/license-unverified", severity="info",
+                message=f"The license of {name} was not checked: {found['reason']}.",
+            ))
+    return findings
+
+
+_LICENSE_STATUS_MARKS = {"allowed": "", "denied": "⛔ ", "unknown": "⚠️ ", "unverified": ""}
+
+
+def _license_cell(r: Dict[str, Any]) -> str:
+    found = r.get("license")
+    if found is None:
+        return "—"
+    if found["status"] in ("allowed", "denied"):
+        return f"{_LICENSE_STATUS_MARKS[found['status']]}{found['spdx_id']}" + (" (denied)" if found["status"] == "denied" else "")
+    return f"{_LICENSE_STATUS_MARKS[found['status']]}{found['status']}"
+
+
+def _dependency_markdown(modules: List[Dict[str, Any]]) -> str:
+    """One table of requirement changes per go.mod, followed by its replace, exclude and go changes."""
+    sections = []
+    for changes in modules:
+        lines = [f"**`{changes['path']}`**" + (f" (`{changes['module']}`)" if changes["module"] else "")]
+        if changes["go_version"]:
+            lines.append(f"- go {changes['go_version']['old'] or '—'} → {changes['go_version']['new'] or '—'}")
+        if changes["requirements"]:
+            # The license column only appears when added requirements were checked
+            licensed = any("license" in r for r in changes["requirements"])
+            lines += ["", "| Module | Change | Old | New |" + (" License |" if licensed else ""),
+                      "|---|---|---|---|" + ("---|" if licensed else "")]
+            for r in changes["requirements"]:
+                module = f"`{r['module']}`" + (f" (was `{r['previous_module']}`)" if r.get("previous_module") else "")
+                change = r["change"] + (", ⚠️ major version" if r["major"] else "") + (" (indirect)" if r["indirect"] else "")
+                lines.append(f"| {module} | {change} | {r['old_version'] or '—'} | {r['new_version'] or '—'} |"
+                             + (f" {_license_cell(r)} |" if licensed else ""))
+            lines.append("")
+        for r in changes["replaces"]:
+            version = f" {r['version']}" if r["version"] else ""
+            target = {
+                "added": f"→ `{r['new_target']}`", "removed": f"(was `{r['old_target']}`)",
+                "changed": f"`{r['old_target']}` → `{r['new_target']}`",
+            }[r["change"]]
+            lines.append(f"- replace `{r['module']}{version}` {r['change']} {target}" + (" ⚠️ local path" if r["local"] else ""))
+        for e in changes["excludes"]:
+            lines.append(f"- exclude `{e['module']} {e['version']}` {e['change']}")
+        sections.append("\n".join(lines).strip())
+    return "\n\n".join(sections)
+
+
+async def _dependency_report(
+    owner: str, repo: str, pr_number: int, keep: Callable[[str], bool],
+    licenses: Optional["LicensePolicy"] = None
+) -> Tuple[List[Dict[str, Any]], List[AnalyzerFinding], List[Dict[str, str]]]:
+    """
+    Compare every go.mod the PR changes at its base and head.
+    
+    Returns the changes of each go.mod with requirement differences, the
+    findings on them, and per-file errors for versions that could not be
+    downloaded. Each module's go.sum is the one in the go.mod's directory.
+    With a license policy, the licenses of added requirements are checked too.
+    """
+    pr_data = await _fetch_pr(owner, repo, pr_number)
+    head, base_sha = _pr_head(pr_data, owner, repo), pr_data.get("base", {}).get("sha")
+    file_diffs = await _fetch_file_diffs(owner, repo, pr_number)
+    go_mods = [d for d in file_diffs.values() if os.path.basename(d.path) == "go.mod" and keep(d.path)]
+    
+    async def fetch(d: FileDiff) -> Tuple[FileDiff, Optional[str], Optional[str], Optional[str], Optional[str]]:
+        go_sum_path = os.path.join(os.path.dirname(d.path), "go.sum")
+        go_sum_diff = file_diffs.get(go_sum_path)
+        try:
+            base = None if d.status == FileStatus.ADDED else await _fetch_file_text(owner, repo, d.old_path or d.path, base_sha)
+            if d.status == FileStatus.REMOVED:
+                return d, base, None, None, None
+            current = await _fetch_head_file_text(owner, repo, head, d.path, d)
+            go_sum = None
+            if go_sum_diff is not None and go_sum_diff.status != FileStatus.REMOVED:
+                go_sum = await _fetch_head_file_text(owner, repo, head, go_sum_path, go_sum_diff)
+            return d, base, current, go_sum, None
+        except (ValueError, httpx.HTTPStatusError) as e:
+            return d, None, None, None, str(e)
+    
+    modules, findings, errors = [], [], []
+    for d, base, current, go_sum, error in await _map_bounded(fetch, go_mods, progress="go.mod files"):
+        if error is not None:
+            errors.append({"path": d.path, "error": error})
+            continue
+        head_mod = _parse_go_mod(current) if current is not None else None
+        changes = _go_mod_changes(d.path, _parse_go_mod(base) if base is not None else None, head_mod)
+        if not (changes["requirements"] or changes["replaces"] or changes["excludes"] or changes["go_version"]):
+            continue
+        modules.append(changes)
+        if head_mod is not None:
+            go_sum_changed = os.path.join(os.path.dirname(d.path), "go.sum") in file_diffs
+            findings.extend(_dependency_findings(changes, head_mod, go_sum_changed, go_sum))
+            added = [r for r in changes["requirements"] if r["change"] == "added"]
+            if licenses is not None and added:
+                findings.extend(await _requirement_licenses(d.path, head_mod, added, licenses))
+    modules.sort(key=lambda m: m["path"])
+    return modules, findings, errors
+
+
+# Path segments under which packages are not API: internal/ cannot be
+# imported by other modules, and go build ignores testdata/ and vendor/
+API_EXEMPT_SEGMENTS = ("internal", "testdata", "vendor")
+
+# How findings name each kind of goast "api" declaration
+_API_KIND_NOUNS = {
+    "func": "function", "method": "method", "type": "type", "field": "field", "var": "variable",
+    "const": "constant", "interface-method": "interface method", "embedded": "embedded interface element",
+}
+
+
+def _api_package_dirs(diffs: List[FileDiff], keep: Callable[[str], bool]) -> List[str]:
+    """Directories of the importable packages whose non-test Go files a PR changes, on either side."""
+    directories = set()
+    for d in diffs:
+        for path in {d.path, d.old_path or d.path}:
+            if (
+                path.endswith(".go") and not path.endswith("_test.go") and keep(path)
+                and not set(path.split("/")[:-1]) & set(API_EXEMPT_SEGMENTS)
+            ):
+                directories.add(os.path.dirname(path))
+    return sorted(directories)
+
+
+async def _fetch_go_package_files(
+    owner: str, repo: str, directories: List[str], ref: str
+) -> Tuple[List[Dict[str, str]], List[Dict[str, str]]]:
+    """
+    Download the non-test Go files of package directories at ref as {path, source} entries.
+    
+    A directory missing at ref, as for a package the PR adds or deletes,
+    has no files; a file that cannot be downloaded is reported in the errors.
+    """
+    async def list_directory(directory: str) -> List[str]:
+        try:
+            listing = (await _github_api_response(
+                "GET", f"/repos/{owner}/{repo}/contents/{directory}", params={"ref": ref}
+            )).json()
+        except httpx.HTTPStatusError as e:
+            if e.response.status_code == 404:
+                return []
+            raise
+        return [
+            e["path"] for e in (listing if isinstance(listing, list) else [])
+            if e["type"] == "file" and e["name"].endswith(".go") and not e["name"].endswith("_test.go")
+        ]
+    
+    async def fetch(path: str) -> Dict[str, str]:
+        try:
+            return {"path": path, "source": await _fetch_file_text(owner, repo, path, ref)}
+        except (ValueError, httpx.HTTPStatusError) as e:
+            return {"path": path, "error": str(e)}
+    
+    paths = [p for ps in await _map_bounded(list_directory, directories) for p in ps]
+    fetched = await _map_bounded(fetch, paths, progress="package files")
+    return [f for f in fetched if "source" in f], [f for f in fetched if "error" in f]
+
+
+def _api_breaks(
+    package: str, base: List[Dict[str, Any]], head: List[Dict[str, Any]], pr_paths: Dict[str, str]
+) -> List[AnalyzerFinding]:
+    """
+    Compare one package's goast "api" declarations at the base and head, each carrying its file's path.
+    
+    Reports removed declarations (once for a removed type, not again for
+    its members) on the base side, and declarations whose fingerprint
+    changed or methods added to an existing interface on the head side.
+    pr_paths maps base paths of renamed files to their PR paths.
+    """
+    before = {d["name"]: d for d in base}
+    after = {d["name"]: d for d in head}
+    findings = []
+    for name, old in before.items():
+        new = after.get(name)
+        noun = _API_KIND_NOUNS.get(old["kind"], old["kind"])
+        if new is None:
+            if old.get("receiver") in before and old["receiver"] not in after:
+                continue
+            findings.append(AnalyzerFinding(
+                analyzer="api-compat", path=pr_paths.get(old["path"], old["path"]), line=old["line"],
+                side="LEFT", symbol=f"{package}.{name}", rule="api-compat/removed", severity="error",
+                message=f"Exported {noun} `{package}.{name}` was removed, so code using it no longer compiles."
+                        f"\n\nBefore:\n```go\n{old['signature']}\n```",
+            ))
+        elif new["fingerprint"] != old["fingerprint"]:
+            findings.append(AnalyzerFinding(
+                analyzer="api-compat", path=new["path"], line=new["line"], symbol=f"{package}.{name}",
+                rule="api-compat/changed", severity="error",
+                message=f"Exported {noun} `{package}.{name}` changed incompatibly."
+                        f"\n\nBefore:\n```go\n{old['signature']}\n```\nAfter:\n```go\n{new['signature']}\n```",
+            ))
+    for name, new in after.items():
+        interface = before.get(new.get("receiver"))
+        if (
+            name not in before and new["kind"] in ("interface-method", "embedded") and interface
+            and after.get(new["receiver"], {}).get("fingerprint") == interface["fingerprint"]
+        ):
+            findings.append(AnalyzerFinding(
+                analyzer="api-compat", path=new["path"], line=new["line"], symbol=f"{package}.{name}",
+                rule="api-compat/interface-extended", severity="error",
+                message=f"`{new['signature']}` was added to exported interface `{package}.{new['receiver']}`, "
+                        "so types in other packages that implemented it no longer do.",
+            ))
+    return findings
+
+
+# Built-in secret detectors; group 1, when present, is the secret itself
+SECRET_DETECTORS: Dict[str, "re.Pattern[str]"] = {
+    "aws-access-key-id": re.compile(r"\b((?:AKIA|ASIA)[0-9A-Z]{16})\b"),
+    "aws-secret-access-key": re.compile(
+        r"(?i)aws.{0,20}?(?:secret|private).{0,20}?[=:]\s*['\"]?([A-Za-z0-9/+=]{40})(?![A-Za-z0-9/+=])"
+    ),
+    "github-token": re.compile(r"\b((?:ghp|gho|ghu|ghs|ghr)_[A-Za-z0-9]{36}|github_pat_[A-Za-z0-9_]{82})\b"),
+    "private-key": re.compile(r"-----BEGIN (?:[A-Z]+ )?PRIVATE KEY(?: BLOCK)?-----"),
+    "slack-token": re.compile(r"\b(xox[abprs]-[A-Za-z0-9-]{10,})\b"),
+}
+
+# A quoted value assigned to a secret-sounding name, checked for entropy
+_SECRET_ASSIGNMENT = re.compile(
+    r"(?i)(?:secret|token|passw(?:or)?d|api[_-]?key|access[_-]?key|credential)\w*['\"]?\s*(?::=|=|:)\s*"
+    r"['\"`]([^'\"`\s]{20,})['\"`]"
+)
+SECRET_ENTROPY_THRESHOLD = 4.0
+
+# Checksum files are full of high-entropy hashes that are not secrets
+_SECRET_SCAN_SKIP = re.compile(r"(^|/)(go\.sum|package-lock\.json|yarn\.lock|pnpm-lock\.yaml|Cargo\.lock)$")
+# The same hashes anywhere else: go.sum's "h1:" hashes, SRI integrity values and prefixed digests
+_CHECKSUM = re.compile(
+    r"h1:[A-Za-z0-9+/]{43}=|sha(?:1|256|384|512)-[A-Za-z0-9+/]{27,}={0,2}|sha(?:1|256|512):[0-9a-f]{40,128}"
+)
+# A go.sum line ("<module> <version>[/go.mod] h1:<hash>"), e.g. quoted in docs or a vendored list
+_HASH_LINE = re.compile(r"^\s*\S+\s+v\S+?(?:/go\.mod)?\s+h1:[A-Za-z0-9+/]{43}=\s*$")
+
+
+def _shannon_entropy(value: str) -> float:
+    """Bits of entropy per character of a string."""
+    counts: Dict[str, int] = {}
+    for ch in value:
+        counts[ch] = counts.get(ch, 0) + 1
+    return -sum(n / len(value) * math.log2(n / len(value)) for n in counts.values())
+
+
+def _redact(secret: str) -> str:
+    """Keep just enough of a secret to recognize it."""
+    return f"{secret[:4]}…[{len(secret)} chars redacted]"
+
+
+def _scan_line_for_secrets(
+    line: str, detectors: Dict[str, "re.Pattern[str]"]
+) -> List[Tuple[str, str]]:
+    """Return (detector, redacted snippet) pairs for the secrets found on one line; checksums are skipped."""
+    if _HASH_LINE.match(line):
+        return []
+    hits = []
+    for name, regex in detectors.items():
+        for match in regex.finditer(line):
+            secret = match.group(1) if regex.groups else match.group(0)
+            if _CHECKSUM.fullmatch(secret):
+                continue
+            if name == "private-key":
+                # The PEM header is not secret itself; the key body below it is
+                hits.append((name, match.group(0)))
+            else:
+                hits.append((name, line.replace(secret, _redact(secret)).strip()[:160]))
+    if not hits:
+        for match in _SECRET_ASSIGNMENT.finditer(line):
+            secret = match.group(1)
+            if not _CHECKSUM.fullmatch(secret) and _shannon_entropy(secret) >= SECRET_ENTROPY_THRESHOLD:
+                hits.append(("high-entropy-secret", line.replace(secret, _redact(secret)).strip()[:160]))
+    return hits
+
+
+def _scan_diff_for_secrets(
+    diff: FileDiff, custom: Optional[Dict[str, "re.Pattern[str]"]] = None
+) -> List[AnalyzerFinding]:
+    """Scan only the added lines of a file diff; secrets are reported redacted and blocking."""
+    if _SECRET_SCAN_SKIP.search(diff.path):
+        return []
+    detectors = {**SECRET_DETECTORS, **(custom or {})}
+    findings = []
+    for hunk in diff.hunks:
+        for line in hunk.lines:
+            if line.kind != "+":
+                continue
+            for detector, snippet in _scan_line_for_secrets(line.content, detectors):
+                findings.append(AnalyzerFinding(
+                    analyzer="secrets",
+                    path=diff.path,
+                    line=line.new_line,
+                    symbol=detector,
+                    rule=f"secrets/{detector}",
+                    message=f"Possible {detector} added: `{snippet}`. Remove it and rotate the credential.",
+                    severity="blocking",
+                ))
+    return findings
+
+
+# Line comment openers and block comment delimiters of each language _detect_language knows
+COMMENT_SYNTAX: Dict[str, Tuple[Tuple[str, ...], Optional[Tuple[str, str]]]] = {
+    **{lang: (("//",), ("/*", "*/")) for lang in ("go", "javascript", "typescript", "java", "rust", "c", "protobuf")},
+    **{lang: (("#",), None) for lang in ("yaml", "shell", "python", "ruby", "toml", "make", "dockerfile")},
+    "terraform": (("#", "//"), ("/*", "*/")),
+    "sql": (("--",), ("/*", "*/")),
+    "css": ((), ("/*", "*/")),
+}
+_QUOTED = re.compile(r'"(?:[^"\\]|\\.)*"|\'(?:[^\'\\]|\\.)*\'|`[^`]*`')
+# Issue references that make a TODO tracked: #123, owner/repo#123, GH-123, ABC-123 or an issue URL
+_ISSUE_REFERENCE = re.compile(r"(?:[\w.-]+/[\w.-]+)?#\d+|\bGH-\d+\b|\b[A-Z][A-Z0-9]+-\d+\b|https?://\S+/issues/\d+")
+# Comment text that reads as code rather than prose
+_CODE_LIKE = re.compile(
+    r"[{};]\s*$|^\s*[})\]]|:=|^\s*[\w.\[\]]+\s*[-+*/|&]?=\s*\S"
+    r"|^\s*[\w.]+\(.*\)\s*$|^\s*return\s+[\w.]+(?:\(.*\))?\s*$|^\s*(?:func|def)\s+\w+\(|^\s*(?:import|package)\s+\S+$"
+)
+
+
+def _line_comment(
+    text: str, syntax: Tuple[Tuple[str, ...], Optional[Tuple[str, str]]], in_block: bool
+) -> Tuple[Optional[str], bool, bool]:
+    """
+    Find the comment text on one line of code, skipping comment openers inside quotes.
+    
+    Returns the text (None if the line has no comment), whether a block
+    comment is still open at the end of the line, and whether the line holds
+    nothing but comment.
+    """
+    line_openers, block = syntax
+    parts: List[str] = []
+    only_comment = True
+    pos = 0
+    while pos < len(text):
+        if in_block:
+            end = text.find(block[1], pos)
+            if end < 0:
+                parts.append(text[pos:])
+                break
+            parts.append(text[pos:end])
+            pos, in_block = end + len(block[1]), False
+            continue
+        opener, i = None, pos
+        while i < len(text) and opener is None:
+            quoted = _QUOTED.match(text, i)
+            if quoted:
+                i = quoted.end()
+                continue
+            opener = next((o for o in line_openers if text.startswith(o, i)), None)
+            if opener is None and block and text.startswith(block[0], i):
+                opener = block[0]
+            if opener is None:
+                i += 1
+        if text[pos:i].strip():
+            only_comment = False
+        if opener is None:
+            break
+        if block and opener == block[0]:
+            pos, in_block = i + len(opener), True
+            continue
+        parts.append(text[i + len(opener):])
+        break
+    return (" ".join(parts) if parts else None), in_block, only_comment and bool(parts)
+
+
+_CODE_TOKEN = re.compile(r'"(?:[^"\\\n]|\\.)*"|\'(?:[^\'\\\n]|\\.)*\'|`[^`]*`|\w+|\S')
+# Languages where indentation is syntax, so it is part of their token stream
+INDENTATION_SENSITIVE = ("python", "yaml", "make")
+# Go comments that change the build: //go:build, // +build, //go:embed, //go:generate, //export...
+_GO_DIRECTIVE = re.compile(r"//(?:[a-z0-9]+:[a-z0-9]|line |export |extern | ?\+build )[^\n]*")
+# The comments directly above import "C", which cgo compiles as C
+_CGO_PREAMBLE = re.compile(r'(?:(?://[^\n]*|/\*.*?\*/)[ \t]*\n[ \t]*)+(?=import[ \t]+"C")', re.S)
+
+
+def _code_tokens(text: str, language: str) -> List[str]:
+    """
+    Split source into its tokens without comments or whitespace.
+    
+    Two versions of a file with the same tokens differ only in comments and
+    layout. Comment openers inside string literals are not comments. Go
+    directives and a cgo preamble are code, each kept as one token.
+    """
+    line_openers, block = COMMENT_SYNTAX[language]
+    cgo = language == "go" and 'import "C"' in text
+    tokens: List[str] = []
+    pos, line_start, new_line = 0, 0, True
+    while pos < len(text):
+        char = text[pos]
+        if char.isspace():
+            pos += 1
+            if char == "\n":
+                line_start, new_line = pos, True
+            continue
+        if language == "go" and new_line:
+            preamble = _CGO_PREAMBLE.match(text, pos) if cgo else None
+            directive = preamble or _GO_DIRECTIVE.match(text, pos)
+            if directive:
+                tokens.append(directive.group().strip())
+                pos = directive.end()
+                continue
+        if any(text.startswith(o, pos) for o in line_openers):
+            end = text.find("\n", pos)
+            pos = len(text) if end < 0 else end
+            continue
+        if block and text.startswith(block[0], pos):
+            end = text.find(block[1], pos + len(block[0]))
+            pos = len(text) if end < 0 else end + len(block[1])
+            continue
+        if new_line and language in INDENTATION_SENSITIVE:
+            indent = text[line_start:pos]
+            tokens.append("\n" + (indent if indent.isspace() else ""))
+        new_line = False
+        token = _CODE_TOKEN.match(text, pos)
+        tokens.append(token.group())
+        pos = token.end()
+    return tokens
+
+
+def _comment_marker_findings(diff: FileDiff, markers: List[str], min_code_lines: int) -> List[AnalyzerFinding]:
+    """
+    Report markers such as TODO added without an issue reference, and runs of
+    at least min_code_lines added comment lines that read as code.
+    
+    A marker comment or commented-out block that the same patch removes
+    elsewhere in the file was moved rather than added, and is not reported.
+    Go doc comments indent their code examples, so indented comment text
+    only counts as code inside a run that unindented code started.
+    """
+    syntax = COMMENT_SYNTAX.get(_detect_language(diff.path))
+    if syntax is None or not (markers or min_code_lines):
+        return []
+    marker = re.compile(r"\b(" + "|".join(map(re.escape, markers)) + r")\b") if markers else None
+    added: List[Tuple[int, Optional[str], bool]] = []
+    removed: Dict[str, int] = {}
+    for hunk in diff.hunks:
+        # Each side is followed in order, so block comments spanning lines are tracked
+        new_block = old_block = False
+        for ln in hunk.lines:
+            if ln.kind in "+ ":
+                comment, new_block, whole = _line_comment(ln.content, syntax, new_block)
+                if ln.kind == "+":
+                    added.append((ln.new_line, comment, whole))
+            if ln.kind in "- ":
+                comment, old_block, _ = _line_comment(ln.content, syntax, old_block)
+                if ln.kind == "-" and comment and comment.strip():
+                    removed[comment.strip()] = removed.get(comment.strip(), 0) + 1
+    
+    def moved(texts: List[str]) -> bool:
+        if any(removed.get(t, 0) < texts.count(t) for t in set(texts)):
+            return False
+        for t in texts:
+            removed[t] -= 1
+        return True
+    
+    findings = []
+    for line, comment, _ in added:
+        match = marker.search(comment) if marker and comment else None
+        if match and not _ISSUE_REFERENCE.search(comment) and not moved([comment.strip()]):
+            findings.append(AnalyzerFinding(
+                analyzer="markers", path=diff.path, line=line, symbol=match.group(1), severity="info",
+                rule="markers/untracked",
+                message=f"`{match.group(1)}` added without an issue reference: `{comment.strip()}`. "
+                        "File an issue and link it here, or resolve it before merging.",
+            ))
+    
+    run: List[Tuple[int, str]] = []
+    
+    def flush() -> None:
+        code = [text for _, text in run if text]
+        if min_code_lines and len(code) >= min_code_lines and not moved(code):
+            first, last = run[0][0], run[-1][0]
+            findings.append(AnalyzerFinding(
+                analyzer="markers", path=diff.path, line=first, severity="info",
+                rule="markers/commented-out-code",
+                message=f"Lines {first}-{last} add {len(code)} lines of commented-out code. "
+                        "Delete them; the history keeps the old version.",
+            ))
+        run.clear()
+    
+    for line, comment, whole in added:
+        text = comment.strip() if comment is not None else ""
+        code_like = whole and bool(_CODE_LIKE.search(text)) and (bool(run) or not comment.startswith(("\t", "  ")))
+        if run and line != run[-1][0] + 1:
+            flush()
+        if code_like or (whole and not text and run):
+            run.append((line, text if code_like else ""))
+        else:
+            flush()
+    flush()
+    return findings
+
+
+def _normalized_added_runs(diff: FileDiff) -> List[List[Tuple[int, str]]]:
+    """
+    A file's added lines as runs of consecutive additions, each line as (line, normalized text).
+    
+    Normalizing drops comments and whitespace, so re-indented or
+    re-commented copies still match. Lines left without a word, such as a
+    lone closing brace, are skipped without ending the run; a context line
+    or the end of a hunk ends it.
+    """
+    language = _detect_language(diff.path)
+    syntax = COMMENT_SYNTAX.get(language)
+    runs: List[List[Tuple[int, str]]] = []
+    for hunk in diff.hunks:
+        run: List[Tuple[int, str]] = []
+        in_block = False
+        for ln in hunk.lines:
+            whole = False
+            if syntax is not None and ln.kind in "+ ":
+                _, in_block, whole = _line_comment(ln.content, syntax, in_block)
+            if ln.kind == " ":
+                runs.append(run)
+                run = []
+            if ln.kind != "+" or whole:
+                continue
+            text = " ".join(_code_tokens(ln.content, language) if syntax is not None else ln.content.split())
+            if re.search(r"\w", text):
+                run.append((ln.new_line, text))
+        runs.append(run)
+    return [run for run in runs if run]
+
+
+def _extend_block(
+    lines_a: List[Tuple[int, str]], lines_b: List[Tuple[int, str]], block: List[int],
+    size: int, similarity: float, same_run: bool,
+) -> None:
+    """
+    Grow a matched block pair [a_start, a_end, b_start, b_end] outward in place.
+    
+    A side grows to the nearest pair of equal lines at most size lines
+    beyond each edge, as long as the pair's similarity stays at least
+    similarity. Copies in one run never grow into each other.
+    """
+    def ratio(a_start: int, a_end: int, b_start: int, b_end: int) -> float:
+        return difflib.SequenceMatcher(
+            None, [t for _, t in lines_a[a_start:a_end]], [t for _, t in lines_b[b_start:b_end]], autojunk=False
+        ).ratio()
+    
+    def grow(step: Callable[[int, int], Optional[List[int]]]) -> bool:
+        for reach in range(2, 2 * size + 1):
+            for ka in range(max(1, reach - size), min(size, reach - 1) + 1):
+                candidate = step(ka, reach - ka)
+                if candidate is not None and ratio(*candidate) >= similarity:
+                    block[:] = candidate
+                    return True
+        return False
+    
+    def back(ka: int, kb: int) -> Optional[List[int]]:
+        a, b = block[0] - ka, block[2] - kb
+        if a < 0 or b < (block[1] if same_run else 0) or lines_a[a][1] != lines_b[b][1]:
+            return None
+        return [a, block[1], b, block[3]]
+    
+    def forward(ka: int, kb: int) -> Optional[List[int]]:
+        a, b = block[1] + ka - 1, block[3] + kb - 1
+        if a >= (block[2] if same_run else len(lines_a)) or b >= len(lines_b) or lines_a[a][1] != lines_b[b][1]:
+            return None
+        return [block[0], a + 1, block[2], b + 1]
+    
+    while grow(back):
+        pass
+    while grow(forward):
+        pass
+
+
+def _duplicate_blocks(
+    files: Dict[str, List[List[Tuple[int, str]]]], policy: "DuplicationPolicy", max_comparisons: int
+) -> Tuple[List[Dict[str, Any]], int, bool]:
+    """
+    Find pairs of added blocks that duplicate each other, across files or far apart in one file.
+    
+    Every window of min_lines normalized lines is hashed; windows with the
+    same hash are compared in pairs, at most max_comparisons of them. The
+    matching windows of two runs are merged into blocks, allowing gaps of
+    up to min_lines lines so that a copy with a few edited lines stays one
+    block, and a block pair is reported when its difflib similarity is at
+    least the policy's. Each block is then grown over nearby matching lines
+    while it stays that similar (see _extend_block), so a copy whose edits
+    split it into windows shorter than min_lines is still reported whole.
+    Returns the pairs, the comparisons made, and whether
+    the cap stopped the search early.
+    """
+    size = policy.min_lines
+    index: Dict[Tuple[str, ...], List[Tuple[str, int, int]]] = {}
+    for path in sorted(files):
+        for r, run in enumerate(files[path]):
+            for i in range(len(run) - size + 1):
+                index.setdefault(tuple(text for _, text in run[i:i + size]), []).append((path, r, i))
+    
+    seeds: Dict[Tuple[str, int, str, int], List[Tuple[int, int]]] = {}
+    comparisons, truncated = 0, False
+    for occurrences in index.values():
+        for x, (path_a, run_a, i) in enumerate(occurrences):
+            for path_b, run_b, j in occurrences[x + 1:]:
+                if comparisons >= max_comparisons:
+                    truncated = True
+                    break
+                comparisons += 1
+                if path_a == path_b:
+                    # Occurrences are in file order, so b starts after a
+                    lines_a, lines_b = files[path_a][run_a], files[path_b][run_b]
+                    if (lines_b[j][0] <= lines_a[i + size - 1][0]
+                            or lines_b[j][0] - lines_a[i][0] < policy.min_line_distance):
+                        continue
+                seeds.setdefault((path_a, run_a, path_b, run_b), []).append((i, j))
+            if truncated:
+                break
+        if truncated:
+            break
+    
+    pairs = []
+    for (path_a, run_a, path_b, run_b), matches in seeds.items():
+        lines_a, lines_b = files[path_a][run_a], files[path_b][run_b]
+        blocks: List[List[int]] = []
+        for i, j in sorted(matches):
+            block = next((
+                b for b in blocks
+                if i <= b[1] + size and j <= b[3] + size and j + size >= b[2]
+                and abs((i - b[0]) - (j - b[2])) <= size
+            ), None)
+            if block is None:
+                blocks.append([i, i + size, j, j + size])
+            else:
+                block[1], block[3] = max(block[1], i + size), max(block[3], j + size)
+        same_run = path_a == path_b and run_a == run_b
+        for block in blocks:
+            if same_run and block[2] < block[1]:
+                continue
+            _extend_block(lines_a, lines_b, block, size, policy.similarity, same_run)
+            a_start, a_end, b_start, b_end = block
+            similarity = difflib.SequenceMatcher(
+                None, [t for _, t in lines_a[a_start:a_end]], [t for _, t in lines_b[b_start:b_end]], autojunk=False
+            ).ratio()
+            if similarity >= policy.similarity:
+                pairs.append({
+                    "block": {"path": path_b, "start_line": lines_b[b_start][0], "end_line": lines_b[b_end - 1][0]},
+                    "original": {"path": path_a, "start_line": lines_a[a_start][0], "end_line": lines_a[a_end - 1][0]},
+                    "lines": b_end - b_start,
+                    "similarity": round(similarity, 2),
+                })
+    pairs.sort(key=lambda p: (p["block"]["path"], p["block"]["start_line"], p["original"]["path"], p["original"]["start_line"]))
+    return pairs, comparisons, truncated
+
+
+def _duplicate_finding(pair: Dict[str, Any]) -> AnalyzerFinding:
+    block, original = pair["block"], pair["original"]
+    where = "earlier in this file" if original["path"] == block["path"] else f"of `{original['path']}`"
+    similar = f" ({round(pair['similarity'] * 100)}% similar)" if pair["similarity"] < 1 else ""
+    return AnalyzerFinding(
+        analyzer="duplicates", path=block["path"], line=block["start_line"], severity="info",
+        symbol=f"{original['path']}:{original['start_line']}-{original['end_line']}", rule="duplicates/block",
+        message=f"Lines {block['start_line']}–{block['end_line']} duplicate lines {original['start_line']}–"
+                f"{original['end_line']} {where}{similar}; consider extracting a helper.",
+    )
+
+
+# ============================================================================
+# Diff Chunking
+# ============================================================================
+
+LANGUAGE_BY_EXTENSION = {
+    ".go": "go", ".sql": "sql", ".yaml": "yaml", ".yml": "yaml", ".json": "json",
+    ".md": "markdown", ".py": "python", ".js": "javascript", ".jsx": "javascript",
+    ".ts": "typescript", ".tsx": "typescript", ".sh": "shell", ".proto": "protobuf",
+    ".tf": "terraform", ".toml": "toml", ".html": "html", ".css": "css",
+    ".java": "java", ".rs": "rust", ".rb": "ruby", ".c": "c", ".h": "c",
+}
+
+# File names whose language the extension does not tell
+LANGUAGE_BY_FILENAME = {
+    "Dockerfile": "dockerfile", "Makefile": "make",
+    "go.mod": "go-module", "go.sum": "go-module", "go.work": "go-module",
+}
+
+
+def _detect_language(path: str) -> str:
+    """Guess a file's language from its name, falling back to 'other'."""
+    name = path.rsplit("/", 1)[-1]
+    if name in LANGUAGE_BY_FILENAME:
+        return LANGUAGE_BY_FILENAME[name]
+    return LANGUAGE_BY_EXTENSION.get(os.path.splitext(name)[1].lower(), "other")
+
+
+def _render_file_patch(entry: Dict[str, Any]) -> str:
+    """Render one files API entry as a self-contained unified diff."""
+    old_path = entry.get("previous_filename") or entry["filename"]
+    return f"--- a/{old_path}\n+++ b/{entry['filename']}\n{entry.get('patch', '')}\n"
+
+
+def _build_diff_chunks(files: List[Dict[str, Any]], max_chars: int) -> List[Dict[str, Any]]:
+    """
+    Group changed files by language and split each group into numbered chunks.
+    
+    Chunks only break between files: a file larger than max_chars gets a
+    chunk of its own rather than being split. Languages and files are
+    ordered by name so the same PR always chunks the same way.
+    """
+    groups: Dict[str, List[Dict[str, Any]]] = {}
+    for entry in sorted(files, key=lambda f: f["filename"]):
+        if entry.get("patch"):
+            groups.setdefault(_detect_language(entry["filename"]), []).append(entry)
+    
+    chunks = []
+    for language in sorted(groups):
+        current: List[Dict[str, Any]] = []
+        size = 0
+        for entry in groups[language]:
+            patch = _render_file_patch(entry)
+            if current and size + len(patch) > max_chars:
+                chunks.append({"language": language, "files": current, "size": size})
+                current, size = [], 0
+            current.append({"path": entry["filename"], "status": entry.get("status", "modified"), "patch": patch})
+            size += len(patch)
+        chunks.append({"language": language, "files": current, "size": size})
+    
+    numbers: Dict[str, int] = {}
+    for chunk in chunks:
+        numbers[chunk["language"]] = numbers.get(chunk["language"], 0) + 1
+        chunk["id"] = f"{chunk['language']}-{numbers[chunk['language']]}"
+    return chunks
+
+
+def _chunk_index_entry(chunk: Dict[str, Any]) -> Dict[str, Any]:
+    return {
+        "id": chunk["id"],
+        "language": chunk["language"],
+        "files": [f["path"] for f in chunk["files"]],
+        "approx_chars": chunk["size"],
+        "approx_tokens": chunk["size"] // 4,
+    }
+
+
+_STREAMED_CHUNK_ID = re.compile(r"part-([1-9]\d*)")
+_GIT_DIFF_HEADER_BYTES = re.compile(rb"(?m)^diff --git a/(.+) b/(.+)$")
+
+
+async def _diff_stream_chunks(pieces: AsyncIterator[bytes], limit: int) -> AsyncIterator[bytes]:
+    """
+    Regroup a streamed diff into chunks of at most limit bytes that end on a line break.
+    
+    Only a line longer than limit is cut, at a UTF-8 character boundary, so
+    every chunk decodes on its own. The boundaries depend only on the diff,
+    not on how the network split it, so chunk N is the same bytes on every
+    pass. At most limit bytes plus one network read are held at a time.
+    """
+    buffer = bytearray()
+    async for piece in pieces:
+        buffer += piece
+        start = 0
+        while len(buffer) - start > limit:
+            cut = buffer.rfind(b"\n", start, start + limit) + 1
+            if not cut:
+                cut = start + limit
+                while cut > start + 1 and buffer[cut] & 0xC0 == 0x80:
+                    cut -= 1
+            yield bytes(buffer[start:cut])
+            start = cut
+        del buffer[:start]
+    if buffer:
+        yield bytes(buffer)
+
+
+class DiffManifest:
+    """Byte counts of a diff's files and chunks, built one streamed chunk at a time."""
+    
+    def __init__(self):
+        self.files: List[Dict[str, Any]] = []
+        self.chunks: List[Dict[str, Any]] = []
+        self.total_bytes = 0
+    
+    def add(self, chunk: bytes) -> None:
+        """Account for the next chunk; a file can start in one chunk and continue in the next."""
+        chunk_id = f"part-{len(self.chunks) + 1}"
+        files: List[str] = []
+        position = 0
+        for header in _GIT_DIFF_HEADER_BYTES.finditer(chunk):
+            self._extend(chunk_id, header.start() - position, files)
+            self.files.append({"path": header.group(2).decode("utf-8", "replace"), "bytes": 0, "chunks": []})
+            position = header.start()
+        self._extend(chunk_id, len(chunk) - position, files)
+        self.chunks.append({"id": chunk_id, "offset": self.total_bytes, "bytes": len(chunk),
+                            "approx_tokens": len(chunk) // 4, "files": files})
+        self.total_bytes += len(chunk)
+    
+    def _extend(self, chunk_id: str, size: int, files: List[str]) -> None:
+        if not size or not self.files:
+            return
+        entry = self.files[-1]
+        entry["bytes"] += size
+        entry["chunks"].append(chunk_id)
+        files.append(entry["path"])
+
+
+class DiffSpool:
+    """
+    A streamed diff written to a temporary file, with its manifest.
+    
+    Every manifest chunk records its byte offset, so reading a chunk back is
+    one seek and that chunk's bytes, however far into the diff it is.
+    """
+    
+    def __init__(self, head_sha: Optional[str]):
+        self.head_sha = head_sha
+        self.manifest = DiffManifest()
+        self._file = tempfile.TemporaryFile()
+    
+    def add(self, chunk: bytes) -> None:
+        self.manifest.add(chunk)
+        self._file.write(chunk)
+    
+    def chunk(self, chunk_id: str) -> Dict[str, Any]:
+        """One chunk's manifest entry with its text."""
+        entry = next((c for c in self.manifest.chunks if c["id"] == chunk_id), None)
+        if entry is None:
+            raise ValueError(f"Unknown chunk '{chunk_id}'; the diff has {len(self.manifest.chunks)} chunks")
+        self._file.seek(entry["offset"])
+        return {**entry, "diff": self._file.read(entry["bytes"]).decode("utf-8", "replace")}
+    
+    def close(self) -> None:
+        self._file.close()
+
+
+# Spools of streamed diffs by (owner, repo, pr_number), least recently read first
+_diff_spools: "OrderedDict[Tuple[str, str, int], DiffSpool]" = OrderedDict()
+
+
+def _keep_diff_spool(key: Tuple[str, str, int], spool: DiffSpool) -> None:
+    """Register a PR's spool in place of an older one, closing those over DIFF_STREAM_SPOOLS."""
+    previous = _diff_spools.pop(key, None)
+    if previous is not None:
+        previous.close()
+    _diff_spools[key] = spool
+    while len(_diff_spools) > DIFF_STREAM_SPOOLS:
+        _diff_spools.popitem(last=False)[1].close()
+
+
+async def _spool_pr_diff(owner: str, repo: str, pr_number: int, head_sha: Optional[str]) -> DiffSpool:
+    """Stream a PR's diff into a new spool."""
+    spool = DiffSpool(head_sha)
+    try:
+        async with aclosing(_stream_pr_diff(owner, repo, pr_number)) as chunks:
+            async for chunk in chunks:
+                spool.add(chunk)
+    except BaseException:
+        spool.close()
+        raise
+    return spool
+
+
+async def _stream_pr_diff(owner: str, repo: str, pr_number: int) -> AsyncIterator[bytes]:
+    """Stream a PR's unified diff as DIFF_STREAM_CHUNK_BYTES chunks."""
+    pieces = _github_api_stream(
+        f"/repos/{owner}/{repo}/pulls/{pr_number}", headers={"Accept": "application/vnd.github.v3.diff"}
+    )
+    async with aclosing(pieces), aclosing(_diff_stream_chunks(pieces, DIFF_STREAM_CHUNK_BYTES)) as chunks:
+        async for chunk in chunks:
+            yield chunk
+
+
+async def _small_diff_or_manifest(
+    owner: str, repo: str, pr_number: int, head_sha: Optional[str], limit: int
+) -> Tuple[Optional[str], DiffManifest]:
+    """
+    Stream a PR's diff, keeping the text only if it is at most limit bytes.
+    
+    The manifest is always complete. A larger diff goes to a temporary file,
+    kept as the PR's spool for its chunks to be read back, so memory stays
+    bounded by limit whatever the diff's size.
+    """
+    spool = DiffSpool(head_sha)
+    kept: Optional[List[bytes]] = []
+    try:
+        async with aclosing(_stream_pr_diff(owner, repo, pr_number)) as chunks:
+            async for chunk in chunks:
+                spool.add(chunk)
+                if kept is not None:
+                    kept.append(chunk)
+                    if spool.manifest.total_bytes > limit:
+                        kept = None
+    except BaseException:
+        spool.close()
+        raise
+    if kept is not None:
+        spool.close()
+        return b"".join(kept).decode("utf-8", "replace"), spool.manifest
+    _keep_diff_spool((owner, repo, pr_number), spool)
+    return None, spool.manifest
+
+
+async def _streamed_diff_chunk(
+    owner: str, repo: str, pr_number: int, chunk_id: str, head_sha: Optional[str]
+) -> Dict[str, Any]:
+    """
+    Read one chunk of a PR's streamed diff at head_sha back from its spool.
+    
+    A spool that was dropped, or never made in this process, is rebuilt by
+    streaming the diff once, so reading every chunk costs at most one more
+    pass over the diff.
+    """
+    if not _STREAMED_CHUNK_ID.fullmatch(chunk_id):
+        raise ValueError(f"Unknown chunk '{chunk_id}'")
+    key = (owner, repo, pr_number)
+    spool = _diff_spools.get(key)
+    if spool is None or spool.head_sha != head_sha:
+        spool = await _spool_pr_diff(owner, repo, pr_number, head_sha)
+        _keep_diff_spool(key, spool)
+    else:
+        _diff_spools.move_to_end(key)
+    return spool.chunk(chunk_id)
+
+
+async def _streamed_diff_head(ctx: Optional[Context], owner: str, repo: str, pr_number: int) -> str:
+    """The PR's head, failing if it moved since github_pr_get_diff streamed the diff in this session."""
+    head_sha = (await _fetch_pr(owner, repo, pr_number))["head"]["sha"]
+    streamed_head = _session_state(ctx).get("diff_streams", {}).get((owner, repo, pr_number))
+    if streamed_head is not None and streamed_head != head_sha:
+        raise ValueError(
+            f"The PR head moved from {streamed_head[:12]} to {head_sha[:12]}; call github_pr_get_diff again"
+        )
+    return head_sha
+
+
+# ============================================================================
+# CODEOWNERS
+# ============================================================================
+
+# Locations GitHub reads CODEOWNERS from; the first one found is used
+CODEOWNERS_PATHS = (".github/CODEOWNERS", "CODEOWNERS", "docs/CODEOWNERS")
+
+
+@dataclass
+class CodeOwnersRule:
+    """One CODEOWNERS line: a path pattern and the owners it assigns."""
+    pattern: str
+    owners: List[str]
+    line: int
+    regex: "re.Pattern[str]" = field(repr=False, default=None)
+    
+    def __post_init__(self):
+        if self.regex is None:
+            self.regex = _codeowners_regex(self.pattern)
+    
+    def matches(self, path: str) -> bool:
+        return self.regex.match(path) is not None
+
+
+def _codeowners_regex(pattern: str) -> "re.Pattern[str]":
+    """
+    Compile a CODEOWNERS pattern into a regex over repository-relative paths.
+    
+    CODEOWNERS follows gitignore rules rather than fnmatch: a pattern without
+    a slash matches at any depth, a leading or inner slash anchors it to the
+    root, a trailing slash matches everything under a directory, `*` stops at
+    `/` and `**` crosses directories. Unlike gitignore, `docs/*` only matches
+    files directly inside docs/.
+    """
+    dir_only = pattern.endswith("/")
+    body = pattern.strip("/") if dir_only else pattern.lstrip("/")
+    anchored = pattern.startswith("/") or "/" in body
+    
+    parts, i = [], 0
+    while i < len(body):
+        if body.startswith("**/", i):
+            parts.append("(?:.*/)?")
+            i += 3
+        elif body.startswith("**", i):
+            parts.append(".*")
+            i += 2
+        elif body[i] == "*":
+            parts.append("[^/]*")
+            i += 1
+        elif body[i] == "?":
+            parts.append("[^/]")
+            i += 1
+        else:
+            parts.append(re.escape(body[i]))
+            i += 1
+    
+    prefix = "^" if anchored else "^(?:.*/)?"
+    last_segment = body.rsplit("/", 1)[-1]
+    if dir_only:
+        suffix = "/.*$"
+    elif "*" in last_segment and "**" not in last_segment:
+        # A wildcard final segment names files, not directories to descend into
+        suffix = "$"
+    else:
+        # A plain name also matches a directory and everything below it
+        suffix = "(?:/.*)?$"
+    return re.compile(prefix + "".join(parts) + suffix)
+
+
+def _parse_codeowners(text: str) -> List[CodeOwnersRule]:
+    """Parse CODEOWNERS content, skipping blank lines and comments."""
+    rules = []
+    for number, raw in enumerate(text.splitlines(), start=1):
+        line = re.sub(r"(^|\s)#.*$", "", raw).strip()
+        if not line:
+            continue
+        pattern, *owners = line.split()
+        rules.append(CodeOwnersRule(pattern=pattern.replace("\\#", "#"), owners=owners, line=number))
+    return rules
+
+
+def _owners_for_path(rules: List[CodeOwnersRule], path: str) -> Optional[CodeOwnersRule]:
+    """Return the rule that applies to a path; the last matching rule wins."""
+    for rule in reversed(rules):
+        if rule.matches(path):
+            return rule
+    return None
+
+
+async def _fetch_codeowners(owner: str, repo: str, ref: str) -> Optional[Tuple[str, str]]:
+    """Download CODEOWNERS from the first standard location present at ref."""
+    for path in CODEOWNERS_PATHS:
+        try:
+            response = await _github_api_response(
+                "GET", f"/repos/{owner}/{repo}/contents/{path}",
+                params={"ref": ref}, headers={"Accept": "application/vnd.github.raw"}
+            )
+        except httpx.HTTPStatusError as e:
+            if e.response.status_code != 404:
+                raise
+            continue
+        return path, response.text
+    return None
+
+
+# ============================================================================
+# Commits
+# ============================================================================
+
+# Commit types allowed by default, those of the Conventional Commits config used by commitlint
+CONVENTIONAL_COMMIT_TYPES = ("feat", "fix", "docs", "style", "refactor", "perf", "test", "build", "ci", "chore", "revert")
+
+# Default subject and body line limits of github_pr_check_commit_messages
+COMMIT_SUBJECT_MAX_CHARS = 72
+COMMIT_BODY_LINE_MAX_CHARS = 100
+
+_CONVENTIONAL_COMMIT = re.compile(
+    rf"^({'|'.join(CONVENTIONAL_COMMIT_TYPES)})(\([\w./-]+\))?!?: \S"
+)
+
+# Any type and scope; whether they are allowed is up to the policy
+_COMMIT_SUBJECT = re.compile(r"^(?P<type>\w+)(?:\((?P<scope>[^()]*)\))?!?: (?P<description>\S.*)$")
+
+# Subjects git writes for commits to be folded into another one by an autosquash rebase
+_AUTOSQUASH_PREFIXES = ("fixup!", "squash!", "amend!")
+
+# Verbs whose -s, -ed and -ing forms the imperative mood check recognises
+_IMPERATIVE_VERBS = frozenset({
+    "add", "allow", "apply", "avoid", "bump", "change", "clean", "convert", "correct", "create", "delete",
+    "deprecate", "disable", "document", "drop", "enable", "ensure", "extract", "fix", "handle", "implement",
+    "improve", "introduce", "make", "merge", "move", "prevent", "refactor", "remove", "rename", "replace",
+    "return", "revert", "rewrite", "set", "simplify", "skip", "support", "update", "upgrade", "use",
+})
+
+
+def _conventional_commit_issue(message: str) -> Optional[str]:
+    """Explain why a commit subject is not a Conventional Commit, or return None."""
+    subject = message.split("\n", 1)[0]
+    if _CONVENTIONAL_COMMIT.match(subject):
+        return None
+    return f"Subject `{subject[:72]}` does not follow Conventional Commits (`type(scope): description`)"
+
+
+def _non_imperative_verb(word: str) -> Optional[str]:
+    """The imperative of a known verb written as 'adds', 'added' or 'adding', or None."""
+    word = word.lower()
+    if word in _IMPERATIVE_VERBS:
+        return None
+    candidates = []
+    if word.endswith(("ies", "ied")):
+        candidates.append(word[:-3] + "y")
+    if word.endswith("s"):
+        candidates += [word[:-1], word[:-2]]
+    if word.endswith("ed"):
+        # added, moved, dropped
+        candidates += [word[:-2], word[:-1], word[:-3]]
+    if word.endswith("ing"):
+        # adding, making, dropping
+        candidates += [word[:-3], word[:-3] + "e", word[:-4]]
+    return next((c for c in candidates if c in _IMPERATIVE_VERBS), None)
+
+
+def _commit_message_findings(
+    message: str,
+    sha: str,
+    rules: "CommitMessagePolicy",
+    title: bool = False
+) -> List[AnalyzerFinding]:
+    """
+    Check one commit message, or a PR title, against the policy's commit conventions.
+    
+    A subject that does not parse as `type(scope): description` gets only
+    the format finding and the length and body checks.
+    """
+    subject, _, rest = message.partition("\n")
+    what = "PR title" if title else "Subject"
+    found = []
+    
+    def add(rule: str, text: str, severity: str = "warning") -> None:
+        found.append(AnalyzerFinding(
+            analyzer="commits", path=None, line=None, commit=sha, rule=f"commits/{rule}", severity=severity,
+            message=text
+        ))
+    
+    match = _COMMIT_SUBJECT.match(subject)
+    if match is None:
+        add("format", f"{what} `{subject[:COMMIT_SUBJECT_MAX_CHARS]}` does not follow Conventional Commits "
+                      "(`type(scope): description`)")
+    else:
+        kind, scope, description = match.group("type", "scope", "description")
+        if kind not in rules.types:
+            add("type", f"Type `{kind}` is not allowed; use one of {', '.join(f'`{t}`' for t in rules.types)}")
+        if scope is None:
+            if rules.require_scope:
+                add("scope", f"{what} `{subject[:COMMIT_SUBJECT_MAX_CHARS]}` has no scope, e.g. `{kind}(api): ...`")
+        elif rules.scopes and scope not in rules.scopes:
+            add("scope", f"Scope `{scope}` is not allowed; use one of {', '.join(f'`{s}`' for s in rules.scopes)}")
+        verb = _non_imperative_verb(description.split()[0]) if rules.imperative_mood else None
+        if verb is not None:
+            add("imperative", f"Write the description in the imperative mood: `{verb}`, not "
+                              f"`{description.split()[0]}`", "info")
+    if len(subject) > rules.max_subject_length:
+        add("subject-length", f"{what} is {len(subject)} characters; keep it to {rules.max_subject_length}")
+    body = rest.splitlines()
+    if body and body[0].strip():
+        add("body-format", "Separate the subject from the body with a blank line")
+    if rules.max_body_line_length is not None:
+        # A line without spaces, such as a URL, cannot be wrapped
+        long_lines = [
+            number for number, text in enumerate(body, start=2)
+            if len(text) > rules.max_body_line_length and " " in text.strip()
+        ]
+        if long_lines:
+            lines = f"Line {long_lines[0]} of the message is" if len(long_lines) == 1 else \
+                f"Lines {', '.join(map(str, long_lines))} of the message are"
+            add("body-line-length", f"{lines} longer than {rules.max_body_line_length} characters")
+    return found
+
+
+async def _fetch_pr_commits(owner: str, repo: str, pr_number: int) -> List[Dict[str, Any]]:
+    """Fetch a PR's commits, oldest first (GitHub lists at most 250)."""
+    return await _github_api_paginate(f"/repos/{owner}/{repo}/pulls/{pr_number}/commits")
+
+
+async def _last_reviewed_sha(
+    owner: str, repo: str, pr_number: int, reviews: Optional[List[Dict[str, Any]]] = None
+) -> Optional[str]:
+    """
+    Return the commit this server's most recent submitted review was made against, from the review state if it knows.
+    
+    reviews are the PR's reviews when the caller already has them, e.g.
+    from a PR snapshot; otherwise they come from the job snapshot or are
+    fetched.
+    """
+    stored = _review_state(owner, repo, pr_number).head_sha
+    if stored:
+        return stored
+    login = await _authenticated_login()
+    if reviews is None:
+        snapshot = await _job_snapshot(owner, repo, pr_number)
+        reviews = snapshot.reviews if snapshot else await _github_api_paginate(
+            f"/repos/{owner}/{repo}/pulls/{pr_number}/reviews"
+        )
+    own = [
+        r for r in reviews
+        if (r.get("user") or {}).get("login") == login and r["state"] != "PENDING" and r.get("commit_id")
+    ]
+    if not own:
+        return None
+    sha = own[-1]["commit_id"]
+    _update_review_state(owner, repo, pr_number, lambda state: replace(state, head_sha=state.head_sha or sha))
+    return sha
+
+
+async def _incremental_compare(owner: str, repo: str, pr_number: int, head_sha: str) -> Dict[str, Any]:
+    """
+    Work out whether a PR can be reviewed incrementally since the last review.
+    
+    Returns {"mode": "incremental", "since_sha", "head_sha", "commits",
+    "files"} when the last reviewed commit is an ancestor of the head, and
+    {"mode": "full", "reason"} otherwise, e.g. after a force-push.
+    """
+    since_sha = await _last_reviewed_sha(owner, repo, pr_number)
+    if not since_sha:
+        return {"mode": "full", "reason": "no earlier review by this account"}
+    try:
+        comparison = await _github_api_request("GET", f"/repos/{owner}/{repo}/compare/{since_sha}...{head_sha}")
+    except httpx.HTTPStatusError as e:
+        if e.response.status_code not in (404, 422):
+            raise
+        return {"mode": "full", "since_sha": since_sha,
+                "reason": f"last reviewed commit {since_sha[:7]} is no longer reachable (force-push?)"}
+    # "diverged" or "behind" means the reviewed commit is not in the head's
+    # history, so a compare would diff against an unrelated merge base
+    if comparison["status"] not in ("ahead", "identical"):
+        return {"mode": "full", "since_sha": since_sha,
+                "reason": f"last reviewed commit {since_sha[:7]} is not an ancestor of the head (history rewritten)"}
+    # Commits that are not the PR's own came in by merging the base branch, e.g. the parent
+    # of a stacked PR; the delta would show their changes as if this PR made them
+    if comparison.get("commits"):
+        own = {c["sha"] for c in await _fetch_pr_commits(owner, repo, pr_number)}
+        merged = [c["sha"] for c in comparison["commits"] if c["sha"] not in own]
+        if merged:
+            return {"mode": "full", "since_sha": since_sha,
+                    "reason": f"{len(merged)} commits from the base branch were merged in since the last review"}
+    return {
+        "mode": "incremental",
+        "since_sha": since_sha,
+        "head_sha": head_sha,
+        "commits": comparison.get("ahead_by", 0),
+        "files": comparison.get("files", []),
+    }
+
+
+def _stack_entry(pr_data: Dict[str, Any]) -> Dict[str, Any]:
+    """Reduce a PR to what a stack listing shows."""
+    return {
+        "number": pr_data["number"],
+        "title": pr_data.get("title"),
+        "author": (pr_data.get("user") or {}).get("login"),
+        "base_ref": pr_data["base"]["ref"],
+        "head_ref": pr_data["head"]["ref"],
+        "draft": pr_data.get("draft", False),
+        "html_url": pr_data.get("html_url"),
+    }
+
+
+async def _open_prs(owner: str, repo: str, **filters: str) -> List[Dict[str, Any]]:
+    """List open PRs filtered by head ("owner:branch") or base branch."""
+    return await _github_api_paginate(f"/repos/{owner}/{repo}/pulls", {"state": "open", **filters})
+
+
+async def _pr_stack(owner: str, repo: str, pr_number: int, pr_data: Dict[str, Any]) -> Dict[str, Any]:
+    """
+    Find the open PRs a PR is stacked on and the ones stacked on it.
+    
+    A PR is stacked on another when its base branch is the other PR's head
+    branch in the same repository. chain runs from the PR nearest the real
+    base branch (root_base) up to this PR, then on through PRs stacked on it
+    for as long as each has exactly one child. A cycle or a chain over
+    PR_STACK_MAX_DEPTH PRs stops the walk.
+    """
+    pr_data = {**pr_data, "number": pr_number}
+    parents: List[Dict[str, Any]] = []
+    seen = {pr_number}
+    current = pr_data
+    while len(seen) < PR_STACK_MAX_DEPTH:
+        above = [p for p in await _open_prs(owner, repo, head=f"{owner}:{current['base']['ref']}")
+                 if p["number"] not in seen]
+        if not above:
+            break
+        current = above[0]
+        seen.add(current["number"])
+        parents.insert(0, current)
+    
+    children = await _open_prs(owner, repo, base=pr_data["head"]["ref"])
+    # A fork's branch of the same name is not this PR's branch
+    if _pr_head(pr_data, owner, repo).is_fork:
+        children = []
+    descendants, below = [], children
+    while len(below) == 1 and below[0]["number"] not in seen and len(seen) < PR_STACK_MAX_DEPTH:
+        seen.add(below[0]["number"])
+        descendants.append(below[0])
+        below = await _open_prs(owner, repo, base=below[0]["head"]["ref"])
+    
+    chain = [_stack_entry(p) for p in parents + [pr_data] + descendants]
+    return {
+        "stacked": bool(parents or children),
+        "root_base": chain[0]["base_ref"],
+        "position": len(parents),
+        "parent": parents[-1]["number"] if parents else None,
+        "children": [c["number"] for c in children],
+        "chain": chain,
+    }
+
+
+def _stack_markdown(stack: Dict[str, Any], pr_number: int) -> str:
+    """Render a stack as a numbered list from the PR nearest the base branch upwards."""
+    markdown = f"Base branch: `{stack['root_base']}`\n\n"
+    for i, entry in enumerate(stack["chain"], start=1):
+        current = " ← this PR" if entry["number"] == pr_number else ""
+        draft = " (draft)" if entry["draft"] else ""
+        markdown += f"{i}. [#{entry['number']}]({entry['html_url']}) {entry['title']} — `{entry['head_ref']}` → `{entry['base_ref']}`{draft}{current}\n"
+    others = [c for c in stack["children"] if c not in {e["number"] for e in stack["chain"]}]
+    if others:
+        markdown += "\nStacked directly on this PR: " + ", ".join(f"#{n}" for n in others) + "\n"
+    return markdown
+
+
+# (owner, repo, login) -> (time counted, merged PRs) of PR authors
+_merged_pr_counts: Dict[Tuple[str, str, str], Tuple[float, int]] = {}
+
+
+async def _merged_pr_count(owner: str, repo: str, login: str) -> int:
+    """Count an author's merged PRs in a repository with one search query, reused for AUTHOR_MERGED_PRS_TTL seconds."""
+    key = (owner.lower(), repo.lower(), login.lower())
+    cached = _merged_pr_counts.get(key)
+    if cached is not None and time.monotonic() - cached[0] < AUTHOR_MERGED_PRS_TTL:
+        return cached[1]
+    query = " ".join([_search_qualifier("repo", f"{owner}/{repo}"), "is:pr", "is:merged", _search_qualifier("author", login)])
+    response = await _github_api_response("GET", "/search/issues", params={"q": query, "per_page": 1})
+    count = response.json()["total_count"]
+    _merged_pr_counts[key] = (time.monotonic(), count)
+    return count
+
+
+async def _author_context(owner: str, repo: str, pr_data: Dict[str, Any]) -> Dict[str, Any]:
+    """
+    Describe a PR's author: their association with the repository, how many
+    of their PRs were merged there before, and whether the account is a bot.
+    
+    merged_prs is None when the search fails; first_time then rests on the
+    association alone.
+    """
+    user = pr_data.get("user") or {}
+    login = user.get("login")
+    merged: Optional[int] = None
+    if login:
+        try:
+            merged = await _merged_pr_count(owner, repo, login)
+            if pr_data.get("merged") or pr_data.get("merged_at"):
+                # The search counts this PR once it is merged, but it came after the earlier ones
+                merged = max(merged - 1, 0)
+        except httpx.HTTPStatusError as e:
+            logger.warning("Could not count the merged PRs of %s in %s/%s: %s", login, owner, repo, e)
+    association = pr_data.get("author_association")
+    bot = user.get("type") == "Bot" or (login or "").endswith("[bot]")
+    return {
+        "login": login,
+        "association": association,
+        "merged_prs": merged,
+        "bot": bot,
+        "first_time": not bot and association in FIRST_TIME_ASSOCIATIONS and not merged,
+    }
+
+
+def _author_note(author: Dict[str, Any]) -> str:
+    """One line on who wrote a PR and how a review should address them."""
+    if author["login"] is None:
+        return "unknown (the account was deleted)"
+    if author["bot"]:
+        return f"{author['login']}, a bot account. Keep comments short and factual; nobody needs encouragement or background."
+    history = []
+    if author["association"]:
+        history.append(author["association"])
+    if author["merged_prs"] is not None:
+        history.append(f"{author['merged_prs']} earlier merged PRs in this repository")
+    who = f"{author['login']} ({', '.join(history)})" if history else author["login"]
+    if author["first_time"]:
+        return (f"{who}. This is their first contribution: be welcoming, explain the project conventions you "
+                "point to, and say clearly which problems must be fixed and which are suggestions.")
+    return f"{who}. They know the project; be direct and skip explaining its conventions."
+
+
+# ============================================================================
+# Blame
+# ============================================================================
+
+_BLAME_QUERY = """
+query($owner: String!, $repo: String!, $ref: String!, $path: String!) {
+  repository(owner: $owner, name: $repo) {
+    object(expression: $ref) {
+      ... on Commit {
+        blame(path: $path) {
+          ranges {
+            startingLine
+            endingLine
+            commit {
+              oid
+              committedDate
+              message
+              author { name date user { login } }
+            }
+          }
+        }
+      }
+    }
+  }
+}
+"""
+
+
+def _modified_line_ranges(diff: FileDiff) -> List[Tuple[int, int]]:
+    """
+    Base-side ranges of the lines a PR modifies or deletes.
+    
+    Added lines have no history, so they are never included; these are the
+    lines worth blaming to see who wrote the code being changed.
+    """
+    lines = sorted(ln.old_line for h in diff.hunks for ln in h.lines if ln.kind == "-")
+    ranges: List[Tuple[int, int]] = []
+    for line in lines:
+        if ranges and line == ranges[-1][1] + 1:
+            ranges[-1] = (ranges[-1][0], line)
+        else:
+            ranges.append((line, line))
+    return ranges
+
+
+async def _fetch_blame(owner: str, repo: str, ref: str, path: str) -> Optional[List[Dict[str, Any]]]:
+    """Blame a file at ref with the GraphQL API; returns None when the file does not exist there."""
+    try:
+        data = await _github_graphql(_BLAME_QUERY, {"owner": owner, "repo": repo, "ref": ref, "path": path})
+    except GitHubGraphQLError as e:
+        if any(err.get("type") == "NOT_FOUND" or "resolve file" in err.get("message", "") for err in e.errors):
+            return None
+        raise
+    target = (data.get("repository") or {}).get("object") or {}
+    blame = target.get("blame")
+    return blame["ranges"] if blame else None
+
+
+def _blame_for_range(blame: List[Dict[str, Any]], start: int, end: int) -> List[Dict[str, Any]]:
+    """The blame ranges overlapping start..end, clipped to it."""
+    spans = []
+    for entry in blame:
+        lo, hi = max(entry["startingLine"], start), min(entry["endingLine"], end)
+        if lo <= hi:
+            spans.append({"start_line": lo, "end_line": hi, "sha": entry["commit"]["oid"]})
+    return spans
+
+
+def _blame_commit(commit: Dict[str, Any], pr_author: Optional[str], now: datetime) -> Dict[str, Any]:
+    author = commit.get("author") or {}
+    login = (author.get("user") or {}).get("login")
+    committed = datetime.fromisoformat(commit["committedDate"].replace("Z", "+00:00"))
+    return {
+        "author": author.get("name"),
+        "login": login,
+        "date": commit["committedDate"],
+        "age_days": (now - committed).days,
+        "by_pr_author": login is not None and login == pr_author,
+        "message": commit["message"],
+    }
+
+
+# ============================================================================
+# File History
+# ============================================================================
+
+# Renames followed per file before giving up, in case of a cycle of renames
+MAX_RENAME_HOPS = 10
+
+
+async def _path_commits(
+    owner: str, repo: str, path: str, ref: str, limit: int, since: Optional[str] = None
+) -> List[Dict[str, Any]]:
+    """
+    List commits touching path reachable from ref, newest first, following renames.
+    
+    The commits API stops at the commit that gave a file its current name.
+    When a name's history runs out before the limit, that oldest commit is
+    fetched; if GitHub reports it as a rename, listing continues under the
+    previous name from its parent. Entries are {"commit", "path", "detail"},
+    with path the file's name in that commit and detail the single-commit
+    response when it was fetched.
+    """
+    entries: List[Dict[str, Any]] = []
+    for _ in range(MAX_RENAME_HOPS + 1):
+        remaining = limit - len(entries)
+        params = {"path": path, "sha": ref, "per_page": min(remaining, GITHUB_PER_PAGE)}
+        if since:
+            params["since"] = since
+        commits = await _github_api_paginate(f"/repos/{owner}/{repo}/commits", params, max_items=remaining)
+        entries.extend({"commit": c, "path": path, "detail": None} for c in commits)
+        if not commits or len(commits) == remaining:
+            break
+        oldest = entries[-1]
+        oldest["detail"] = await _github_api_request("GET", f"/repos/{owner}/{repo}/commits/{oldest['commit']['sha']}")
+        change = next((f for f in oldest["detail"].get("files", []) if f["filename"] == path), {})
+        parents = oldest["detail"].get("parents", [])
+        if change.get("status") != "renamed" or not change.get("previous_filename") or not parents:
+            break
+        path, ref = change["previous_filename"], parents[0]["sha"]
+    return entries
+
+
+# ============================================================================
+# Ref Comparison
+# ============================================================================
+
+# The compare API lists at most this many changed files, on the first page only
+GITHUB_COMPARE_FILES_LIMIT = 300
+
+
+def _compare_endpoint(owner: str, repo: str, base: str, head: str) -> str:
+    return f"/repos/{owner}/{repo}/compare/{quote(base, safe='/:')}...{quote(head, safe='/:')}"
+
+
+async def _fetch_comparison(owner: str, repo: str, base: str, head: str) -> Dict[str, Any]:
+    """
+    Fetch a comparison with every commit, paginating past the 250 commits GitHub returns at once.
+    
+    Changed files only come with the first page, so later pages are read for
+    their commits alone.
+    """
+    endpoint = _compare_endpoint(owner, repo, base, head)
+    comparison = (await _github_api_response("GET", endpoint, params={"per_page": GITHUB_PER_PAGE})).json()
+    if comparison.get("total_commits", 0) > len(comparison.get("commits", [])):
+        comparison["commits"] = await _github_api_paginate(endpoint, items_key="commits")
+    return comparison
+
+
+def _compare_file_diffs(files: List[Dict[str, Any]]) -> Dict[str, FileDiff]:
+    """Parse compare API files like PR files, marked as not comment-addressable."""
+    diffs = {}
+    for entry in files:
+        diff = _file_diff_from_api(entry)
+        diff.comment_addressable = False
+        diffs[diff.path] = diff
+    return diffs
+
+
+# ============================================================================
+# CI Checks
+# ============================================================================
+
+# Check run conclusions that mean the run did not pass
+FAILED_CONCLUSIONS = ("failure", "timed_out", "cancelled", "action_required", "startup_failure")
+
+
+def _truncate(text: Optional[str], limit: int) -> Optional[str]:
+    if text is None or len(text) <= limit:
+        return text
+    return text[:limit] + f"… [{len(text) - limit} more characters]"
+
+
+def _latest_by(items: List[Dict[str, Any]], key: str, timestamp: str) -> List[Dict[str, Any]]:
+    """Keep only the most recent item per key, e.g. the last rerun of a check."""
+    latest: Dict[str, Dict[str, Any]] = {}
+    for item in items:
+        current = latest.get(item[key])
+        if current is None or (item.get(timestamp) or "") > (current.get(timestamp) or ""):
+            latest[item[key]] = item
+    return sorted(latest.values(), key=lambda i: i[key])
+
+
+async def _fetch_checks(owner: str, repo: str, sha: str, max_output_chars: int) -> Dict[str, Any]:
+    """Combine check runs, check suites and commit statuses for one commit."""
+    base = f"/repos/{owner}/{repo}/commits/{sha}"
+    runs = _latest_by(
+        await _github_api_paginate(f"{base}/check-runs", params={"filter": "all"}, items_key="check_runs"),
+        "name", "started_at"
+    )
+    suites = await _github_api_paginate(f"{base}/check-suites", items_key="check_suites")
+    # Statuses come newest first and repeat per context on every update
+    statuses = _latest_by(await _github_api_paginate(f"{base}/statuses"), "context", "updated_at")
+    
+    checks = []
+    for run in runs:
+        check = {
+            "name": run["name"],
+            "status": run["status"],
+            "conclusion": run.get("conclusion"),
+            "details_url": run.get("details_url") or run.get("html_url"),
+        }
+        if run.get("conclusion") in FAILED_CONCLUSIONS:
+            output = run.get("output") or {}
+            check["title"] = output.get("title")
+            check["summary"] = _truncate(output.get("summary"), max_output_chars)
+            if output.get("annotations_count"):
+                annotations = await _github_api_paginate(f"/repos/{owner}/{repo}/check-runs/{run['id']}/annotations")
+                check["annotations"] = [
+                    {
+                        "path": a["path"],
+                        "line": a.get("start_line"),
+                        "level": a.get("annotation_level"),
+                        "message": _truncate(a.get("message"), max_output_chars),
+                    }
+                    for a in annotations
+                ]
+        checks.append(check)
+    
+    for status in statuses:
+        checks.append({
+            "name": status["context"],
+            "status": "completed" if status["state"] != "pending" else "in_progress",
+            # Legacy statuses use success/failure/error/pending states
+            "conclusion": {"error": "failure", "pending": None}.get(status["state"], status["state"]),
+            "details_url": status.get("target_url"),
+            **({"summary": _truncate(status.get("description"), max_output_chars)}
+               if status["state"] in ("failure", "error") else {}),
+        })
+    
+    if any(c["conclusion"] in FAILED_CONCLUSIONS for c in checks):
+        state = "failure"
+    elif any(c["status"] != "completed" for c in checks):
+        state = "pending"
+    else:
+        state = "success" if checks else "none"
+    return {
+        "sha": sha,
+        "state": state,
+        "checks": checks,
+        "suites": [
+            {
+                "app": (suite.get("app") or {}).get("name"),
+                "status": suite["status"],
+                "conclusion": suite.get("conclusion"),
+            }
+            for suite in suites
+        ],
+    }
+
+
+# ============================================================================
+# Branch Protection
+# ============================================================================
+
+# Check conclusions that satisfy a required status check
+PASSING_CONCLUSIONS = ("success", "neutral", "skipped")
+
+_REVIEW_DECISION_QUERY = """
+query($owner: String!, $repo: String!, $number: Int!) {
+  repository(owner: $owner, name: $repo) {
+    pullRequest(number: $number) { reviewDecision }
+  }
+}
+"""
+
+
+def _enabled(protection: Dict[str, Any], setting: str) -> bool:
+    return bool((protection.get(setting) or {}).get("enabled"))
+
+
+async def _branch_protection(owner: str, repo: str, branch: str) -> Dict[str, Any]:
+    """
+    Read a branch's protection rules, reduced to what decides whether a PR can merge.
+    
+    protected is False for an unprotected branch, and None when the token
+    may not read the rules (reading them needs admin access to the
+    repository), which is reported instead of raised.
+    """
+    try:
+        protection = await _github_api_request(
+            "GET", f"/repos/{owner}/{repo}/branches/{quote(branch, safe='')}/protection"
+        )
+    except httpx.HTTPStatusError as e:
+        if e.response.status_code == 404 and "not protected" in _github_error_message(e).lower():
+            return {"branch": branch, "protected": False}
+        if e.response.status_code in (403, 404):
+            # Without admin access GitHub answers 403, or 404 for some private repositories
+            return {
+                "branch": branch, "protected": None,
+                "reason": "unknown, insufficient permissions to read branch protection",
+            }
+        raise
+    checks = protection.get("required_status_checks")
+    reviews = protection.get("required_pull_request_reviews")
+    return {
+        "branch": branch,
+        "protected": True,
+        "required_status_checks": {
+            # Up to date with the base branch before merging
+            "strict": bool(checks.get("strict")),
+            "contexts": list(dict.fromkeys(
+                [c["context"] for c in checks.get("checks") or []] + list(checks.get("contexts") or [])
+            )),
+        } if checks else None,
+        "required_reviews": {
+            "approving_count": reviews.get("required_approving_review_count", 0),
+            "code_owner_reviews": bool(reviews.get("require_code_owner_reviews")),
+            "dismiss_stale_reviews": bool(reviews.get("dismiss_stale_reviews")),
+            "last_push_approval": bool(reviews.get("require_last_push_approval")),
+        } if reviews else None,
+        "required_conversation_resolution": _enabled(protection, "required_conversation_resolution"),
+        "required_linear_history": _enabled(protection, "required_linear_history"),
+        "required_signatures": _enabled(protection, "required_signatures"),
+        "allow_force_pushes": _enabled(protection, "allow_force_pushes"),
+        "enforce_admins": _enabled(protection, "enforce_admins"),
+    }
+
+
+def _protection_markdown(protection: Dict[str, Any]) -> str:
+    branch = protection["branch"]
+    if protection["protected"] is None:
+        return f"`{branch}`: {protection['reason']}.\n"
+    if not protection["protected"]:
+        return f"`{branch}` is not protected.\n"
+    markdown = f"`{branch}` is protected.\n\n"
+    checks, reviews = protection["required_status_checks"], protection["required_reviews"]
+    if checks:
+        names = ", ".join(f"`{c}`" for c in checks["contexts"]) or "none named"
+        strict = " (must be up to date with the base)" if checks["strict"] else ""
+        markdown += f"- **Required checks:** {names}{strict}\n"
+    if reviews:
+        markdown += f"- **Required approvals:** {reviews['approving_count']}"
+        markdown += ", including code owners\n" if reviews["code_owner_reviews"] else "\n"
+    for key, label in (
+        ("required_conversation_resolution", "Conversations must be resolved"),
+        ("required_linear_history", "Linear history required"),
+        ("required_signatures", "Signed commits required"),
+        ("allow_force_pushes", "Force-pushes allowed"),
+        ("enforce_admins", "Enforced for administrators"),
+    ):
+        if protection[key]:
+            markdown += f"- {label}\n"
+    return markdown
+
+
+def _requirement(name: str, met: Optional[bool], detail: str) -> Dict[str, Any]:
+    return {"requirement": name, "met": met, "detail": detail}
+
+
+def _merge_requirements(
+    pr_data: Dict[str, Any],
+    protection: Dict[str, Any],
+    checks: Dict[str, Any],
+    reviews: Dict[str, str],
+    review_decision: Optional[str],
+    unresolved_threads: Optional[int]
+) -> List[Dict[str, Any]]:
+    """Each thing standing between a PR and its merge with whether it is met (None when it cannot be told)."""
+    requirements = []
+    if pr_data.get("draft"):
+        requirements.append(_requirement("ready_for_review", False, "The PR is a draft"))
+    mergeable = pr_data.get("mergeable")
+    requirements.append(_requirement(
+        "no_conflicts", mergeable,
+        "Merges cleanly" if mergeable else "Conflicts with the base branch" if mergeable is False
+        else "GitHub has not finished computing mergeability"
+    ))
+    if protection["protected"] is None:
+        requirements.append(_requirement("branch_protection", None, protection["reason"]))
+        return requirements
+    if not protection["protected"]:
+        return requirements
+    
+    required_checks = protection["required_status_checks"]
+    if required_checks:
+        by_name = {c["name"]: c for c in checks["checks"]}
+        for name in required_checks["contexts"]:
+            check = by_name.get(name)
+            if check is None:
+                met, detail = False, "Has not reported on the head commit"
+            elif check["status"] != "completed":
+                met, detail = False, "Still running"
+            else:
+                met, detail = check["conclusion"] in PASSING_CONCLUSIONS, f"Concluded {check['conclusion']}"
+            requirements.append(_requirement(f"check:{name}", met, detail))
+        if required_checks["strict"]:
+            behind = pr_data.get("mergeable_state") == "behind"
+            requirements.append(_requirement(
+                "up_to_date", not behind,
+                "Behind the base branch; update it" if behind else "Up to date with the base branch"
+            ))
+    
+    required_reviews = protection["required_reviews"]
+    if required_reviews:
+        approvals = sum(1 for state in reviews.values() if state == "APPROVED")
+        needed = required_reviews["approving_count"]
+        requirements.append(_requirement(
+            "approvals", approvals >= needed, f"{approvals} of {needed} required approvals"
+        ))
+        blocking = sorted(login for login, state in reviews.items() if state == "CHANGES_REQUESTED")
+        requirements.append(_requirement(
+            "no_changes_requested", not blocking,
+            f"Changes requested by {', '.join(blocking)}" if blocking else "No outstanding change requests"
+        ))
+        if required_reviews["code_owner_reviews"]:
+            # GitHub reports code owner approval only as part of the overall review decision
+            if review_decision == "APPROVED":
+                met, detail = True, "Code owners approved"
+            elif review_decision == "REVIEW_REQUIRED" and approvals >= needed and not blocking:
+                met, detail = False, "Enough approvals, but GitHub still requires a review: likely from a code owner"
+            else:
+                met, detail = None, "Cannot tell whether code owners approved"
+            requirements.append(_requirement("code_owner_review", met, detail))
+    if protection["required_conversation_resolution"]:
+        requirements.append(_requirement(
+            "conversations_resolved", unresolved_threads == 0,
+            f"{unresolved_threads} unresolved review threads" if unresolved_threads else "All review threads resolved"
+        ))
+    return requirements
+
+
+# ============================================================================
+# Branch Updates
+# ============================================================================
+
+async def _poll_pr(
+    owner: str,
+    repo: str,
+    pr_number: int,
+    done: Callable[[Dict[str, Any]], bool],
+    timeout: float
+) -> Tuple[Dict[str, Any], bool]:
+    """
+    Re-fetch a PR with exponential backoff until done(pr) holds or timeout expires.
+    
+    Returns the last PR object and whether done() was satisfied.
+    """
+    delay, waited = 1.0, 0.0
+    while True:
+        pr_data = await _fetch_pr(owner, repo, pr_number)
+        if done(pr_data):
+            return pr_data, True
+        if waited >= timeout:
+            return pr_data, False
+        step = min(delay, timeout - waited)
+        await asyncio.sleep(step)
+        waited += step
+        delay = min(delay * 2, 8.0)
+
+
+async def _conflicting_files(
+    owner: str,
+    repo: str,
+    base_ref: str,
+    head_sha: str,
+    head_side: Optional[Dict[str, Any]] = None
+) -> List[str]:
+    """
+    List the files changed on both the base and head side since their merge base.
+    
+    The REST API does not expose the merge result itself, so these are the
+    files that can conflict; a file only one side touched never does.
+    head_side is the base...head comparison, if the caller already has it.
+    """
+    if head_side is None:
+        head_side = await _github_api_request("GET", f"/repos/{owner}/{repo}/compare/{base_ref}...{head_sha}")
+    merge_base = head_side["merge_base_commit"]["sha"]
+    base_side = await _github_api_request("GET", f"/repos/{owner}/{repo}/compare/{merge_base}...{base_ref}")
+    
+    def paths(comparison: Dict[str, Any]) -> set:
+        names = set()
+        for entry in comparison.get("files", []):
+            names.add(entry["filename"])
+            if entry.get("previous_filename"):
+                names.add(entry["previous_filename"])
+        return names
+    
+    return sorted(paths(head_side) & paths(base_side))
+
+
+# ============================================================================
+# PR Description
+# ============================================================================
+
+def _upsert_summary_section(body: Optional[str], content: str) -> str:
+    """
+    Insert or replace the marked summary section, leaving the author's text alone.
+    
+    The section is appended when the body has none. Running again with the
+    same content returns the body unchanged, and any extra copies of the
+    section (e.g. pasted by hand) are removed rather than updated twice.
+    """
+    body = body or ""
+    section = f"{PR_SUMMARY_START}\n{content.strip()}\n{PR_SUMMARY_END}"
+    pattern = re.compile(re.escape(PR_SUMMARY_START) + r".*?" + re.escape(PR_SUMMARY_END), re.DOTALL)
+    matches = list(pattern.finditer(body))
+    if not matches:
+        if PR_SUMMARY_START in body or PR_SUMMARY_END in body:
+            raise ValueError(
+                "The description has an unmatched pr-reviewer:summary marker; "
+                "fix it on GitHub or use mode='replace'"
+            )
+        return f"{body.rstrip()}\n\n{section}" if body.strip() else section
+    
+    first = matches[0]
+    rest = pattern.sub("", body[first.end():])
+    return body[:first.start()] + section + rest
+
+
+# ============================================================================
+# Summary Comment
+# ============================================================================
+
+def _parse_summary_comment(body: str) -> Tuple[str, List[str]]:
+    """Split a summary comment into its current summary and earlier runs, newest first."""
+    body = body.replace(SUMMARY_COMMENT_MARKER, "", 1)
+    current, _, history = body.partition(SUMMARY_HISTORY_MARKER)
+    if history:
+        current = current[:current.rfind("<details>")] if "<details>" in current else current
+        history = history.strip().removesuffix("</details>")
+    runs = [run.strip() for run in history.split(SUMMARY_RUN_MARKER) if run.strip()]
+    return current.strip(), runs
+
+
+def _render_summary_comment(summary: str, history: List[str]) -> str:
+    """Build a summary comment body with an optional collapsed block of earlier runs."""
+    body = f"{SUMMARY_COMMENT_MARKER}\n{summary.strip()}"
+    if history:
+        runs = "\n\n".join(f"{SUMMARY_RUN_MARKER}\n{run}" for run in history)
+        body += (
+            f"\n\n<details>\n<summary>Previous runs ({len(history)})</summary>\n\n"
+            f"{SUMMARY_HISTORY_MARKER}\n{runs}\n\n</details>"
+        )
+    return body
+
+
+async def _find_summary_comment(owner: str, repo: str, pr_number: int) -> Optional[Dict[str, Any]]:
+    """
+    Return the newest marked summary comment the bot posted on the PR, if it still exists.
+    
+    The comment the review state names is fetched on its own; only when
+    there is none, or it was deleted, are all the PR's comments listed.
+    """
+    comment_id = _review_state(owner, repo, pr_number).summary_comment_id
+    if comment_id is not None:
+        try:
+            comment = await _github_api_request("GET", f"/repos/{owner}/{repo}/issues/comments/{comment_id}")
+        except httpx.HTTPStatusError as e:
+            if e.response.status_code != 404:
+                raise
+        else:
+            if SUMMARY_COMMENT_MARKER in (comment.get("body") or ""):
+                return comment
+    login = await _authenticated_login()
+    comments = await _github_api_paginate(f"/repos/{owner}/{repo}/issues/{pr_number}/comments")
+    marked = [
+        c for c in comments
+        # A human quoting the summary copies the marker but is not the bot
+        if SUMMARY_COMMENT_MARKER in (c.get("body") or "") and _login_matches(c.get("user"), login)
+    ]
+    found = marked[-1]["id"] if marked else None
+    if found != comment_id:
+        _update_review_state(owner, repo, pr_number, lambda state: replace(state, summary_comment_id=found))
+    return marked[-1] if marked else None
+
+
+async def _upsert_summary_comment(
+    owner: str, repo: str, pr_number: int, summary: str, history_limit: int = 0, head_sha: Optional[str] = None,
+    dry_run: bool = False
+) -> Dict[str, Any]:
+    """
+    Edit the bot's summary comment in place, or create it when there is none.
+    
+    With history_limit, the replaced summary is kept (stamped with when it
+    was posted) in a collapsed block holding at most that many earlier runs.
+    A head_sha is recorded in a hidden marker that moves into the history
+    with its summary.
+    
+    Returns:
+        Dict[str, Any]: action ("created" or "updated"), comment_id, html_url
+            and previous_runs; a dry run sends nothing and returns action
+            "create" or "update" with the planned_request instead
+    """
+    if head_sha:
+        summary = f"{summary.strip()}\n\n{_data_marker(SUMMARY_HEAD_MARKER, {'head_sha': head_sha})}"
+    existing = await _find_summary_comment(owner, repo, pr_number)
+    history: List[str] = []
+    if existing and history_limit:
+        previous, runs = _parse_summary_comment(existing["body"])
+        stamp = existing.get("updated_at") or existing.get("created_at") or "earlier run"
+        history = [f"**{stamp}**\n\n{previous}", *runs][:history_limit]
+    body = _render_summary_comment(summary, history)
+    if dry_run:
+        planned = (
+            _planned_request("PATCH", f"/repos/{owner}/{repo}/issues/comments/{existing['id']}", {"body": body})
+            if existing else _planned_request("POST", f"/repos/{owner}/{repo}/issues/{pr_number}/comments", {"body": body})
+        )
+        return {
+            "action": "update" if existing else "create",
+            "comment_id": existing["id"] if existing else None,
+            "previous_runs": len(history),
+            "planned_request": planned,
+        }
+    if existing:
+        result = await _github_api_request(
+            "PATCH", f"/repos/{owner}/{repo}/issues/comments/{existing['id']}", {"body": body}
+        )
+        action = "updated"
+    else:
+        result = await _github_api_request("POST", f"/repos/{owner}/{repo}/issues/{pr_number}/comments", {"body": body})
+        action = "created"
+        _update_review_state(owner, repo, pr_number, lambda state: replace(state, summary_comment_id=result["id"]))
+    return {"action": action, "comment_id": result["id"], "html_url": result.get("html_url"), "previous_runs": len(history)}
+
+
+# ============================================================================
+# Review Templates
+# ============================================================================
+
+# The user-visible text the server renders, by template name; a file <name>.tmpl replaces one
+REVIEW_TEMPLATE_NAMES = {
+    "summary": "Summary comment of github_pr_comprehensive_review",
+    "review": "Body of a review posted by github_pr_create_review",
+    "review_approve": "Body of an APPROVE review, instead of review",
+    "review_request_changes": "Body of a REQUEST_CHANGES review, instead of review",
+    "review_comment": "Body of a COMMENT review, instead of review",
+    "inline_comment": "Body of each inline finding comment",
+    "suggestion": "Suggestion block of an inline comment whose finding has one",
+    "sweep_reply": "Reply github_pr_sweep_resolved_findings posts before resolving a thread",
+}
+REVIEW_TEMPLATE_SUFFIX = ".tmpl"
+# Repository templates, read from the default branch like the review policy
+REPO_TEMPLATES_PATH = ".github/pr-reviewer/templates"
+# Nesting limit of {{template}} calls, which stops a template from including itself forever
+TEMPLATE_MAX_DEPTH = 20
+
+BUILTIN_TEMPLATES = {
+    "summary": (
+        "## 🤖 Automated Review for PR #{{.Run.Number}}\n"
+        "{{- range .Sections}}\n"
+        "\n"
+        "{{if .Title}}### "
+        "{{- if eq .Kind \"submodules\"}} 📦{{else if eq .Kind \"dependencies\"}} 📚"
+        "{{else if eq .Kind \"static_analysis\"}} 🔍{{else if eq .Kind \"tests\"}} 🧪{{end}} {{.Title}}\n"
+        "{{end}}{{.Body}}\n"
+        "{{- end}}\n"
+        "{{- if .Findings}}\n"
+        "\n"
+        "### Findings\n"
+        "{{range .Findings}}\n"
+        "- **{{.Severity}}** `{{.Path}}:{{.Line}}`: {{.Body}}\n"
+        "{{- end}}\n"
+        "{{- end}}"
+    ),
+    "review": (
+        "{{.Summary}}\n"
+        "{{- range .Notes}}\n"
+        "\n"
+        "{{.}}\n"
+        "{{- end}}\n"
+        "{{- if .Findings}}\n"
+        "\n"
+        "### Additional Findings\n"
+        "{{range .Findings}}\n"
+        "- `{{.Path}}:{{.Line}}` — {{.Body}}\n"
+        "{{- end}}\n"
+        "{{- end}}\n"
+        "{{- if .CommitFindings}}\n"
+        "\n"
+        "{{/* A bare SHA, not a code span, so GitHub links it to the commit */}}"
+        "### Commit Findings\n"
+        "{{range .CommitFindings}}\n"
+        "- {{.Commit}} — {{.Body}}\n"
+        "{{- end}}\n"
+        "{{- end}}"
+    ),
+    "inline_comment": (
+        "{{.Finding.Body}}\n"
+        "{{- if .Finding.HasSuggestion}}\n"
+        "\n"
+        "{{template \"suggestion\" .}}\n"
+        "{{- end}}"
+    ),
+    "suggestion": "```suggestion\n{{.Finding.Suggestion}}\n```",
+    "sweep_reply": "Resolved in {{.Run.ShortSHA}}, thanks!",
+}
+
+
+class TemplateError(ValueError):
+    """A review template that does not parse or render, located by file and line."""
+    
+    def __init__(self, source: str, line: int, message: str):
+        super().__init__(f"{source}:{line}: {message}")
+        self.source, self.line, self.message = source, line, message
+
+
+@dataclass
+class _TemplateNode:
+    """A parsed piece of a template: literal text, an output action, or a block with a body."""
+    kind: str
+    line: int
+    text: str = ""
+    pipeline: List[List[Tuple[str, Any]]] = field(default_factory=list)
+    body: List["_TemplateNode"] = field(default_factory=list)
+    alternative: List["_TemplateNode"] = field(default_factory=list)
+    name: str = ""
+
+
+@dataclass
+class ParsedTemplate:
+    """A review template ready to render, and the file it came from."""
+    name: str
+    source: str
+    nodes: List[_TemplateNode]
+
+
+# {{action}}, with the "{{- " and " -}}" markers that trim the whitespace around it
+_TEMPLATE_ACTION = re.compile(r"\{\{(-\s)?(.*?)(\s-)?\}\}", re.DOTALL)
+_TEMPLATE_TOKEN = re.compile(r"""\s*(?:
+    (?P<string>"(?:[^"\\\n]|\\.)*")
+  | (?P<raw>`[^`]*`)
+  | (?P<number>-?\d+(?:\.\d+)?)
+  | (?P<variable>\$[A-Za-z_]\w*)
+  | (?P<field>\$?(?:\.[A-Za-z_]\w*)+|\$|\.)
+  | (?P<ident>[A-Za-z_]\w*)
+  | (?P<punct>[|()])
+)""", re.VERBOSE)
+
+
+def _template_text(value: Any) -> str:
+    """Print a value the way text/template does, with nothing for a missing one."""
+    if value is None:
+        return ""
+    if isinstance(value, bool):
+        return "true" if value else "false"
+    if isinstance(value, (list, tuple)):
+        return "[" + " ".join(_template_text(v) for v in value) + "]"
+    return str(value)
+
+
+def _template_printf(fmt: str, *args: Any) -> str:
+    """printf with the Go verbs templates use: %v, %s, %d, %f, %q, %x and %%."""
+    values = list(args)
+    
+    def verb(match: "re.Match[str]") -> str:
+        spec, kind = match.group(1), match.group(2)
+        if kind == "%":
+            return "%"
+        if not values:
+            return f"%!{kind}(MISSING)"
+        value = values.pop(0)
+        if kind == "q":
+            return json.dumps(_template_text(value))
+        if kind in "dfx":
+            return f"%{spec}{kind}" % value
+        return f"%{spec}s" % _template_text(value)
+    
+    return re.sub(r"%([-+# 0]*\d*(?:\.\d+)?)([vsdfqxt%])", verb, fmt)
+
+
+def _template_index(value: Any, *keys: Any) -> Any:
+    for key in keys:
+        value = value[key]
+    return value
+
+
+# Functions a template may call; and and or are evaluated lazily by _TemplateRun.logic
+TEMPLATE_FUNCTIONS: Dict[str, Callable[..., Any]] = {
+    "and": lambda *values: next((v for v in values if not v), values[-1]),
+    "or": lambda *values: next((v for v in values if v), values[-1]),
+    "not": lambda value: not value,
+    "eq": lambda value, *others: any(value == other for other in others),
+    "ne": lambda a, b: a != b,
+    "lt": lambda a, b: a < b,
+    "le": lambda a, b: a <= b,
+    "gt": lambda a, b: a > b,
+    "ge": lambda a, b: a >= b,
+    "len": len,
+    "index": _template_index,
+    "print": lambda *values: "".join(_template_text(v) for v in values),
+    "printf": _template_printf,
+    "join": lambda sep, values: sep.join(_template_text(v) for v in values),
+    "upper": lambda value: _template_text(value).upper(),
+    "lower": lambda value: _template_text(value).lower(),
+    "trim": lambda value: _template_text(value).strip(),
+}
+
+
+class _TemplateParser:
+    """Parse the subset of Go's text/template that review templates use into nodes."""
+    
+    def __init__(self, text: str, source: str):
+        self.source = source
+        self.items: List[Tuple[str, int, str]] = []
+        pos, trim_next = 0, False
+        for match in _TEMPLATE_ACTION.finditer(text):
+            chunk = text[pos:match.start()]
+            if trim_next:
+                chunk = chunk.lstrip()
+            if match.group(1):
+                chunk = chunk.rstrip()
+            line = text.count("\n", 0, match.start()) + 1
+            self.items.append(("text", line, chunk))
+            self.items.append(("action", line, match.group(2).strip()))
+            pos, trim_next = match.end(), bool(match.group(3))
+        tail = text[pos:].lstrip() if trim_next else text[pos:]
+        if "{{" in tail:
+            raise TemplateError(source, text.count("\n", 0, text.index("{{", pos)) + 1, "unclosed action")
+        self.items.append(("text", text.count("\n") + 1, tail))
+        self.pos = 0
+    
+    def error(self, line: int, message: str) -> TemplateError:
+        return TemplateError(self.source, line, message)
+    
+    def parse(self) -> List[_TemplateNode]:
+        nodes, end = self.parse_list()
+        if end is not None:
+            raise self.error(end[0], f"unexpected {{{{{end[1]}}}}}")
+        return nodes
+    
+    def parse_list(self) -> Tuple[List[_TemplateNode], Optional[Tuple[int, str]]]:
+        """Nodes up to the next {{end}} or {{else}}, which is returned as (line, action)."""
+        nodes = []
+        while self.pos < len(self.items):
+            kind, line, content = self.items[self.pos]
+            self.pos += 1
+            if kind == "text":
+                if content:
+                    nodes.append(_TemplateNode("text", line, text=content))
+                continue
+            if content.startswith("/*"):
+                if not content.endswith("*/"):
+                    raise self.error(line, "unclosed comment")
+                continue
+            keyword, _, rest = content.partition(" ")
+            if keyword in ("end", "else"):
+                return nodes, (line, content)
+            if keyword in ("if", "range", "with"):
+                nodes.append(self.parse_block(keyword, line, rest))
+            elif keyword == "template":
+                nodes.append(self.parse_template_call(line, rest))
+            elif keyword in ("define", "block"):
+                raise self.error(line, f"{{{{{keyword}}}}} is not supported; put each template in its own file")
+            else:
+                nodes.append(_TemplateNode("output", line, pipeline=self.parse_pipeline(line, content)))
+        return nodes, None
+    
+    def parse_block(self, keyword: str, line: int, rest: str) -> _TemplateNode:
+        node = _TemplateNode(keyword, line, pipeline=self.parse_pipeline(line, rest))
+        node.body, end = self.parse_list()
+        if end is None:
+            raise self.error(line, f"unclosed {{{{{keyword}}}}}: missing {{{{end}}}}")
+        end_line, content = end
+        if content == "else":
+            node.alternative, end = self.parse_list()
+            if end is None or end[1] != "end":
+                raise self.error(end[0] if end else line, f"{{{{{keyword}}}}} has more than one {{{{else}}}}")
+        elif content.startswith("else if ") and keyword == "if":
+            node.alternative = [self.parse_block("if", end_line, content[len("else if "):])]
+        elif content != "end":
+            raise self.error(end_line, f"unexpected {{{{{content}}}}}")
+        return node
+    
+    def parse_template_call(self, line: int, rest: str) -> _TemplateNode:
+        match = re.match(r'\s*"([^"]*)"\s*(.*)$', rest, re.DOTALL)
+        if not match:
+            raise self.error(line, '{{template}} needs a quoted name, as in {{template "suggestion" .}}')
+        name = match.group(1)
+        if name not in REVIEW_TEMPLATE_NAMES:
+            raise self.error(line, f"no template named {name!r}; use one of {', '.join(REVIEW_TEMPLATE_NAMES)}")
+        pipeline = self.parse_pipeline(line, match.group(2)) if match.group(2).strip() else []
+        return _TemplateNode("template", line, pipeline=pipeline, name=name)
+    
+    def parse_pipeline(self, line: int, text: str) -> List[List[Tuple[str, Any]]]:
+        tokens = self.tokenize(line, text)
+        pipeline, pos = self.pipeline_at(line, tokens, 0)
+        if pos < len(tokens):
+            raise self.error(line, f"unexpected {tokens[pos][1]!r}")
+        return pipeline
+    
+    def tokenize(self, line: int, text: str) -> List[Tuple[str, str]]:
+        tokens, pos = [], 0
+        while text[pos:].strip():
+            match = _TEMPLATE_TOKEN.match(text, pos)
+            if not match:
+                raise self.error(line, f"unexpected {text[pos:].strip()[:20]!r}")
+            tokens.append((match.lastgroup, match.group(match.lastgroup)))
+            pos = match.end()
+        if not tokens:
+            raise self.error(line, "missing value")
+        return tokens
+    
+    def pipeline_at(self, line: int, tokens: List[Tuple[str, str]], pos: int) -> Tuple[List[List[Tuple[str, Any]]], int]:
+        pipeline: List[List[Tuple[str, Any]]] = [[]]
+        while pos < len(tokens):
+            kind, text = tokens[pos]
+            if kind == "punct" and text == ")":
+                break
+            pos += 1
+            if kind == "punct" and text == "|":
+                pipeline.append([])
+                continue
+            if kind == "punct":
+                operand, pos = self.pipeline_at(line, tokens, pos)
+                if pos >= len(tokens):
+                    raise self.error(line, "unclosed (")
+                pos += 1
+                pipeline[-1].append(("pipeline", operand))
+            elif kind == "variable":
+                raise self.error(line, f"variables such as {text} are not supported; use . or $")
+            elif kind == "field":
+                base = "root" if text.startswith("$") else "dot"
+                pipeline[-1].append(("field", (base, [name for name in text.lstrip("$").split(".") if name])))
+            elif kind == "ident":
+                if text in ("true", "false", "nil"):
+                    pipeline[-1].append(("literal", {"true": True, "false": False, "nil": None}[text]))
+                elif text not in TEMPLATE_FUNCTIONS:
+                    raise self.error(line, f"function {text!r} not defined; use one of {', '.join(TEMPLATE_FUNCTIONS)}")
+                else:
+                    pipeline[-1].append(("function", text))
+            elif kind == "number":
+                pipeline[-1].append(("literal", float(text) if "." in text else int(text)))
+            elif kind == "raw":
+                pipeline[-1].append(("literal", text[1:-1]))
+            else:
+                pipeline[-1].append(("literal", json.loads(text)))
+        for index, command in enumerate(pipeline):
+            if not command:
+                raise self.error(line, "missing value in pipeline")
+            if command[0][0] != "function" and (len(command) > 1 or index > 0):
+                raise self.error(line, "can't give an argument to a non-function")
+        return pipeline, pos
+
+
+def _parse_template(name: str, text: str, source: str) -> ParsedTemplate:
+    """Parse a template's text; syntax errors raise TemplateError with the source and line."""
+    return ParsedTemplate(name, source, _TemplateParser(text, source).parse())
+
+
+@dataclass
+class _TemplateRun:
+    """State of one rendering: the whole template set, the root data and the output so far."""
+    templates: "ReviewTemplates"
+    root: Dict[str, Any]
+    out: List[str] = field(default_factory=list)
+    depth: int = 0
+    
+    def execute(self, template: ParsedTemplate, nodes: List[_TemplateNode], dot: Any) -> None:
+        for node in nodes:
+            if node.kind == "text":
+                self.out.append(node.text)
+            elif node.kind == "output":
+                self.out.append(_template_text(self.pipeline(template, node, dot)))
+            elif node.kind == "if":
+                branch = node.body if self.pipeline(template, node, dot) else node.alternative
+                self.execute(template, branch, dot)
+            elif node.kind == "with":
+                value = self.pipeline(template, node, dot)
+                self.execute(template, node.body if value else node.alternative, value if value else dot)
+            elif node.kind == "range":
+                value = self.pipeline(template, node, dot)
+                if isinstance(value, dict):
+                    value = [value[k] for k in sorted(value)]
+                elif value is not None and not isinstance(value, (list, tuple)):
+                    raise TemplateError(
+                        template.source, node.line, f"range can't iterate over {_template_text(value)!r}"
+                    )
+                for item in value or []:
+                    self.execute(template, node.body, item)
+                if not value:
+                    self.execute(template, node.alternative, dot)
+            else:
+                self.call(template, node, self.pipeline(template, node, dot) if node.pipeline else None)
+    
+    def call(self, template: ParsedTemplate, node: _TemplateNode, dot: Any) -> None:
+        target = self.templates.templates.get(node.name)
+        if target is None:
+            raise TemplateError(template.source, node.line, f"no template named {node.name!r} in this set")
+        if self.depth >= TEMPLATE_MAX_DEPTH:
+            raise TemplateError(
+                template.source, node.line, f"{{{{template}}}} calls nest more than {TEMPLATE_MAX_DEPTH} deep"
+            )
+        self.depth += 1
+        self.execute(target, target.nodes, dot)
+        self.depth -= 1
+    
+    def pipeline(self, template: ParsedTemplate, node: _TemplateNode, dot: Any) -> Any:
+        return self.evaluate(template, node.line, node.pipeline, dot)
+    
+    def evaluate(self, template: ParsedTemplate, line: int, pipeline: List[List[Tuple[str, Any]]], dot: Any) -> Any:
+        value, piped = None, False
+        for command in pipeline:
+            kind, head = command[0]
+            if kind != "function":
+                value = self.operand(template, line, command[0], dot)
+            elif head in ("and", "or"):
+                value = self.logic(template, line, head, command[1:], dot)
+            else:
+                args = [self.operand(template, line, operand, dot) for operand in command[1:]]
+                try:
+                    value = TEMPLATE_FUNCTIONS[head](*args, *([value] if piped else []))
+                except (TypeError, KeyError, IndexError, ValueError) as e:
+                    raise TemplateError(template.source, line, f"error calling {head}: {e}") from None
+            piped = True
+        return value
+    
+    def operand(self, template: ParsedTemplate, line: int, operand: Tuple[str, Any], dot: Any) -> Any:
+        kind, value = operand
+        if kind == "literal":
+            return value
+        if kind == "pipeline":
+            return self.evaluate(template, line, value, dot)
+        base, names = value
+        value = self.root if base == "root" else dot
+        for name in names:
+            if value is None:
+                return None
+            if not isinstance(value, dict):
+                raise TemplateError(template.source, line, f"can't evaluate field {name} of {_template_text(value)!r}")
+            if name not in value:
+                raise TemplateError(
+                    template.source, line, f"can't evaluate field {name}; it has {', '.join(value) or 'no fields'}"
+                )
+            value = value[name]
+        return value
+    
+    def logic(self, template: ParsedTemplate, line: int, op: str, operands: List[Tuple[str, Any]], dot: Any) -> Any:
+        """and/or stop at the first operand that decides them and return it, as in Go."""
+        value = None
+        for operand in operands:
+            value = self.operand(template, line, operand, dot)
+            if bool(value) == (op == "or"):
+                return value
+        return value
+
+
+TEMPLATE_SAMPLE_SHA = "3f6c9a1e8b2d4f7a9c0e1b3d5f7a9c1e3b5d7f9a"
+
+
+def _template_finding(finding: Union[ReviewFinding, AnalyzerFinding, None] = None, **fields: Any) -> Dict[str, Any]:
+    """The Finding of the template data model; fields fill in one that exists only as a thread."""
+    data: Dict[str, Any] = {
+        "Path": "", "Line": 0, "StartLine": 0, "Side": "RIGHT", "Severity": "", "Category": "", "Rule": "",
+        "Body": "", "Suggestion": "", "HasSuggestion": False, "Commit": "", "ID": "",
+    }
+    if isinstance(finding, ReviewFinding):
+        data.update({
+            "Path": finding.path or "", "Line": finding.line or 0, "StartLine": finding.start_line or 0,
+            "Side": finding.side, "Severity": finding.severity, "Category": finding.category or "",
+            "Rule": finding.rule or "", "Body": finding.body, "Suggestion": finding.suggestion or "",
+            "HasSuggestion": finding.suggestion is not None, "Commit": finding.commit or "", "ID": _finding_id(finding),
+        })
+    elif isinstance(finding, AnalyzerFinding):
+        data.update({
+            "Path": finding.path or "", "Line": finding.line or 0, "Side": finding.side, "Severity": finding.severity,
+            "Category": ANALYZER_CATEGORIES.get(finding.analyzer, ""), "Rule": finding.rule or finding.analyzer,
+            "Body": finding.message, "Commit": finding.commit or "",
+        })
+    data.update(fields)
+    return data
+
+
+def _template_run(
+    owner: str, repo: str, pr_number: int, head_sha: Optional[str] = None, run_id: Optional[str] = None,
+    event: str = "", draft: bool = False
+) -> Dict[str, Any]:
+    """The RunInfo of the template data model."""
+    return {
+        "Owner": owner, "Repo": repo, "Number": pr_number, "HeadSHA": head_sha or "", "ShortSHA": (head_sha or "")[:7],
+        "RunID": run_id or "", "Event": event, "Draft": draft,
+    }
+
+
+def _template_policy(loaded: Optional["LoadedPolicy"]) -> Dict[str, Any]:
+    """The Policy of the template data model."""
+    if loaded is None:
+        return {"Source": "", "Path": "", "Ref": "", "ReviewEvents": {}}
+    return {
+        "Source": loaded.source, "Path": loaded.path or "", "Ref": loaded.ref or "",
+        "ReviewEvents": dict(loaded.policy.review_events),
+    }
+
+
+def _template_section(kind: str, body: str, title: str = "") -> Dict[str, Any]:
+    """A section of the summary comment; notes have no title."""
+    return {"Kind": kind, "Title": title, "Body": body.strip()}
+
+
+def _sample_template_data(name: str, policy: Optional[Dict[str, Any]] = None) -> Dict[str, Any]:
+    """Made-up data for a template, for checking it at load and for github_pr_render_preview."""
+    event = {"review_approve": "APPROVE", "review_request_changes": "REQUEST_CHANGES"}.get(name, "COMMENT")
+    run = _template_run("octo-org", "service", 42, TEMPLATE_SAMPLE_SHA, "r-5d41402abc4b2a76", event)
+    finding = _template_finding(ReviewFinding(
+        path="internal/cache/store.go", line=87, body="`Get` reads `entries` without holding `mu`.",
+        suggestion="\tmu.RLock()\n\tdefer mu.RUnlock()", severity="error", category="concurrency",
+        rule="go-vet/copylocks"
+    ))
+    data = {"Run": run, "Policy": policy or _template_policy(LoadedPolicy(ReviewPolicy(), source="built-in default"))}
+    if name == "summary":
+        data.update({
+            "Sections": [
+                _template_section("note", DRAFT_STAGE_NOTE),
+                _template_section("dependencies", "- `golang.org/x/sync` added at v0.7.0", "Dependencies"),
+                _template_section("tests", "✅ **All tests passed!**", "Test Results"),
+            ],
+            "Findings": [_template_finding(AnalyzerFinding(
+                analyzer="dependencies", path="go.mod", line=5, rule="dependencies/license-unknown", severity="error",
+                message="No license found for `example.com/lib` v1.2.0"
+            ))],
+        })
+    elif name.startswith("review"):
+        data.update({
+            "Summary": "Two problems in the cache; the rest looks good.",
+            "Notes": [_scope_note(["internal/"])],
+            "Findings": [_template_finding(ReviewFinding(
+                path="internal/cache/store.go", line=300, body="Not in the diff"
+            ))],
+            "CommitFindings": [_template_finding(ReviewFinding(commit=TEMPLATE_SAMPLE_SHA, body="Subject is too long"))],
+        })
+    elif name == "sweep_reply":
+        data["Finding"] = _template_finding(Path="internal/cache/store.go", Line=87, Rule="go-vet/copylocks")
+    else:
+        data["Finding"] = finding
+    return data
+
+
+@dataclass
+class ReviewTemplates:
+    """
+    The templates the server renders with, by name.
+    
+    errors lists templates that were left out because they do not parse or
+    render; a rendering that fails at run time falls back to the template it
+    overrode and is listed there too.
+    """
+    templates: Dict[str, ParsedTemplate]
+    fallbacks: Dict[str, ParsedTemplate] = field(default_factory=dict)
+    errors: List[str] = field(default_factory=list)
+    
+    @classmethod
+    def builtin(cls) -> "ReviewTemplates":
+        return cls({name: _parse_template(name, text, f"built-in {name}") for name, text in BUILTIN_TEMPLATES.items()})
+    
+    def render(self, name: str, data: Dict[str, Any]) -> str:
+        """Render a template; its trailing whitespace is dropped so a file's final newline does not matter."""
+        template = self.templates[name]
+        try:
+            run = _TemplateRun(self, data)
+            run.execute(template, template.nodes, data)
+            return "".join(run.out).rstrip()
+        except TemplateError as e:
+            fallback = self.fallbacks.get(name)
+            if fallback is None:
+                raise
+            logger.warning("Template %s failed, using %s: %s", template.source, fallback.source, e)
+            self.errors.append(str(e))
+            return ReviewTemplates({**self.templates, name: fallback}).render(name, data)
+    
+    def review_template(self, event: str) -> str:
+        """The name of the template for a review with this event: its own one, else review."""
+        name = f"review_{event.lower()}"
+        return name if name in self.templates else "review"
+    
+    def check(self, name: str) -> None:
+        """Render a template against the sample data, raising TemplateError if it fails."""
+        rendered = ReviewTemplates(self.templates).render(name, _sample_template_data(name))
+        suggestion = _sample_template_data("suggestion")["Finding"]["Suggestion"]
+        if name == "suggestion" and not any(suggestion in block for block in _SUGGESTION_BLOCK.findall(rendered)):
+            raise TemplateError(
+                self.templates[name].source, 1, "must render .Finding.Suggestion inside a ```suggestion block"
+            )
+    
+    def overlay(self, files: Dict[str, str], strict: bool = False) -> "ReviewTemplates":
+        """
+        Return this set with the templates in files (text by path) replacing ones of the same name.
+        
+        Each replacement is parsed and rendered against sample data. Without
+        strict, a failing one is left out and listed in errors; with strict,
+        every failure is raised together as a ValueError.
+        """
+        merged = dict(self.templates)
+        errors: List[str] = []
+        replaced = []
+        for source, text in sorted(files.items()):
+            name = posixpath.basename(source).removesuffix(REVIEW_TEMPLATE_SUFFIX)
+            if name not in REVIEW_TEMPLATE_NAMES:
+                errors.append(f"{source}:1: unknown template {name!r}; use one of {', '.join(REVIEW_TEMPLATE_NAMES)}")
+                continue
+            try:
+                merged[name] = _parse_template(name, text, source)
+                replaced.append(name)
+            except TemplateError as e:
+                errors.append(str(e))
+        fallbacks = dict(self.fallbacks)
+        for name in replaced:
+            base = self.templates.get(name) or (self.templates["review"] if name.startswith("review_") else None)
+            if base is not None:
+                fallbacks.setdefault(name, base)
+        result = ReviewTemplates(merged, fallbacks)
+        for name in replaced:
+            try:
+                result.check(name)
+            except TemplateError as e:
+                errors.append(str(e))
+                if name in self.templates:
+                    result.templates[name] = self.templates[name]
+                else:
+                    del result.templates[name]
+        if strict and errors:
+            raise ValueError("\n".join(errors))
+        result.errors = self.errors + errors
+        return result
+
+
+def _load_review_template_dir(directory: str) -> ReviewTemplates:
+    """
+    Return the built-in templates overlaid with the .tmpl files in directory.
+    
+    Every file is parsed and rendered against sample data here, so a
+    mistake stops the server from starting instead of failing a review.
+    
+    Raises:
+        ValueError: If the directory is missing or any template is invalid,
+            with the file and line of each problem
+    """
+    templates = ReviewTemplates.builtin()
+    if not directory:
+        return templates
+    root = Path(directory)
+    if not root.is_dir():
+        raise ValueError(f"Template directory {directory} does not exist")
+    files = {
+        str(path): path.read_text(encoding="utf-8")
+        for path in sorted(root.iterdir()) if path.suffix == REVIEW_TEMPLATE_SUFFIX and path.is_file()
+    }
+    return templates.overlay(files, strict=True)
+
+
+# The built-in templates overlaid with PR_REVIEWER_TEMPLATES_DIR, set at startup
+_server_templates = ReviewTemplates.builtin()
+
+
+def _server_template_set() -> ReviewTemplates:
+    """A copy of the server's templates, so the fallbacks of one request are reported with it alone."""
+    return replace(_server_templates, errors=list(_server_templates.errors))
+
+
+async def _load_review_templates(owner: str, repo: str) -> ReviewTemplates:
+    """
+    Overlay the server's templates with the repository's, read from its default branch.
+    
+    As with the review policy, the PR's own copy is never used. A repository
+    template that does not parse or render is left out, with the problem in
+    the set's errors, and the server's template is used instead.
+    """
+    ref = (await _github_api_request("GET", f"/repos/{owner}/{repo}"))["default_branch"]
+    try:
+        listing = (await _github_api_response(
+            "GET", f"/repos/{owner}/{repo}/contents/{REPO_TEMPLATES_PATH}", params={"ref": ref}
+        )).json()
+    except httpx.HTTPStatusError as e:
+        if e.response.status_code != 404:
+            raise
+        return _server_template_set()
+    files = {
+        entry["path"]: await _fetch_file_text(owner, repo, entry["path"], ref)
+        for entry in (listing if isinstance(listing, list) else [])
+        if entry.get("type") == "file" and entry["name"].endswith(REVIEW_TEMPLATE_SUFFIX)
+    }
+    return _server_templates.overlay(files) if files else _server_template_set()
+
+
+# ============================================================================
+# SARIF
+# ============================================================================
+
+SARIF_SCHEMA = "https://json.schemastore.org/sarif-2.1.0.json"
+
+
+def _build_sarif(findings: List[ReviewFinding], tool_name: str) -> Dict[str, Any]:
+    """
+    Convert findings into a SARIF 2.1.0 document with a single run.
+    
+    Rules are listed in order of first use and results reference them by
+    index, so the same findings always produce the same document. Findings
+    without a rule fall back to their category, then to "review". A commit
+    finding has no file, so its SHA is given as a logical location.
+    """
+    rules: List[Dict[str, Any]] = []
+    rule_index: Dict[str, int] = {}
+    results = []
+    for finding in findings:
+        rule = finding.rule or finding.category or "review"
+        if rule not in rule_index:
+            rule_index[rule] = len(rules)
+            rules.append({"id": rule, "shortDescription": {"text": rule}})
+        results.append({
+            "ruleId": rule,
+            "ruleIndex": rule_index[rule],
+            "level": SARIF_LEVELS[finding.severity],
+            "message": {"text": finding.body},
+            "locations": [{
+                "logicalLocations": [{"name": finding.commit, "kind": "commit"}]
+            } if finding.commit is not None else {
+                "physicalLocation": {
+                    "artifactLocation": {"uri": finding.path, "uriBaseId": "%SRCROOT%"},
+                    "region": {"startLine": finding.start_line or finding.line, "endLine": finding.line},
+                }
+            }],
+        })
+    return {
+        "$schema": SARIF_SCHEMA,
+        "version": "2.1.0",
+        "runs": [{
+            "tool": {"driver": {
+                "name": tool_name,
+                "informationUri": "https://github.com/Ankushryuga/Github-MCP-PR-Reviewer",
+                "rules": rules,
+            }},
+            "results": results,
+        }],
+    }
+
+
+def _encode_sarif(document: Dict[str, Any]) -> str:
+    """Gzip and base64-encode a SARIF document as the code scanning upload API expects."""
+    return base64.b64encode(gzip.compress(json.dumps(document).encode())).decode()
+
+
+# ============================================================================
+# Config File Validation
+# ============================================================================
+
+# Schemas for well-known config files, bundled so checks never download them
+CONFIG_SCHEMA_DIR = Path(__file__).resolve().parent / "analyzers" / "schemas"
+CONFIG_EXTENSIONS = (".yaml", ".yml", ".json")
+# JSON files that allow comments and trailing commas (JSONC), which a strict parser rejects
+JSONC_PATHS = ("**/tsconfig*.json", "**/jsconfig*.json", ".vscode/**", ".devcontainer/**", "**/.eslintrc.json")
+# Bundled schema for each kind of well-known file, by path glob
+CONFIG_SCHEMAS = (
+    (".github/workflows/*.{yml,yaml}", "github-workflow.json"),
+    ("**/{docker-,}compose*.{yml,yaml}", "docker-compose.json"),
+)
+_SCHEMA_TYPES = {
+    "object": dict, "array": list, "string": str, "boolean": bool, "null": type(None),
+    "number": (int, float), "integer": int,
+}
+
+_config_schemas: Dict[str, Dict[str, Any]] = {}
+
+
+def _config_schema(name: str) -> Dict[str, Any]:
+    if name not in _config_schemas:
+        _config_schemas[name] = json.loads((CONFIG_SCHEMA_DIR / name).read_text())
+    return _config_schemas[name]
+
+
+def _config_schema_name(path: str) -> Optional[str]:
+    return next((name for glob, name in CONFIG_SCHEMAS if _glob_match(glob, path)), None)
+
+
+def _a_or_an(noun: str) -> str:
+    return ("an " if noun[0] in "aeiou" else "a ") + noun
+
+
+def _schema_type_matches(value: Any, name: str) -> bool:
+    if isinstance(value, bool) and name in ("number", "integer"):
+        return False
+    return isinstance(value, _SCHEMA_TYPES[name])
+
+
+def _schema_errors(
+    value: Any, schema: Dict[str, Any], root: Dict[str, Any], location: Tuple[Any, ...] = ()
+) -> List[Tuple[Tuple[Any, ...], str]]:
+    """
+    Validate value against a JSON Schema, returning (location, problem) pairs.
+    
+    Only the keywords the bundled schemas use are supported: $ref to the
+    schema's own definitions, type, enum, required, properties,
+    patternProperties, additionalProperties, minProperties, items, minItems
+    and anyOf.
+    """
+    if "$ref" in schema:
+        schema = root["definitions"][schema["$ref"].rsplit("/", 1)[-1]]
+    types = schema.get("type")
+    if types is not None:
+        types = [types] if isinstance(types, str) else types
+        if not any(_schema_type_matches(value, t) for t in types):
+            return [(location, f"must be {' or '.join(_a_or_an(t) for t in types)}, not {_json_type(value)}")]
+    if "enum" in schema and value not in schema["enum"]:
+        return [(location, f"must be one of {', '.join(map(json.dumps, schema['enum']))}")]
+    
+    errors = []
+    if isinstance(value, dict):
+        missing = [key for key in schema.get("required", []) if key not in value]
+        if missing:
+            errors.append((location, f"is missing required {', '.join(f'`{k}`' for k in missing)}"))
+        if "minProperties" in schema and len(value) < schema["minProperties"]:
+            errors.append((location, f"needs at least {schema['minProperties']} entries"))
+        for key, item in value.items():
+            key = str(key)
+            if key in schema.get("properties", {}):
+                errors.extend(_schema_errors(item, schema["properties"][key], root, location + (key,)))
+                continue
+            patterns = [sub for pattern, sub in schema.get("patternProperties", {}).items() if re.search(pattern, key)]
+            for sub in patterns:
+                errors.extend(_schema_errors(item, sub, root, location + (key,)))
+            extra = schema.get("additionalProperties", True)
+            if patterns or extra is True:
+                continue
+            if extra is False:
+                errors.append((location + (key,), "is not an allowed key"))
+            else:
+                errors.extend(_schema_errors(item, extra, root, location + (key,)))
+    if isinstance(value, list):
+        if "minItems" in schema and len(value) < schema["minItems"]:
+            errors.append((location, f"needs at least {schema['minItems']} items"))
+        if "items" in schema:
+            for index, item in enumerate(value):
+                errors.extend(_schema_errors(item, schema["items"], root, location + (index,)))
+    if "anyOf" in schema:
+        alternatives = [_schema_errors(value, sub, root, location) for sub in schema["anyOf"]]
+        if all(alternatives):
+            if all(set(sub) == {"required"} for sub in schema["anyOf"]):
+                problem = "needs " + " or ".join("`" + "` and `".join(sub["required"]) + "`" for sub in schema["anyOf"])
+            else:
+                problem = "must match one of: " + "; or ".join(a[0][1] for a in alternatives)
+            errors.append((location, problem))
+    return errors
+
+
+def _json_type(value: Any) -> str:
+    for name in ("null", "boolean", "object", "array", "string", "integer", "number"):
+        if _schema_type_matches(value, name):
+            return name
+    return type(value).__name__
+
+
+def _schema_location(location: Tuple[Any, ...]) -> str:
+    """Render a location such as ('jobs', 'build', 'steps', 2) as jobs.build.steps[2]."""
+    text = ""
+    for part in location:
+        text += f"[{part}]" if isinstance(part, int) else f".{part}" if text else str(part)
+    return text or "the document"
+
+
+def _yaml_node_line(node: "yaml.Node", location: Tuple[Any, ...]) -> int:
+    """The 1-based line of the node at location, or of the deepest node on the way that exists."""
+    for part in location:
+        if isinstance(node, yaml.MappingNode):
+            match = next(((k, v) for k, v in node.value if isinstance(k, yaml.ScalarNode) and k.value == part), None)
+            if match is None:
+                break
+            # A key that is not allowed is reported where the key is, not its value
+            node = match[0] if part == location[-1] else match[1]
+        elif isinstance(node, yaml.SequenceNode) and isinstance(part, int) and part < len(node.value):
+            node = node.value[part]
+        else:
+            break
+    return node.start_mark.line + 1
+
+
+def _yaml_plain(node: "yaml.Node", loader: "yaml.SafeLoader") -> Any:
+    """
+    Convert a composed YAML node to plain values, keeping mapping keys as written.
+    
+    Unlike safe_load this leaves `on:` a string key where YAML 1.1 reads a
+    boolean, as GitHub Actions does. Merge keys (<<) are applied.
+    """
+    if isinstance(node, yaml.MappingNode):
+        result: Dict[Any, Any] = {}
+        merged: Dict[Any, Any] = {}
+        for key, value in node.value:
+            if key.tag == "tag:yaml.org,2002:merge":
+                sources = value.value if isinstance(value, yaml.SequenceNode) else [value]
+                for source in sources:
+                    plain = _yaml_plain(source, loader)
+                    if isinstance(plain, dict):
+                        merged.update({k: v for k, v in plain.items() if k not in merged})
+                continue
+            name = key.value if isinstance(key, yaml.ScalarNode) else repr(_yaml_plain(key, loader))
+            result[name] = _yaml_plain(value, loader)
+        return {**merged, **result}
+    if isinstance(node, yaml.SequenceNode):
+        return [_yaml_plain(item, loader) for item in node.value]
+    return loader.construct_object(node)
+
+
+def _yaml_duplicate_keys(node: "yaml.Node") -> List[Tuple[str, int, int]]:
+    """(key, first line, repeated line) of every key repeated within one mapping, 1-based."""
+    duplicates, pending, seen_nodes = [], [node], set()
+    while pending:
+        current = pending.pop()
+        if id(current) in seen_nodes:
+            continue
+        seen_nodes.add(id(current))
+        if isinstance(current, yaml.MappingNode):
+            first: Dict[str, int] = {}
+            for key, value in current.value:
+                if isinstance(key, yaml.ScalarNode) and key.tag != "tag:yaml.org,2002:merge":
+                    line = key.start_mark.line + 1
+                    if key.value in first:
+                        duplicates.append((key.value, first[key.value], line))
+                    else:
+                        first[key.value] = line
+                pending.append(value)
+        elif isinstance(current, yaml.SequenceNode):
+            pending.extend(current.value)
+    return sorted(duplicates, key=lambda d: d[2])
+
+
+def _json_duplicate_keys(text: str) -> List[Tuple[str, int]]:
+    """
+    (key, line) of keys repeated within one JSON object.
+    
+    The parser does not report positions, so the line is that of the key's
+    last occurrence in the text, which may be a different object's key of
+    the same name.
+    """
+    repeated: List[str] = []
+    
+    def pairs(items: List[Tuple[str, Any]]) -> Dict[str, Any]:
+        keys = [k for k, _ in items]
+        repeated.extend(k for i, k in enumerate(keys) if k in keys[:i])
+        return dict(items)
+    
+    json.loads(text, object_pairs_hook=pairs)
+    found = []
+    for key in dict.fromkeys(repeated):
+        offsets = [m.start() for m in re.finditer(re.escape(json.dumps(key)) + r"\s*:", text)]
+        found.append((key, text.count("\n", 0, offsets[-1]) + 1 if offsets else 1))
+    return found
+
+
+def _config_file_findings(diff: FileDiff, text: str, check_schema: bool) -> List[AnalyzerFinding]:
+    """
+    Validate one YAML or JSON file: syntax, duplicate keys and, for well-known files, its schema.
+    
+    A finding sits on the line it reports when the diff shows that line, and
+    otherwise on line 1 with the line named in the message, which
+    github_pr_create_review lists in the summary unless line 1 is in the diff.
+    """
+    commentable = diff.commentable_lines("RIGHT")
+    
+    def finding(line: int, rule: str, message: str, severity: str) -> AnalyzerFinding:
+        if line not in commentable:
+            message = message.rstrip(".") + f" (line {line})."
+            line = 1
+        return AnalyzerFinding(
+            analyzer="config", path=diff.path, line=line, rule=rule, severity=severity, message=message
+        )
+    
+    if diff.path.endswith(".json"):
+        try:
+            duplicates = _json_duplicate_keys(text)
+        except json.JSONDecodeError as e:
+            return [finding(e.lineno, "config/syntax", f"Invalid JSON: {e.msg} at column {e.colno}.", "error")]
+        return [
+            finding(line, "config/duplicate-key", f"Key `{key}` is repeated in the same object.", "error")
+            for key, line in duplicates
+        ]
+    
+    try:
+        documents = list(yaml.compose_all(text, Loader=yaml.SafeLoader))
+    except yaml.YAMLError as e:
+        mark = getattr(e, "problem_mark", None)
+        problem = getattr(e, "problem", None) or str(e)
+        context = getattr(e, "context", None)
+        detail = f"{context}, {problem}" if context else problem
+        return [finding(mark.line + 1 if mark else 1, "config/syntax", f"Invalid YAML: {detail}.", "error")]
+    findings = [
+        finding(line, "config/duplicate-key", f"Key `{key}` is repeated in the same mapping (first on line {first}).", "error")
+        for document in documents for key, first, line in _yaml_duplicate_keys(document)
+    ]
+    schema_name = _config_schema_name(diff.path) if check_schema else None
+    if schema_name and len(documents) == 1:
+        schema = _config_schema(schema_name)
+        value = _yaml_plain(documents[0], yaml.SafeLoader(""))
+        for location, problem in _schema_errors(value, schema, schema):
+            findings.append(finding(
+                _yaml_node_line(documents[0], location), "config/schema",
+                f"`{_schema_location(location)}` {problem} ({schema_name.rsplit('.', 1)[0]} schema).", "warning"
+            ))
+    return sorted(findings, key=lambda f: f.line)
+
+
+# ============================================================================
+# Documentation Checks
+# ============================================================================
+
+DOC_EXTENSIONS = (".md", ".markdown", ".rst", ".txt")
+# Common misspellings and their corrections, bundled so checks work offline. Only
+# listed words are reported, so project jargon never is.
+MISSPELLINGS_PATH = Path(__file__).resolve().parent / "analyzers" / "wordlists" / "misspellings.txt"
+# Code spans, URLs, autolinks, HTML tags and markdown link targets: not prose
+_DOC_NON_PROSE = re.compile(r"(`+).*?\1|<[^>\s]+>|\b(?:https?|ftp|mailto):\S+|\bwww\.\S+|\]\([^)]*\)")
+_DOC_WORD = re.compile(r"[A-Za-z]+(?:'[A-Za-z]+)*")
+_CODE_SPAN = re.compile(r"(`+).*?\1")
+# Markdown inline links and images, autolinks, and reference definitions ("[id]: target")
+_MD_LINK = re.compile(r"!?\[[^\]]*\]\(\s*(?P<target><[^>]*>|[^\s)]+)[^)]*\)|<(?P<auto>https?://[^>\s]+)>")
+_MD_REFERENCE = re.compile(r"^\s{0,3}\[[^\]]+\]:\s*(?P<target><[^>]*>|\S+)")
+_MD_FENCE = re.compile(r"^\s{0,3}(`{3,}|~{3,})")
+_RST_LITERAL = re.compile(r"::\s*$|^\s*\.\. (?:code-block|code|sourcecode)::")
+_URL_SCHEME = re.compile(r"^[A-Za-z][A-Za-z0-9+.-]*:")
+
+_misspellings: Dict[str, List[str]] = {}
+
+
+def _misspelling_list() -> Dict[str, List[str]]:
+    if not _misspellings:
+        for line in MISSPELLINGS_PATH.read_text().splitlines():
+            if line.strip() and not line.startswith("#"):
+                wrong, _, right = line.partition("->")
+                _misspellings[wrong.strip()] = [c.strip() for c in right.split(",")]
+    return _misspellings
+
+
+def _doc_code_lines(path: str, text: str) -> set:
+    """Line numbers inside a document's code blocks: markdown fences and reStructuredText literal blocks."""
+    code = set()
+    lines = text.splitlines()
+    if path.lower().endswith((".md", ".markdown")):
+        fence = None
+        for number, line in enumerate(lines, 1):
+            match = _MD_FENCE.match(line)
+            if fence is None:
+                if match:
+                    fence = match.group(1)
+                    code.add(number)
+                continue
+            code.add(number)
+            # A fence closes with the same character, at least as many times, and nothing after it
+            if match and match.group(1)[0] == fence[0] and len(match.group(1)) >= len(fence) \
+                    and not line.strip()[len(match.group(1)):].strip():
+                fence = None
+    elif path.lower().endswith(".rst"):
+        indent = None
+        for number, line in enumerate(lines, 1):
+            if indent is not None:
+                if not line.strip() or len(line) - len(line.lstrip()) > indent:
+                    code.add(number)
+                    continue
+                indent = None
+            if _RST_LITERAL.search(line):
+                indent = len(line) - len(line.lstrip())
+    return code
+
+
+def _match_case(word: str, correction: str) -> str:
+    """Spell a correction the way the misspelled word was capitalised."""
+    if len(word) > 1 and word.isupper():
+        return correction.upper()
+    return correction[0].upper() + correction[1:] if word[0].isupper() else correction
+
+
+def _spelling_findings(path: str, lines: List[Tuple[int, str]], accepted: set) -> List[AnalyzerFinding]:
+    """Report listed misspellings in prose lines, once per word and line."""
+    misspellings = _misspelling_list()
+    findings = []
+    for number, content in lines:
+        prose = _DOC_NON_PROSE.sub(lambda m: " " * len(m.group(0)), content)
+        seen = set()
+        for match in _DOC_WORD.finditer(prose):
+            word = match.group(0)
+            key = word.lower()
+            if key not in misspellings or key in accepted or key in seen:
+                continue
+            seen.add(key)
+            corrections = " or ".join(f"`{_match_case(word, c)}`" for c in misspellings[key])
+            findings.append(AnalyzerFinding(
+                analyzer="docs", path=path, line=number, symbol=word, severity="info", rule="docs/spelling",
+                message=f"`{word}` looks misspelled; did you mean {corrections}? If it is intended, "
+                        f"add it to `spelling.words` in {REVIEW_POLICY_PATH}.",
+            ))
+    return findings
+
+
+def _doc_links(line: str) -> List[str]:
+    """The link targets of a markdown line, outside code spans."""
+    text = _CODE_SPAN.sub(lambda m: " " * len(m.group(0)), line)
+    targets = [m.group("target") or m.group("auto") for m in _MD_LINK.finditer(text)]
+    reference = _MD_REFERENCE.match(text)
+    if reference:
+        targets.append(reference.group("target"))
+    return list(dict.fromkeys(t[1:-1] if t.startswith("<") and t.endswith(">") else t for t in targets))
+
+
+def _resolve_doc_link(doc_path: str, target: str) -> Optional[str]:
+    """
+    The repository path a relative link points at, ignoring its #fragment and ?query.
+    
+    Returns None for in-page anchors; a leading "/" is the repository root,
+    as GitHub renders it, and a link leaving the repository gives "..".
+    """
+    path = unquote(target.split("#", 1)[0].split("?", 1)[0])
+    if not path:
+        return None
+    joined = path.lstrip("/") if path.startswith("/") else posixpath.join(posixpath.dirname(doc_path), path)
+    resolved = posixpath.normpath(joined) if joined else "."
+    return ".." if resolved == ".." or resolved.startswith("../") else resolved.rstrip("/")
+
+
+async def _fetch_head_tree(head: PRHead) -> Tuple[set, bool]:
+    """Every file and directory path at the head commit, and whether GitHub truncated the listing."""
+    data = await _github_api_request("GET", f"/repos/{head.owner}/{head.repo}/git/trees/{head.sha}?recursive=1")
+    return {entry["path"] for entry in data.get("tree", [])}, bool(data.get("truncated"))
+
+
+class LocalLinkHostError(Exception):
+    """An external link, or a redirect it led to, whose host resolves to an address that is not public."""
+    
+    def __init__(self, host: str, address: str):
+        self.host = host
+        self.address = address
+        super().__init__(f"{host} resolves to {address}, which is not a public address")
+
+
+async def _host_addresses(host: str, port: int) -> List[str]:
+    """The addresses a host name resolves to; a literal address resolves to itself."""
+    infos = await asyncio.get_running_loop().getaddrinfo(host, port, type=socket.SOCK_STREAM)
+    return [info[4][0] for info in infos]
+
+
+async def _refuse_local_link_host(request: httpx.Request) -> None:
+    """
+    Request hook of the link checker: refuse hosts resolving to private, loopback or link-local addresses.
+    
+    Links are written by PR authors, so without this a webhook server
+    would request its own network on their behalf. The hook runs for
+    every redirect too.
+    """
+    port = request.url.port or (443 if request.url.scheme == "https" else 80)
+    try:
+        addresses = await _host_addresses(request.url.host, port)
+    except socket.gaierror as e:
+        raise httpx.ConnectError(f"{request.url.host} does not resolve", request=request) from e
+    for text in addresses:
+        address = ipaddress.ip_address(text.split("%", 1)[0])
+        if isinstance(address, ipaddress.IPv6Address) and address.ipv4_mapped:
+            address = address.ipv4_mapped
+        if not address.is_global:
+            raise LocalLinkHostError(request.url.host, str(address))
+
+
+def _link_check_transport() -> httpx.AsyncBaseTransport:
+    """
+    The transport external links are requested over.
+    
+    It is a plain one: the proxy, client certificate and TLS settings
+    configured for GitHub are never sent to the hosts PR authors link to.
+    """
+    return httpx.AsyncHTTPTransport()
+
+
+async def _external_link_status(url: str, timeout: float) -> Tuple[str, Optional[str]]:
+    """
+    Check one external link: ("ok", None), ("broken", why) or ("unverified", why).
+    
+    Only a 404 or 410, or a host that cannot be reached, counts as broken;
+    a timeout or an answer such as 403 or 429 says nothing about the link.
+    Servers refusing HEAD requests are asked again with a GET whose body is
+    not read. Hosts that are not public are not requested at all and the
+    link is left unverified (see _refuse_local_link_host).
+    """
+    try:
+        async with httpx.AsyncClient(
+            timeout=timeout, follow_redirects=True, transport=_link_check_transport(),
+            event_hooks={"request": [_refuse_local_link_host]}
+        ) as client:
+            response = await client.head(url)
+            if response.status_code in (403, 405, 501):
+                async with client.stream("GET", url) as response:
+                    pass
+    except LocalLinkHostError as e:
+        return "unverified", f"not requested: {e}"
+    except httpx.TimeoutException:
+        return "unverified", f"no answer within {timeout:g}s"
+    except httpx.HTTPError as e:
+        return "broken", f"could not be reached ({type(e).__name__})"
+    if response.status_code in (404, 410):
+        return "broken", f"answers {response.status_code}"
+    if response.status_code >= 400:
+        return "unverified", f"answers {response.status_code}"
+    return "ok", None
+
+
+# ============================================================================
+# Review Policy
+# ============================================================================
+
+PolicySeverity = Literal["info", "warning", "error", "blocking", "off"]
+ReviewEvent = Literal["COMMENT", "APPROVE", "REQUEST_CHANGES"]
+# Review events from the most lenient to the strictest
+REVIEW_EVENT_STRICTNESS: Tuple[str, ...] = ("APPROVE", "COMMENT", "REQUEST_CHANGES")
+
+# Paths treated as tests by require_tests rules
+_TEST_PATH = re.compile(
+    r"(_test\.go|_test\.py|\.(?:test|spec)\.[cm]?[jt]sx?)$|(^|/)test_[^/]+\.py$|(^|/)(tests?|__tests__|testdata)/"
+)
+
+
+class PolicyRule(BaseModel):
+    """A path-scoped rule in a review policy; the last matching rule wins."""
+    model_config = ConfigDict(str_strip_whitespace=True, extra='forbid')
+    
+    paths: List[str] = Field(default_factory=lambda: ["**"], min_length=1, description="Globs the rule applies to")
+    findings: List[str] = Field(
+        default_factory=list,
+        description="Analyzer names or rule IDs (globs such as 'secrets/*') the severity applies to; empty means all"
+    )
+    severity: Optional[PolicySeverity] = Field(
+        default=None,
+        description="Severity for matching findings ('off' drops them), or of the missing-tests finding"
+    )
+    require_tests: bool = Field(default=False, description="Changes under these paths must include a test change")
+    description: Optional[str] = Field(default=None, description="Why the rule exists, shown to reviewers")
+    
+    @model_validator(mode="after")
+    def has_effect(self) -> "PolicyRule":
+        if self.severity is None and not self.require_tests:
+            raise ValueError("a rule needs a severity, require_tests, or both")
+        return self
+    
+    def covers(self, path: Optional[str]) -> bool:
+        # Commit findings have no path; only rules for every path cover them
+        if path is None:
+            return "**" in self.paths
+        return any(_glob_match(p, path) for p in self.paths)
+    
+    def matches(self, finding: "AnalyzerFinding") -> bool:
+        if self.severity is None or not self.covers(finding.path):
+            return False
+        names = [finding.analyzer] + ([finding.rule] if finding.rule else [])
+        return not self.findings or any(_glob_match(p, name) for p in self.findings for name in names)
+
+
+class PRSizeLimit(BaseModel):
+    """Thresholds above which a PR is reported as too large to review well."""
+    model_config = ConfigDict(extra='forbid')
+    
+    files: Optional[int] = Field(default=None, ge=1, description="Most changed files")
+    changed_lines: Optional[int] = Field(default=None, ge=1, description="Most added plus deleted lines")
+    severity: Literal["info", "warning", "error", "blocking"] = Field(default="warning")
+
+
+class CommitMessagePolicy(BaseModel):
+    """How github_pr_check_commit_messages checks commit messages against Conventional Commits."""
+    model_config = ConfigDict(str_strip_whitespace=True, extra='forbid')
+    
+    types: List[str] = Field(
+        default_factory=lambda: list(CONVENTIONAL_COMMIT_TYPES), min_length=1, description="Allowed commit types"
+    )
+    scopes: List[str] = Field(default_factory=list, description="Allowed scopes; empty allows any scope")
+    require_scope: bool = Field(default=False, description="Every subject must name a scope")
+    max_subject_length: int = Field(default=COMMIT_SUBJECT_MAX_CHARS, ge=10, description="Longest subject line")
+    max_body_line_length: Optional[int] = Field(
+        default=COMMIT_BODY_LINE_MAX_CHARS, ge=20, description="Longest body line; null disables the check"
+    )
+    imperative_mood: bool = Field(default=True, description="Flag descriptions starting with 'added' or 'fixes'")
+    check_pr_title: bool = Field(
+        default=False, description="Also check the PR title, which squash merges use as the commit subject"
+    )
+
+
+class RiskWeights(BaseModel):
+    """How much each factor counts towards a PR's risk score; only their ratios matter."""
+    model_config = ConfigDict(extra='forbid')
+    
+    size: float = Field(default=30, ge=0, description="Changed lines, relative to size_lines")
+    hot_paths: float = Field(default=30, ge=0, description="Whether the PR touches a hot path")
+    missing_tests: float = Field(default=25, ge=0, description="How little of the change is tests")
+    churn: float = Field(default=15, ge=0, description="Share of modified files that changed often recently")
+    
+    @model_validator(mode="after")
+    def has_weight(self) -> "RiskWeights":
+        if not any((self.size, self.hot_paths, self.missing_tests, self.churn)):
+            raise ValueError("at least one risk weight must be above zero")
+        return self
+
+
+class RiskPolicy(BaseModel):
+    """How github_pr_get_stats scores a PR's risk."""
+    model_config = ConfigDict(str_strip_whitespace=True, extra='forbid')
+    
+    hot_paths: List[str] = Field(default_factory=list, description="Globs of sensitive code, e.g. 'auth/**'")
+    weights: RiskWeights = Field(default_factory=RiskWeights)
+    size_lines: int = Field(default=500, ge=1, description="Changed lines at which the size factor is at its maximum")
+    churn_days: int = Field(default=90, ge=1, le=365, description="Look-back window of the churn factor")
+    churn_commits: int = Field(default=5, ge=1, description="Commits in the window that make a file hot")
+
+
+class SpellingPolicy(BaseModel):
+    """Words github_pr_check_docs accepts although its bundled list calls them misspelled."""
+    model_config = ConfigDict(str_strip_whitespace=True, extra='forbid')
+    
+    words: List[str] = Field(
+        default_factory=list,
+        description="Words taken off the bundled misspellings list, e.g. a project name spelled like a listed typo"
+    )
+
+
+class LicensePolicy(BaseModel):
+    """Which licenses github_pr_check_dependencies accepts for Go modules a PR adds."""
+    model_config = ConfigDict(str_strip_whitespace=True, extra='forbid')
+    
+    allow: List[str] = Field(
+        default_factory=list,
+        description="SPDX license IDs or globs, e.g. 'BSD-*'; when set, every other license is denied"
+    )
+    deny: List[str] = Field(
+        default_factory=list, description="SPDX license IDs or globs never accepted, e.g. 'AGPL-*'; wins over allow"
+    )
+    
+    def status(self, spdx_id: str) -> str:
+        """"allowed" or "denied"; IDs are compared case-insensitively."""
+        def listed(patterns: List[str]) -> bool:
+            return any(_glob_match(p.lower(), spdx_id.lower()) for p in patterns)
+        return "denied" if listed(self.deny) or (self.allow and not listed(self.allow)) else "allowed"
+
+
+class DuplicationPolicy(BaseModel):
+    """How github_pr_check_duplicates matches copied blocks among the lines a PR adds."""
+    model_config = ConfigDict(extra='forbid')
+    
+    min_lines: int = Field(
+        default=6, ge=2, description="Fewest code lines in a reported block (comments and lone braces do not count)"
+    )
+    similarity: float = Field(default=0.9, gt=0, le=1, description="Lowest similarity of two blocks to report, 0-1")
+    min_line_distance: int = Field(
+        default=30, ge=0, description="Fewest lines between the starts of two blocks in one file for them to count"
+    )
+
+
+class ReviewPolicy(BaseModel):
+    """
+    Which findings matter in a repository, read from .github/pr-reviewer.yml.
+    
+    Severities set by analyzers are defaults; rules override them per path.
+    """
+    model_config = ConfigDict(str_strip_whitespace=True, extra='forbid')
+    
+    exclude: List[str] = Field(default_factory=list, description="Globs whose findings are dropped")
+    rules: List[PolicyRule] = Field(default_factory=list)
+    max_pr_size: Optional[PRSizeLimit] = None
+    commit_messages: CommitMessagePolicy = Field(default_factory=CommitMessagePolicy)
+    risk: RiskPolicy = Field(default_factory=RiskPolicy)
+    spelling: SpellingPolicy = Field(default_factory=SpellingPolicy)
+    licenses: LicensePolicy = Field(default_factory=LicensePolicy)
+    duplicates: DuplicationPolicy = Field(default_factory=DuplicationPolicy)
+    lightweight_authors: List[str] = Field(
+        default_factory=list,
+        description="Logins, e.g. 'dependabot[bot]', whose PRs github_pr_comprehensive_review only checks "
+                    "for dependency changes"
+    )
+    review_events: Dict[Literal["none", "info", "warning", "error", "blocking"], ReviewEvent] = Field(
+        default_factory=lambda: {"blocking": "REQUEST_CHANGES"},
+        description="Review event when the most severe finding is at least this severe; "
+                    "'none' is used by event AUTO when there are no findings"
+    )
+    
+    def excludes(self, path: Optional[str]) -> bool:
+        return path is not None and any(_glob_match(p, path) for p in self.exclude)
+    
+    def lightweight_author(self, login: Optional[str]) -> bool:
+        # Logins are compared whole: bot logins end in "[bot]", which a glob would read as a character class
+        return login is not None and login.lower() in {a.lower() for a in self.lightweight_authors}
+    
+    def apply(self, findings: List["AnalyzerFinding"]) -> List["AnalyzerFinding"]:
+        """Drop findings in excluded paths and re-grade the rest by the last matching rule."""
+        kept = []
+        for finding in findings:
+            if self.excludes(finding.path):
+                continue
+            rule = next((r for r in reversed(self.rules) if r.matches(finding)), None)
+            if rule is not None:
+                if rule.severity == "off":
+                    continue
+                finding = replace(finding, severity=rule.severity)
+            kept.append(finding)
+        return kept
+    
+    def review_event(self, severities: List[str]) -> Optional[str]:
+        """Event for the most severe level among severities, falling back to lower configured levels."""
+        if not severities:
+            return None
+        worst = max(FINDING_SEVERITIES.index(s) for s in severities)
+        for level in reversed(FINDING_SEVERITIES[:worst + 1]):
+            if level in self.review_events:
+                return self.review_events[level]
+        return None
+
+
+@dataclass
+class LoadedPolicy:
+    """The policy in effect for a repository and where it came from."""
+    policy: ReviewPolicy
+    source: str
+    path: Optional[str] = None
+    ref: Optional[str] = None
+    # A single finding describing a policy file that could not be used
+    warnings: List[AnalyzerFinding] = field(default_factory=list)
+    
+    def apply(self, findings: List[AnalyzerFinding]) -> List[AnalyzerFinding]:
+        return self.warnings + self.policy.apply(findings)
+
+
+def _parse_review_policy(text: str, path: str) -> Tuple[Optional[ReviewPolicy], Optional[AnalyzerFinding]]:
+    """Parse a policy file; a malformed one yields a warning finding instead of a policy."""
+    line = 1
+    try:
+        data = yaml.safe_load(text)
+        if data is None:
+            data = {}
+        if not isinstance(data, dict):
+            raise ValueError("the file must contain a mapping of policy settings")
+        return ReviewPolicy.model_validate(data), None
+    except yaml.YAMLError as e:
+        mark = getattr(e, "problem_mark", None)
+        if mark is not None:
+            line = mark.line + 1
+        problem = str(e)
+    except ValidationError as e:
+        problem = "\n".join(f"{'.'.join(map(str, err['loc']))}: {err['msg']}" for err in e.errors())
+    except ValueError as e:
+        problem = str(e)
+    return None, AnalyzerFinding(
+        analyzer="policy", path=path, line=line, rule="policy/invalid", severity="warning",
+        message=f"`{path}` is not a valid review policy and was ignored:\n```\n{problem}\n```"
+    )
+
+
+def _server_default_policy() -> LoadedPolicy:
+    """The policy from PR_REVIEWER_DEFAULT_POLICY, or the built-in one."""
+    if not PR_REVIEWER_DEFAULT_POLICY:
+        return LoadedPolicy(ReviewPolicy(), source="built-in default")
+    policy, warning = _parse_review_policy(Path(PR_REVIEWER_DEFAULT_POLICY).read_text(), PR_REVIEWER_DEFAULT_POLICY)
+    if warning is not None:
+        return LoadedPolicy(ReviewPolicy(), source="built-in default", warnings=[warning])
+    return LoadedPolicy(policy, source="server default", path=PR_REVIEWER_DEFAULT_POLICY)
+
+
+async def _load_review_policy(owner: str, repo: str) -> LoadedPolicy:
+    """
+    Load the repository's policy from its default branch.
+    
+    The PR's own copy is never used, so a PR cannot relax the rules it is
+    reviewed under. Without a policy file the server default applies; a
+    malformed file also falls back to it, with a warning finding.
+    """
+    ref = (await _github_api_request("GET", f"/repos/{owner}/{repo}"))["default_branch"]
+    try:
+        response = await _github_api_response(
+            "GET", f"/repos/{owner}/{repo}/contents/{REVIEW_POLICY_PATH}",
+            params={"ref": ref}, headers={"Accept": "application/vnd.github.raw"}
+        )
+    except httpx.HTTPStatusError as e:
+        if e.response.status_code != 404:
+            raise
+        return _server_default_policy()
+    policy, warning = _parse_review_policy(response.text, REVIEW_POLICY_PATH)
+    if warning is not None:
+        fallback = _server_default_policy()
+        fallback.warnings = [warning]
+        return fallback
+    return LoadedPolicy(policy, source="repository", path=REVIEW_POLICY_PATH, ref=ref)
+
+
+def _policy_violations(policy: ReviewPolicy, diffs: List[FileDiff]) -> List[Dict[str, Any]]:
+    """Check a PR's changed files against the policy's size limit and test requirements."""
+    diffs = [d for d in diffs if not policy.excludes(d.path)]
+    violations = []
+    limit = policy.max_pr_size
+    if limit is not None:
+        changed_lines = sum(1 for d in diffs for h in d.hunks for ln in h.lines if ln.kind in "+-")
+        over = []
+        if limit.files and len(diffs) > limit.files:
+            over.append(f"{len(diffs)} files (limit {limit.files})")
+        if limit.changed_lines and changed_lines > limit.changed_lines:
+            over.append(f"{changed_lines} changed lines (limit {limit.changed_lines})")
+        if over:
+            violations.append({
+                "rule": "policy/max-pr-size",
+                "severity": limit.severity,
+                "message": f"PR changes {' and '.join(over)}; consider splitting it",
+                "paths": [],
+            })
+    for rule in policy.rules:
+        if not rule.require_tests:
+            continue
+        covered = [d.path for d in diffs if rule.covers(d.path) and d.status != "removed"]
+        code = [path for path in covered if not _TEST_PATH.search(path)]
+        if code and len(code) == len(covered):
+            violations.append({
+                "rule": "policy/require-tests",
+                "severity": rule.severity if rule.severity not in (None, "off") else "warning",
+                "message": f"Changes under {', '.join(rule.paths)} need accompanying tests"
+                           + (f": {rule.description}" if rule.description else ""),
+                "paths": code,
+            })
+    return violations
+
+
+# ============================================================================
+# PR Statistics
+# ============================================================================
+
+# Languages whose files count as source code in test-to-source ratios
+SOURCE_LANGUAGES = (
+    "go", "python", "javascript", "typescript", "shell", "java", "rust", "ruby", "c", "sql", "protobuf", "terraform"
+)
+
+
+def _file_kind(path: str) -> str:
+    """Classify a changed file as "test", "generated", "source" or "other"."""
+    if _TEST_PATH.search(path):
+        return "test"
+    if _is_generated_path(path):
+        return "generated"
+    return "source" if _detect_language(path) in SOURCE_LANGUAGES else "other"
+
+
+def _file_stats(files: List[Dict[str, Any]]) -> List[Dict[str, Any]]:
+    """Reduce files API entries to their sizes and kind, largest first."""
+    entries = [{
+        "path": f["filename"],
+        "previous_path": f.get("previous_filename"),
+        "status": f["status"],
+        "additions": f.get("additions", 0),
+        "deletions": f.get("deletions", 0),
+        "changes": f.get("additions", 0) + f.get("deletions", 0),
+        "kind": _file_kind(f["filename"]),
+    } for f in files]
+    entries.sort(key=lambda e: (-e["changes"], e["path"]))
+    return entries
+
+
+def _pr_stats(entries: List[Dict[str, Any]], top_files: int) -> Dict[str, Any]:
+    """Totals, per-extension counts and the largest files of a PR's file stats."""
+    by_extension: Dict[str, Dict[str, int]] = {}
+    for e in entries:
+        extension = os.path.splitext(e["path"].rsplit("/", 1)[-1])[1].lower() or "(none)"
+        counts = by_extension.setdefault(extension, {"files": 0, "additions": 0, "deletions": 0})
+        counts["files"] += 1
+        counts["additions"] += e["additions"]
+        counts["deletions"] += e["deletions"]
+    lines = Counter()
+    files = Counter()
+    for e in entries:
+        lines[e["kind"]] += e["changes"]
+        files[e["kind"]] += 1
+    statuses = Counter(e["status"] for e in entries)
+    return {
+        "files": len(entries),
+        "additions": sum(e["additions"] for e in entries),
+        "deletions": sum(e["deletions"] for e in entries),
+        "new_files": statuses["added"] + statuses["copied"],
+        "modified_files": statuses["modified"] + statuses["changed"],
+        "renamed_files": statuses["renamed"],
+        "removed_files": statuses["removed"],
+        "by_extension": dict(sorted(
+            by_extension.items(), key=lambda item: (-(item[1]["additions"] + item[1]["deletions"]), item[0])
+        )),
+        "largest_files": [
+            {k: e[k] for k in ("path", "status", "additions", "deletions", "changes")} for e in entries[:top_files]
+        ],
+        "test_files": files["test"],
+        "source_files": files["source"],
+        "generated_files": files["generated"],
+        "test_lines": lines["test"],
+        "source_lines": lines["source"],
+        "test_to_source_ratio": round(lines["test"] / lines["source"], 2) if lines["source"] else None,
+    }
+
+
+def _plural(count: int, noun: str) -> str:
+    return f"{count} {noun}{'' if count == 1 else 's'}"
+
+
+def _risk_score(
+    entries: List[Dict[str, Any]], risk: RiskPolicy, churn: Optional[Dict[str, int]] = None
+) -> Dict[str, Any]:
+    """
+    Score a PR's risk from 0 to 100 as the weighted mean of factors between 0 and 1.
+    
+    churn maps the modified files that were checked to their commits in the
+    window; without it the churn factor is left out and the other weights
+    are scaled up. Every factor is reported with its value, its contribution
+    to the score and a phrase for explaining it, and the summary joins the
+    phrases of the factors that raised the score.
+    """
+    factors = []
+    
+    changed = sum(e["changes"] for e in entries if e["kind"] != "generated")
+    detail = f"{changed:,} lines changed"
+    if any(e["kind"] == "generated" for e in entries):
+        detail += " outside generated files"
+    factors.append({"factor": "size", "value": min(1.0, changed / risk.size_lines), "detail": detail})
+    
+    touched = [
+        e["path"] for e in entries
+        if any(_glob_match(g, p) for g in risk.hot_paths for p in (e["path"], e["previous_path"]) if p)
+    ]
+    globs = [g for g in risk.hot_paths if any(_glob_match(g, p) for p in touched)]
+    factors.append({
+        "factor": "hot_paths",
+        "value": 1.0 if touched else 0.0,
+        "detail": f"{', '.join(globs)} {'was' if len(globs) == 1 else 'were'} touched" if touched
+                  else "no hot paths touched" if risk.hot_paths else "no hot paths configured",
+        "paths": touched,
+    })
+    
+    source = [e for e in entries if e["kind"] == "source" and e["status"] != "removed"]
+    source_lines = sum(e["changes"] for e in source)
+    test_lines = sum(e["changes"] for e in entries if e["kind"] == "test")
+    if not source_lines:
+        value, detail = 0.0, "no source files changed"
+    elif not test_lines:
+        value, detail = 1.0, f"0 test files changed for {_plural(len(source), 'source file')}"
+    else:
+        value = max(0.0, 1 - test_lines / source_lines)
+        detail = f"test changes are {test_lines / source_lines:.0%} of source changes"
+    factors.append({"factor": "missing_tests", "value": value, "detail": detail})
+    
+    if churn is None:
+        factors.append({"factor": "churn", "value": None, "detail": "not checked"})
+    else:
+        hot = sorted(path for path, commits in churn.items() if commits >= risk.churn_commits)
+        factors.append({
+            "factor": "churn",
+            "value": len(hot) / len(churn) if churn else 0.0,
+            "detail": f"{len(hot)} of {_plural(len(churn), 'modified file')} changed at least "
+                      f"{risk.churn_commits} times in {risk.churn_days} days",
+            "paths": hot,
+        })
+    
+    weights = risk.weights.model_dump()
+    total = sum(weights[f["factor"]] for f in factors if f["value"] is not None)
+    for f in factors:
+        f["weight"] = weights[f["factor"]]
+        f["value"] = None if f["value"] is None else round(f["value"], 2)
+        f["contribution"] = round(100 * f["weight"] * f["value"] / total, 1) if total and f["value"] else 0.0
+    score = round(sum(f["contribution"] for f in factors))
+    level = next((name for name, floor in RISK_LEVELS if score >= floor), "low")
+    reasons = [f["detail"] for f in sorted(factors, key=lambda f: -f["contribution"]) if f["contribution"] > 0]
+    summary = f"{level.capitalize()} risk ({score}/100)"
+    if reasons:
+        summary += " because " + (", ".join(reasons[:-1]) + " and " if len(reasons) > 1 else "") + reasons[-1]
+    return {"score": score, "level": level, "summary": summary, "factors": factors}
+
+
+def _stats_markdown(result: Dict[str, Any]) -> str:
+    stats, risk = result["stats"], result["risk"]
+    markdown = f"# Stats for PR #{result['pr_number']}\n\n"
+    markdown += f"**{risk['summary']}**\n\n"
+    markdown += (f"{_plural(stats['files'], 'file')} changed: +{stats['additions']} / -{stats['deletions']} "
+                 f"({stats['new_files']} new, {stats['modified_files']} modified, "
+                 f"{stats['renamed_files']} renamed, {stats['removed_files']} removed)\n")
+    ratio = stats["test_to_source_ratio"]
+    markdown += (f"Tests: {_plural(stats['test_files'], 'file')}, {stats['test_lines']} lines against "
+                 f"{stats['source_lines']} source lines"
+                 + (f" (ratio {ratio})" if ratio is not None else "") + "\n")
+    markdown += "\n## Risk Factors\n\n| Factor | Value | Weight | Points | Detail |\n|--------|-------|--------|--------|--------|\n"
+    for f in risk["factors"]:
+        value = "—" if f["value"] is None else f["value"]
+        markdown += f"| {f['factor']} | {value} | {f['weight']:g} | {f['contribution']:g} | {f['detail']} |\n"
+    if stats["by_extension"]:
+        markdown += "\n## By Extension\n\n| Extension | Files | + | - |\n|-----------|-------|---|---|\n"
+        for extension, counts in stats["by_extension"].items():
+            markdown += f"| `{extension}` | {counts['files']} | {counts['additions']} | {counts['deletions']} |\n"
+    if stats["largest_files"]:
+        markdown += "\n## Largest Files\n\n| File | Status | + | - |\n|------|--------|---|---|\n"
+        for f in stats["largest_files"]:
+            markdown += f"| `{f['path']}` | {f['status']} | {f['additions']} | {f['deletions']} |\n"
+    return markdown
+
+
+# ============================================================================
+# MCP Tools
+# ============================================================================
+
+@mcp.tool(name="github_pr_analyze_code")
+async def analyze_code(params: AnalyzeCodeInput) -> str:
+    """Analyze Go code for quality issues using static analysis tools."""
+    file_path = Path(params.file_path)
+    
+    if not file_path.exists():
+        return json.dumps({"error": f"Path not found: {params.file_path}", "success": False})
+    
+    results = {}
+    
+    if params.analysis_type in ["lint", "all"]:
+        results["lint"] = await _run_command_async(
+            ["golangci-lint", "run", "--out-format", "colored-line-number", str(file_path)],
+            cwd=str(file_path.parent) if file_path.is_file() else str(file_path)
+        )
+    
+    if params.analysis_type in ["fmt", "all"]:
+        results["fmt"] = await _run_command_async(["gofmt", "-l", str(file_path)])
+    
+    if params.analysis_type in ["vet", "all"]:
+        results["vet"] = await _run_command_async(
+            ["go", "vet", str(file_path)],
+            cwd=str(file_path.parent) if file_path.is_file() else str(file_path)
+        )
+    
+    if params.response_format == ResponseFormat.JSON:
+        return json.dumps(results, indent=2)
+    return _format_markdown_analysis(results)
+
+
+@mcp.tool(name="github_pr_run_tests")
+async def run_tests(params: RunTestsInput) -> str:
+    """Run Go tests with optional coverage analysis."""
+    cmd = ["go", "test"]
+    if params.verbose:
+        cmd.append("-v")
+    if params.coverage:
+        cmd.extend(["-coverprofile=coverage.out", "-covermode=atomic"])
+    cmd.append(params.package_path)
+    
+    test_result = await _run_command_async(cmd)
+    
+    if params.coverage and test_result["success"]:
+        coverage_result = await _run_command_async(["go", "tool", "cover", "-func=coverage.out"])
+        test_result["coverage"] = coverage_result["stdout"]
+    
+    if params.response_format == ResponseFormat.JSON:
+        return json.dumps(test_result, indent=2)
+    return _format_test_results_markdown(test_result, params.coverage)
+
+
+def _streamed_diff_result(params: GetPRDiffInput, pr_data: Dict[str, Any], manifest: DiffManifest) -> str:
+    """The manifest github_pr_get_diff returns in place of a diff too large for one response."""
+    resource = _pr_resource_uri(params.owner, params.repo, params.pr_number, "diff")
+    result = {
+        "pr_number": params.pr_number,
+        "title": pr_data["title"],
+        "state": pr_data["state"],
+        "draft": pr_data.get("draft", False),
+        "author": (pr_data.get("user") or {}).get("login"),
+        "head_sha": pr_data["head"]["sha"],
+        "streamed": True,
+        "total_bytes": manifest.total_bytes,
+        "files": manifest.files,
+        "chunks": manifest.chunks,
+        "note": f"The diff is {manifest.total_bytes} bytes, too large for one response. Fetch each chunk "
+                f"with github_pr_get_diff_chunk or read {resource}/{{chunk_id}}; filters such as include "
+                "and exclude do not apply to the chunks."
+    }
+    if params.response_format == ResponseFormat.JSON:
+        return json.dumps(result, indent=2)
+    
+    markdown = f"# PR #{params.pr_number}: {result['title']}\n"
+    markdown += f"**Status:** {result['state']}{' (draft)' if result['draft'] else ''}\n\n"
+    markdown += f"{result['note']}\n\n## Files\n"
+    for f in manifest.files:
+        markdown += f"- `{f['path']}` ({f['bytes']} bytes): {', '.join(f['chunks'])}\n"
+    return markdown
+
+
+@mcp.tool(name="github_pr_get_diff")
+async def get_pr_diff(params: GetPRDiffInput, ctx: Context = None) -> str:
+    """Fetch the diff for a GitHub pull request."""
+    try:
+        endpoint = f"/repos/{params.owner}/{params.repo}/pulls/{params.pr_number}"
+        pr_data = await _fetch_pr(params.owner, params.repo, params.pr_number)
+        head_sha = pr_data.get("head", {}).get("sha")
+        _record_reviewed_head(ctx, params.owner, params.repo, params.pr_number, head_sha)
+        
+        incremental = None
+        if params.since_last_review:
+            incremental = await _incremental_compare(params.owner, params.repo, params.pr_number, head_sha)
+            if incremental["mode"] == "incremental":
+                # The compare diff's new side is the PR head, so its line
+                # numbers are valid anchors for review comments
+                endpoint = f"/repos/{params.owner}/{params.repo}/compare/{incremental['since_sha']}...{head_sha}"
+        
+        # Request the diff media type from the API rather than following
+        # pr_data["diff_url"], so it is authenticated and stays on the
+        # configured (possibly Enterprise) host
+        diff_text = None
+        if (_stream_large_diffs and GITHUB_DIFF_STREAM_THRESHOLD and ctx is not None and not params.path
+                and not (incremental and incremental["mode"] == "incremental")):
+            # A long-lived HTTP server never holds a huge diff, nor sends it in
+            # one response; the client fetches its chunks instead. Other tools
+            # calling this one (without a ctx) get the diff itself.
+            diff_text, manifest = await _small_diff_or_manifest(
+                params.owner, params.repo, params.pr_number, head_sha, GITHUB_DIFF_STREAM_THRESHOLD
+            )
+            if diff_text is None:
+                streams = _session_state(ctx).setdefault("diff_streams", {})
+                streams[(params.owner, params.repo, params.pr_number)] = head_sha
+                return _streamed_diff_result(params, pr_data, manifest)
+        if diff_text is None:
+            diff_text = (await _github_api_response(
+                "GET", endpoint, headers={"Accept": "application/vnd.github.v3.diff"}
+            )).text
+        
+        # The unified diff only lists the files GitHub is willing to render, so
+        # the changed-file list comes from the paginated files API instead.
+        if incremental and incremental["mode"] == "incremental":
+            files = incremental.pop("files")
+            file_summary = _summarize_pr_files(files, len(files))
+        else:
+            files = await _fetch_pr_files(params.owner, params.repo, params.pr_number)
+            file_summary = _summarize_pr_files(files, pr_data.get("changed_files", len(files)))
+        # Filtered and out-of-scope files are dropped here so nothing
+        # downstream (analysis, findings) ever sees them
+        scope = _path_scope(params.path_scope)
+        keep = _path_filter(params.include, params.exclude, scope)
+        kept = [f for f in files if keep(f["filename"])]
+        in_scope_count = sum(1 for f in files if _in_scope(f["filename"], scope))
+        filtered_out_count = in_scope_count - len(kept)
+        files = kept
+        
+        # Binary sections carry no reviewable text, only tokens
+        sections = [
+            section for section in _split_diff_sections(_strip_binary_sections(diff_text))
+            if keep(section[0])
+        ]
+        # Oversized files are judged on their patch size and line count, and
+        # then left out of everything below, so nothing of theirs is fetched.
+        # The files API drops the patch of the largest files; the unified
+        # diff still has it.
+        section_bytes = {path: len(text.encode()) for path, text in sections}
+        candidates = [_file_diff_from_api(f) for f in files]
+        for d in candidates:
+            d.patch_bytes = max(d.patch_bytes, section_bytes.get(d.path, 0))
+        candidates, skipped = _skip_large_files(
+            candidates, params.include_large_files + ([params.path] if params.path else [])
+        )
+        generated = {} if params.include_generated else await _generated_files(
+            params.owner, params.repo, candidates, pr_data.get("base", {}).get("sha"),
+            _pr_head(pr_data, params.owner, params.repo) if "head" in pr_data else None
+        )
+        generated.pop(params.path, None)
+        dropped = {s["filename"] for s in skipped} | set(generated)
+        files = [f for f in files if f["filename"] not in dropped]
+        sections = [section for section in sections if section[0] not in dropped]
+        
+        omitted_paths: List[str] = []
+        if params.path:
+            sections = [section for section in sections if section[0] == params.path]
+            if not sections:
+                raise ValueError(f"{params.path} has no patch in PR #{params.pr_number}")
+        else:
+            budget = GITHUB_DIFF_MAX_CHARS if params.max_diff_chars is None else params.max_diff_chars
+            sections, omitted_paths = _fit_diff_to_budget(sections, budget, params.prioritize)
+        diff_content = "".join(text for _, text in sections)
+        
+        result = {
+            "pr_number": params.pr_number,
+            "title": pr_data["title"],
+            "state": pr_data["state"],
+            "draft": pr_data.get("draft", False),
+            "author": (pr_data.get("user") or {}).get("login"),
+            "author_context": await _author_context(params.owner, params.repo, pr_data),
+            "milestone": _milestone_summary(pr_data.get("milestone")),
+            "assignees": [a["login"] for a in pr_data.get("assignees") or []],
+            "linked_issues": await _linked_issues(params.owner, params.repo, params.pr_number, pr_data.get("body")),
+            **await _describe_changed_files(
+                params.owner, params.repo, files, omitted_paths,
+                pr_data.get("base", {}).get("sha"), head_sha, _head_location(pr_data, params.owner, params.repo),
+                _diff_modes(diff_text)
+            ),
+            "total_files_count": file_summary["total_count"],
+            "files_truncated": file_summary["truncated"],
+            "filtered_out_count": filtered_out_count,
+            **({"path_scope": scope, "in_scope_count": in_scope_count} if scope else {}),
+            "skipped_large_files": skipped,
+            "large_files_finding": _large_files_finding(skipped),
+            "generated_files": _generated_entries(generated),
+            "diff": diff_content
+        }
+        if incremental:
+            result["incremental"] = incremental
+        
+        if params.response_format == ResponseFormat.JSON:
+            return json.dumps(result, indent=2)
+            
+        markdown = f"# PR #{params.pr_number}: {result['title']}\n"
+        markdown += f"**Status:** {result['state']}{' (draft)' if result['draft'] else ''}\n"
+        markdown += f"**Author:** {_author_note(result['author_context'])}\n"
+        markdown += _pr_context_markdown(result)
+        if incremental and incremental["mode"] == "incremental":
+            markdown += (
+                f"**Incremental:** {incremental['commits']} commits since the last review "
+                f"(`{incremental['since_sha'][:7]}`...`{head_sha[:7]}`)\n"
+            )
+        elif incremental:
+            markdown += f"⚠️ Showing the full diff: {incremental['reason']}\n"
+        if scope:
+            markdown += f"{_scope_note(scope)} {in_scope_count} changed files are in scope.\n"
+        markdown += "\n## Go Files Changed\n"
+        go_files, binary_files = result["go_files_changed"], result["binary_files"]
+        markdown += "\n".join(f"- {f}" for f in go_files) if go_files else "No Go files changed"
+        if binary_files:
+            markdown += f"\n\n## Binary Files\n{_binary_files_note(binary_files)}\n"
+            markdown += "\n".join(f"- `{b['path']}` ({b['status']}, {b['size_delta']:+d} bytes)" for b in binary_files)
+        markdown += _mode_changes_markdown(result)
+        if generated:
+            markdown += f"\n\n{_generated_files_note(result['generated_files'])} Pass `include_generated` to review them."
+        if skipped:
+            markdown += f"\n\n## Skipped Large Files\n{_large_files_note(skipped)} Request one with `path` or `include_large_files`.\n"
+            markdown += "\n".join(
+                f"- `{s['filename']}` ({s['patch_bytes']} byte patch, {s['changes']} changes)" for s in skipped
+            )
+        if omitted_paths:
+            markdown += (
+                f"\n\n⚠️ {len(omitted_paths)} files were left out of the diff to stay within the size "
+                "budget; request them one at a time with `path`:\n"
+            )
+            markdown += "\n".join(f"- `{f['filename']}` ({f['changes']} changes)" for f in result["omitted_files"])
+        if file_summary["truncated"]:
+            markdown += (
+                f"\n\n⚠️ Only the first {file_summary['returned_count']} of "
+                f"{file_summary['total_count']} changed files could be listed."
+            )
+        return markdown
+            
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_list_files")
+async def list_pr_files(params: ListPRFilesInput, ctx: Context = None) -> str:
+    """
+    List every file changed in a GitHub pull request, following pagination.
+    
+    Files are returned page_size at a time; pass next_cursor to continue.
+    """
+    async def build() -> Dict[str, Any]:
+        pr_data = await _fetch_pr(params.owner, params.repo, params.pr_number)
+        files = await _fetch_pr_files(params.owner, params.repo, params.pr_number)
+        modes = await _fetch_file_modes(params.owner, params.repo, params.pr_number) if any(map(_may_hide_mode, files)) else {}
+        result = {"pr_number": params.pr_number}
+        result.update(_summarize_pr_files(files, pr_data.get("changed_files", len(files)), modes))
+        keep = _path_filter(params.include, params.exclude, params.path_scope)
+        result["files"] = [f for f in result["files"] if keep(f["filename"])]
+        result["filtered_out_count"] = result["returned_count"] - len(result["files"])
+        return result
+    
+    try:
+        result = await _paginate_result(ctx, "list_files", params, build, ("files",))
+        
+        if params.response_format == ResponseFormat.JSON:
+            return json.dumps(result, indent=2)
+        
+        markdown = f"# Files Changed in PR #{params.pr_number}\n"
+        markdown += f"**Total:** {result['total_count']} files\n"
+        if result["filtered_out_count"]:
+            markdown += f"**Filtered out:** {result['filtered_out_count']} files\n"
+        markdown += "\n"
+        for f in result["files"]:
+            path = f"`{f['previous_filename']}` → `{f['filename']}`" if "previous_filename" in f else f"`{f['filename']}`"
+            mode = f", mode {f['old_mode'] or '-'} → {f['new_mode'] or '-'}" if "old_mode" in f else ""
+            kind = ", symlink" if f.get("symlink") else ", submodule" if f.get("submodule") else ""
+            markdown += f"- {path} ({f['status']}{kind}{mode}, +{f['additions']}/-{f['deletions']})\n"
+        if result["truncated"]:
+            markdown += (
+                f"\n⚠️ GitHub only returns the first {GITHUB_PR_FILES_LIMIT} files; "
+                f"{result['total_count'] - result['returned_count']} files are not listed.\n"
+            )
+        return markdown + _next_page_note(result)
+    except CursorError as e:
+        return _cursor_error_response(e)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_post_review")
+async def post_review_comment(params: PostReviewCommentInput) -> str:
+    """Post a review comment to a GitHub pull request."""
+    try:
+        endpoint = f"/repos/{params.owner}/{params.repo}/pulls/{params.pr_number}/reviews"
+        review_data = {"body": params.body, "event": params.event}
+        if params.commit_id:
+            review_data["commit_id"] = params.commit_id
+        if _dry_run(params):
+            return _dry_run_response([_planned_request("POST", endpoint, review_data)])
+        
+        result = await _github_api_request("POST", endpoint, review_data)
+        return json.dumps({"success": True, "html_url": result["html_url"]}, indent=2)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+def _dry_run(params: BaseModel) -> bool:
+    """Whether a mutating tool call only reports what it would send; --read-only forces it."""
+    return GITHUB_READ_ONLY or getattr(params, "dry_run", False)
+
+
+def _planned_request(method: str, endpoint: str, body: Optional[Dict[str, Any]] = None) -> Dict[str, Any]:
+    """A write request a dry run would have sent."""
+    return {"method": method, "endpoint": endpoint, "body": body}
+
+
+def _dry_run_response(planned: List[Dict[str, Any]], **details: Any) -> str:
+    """Result of a mutating tool in dry-run mode, flagged as not posted."""
+    return json.dumps({
+        "success": True,
+        "dry_run": True,
+        "posted": False,
+        "read_only": GITHUB_READ_ONLY,
+        "planned_requests": planned,
+        **details,
+    }, indent=2)
+
+
+def _nothing_in_scope(pr_number: int, scope: List[str]) -> Dict[str, Any]:
+    """Result of a posting tool for a PR that changes no file in the path scope; nothing is posted."""
+    return {
+        "success": True,
+        "posted": False,
+        "nothing_in_scope": True,
+        "path_scope": scope,
+        "message": f"PR #{pr_number} changes no files under " + ", ".join(scope) + "; nothing was posted",
+    }
+
+
+# Added to the summary of a review of a draft PR, which is posted as a comment whatever its findings
+DRAFT_STAGE_NOTE = (
+    "> 📝 Draft-stage pass: this pull request is still a draft, so these findings are comments only "
+    "and block nothing. They may change once it is marked ready for review."
+)
+
+
+async def _own_pr_event_fallback(owner: str, repo: str, pr_number: int, event: str) -> Optional[str]:
+    """
+    Explain why event cannot be posted on this PR, or return None if it can.
+    
+    GitHub rejects approvals and change requests from the PR's author,
+    which for a bot is every PR it opened itself.
+    """
+    if event == "COMMENT":
+        return None
+    author = ((await _fetch_pr(owner, repo, pr_number)).get("user") or {}).get("login")
+    if not author or author.lower() != (await _authenticated_login()).lower():
+        return None
+    action = "approve" if event == "APPROVE" else "request changes on"
+    return f"GitHub does not let {author}, the author of this pull request, {action} it"
+
+
+@mcp.tool(name="github_pr_create_review")
+async def create_review(params: CreateReviewInput, ctx: Context = None) -> str:
+    """
+    Post a summary and a batch of inline findings as one pull request review.
+    
+    Each review carries a run ID (run_id, or one derived from the head SHA
+    and the findings). When a review with that run ID is already on the PR,
+    for instance because an earlier attempt landed but its response was
+    lost, its details are returned with already_posted instead of posting
+    it twice. A review of a draft PR is always posted as a COMMENT, with a
+    note in the summary that it is a draft-stage pass.
+    
+    One bad finding does not sink the review. Findings with malformed line
+    ranges are dropped before posting, and when GitHub still refuses the
+    batch its comments are posted one at a time, so only the ones GitHub
+    rejects are left out. Both are listed, with partial set, and findings
+    whose comments an earlier review already carries are not posted again,
+    so a retry of the dropped or rejected findings is safe.
+    
+    Credentials that may not post reviews on the repository are refused
+    with error_code missing_permission before anything is fetched. With
+    fallback_to_output the review is built anyway and returned as a dry
+    run, with missing_permission naming what is lacking.
+    """
+    run_id = None
+    try:
+        file_diffs = await _fetch_file_diffs(params.owner, params.repo, params.pr_number)
+        scope = _path_scope(params.path_scope)
+        if not any(_in_scope(path, scope) for path in file_diffs):
+            return json.dumps(_nothing_in_scope(params.pr_number, scope), indent=2)
+        head_sha, draft = await _review_target(params.owner, params.repo, params.pr_number, params.commit_id)
+        run_id = params.run_id or _review_run_id(head_sha, params.findings, draft)
+        posted = await _posted_review(params.owner, params.repo, params.pr_number, run_id)
+        if posted is not None:
+            return await _already_posted_response(params.owner, params.repo, params.pr_number, posted, run_id)
+        in_scope = [f for f in params.findings if _finding_in_scope(f, scope)]
+        loaded = await _load_review_policy(params.owner, params.repo)
+        policy = loaded.policy
+        templates = await _load_review_templates(params.owner, params.repo)
+        graded = [f for f in in_scope if not policy.excludes(f.path)]
+        await _report_progress(1, 3, f"checking {len(graded)} findings against the diff of {len(file_diffs)} files")
+        findings, suppressed = graded, 0
+        if params.skip_duplicates and findings:
+            existing = await _existing_bot_comments(params.owner, params.repo, params.pr_number)
+            findings, suppressed = _drop_duplicate_findings(findings, existing, templates, {
+                "Run": _template_run(params.owner, params.repo, params.pr_number, head_sha, run_id, draft=draft),
+                "Policy": _template_policy(loaded),
+            })
+        already_posted = 0
+        if any(f.commit is None for f in findings):
+            # An earlier review whose batch GitHub partly rejected may carry some of these already
+            posted_ids = await _posted_finding_ids(params.owner, params.repo, params.pr_number)
+            kept = [f for f in findings if f.commit is not None or _finding_id(f) not in posted_ids]
+            findings, already_posted = kept, len(findings) - len(kept)
+        await _report_progress(2, 3, f"posting {len(findings)} findings ({suppressed} duplicates suppressed)")
+        # Duplicates still count: a leaked secret stays unfixed until it is gone
+        requested = params.event
+        if requested == "AUTO":
+            requested = "COMMENT" if graded else policy.review_events.get("none", "APPROVE")
+        policy_event = policy.review_event([f.severity for f in graded])
+        explicit = params.event != "AUTO" and "event" in params.model_fields_set
+        notes: List[str] = []
+        if params.request_changes_at is not None:
+            severe = any(_severity_at_least(f.severity, params.request_changes_at) for f in graded)
+            event = "REQUEST_CHANGES" if severe else requested
+        elif not explicit or policy_event is None:
+            event = policy_event or requested
+        elif REVIEW_EVENT_STRICTNESS.index(requested) >= REVIEW_EVENT_STRICTNESS.index(policy_event):
+            # A caller may be stricter than the policy, never laxer
+            event = requested
+        else:
+            event = policy_event
+            notes.append(f"> ℹ️ Posted as {policy_event} instead of {requested}: "
+                         f"the repository policy requires it for these findings.")
+        chosen_event = event
+        policy_fields = (
+            {"policy_event": policy_event}
+            if explicit and params.request_changes_at is None and policy_event not in (None, requested) else {}
+        )
+        marker = _review_marker(chosen_event, [f.severity for f in graded], head_sha, run_id)
+        if scope:
+            notes.append(_scope_note(scope))
+        if draft:
+            notes.append(DRAFT_STAGE_NOTE)
+            fallback = "the pull request is a draft" if event != "COMMENT" else None
+        else:
+            fallback = await _own_pr_event_fallback(params.owner, params.repo, params.pr_number, event)
+        if fallback:
+            event = "COMMENT"
+            notes.append(f"> ℹ️ Posted as a comment instead of {chosen_event}: {fallback}.")
+        context = {
+            "Run": _template_run(params.owner, params.repo, params.pr_number, head_sha, run_id, event, draft),
+            "Policy": _template_policy(loaded),
+            "Notes": notes,
+        }
+        review = _build_review_payload(
+            params.summary, event, findings, file_diffs, params.commit_id, run_id, marker, templates, context
+        )
+        template_fields = {"template_errors": templates.errors} if templates.errors else {}
+        dropped = [
+            {"path": item["path"], "line": findings[item["index"]].line, "reason": item["error"],
+             "finding": findings[item["index"]].model_dump(mode="json", exclude_none=True)}
+            for item in review["invalid"]
+        ]
+        patch_fields: Dict[str, Any] = {}
+        if params.patch:
+            head = _pr_head(await _fetch_pr(params.owner, params.repo, params.pr_number), params.owner, params.repo)
+            if params.commit_id:
+                head = replace(head, sha=params.commit_id)
+            patch = await _suggestion_patch(params.owner, params.repo, head, review["payload"]["comments"], file_diffs)
+            if patch["patch"]:
+                review["payload"]["body"] += f"\n\n{_patch_details(patch)}"
+            patch_fields = {"patch": patch["patch"], "patch_files": patch["files"],
+                            "patch_conflicts": patch["conflicts"], "patch_errors": patch["errors"]}
+        
+        endpoint = f"/repos/{params.owner}/{params.repo}/pulls/{params.pr_number}/reviews"
+        missing = None
+        if params.fallback_to_output and not _dry_run(params):
+            missing = await _missing_permission(params.owner, params.repo, *CreateReviewInput.REQUIRED_PERMISSION)
+        if _dry_run(params) or missing is not None:
+            return _dry_run_response(
+                [_planned_request("POST", endpoint, review["payload"])],
+                **({"missing_permission": f"{missing.permission}:{missing.level}",
+                    "permission_error": str(missing)} if missing else {}),
+                run_id=run_id,
+                event=event,
+                **({"requested_event": chosen_event, "event_fallback": fallback} if fallback else {}),
+                **policy_fields,
+                **({"draft_stage": True} if draft else {}),
+                comments_planned=len(review["payload"]["comments"]),
+                dropped_comments=dropped,
+                already_posted_comments=already_posted,
+                duplicates_suppressed=suppressed,
+                excluded_by_policy=len(in_scope) - len(graded),
+                out_of_scope=len(params.findings) - len(in_scope),
+                rejected_findings=params.rejected_findings,
+                downgraded_suggestions=review["downgraded"],
+                findings_in_summary=[_finding_location(f) for f in review["unplaced"]],
+                **patch_fields,
+                **template_fields,
+            )
+        comments, rejected, failed = review["payload"]["comments"], [], set()
+        _forget_job_snapshot(params.owner, params.repo, params.pr_number)
+        try:
+            result = await _github_api_request("POST", endpoint, review["payload"])
+        except httpx.HTTPStatusError as e:
+            if e.response.status_code != 422 or not comments:
+                raise
+            logger.info("GitHub refused the %d comments of a review of %s/%s#%d together (%s); posting them one at a time",
+                        len(comments), params.owner, params.repo, params.pr_number, _github_error_message(e))
+            result, failures = await _post_review_comments_singly(params.owner, params.repo, params.pr_number, review["payload"])
+            rejected = [
+                {"path": comments[i]["path"], "line": comments[i]["line"], "error": error,
+                 "finding": findings[review["placed"][i]].model_dump(mode="json", exclude_none=True)}
+                for i, error in failures
+            ]
+            failed = {i for i, _ in failures}
+        posted_ids = [_finding_id(findings[review["placed"][i]]) for i in range(len(comments)) if i not in failed]
+        _update_review_state(
+            params.owner, params.repo, params.pr_number,
+            lambda state: replace(_with_finding_ids(state, posted_ids), head_sha=head_sha)
+        )
+        posted_count = len(comments) - len(rejected)
+        METRICS.inc("github_pr_mcp_comments_posted_total", {"tool": "github_pr_create_review"}, posted_count)
+        await _report_progress(3, 3, f"posted {posted_count} comments")
+        posted_comments = (
+            await _review_comments(params.owner, params.repo, params.pr_number, result["id"]) if posted_count else []
+        )
+        started = _session_state(ctx).get("review_started", {}).pop((params.owner, params.repo, params.pr_number), None)
+        if started is not None:
+            METRICS.observe("github_pr_mcp_review_duration_seconds", {"mode": "session"}, time.monotonic() - started)
+        return json.dumps({
+            "success": True,
+            "html_url": result["html_url"],
+            "review_id": result["id"],
+            "run_id": run_id,
+            "event": event,
+            **({"requested_event": chosen_event, "event_fallback": fallback} if fallback else {}),
+            **policy_fields,
+            **({"draft_stage": True} if draft else {}),
+            "comments_posted": posted_count,
+            "partial": bool(dropped or rejected),
+            "posted_comments": posted_comments,
+            "dropped_comments": dropped,
+            "rejected_comments": rejected,
+            "already_posted_comments": already_posted,
+            "duplicates_suppressed": suppressed,
+            "excluded_by_policy": len(in_scope) - len(graded),
+            "out_of_scope": len(params.findings) - len(in_scope),
+            "rejected_findings": params.rejected_findings,
+            "downgraded_suggestions": review["downgraded"],
+            "findings_in_summary": [
+                _finding_location(f) if f.commit is not None else {
+                    **_finding_location(f),
+                    "nearest_lines": file_diffs[f.path].nearest_commentable(f.line, f.side) if f.path in file_diffs else [],
+                }
+                for f in review["unplaced"]
+            ],
+            **patch_fields,
+            **template_fields,
+        }, indent=2)
+    except RetryableError as e:
+        # The review may have landed before the connection dropped
+        try:
+            posted = await _posted_review(params.owner, params.repo, params.pr_number, run_id) if run_id else None
+            if posted is not None:
+                return await _already_posted_response(params.owner, params.repo, params.pr_number, posted, run_id)
+        except Exception:
+            pass
+        return _retryable_error_response(e)
+    except PendingReviewExistsError as e:
+        return e.response()
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_list_review_threads")
+async def list_review_threads(params: ListReviewThreadsInput, ctx: Context = None) -> str:
+    """List the review conversation threads of a PR with their resolution state, a page at a time."""
+    async def build() -> Dict[str, Any]:
+        threads = await _fetch_review_threads(params.owner, params.repo, params.pr_number)
+        return {"pr_number": params.pr_number, "threads": [_summarize_thread(t) for t in threads]}
+    
+    try:
+        result = await _paginate_result(ctx, "list_review_threads", params, build, ("threads",))
+        
+        if params.response_format == ResponseFormat.JSON:
+            return json.dumps(result, indent=2)
+        
+        markdown = f"# Review Threads for PR #{params.pr_number}\n\n"
+        if not result["threads"]:
+            return markdown + "No review threads."
+        for t in result["threads"]:
+            state = "✅ resolved" if t["is_resolved"] else "💬 open"
+            if t["is_outdated"]:
+                state += ", outdated"
+            first_line = t["first_comment"]["body"].split("\n", 1)[0]
+            markdown += f"- `{t['thread_id']}` {t['path']}:{t['line']} ({state}) — {first_line}\n"
+        return markdown + _next_page_note(result)
+    except CursorError as e:
+        return _cursor_error_response(e)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_resolve_thread")
+async def resolve_thread(params: ResolveThreadInput) -> str:
+    """Mark a review conversation thread as resolved."""
+    return await _set_thread_resolution(params, resolve=True)
+
+
+@mcp.tool(name="github_pr_unresolve_thread")
+async def unresolve_thread(params: ResolveThreadInput) -> str:
+    """Reopen a previously resolved review conversation thread."""
+    return await _set_thread_resolution(params, resolve=False)
+
+
+@mcp.tool(name="github_pr_start_pending_review")
+async def start_pending_review(params: StartPendingReviewInput, ctx: Context = None) -> str:
+    """Start a pending review that collects comments without notifying the author."""
+    try:
+        key = (params.owner, params.repo, params.pr_number)
+        pending = _pending_reviews(ctx)
+        if key in pending:
+            return json.dumps({
+                "error": f"A pending review ({pending[key]['review_id']}) is already open for "
+                         f"{params.owner}/{params.repo}#{params.pr_number}; submit or discard it first",
+                "success": False
+            })
+        
+        endpoint = f"/repos/{params.owner}/{params.repo}/pulls/{params.pr_number}/reviews"
+        # Omitting "event" leaves the review in the PENDING state
+        review_data = {}
+        if params.commit_id:
+            review_data["commit_id"] = params.commit_id
+        if _dry_run(params):
+            # Kept in the session so the rest of the flow can be rehearsed; it never reaches GitHub
+            pending[key] = {
+                "review_id": None, "node_id": None, "comments": 0,
+                "commit_id": params.commit_id, "severities": [], "dry_run": True
+            }
+            return _dry_run_response([_planned_request("POST", endpoint, review_data)], review_id=None, state="PENDING")
+        result = await _github_api_request("POST", endpoint, review_data)
+        
+        pending[key] = {
+            "review_id": result["id"], "node_id": result["node_id"], "comments": 0,
+            "commit_id": params.commit_id, "severities": []
+        }
+        return json.dumps({"success": True, "review_id": result["id"], "state": result.get("state", "PENDING")}, indent=2)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_add_pending_comment")
+async def add_pending_comment(params: AddPendingCommentInput, ctx: Context = None) -> str:
+    """Add inline comments to the session's pending review for a PR."""
+    try:
+        review = _pending_reviews(ctx).get((params.owner, params.repo, params.pr_number))
+        if review is None:
+            return _no_pending_review(params.owner, params.repo, params.pr_number)
+        
+        file_diffs = await _fetch_file_diffs(params.owner, params.repo, params.pr_number)
+        scope = _path_scope(params.path_scope)
+        if not any(_in_scope(path, scope) for path in file_diffs):
+            return json.dumps(_nothing_in_scope(params.pr_number, scope), indent=2)
+        findings = [f for f in params.findings if _finding_in_scope(f, scope)]
+        mapped = _build_review_payload("", "COMMENT", findings, file_diffs)
+        if mapped["invalid"]:
+            return json.dumps({
+                "error": "Some findings have invalid line ranges; nothing was added",
+                "invalid_findings": mapped["invalid"],
+                "success": False
+            }, indent=2)
+        
+        dry_run = _dry_run(params) or review.get("dry_run", False)
+        planned = []
+        for comment in mapped["payload"]["comments"]:
+            thread_input = _review_thread_input(review["node_id"], comment)
+            if dry_run:
+                planned.append(_planned_request(
+                    "POST", "/graphql", {"query": _ADD_REVIEW_THREAD_MUTATION, "variables": {"input": thread_input}}
+                ))
+                if not review.get("dry_run"):
+                    continue
+            else:
+                await _github_graphql(_ADD_REVIEW_THREAD_MUTATION, {"input": thread_input})
+            review["comments"] += 1
+            review["severities"].append((_parse_data_marker(comment["body"], FINDING_DATA_MARKER) or {}).get("severity"))
+            if not dry_run:
+                METRICS.inc("github_pr_mcp_comments_posted_total", {"tool": "github_pr_add_pending_comment"})
+        
+        result = {
+            "review_id": review["review_id"],
+            "comments_added": len(mapped["payload"]["comments"]),
+            "pending_comments": review["comments"],
+            # Not in the diff: the caller can mention these in the summary body
+            "not_added": [_finding_location(f) for f in mapped["unplaced"]],
+            "out_of_scope": len(params.findings) - len(findings),
+            "rejected_findings": params.rejected_findings,
+            "downgraded_suggestions": mapped["downgraded"],
+        }
+        if dry_run:
+            return _dry_run_response(planned, **result)
+        return json.dumps({"success": True, **result}, indent=2)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_submit_pending_review")
+async def submit_pending_review(params: SubmitPendingReviewInput, ctx: Context = None) -> str:
+    """Submit the session's pending review with a summary and event type."""
+    try:
+        key = (params.owner, params.repo, params.pr_number)
+        review = _pending_reviews(ctx).get(key)
+        if review is None:
+            return _no_pending_review(*key)
+        
+        endpoint = f"/repos/{params.owner}/{params.repo}/pulls/{params.pr_number}/reviews/{review['review_id']}/events"
+        marker = _review_marker(params.event, [s for s in review.get("severities", []) if s], review.get("commit_id"))
+        if _dry_run(params) or review.get("dry_run"):
+            if review.get("dry_run"):
+                del _pending_reviews(ctx)[key]
+            return _dry_run_response(
+                [_planned_request("POST", endpoint, {"body": f"{params.body}\n\n{marker}", "event": params.event})],
+                review_id=review["review_id"], comments=review["comments"]
+            )
+        result = await _github_api_request(
+            "POST", endpoint, {"body": f"{params.body}\n\n{marker}", "event": params.event}
+        )
+        del _pending_reviews(ctx)[key]
+        # The pending comments are not tracked one by one, so the next run reads the finding IDs from the markers
+        head_sha = result.get("commit_id") or review.get("commit_id")
+        _update_review_state(
+            params.owner, params.repo, params.pr_number,
+            lambda state: replace(state, head_sha=head_sha or state.head_sha, finding_ids=None)
+        )
+        return json.dumps({
+            "success": True,
+            "review_id": review["review_id"],
+            "state": result.get("state"),
+            "html_url": result.get("html_url"),
+            "comments": review["comments"],
+        }, indent=2)
+    except RetryableError as e:
+        return _retryable_error_response(e)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_discard_pending_review")
+async def discard_pending_review(params: DiscardPendingReviewInput, ctx: Context = None) -> str:
+    """Delete the session's pending review and all comments added to it."""
+    try:
+        key = (params.owner, params.repo, params.pr_number)
+        review = _pending_reviews(ctx).get(key)
+        if review is None:
+            return _no_pending_review(*key)
+        
+        endpoint = f"/repos/{params.owner}/{params.repo}/pulls/{params.pr_number}/reviews/{review['review_id']}"
+        if _dry_run(params) or review.get("dry_run"):
+            if review.get("dry_run"):
+                del _pending_reviews(ctx)[key]
+            return _dry_run_response(
+                [_planned_request("DELETE", endpoint)], review_id=review["review_id"], discarded_comments=review["comments"]
+            )
+        await _github_api_request("DELETE", endpoint)
+        del _pending_reviews(ctx)[key]
+        return json.dumps({"success": True, "review_id": review["review_id"], "discarded_comments": review["comments"]}, indent=2)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_dismiss_review")
+async def dismiss_review(params: DismissReviewInput) -> str:
+    """Dismiss the bot's own earlier REQUEST_CHANGES reviews on a PR."""
+    try:
+        login = await _authenticated_login()
+        endpoint = f"/repos/{params.owner}/{params.repo}/pulls/{params.pr_number}/reviews"
+        reviews = await _github_api_paginate(endpoint)
+        # Reviews by anyone else, humans especially, are never touched
+        stale = [
+            r for r in reviews
+            if (r.get("user") or {}).get("login") == login and r["state"] == "CHANGES_REQUESTED"
+        ]
+        
+        if _dry_run(params):
+            return _dry_run_response(
+                [
+                    _planned_request("PUT", f"{endpoint}/{r['id']}/dismissals", {"message": params.message, "event": "DISMISS"})
+                    for r in stale
+                ],
+                login=login
+            )
+        dismissed, failed = [], []
+        for review in stale:
+            try:
+                await _github_api_request(
+                    "PUT", f"{endpoint}/{review['id']}/dismissals",
+                    {"message": params.message, "event": "DISMISS"}
+                )
+                dismissed.append(review["id"])
+            except httpx.HTTPStatusError as e:
+                if e.response.status_code != 422:
+                    raise
+                # e.g. repositories that do not allow dismissing reviews
+                failed.append({"review_id": review["id"], "error": _github_error_message(e)})
+        
+        return json.dumps({
+            "success": not failed,
+            "login": login,
+            "dismissed_review_ids": dismissed,
+            "failed": failed,
+        }, indent=2)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+_MINIMIZE_COMMENT_MUTATION = """
+mutation($id: ID!, $classifier: ReportedContentClassifiers!) {
+  minimizeComment(input: {subjectId: $id, classifier: $classifier}) { minimizedComment { isMinimized } }
+}
+"""
+
+
+def _has_bot_marker(body: Optional[str]) -> bool:
+    """Whether a body carries one of the hidden markers this server adds to what it posts."""
+    body = body or ""
+    return REVIEW_COMMENT_MARKER in body or SUMMARY_COMMENT_MARKER in body or _DATA_MARKER.search(body) is not None
+
+
+@mcp.tool(name="github_pr_cleanup_bot_comments")
+async def cleanup_bot_comments(params: CleanupBotCommentsInput) -> str:
+    """
+    Delete or minimize every inline and conversation comment the bot posted on a PR, e.g. after a bad run.
+    
+    Only comments by the authenticated account that carry this server's
+    hidden markers are touched (any of the account's comments with
+    include_unmarked); human comments never are. Submitted reviews cannot be
+    deleted, so the bot's approvals and change requests are dismissed instead;
+    its plain comment reviews are reported as kept.
+    """
+    try:
+        login = await _authenticated_login()
+        base = f"/repos/{params.owner}/{params.repo}"
+        reviews, review_comments, issue_comments = await asyncio.gather(
+            _github_api_paginate(f"{base}/pulls/{params.pr_number}/reviews"),
+            _github_api_paginate(f"{base}/pulls/{params.pr_number}/comments"),
+            _github_api_paginate(f"{base}/issues/{params.pr_number}/comments"),
+        )
+        since = _parse_timestamp(params.posted_after) if params.posted_after else None
+        
+        def ours(item: Dict[str, Any], posted_at: Optional[str]) -> bool:
+            if not _login_matches(item.get("user"), login):
+                return False
+            if since is not None and (not posted_at or _parse_timestamp(posted_at) < since):
+                return False
+            return params.include_unmarked or _has_bot_marker(item.get("body"))
+        
+        targets = [
+            {"type": "review_comment", "id": c["id"], "node_id": c.get("node_id"), "html_url": c.get("html_url"),
+             "endpoint": f"{base}/pulls/comments/{c['id']}"}
+            for c in review_comments if ours(c, c.get("created_at"))
+        ] + [
+            {"type": "issue_comment", "id": c["id"], "node_id": c.get("node_id"), "html_url": c.get("html_url"),
+             "endpoint": f"{base}/issues/comments/{c['id']}"}
+            for c in issue_comments if ours(c, c.get("created_at"))
+        ]
+        cleaned_reviews = {c["pull_request_review_id"] for c in review_comments if ours(c, c.get("created_at"))}
+        own_reviews = [
+            r for r in reviews
+            if r.get("state") not in ("PENDING", "DISMISSED")
+            and (ours(r, r.get("submitted_at")) or (r["id"] in cleaned_reviews and _login_matches(r.get("user"), login)))
+        ]
+        verdicts = [r for r in own_reviews if r["state"] in ("APPROVED", "CHANGES_REQUESTED")]
+        kept = [
+            {"review_id": r["id"], "state": r["state"], "reason": "comment reviews cannot be deleted or dismissed"}
+            for r in own_reviews if r not in verdicts
+        ]
+        
+        def planned(target: Dict[str, Any]) -> Dict[str, Any]:
+            if params.mode == "delete":
+                return _planned_request("DELETE", target["endpoint"])
+            return _planned_request("POST", "/graphql", {
+                "query": _MINIMIZE_COMMENT_MUTATION,
+                "variables": {"id": target["node_id"], "classifier": params.reason},
+            })
+        
+        dismissal = {"message": params.dismiss_message, "event": "DISMISS"}
+        if _dry_run(params):
+            return _dry_run_response(
+                [planned(t) for t in targets] + [
+                    _planned_request("PUT", f"{base}/pulls/{params.pr_number}/reviews/{r['id']}/dismissals", dismissal)
+                    for r in verdicts
+                ],
+                mode=params.mode,
+                comments=[{k: t[k] for k in ("type", "id", "html_url")} for t in targets],
+                reviews_to_dismiss=[{"review_id": r["id"], "state": r["state"]} for r in verdicts],
+                kept_reviews=kept,
+            )
+        
+        cleaned, dismissed, failed = [], [], []
+        for target in targets:
+            try:
+                if params.mode == "delete":
+                    await _github_api_request("DELETE", target["endpoint"])
+                else:
+                    await _github_graphql(_MINIMIZE_COMMENT_MUTATION, {"id": target["node_id"], "classifier": params.reason})
+                cleaned.append({k: target[k] for k in ("type", "id", "html_url")})
+            except httpx.HTTPStatusError as e:
+                if e.response.status_code == 404:
+                    # Already gone, e.g. deleted by hand during the cleanup
+                    continue
+                failed.append({"type": target["type"], "id": target["id"], "error": _github_error_message(e)})
+            except GitHubGraphQLError as e:
+                failed.append({"type": target["type"], "id": target["id"], "error": str(e)})
+        for review in verdicts:
+            try:
+                await _github_api_request(
+                    "PUT", f"{base}/pulls/{params.pr_number}/reviews/{review['id']}/dismissals", dismissal
+                )
+                dismissed.append(review["id"])
+            except httpx.HTTPStatusError as e:
+                if e.response.status_code != 422:
+                    raise
+                failed.append({"type": "review", "id": review["id"], "error": _github_error_message(e)})
+        if params.mode == "delete" and cleaned:
+            # Deleted comments no longer count as posted; the next run reads what is left from the markers
+            _update_review_state(params.owner, params.repo, params.pr_number, lambda state: replace(state, finding_ids=None))
+        
+        return json.dumps({
+            "success": not failed,
+            "mode": params.mode,
+            "deleted" if params.mode == "delete" else "minimized": cleaned,
+            "dismissed_review_ids": dismissed,
+            "kept_reviews": kept,
+            "failed": failed,
+        }, indent=2)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+def _reanchor_key(line: str) -> str:
+    """Compare lines ignoring indentation and whitespace changes, which rebases often bring."""
+    return " ".join(line.split())
+
+
+def _reanchor_trivial(key: str) -> bool:
+    """Lines like "}" or blank ones repeat too often to be matched on their own."""
+    return sum(c.isalnum() for c in key) < 3
+
+
+def _reanchor_context_score(old_keys: List[str], new_keys: List[str], i: int, j: int) -> int:
+    """How many of the REANCHOR_CONTEXT lines either side of old line i match those around new line j."""
+    score = 0
+    for k in range(1, REANCHOR_CONTEXT + 1):
+        for oi, nj in ((i - k, j - k), (i + k, j + k)):
+            if 0 <= oi < len(old_keys) and 0 <= nj < len(new_keys) and old_keys[oi] == new_keys[nj]:
+                score += 1
+    return score
+
+
+def _reanchor_line(old_lines: List[str], new_lines: List[str], line: int) -> Dict[str, Any]:
+    """
+    Find where a commented line of the old file is in the new file.
+    
+    The expected position comes from aligning the two files; an unchanged
+    line there still applies. Otherwise the line's content (whitespace
+    ignored) is searched within REANCHOR_WINDOW lines of that position,
+    repeats being told apart by their surrounding lines, and then once
+    anywhere in the file in case the code moved. A similar but changed line
+    nearby makes the result indeterminate; no trace of it means the comment
+    appears fixed.
+    
+    Args:
+        old_lines (List[str]): File lines at the old head
+        new_lines (List[str]): File lines at the new head
+        line (int): 1-based commented line in the old file
+    
+    Returns:
+        Dict[str, Any]: status ("applies", "fixed" or "indeterminate"),
+            line (1-based new line, or None) and reason
+    """
+    if not 1 <= line <= len(old_lines):
+        return {"status": "indeterminate", "line": None, "reason": f"line {line} is past the end of the old file"}
+    old_keys = [_reanchor_key(l) for l in old_lines]
+    new_keys = [_reanchor_key(l) for l in new_lines]
+    i, target = line - 1, old_keys[line - 1]
+    
+    trivial = _reanchor_trivial(target)
+    expected = 0
+    for tag, i1, i2, j1, j2 in difflib.SequenceMatcher(None, old_keys, new_keys, autojunk=False).get_opcodes():
+        if i1 <= i < i2:
+            expected = min(j1 + (i - i1), max(j2 - 1, j1))
+            # A lone brace aligned amid rewritten code says nothing about where the comment belongs
+            if tag == "equal" and (not trivial or _reanchor_context_score(old_keys, new_keys, i, expected)):
+                return {"status": "applies", "line": expected + 1, "reason": "line unchanged"}
+            break
+    
+    window = range(max(0, expected - REANCHOR_WINDOW), min(len(new_keys), expected + REANCHOR_WINDOW + 1))
+    candidates = [j for j in window if new_keys[j] == target]
+    scored = sorted(
+        ((_reanchor_context_score(old_keys, new_keys, i, j), -abs(j - expected), j) for j in candidates),
+        reverse=True
+    )
+    if scored and (not trivial or scored[0][0] > 0):
+        return {"status": "applies", "line": scored[0][2] + 1, "reason": "same line nearby"}
+    
+    if not trivial:
+        anywhere = [j for j, key in enumerate(new_keys) if key == target]
+        if len(anywhere) == 1 and _reanchor_context_score(old_keys, new_keys, i, anywhere[0]) > 0:
+            return {"status": "applies", "line": anywhere[0] + 1, "reason": "code moved"}
+        if len(anywhere) > 1:
+            return {
+                "status": "indeterminate", "line": None,
+                "reason": f"the line appears {len(anywhere)} times in the new file, none near where it was"
+            }
+    
+    similar = [
+        (difflib.SequenceMatcher(None, target, new_keys[j], autojunk=False).ratio(), -abs(j - expected), j)
+        for j in window if not _reanchor_trivial(new_keys[j])
+    ]
+    best = max(similar, default=None)
+    if not trivial and best is not None and best[0] >= REANCHOR_FUZZY_RATIO:
+        return {
+            "status": "indeterminate", "line": best[2] + 1,
+            "reason": f"a similar but changed line is nearby ({best[0]:.0%} alike)"
+        }
+    if trivial and scored:
+        return {"status": "indeterminate", "line": None, "reason": "the line is too generic to place without its context"}
+    return {"status": "fixed", "line": None, "reason": "the commented code is no longer there"}
+
+
+def _sha_matches(sha: Optional[str], prefix: str) -> bool:
+    return bool(sha) and sha.lower().startswith(prefix.lower())
+
+
+@mcp.tool(name="github_pr_reanchor_comments")
+async def reanchor_comments(params: ReanchorCommentsInput) -> str:
+    """
+    Map the bot's unresolved review comments from the head before a force-push onto the new head.
+    
+    Each comment's line is looked up by content in the new version of its
+    file. The result says whether the comment still applies (with its new
+    line and whether that line is in the diff), appears fixed, or is
+    indeterminate. With repost the comments that still apply are posted
+    again at their new lines as one review, and with resolve_orphaned their
+    old threads are resolved.
+    """
+    try:
+        pr_data = await _fetch_pr(params.owner, params.repo, params.pr_number)
+        head = _pr_head(pr_data, params.owner, params.repo)
+        if head.deleted:
+            return json.dumps({"error": "The PR's head repository was deleted, so old file versions cannot be read", "success": False})
+        if params.repost and not _sha_matches(head.sha, params.new_sha):
+            return json.dumps({
+                "error": f"new_sha {params.new_sha} is not the PR's current head {head.sha}; "
+                         "comments can only be posted on the current head",
+                "success": False
+            })
+        new_sha = head.sha if _sha_matches(head.sha, params.new_sha) else params.new_sha
+        login = await _authenticated_login()
+        threads = await _fetch_review_threads(params.owner, params.repo, params.pr_number)
+        rest_comments = {
+            c["id"]: c for c in await _github_api_paginate(f"/repos/{params.owner}/{params.repo}/pulls/{params.pr_number}/comments")
+        }
+        file_diffs = await _fetch_file_diffs(params.owner, params.repo, params.pr_number)
+        renamed = {d.old_path: d.path for d in file_diffs.values() if d.old_path}
+        texts: Dict[Tuple[str, str], Optional[List[str]]] = {}
+        
+        async def lines_at(path: str, ref: str) -> Optional[List[str]]:
+            """File lines at ref, or None when the file is not there."""
+            if (path, ref) not in texts:
+                try:
+                    texts[(path, ref)] = (await _fetch_file_text(head.owner, head.repo, path, ref)).splitlines()
+                except httpx.HTTPStatusError as e:
+                    if e.response.status_code != 404:
+                        raise
+                    texts[(path, ref)] = None
+            return texts[(path, ref)]
+        
+        results = []
+        for thread in threads:
+            nodes = thread["comments"]["nodes"]
+            if thread["isResolved"] or not nodes:
+                continue
+            first = nodes[0]
+            if REVIEW_COMMENT_MARKER not in first["body"] or not _login_matches(first.get("author"), login):
+                continue
+            comment = rest_comments.get(first["databaseId"])
+            if comment is None:
+                continue
+            entry = {
+                "comment_id": comment["id"],
+                "thread_id": thread["id"],
+                "path": comment["path"],
+                "html_url": comment.get("html_url"),
+            }
+            # The line the comment points at in the old head, else where it was first posted
+            if _sha_matches(comment.get("commit_id"), params.old_sha) and comment.get("line"):
+                ref, old_line = comment["commit_id"], comment["line"]
+            else:
+                ref, old_line = comment.get("original_commit_id"), comment.get("original_line")
+            entry["old_line"] = old_line
+            if comment.get("side") == "LEFT" or not ref or not old_line:
+                results.append({**entry, "status": "indeterminate", "new_line": None,
+                                "reason": "the comment is on a removed line" if comment.get("side") == "LEFT"
+                                else "the comment has no line to follow"})
+                continue
+            
+            try:
+                old_lines = await lines_at(comment["path"], ref)
+            except Exception as e:
+                old_lines, error = None, str(e)
+            else:
+                error = "the old version of the file is no longer available"
+            if old_lines is None:
+                results.append({**entry, "status": "indeterminate", "new_line": None, "reason": error})
+                continue
+            new_path = comment["path"] if comment["path"] in file_diffs else renamed.get(comment["path"], comment["path"])
+            new_lines = await lines_at(new_path, new_sha)
+            if new_lines is None:
+                results.append({**entry, "status": "fixed", "new_line": None, "reason": "the file no longer exists"})
+                continue
+            
+            match = _reanchor_line(old_lines, new_lines, old_line)
+            entry.update({"status": match["status"], "new_line": match["line"], "reason": match["reason"]})
+            if new_path != comment["path"]:
+                entry["new_path"] = new_path
+            if match["status"] == "applies":
+                diff = file_diffs.get(new_path)
+                entry["commentable"] = diff is not None and match["line"] in diff.commentable_lines("RIGHT")
+                span = (comment.get("original_line") or 0) - (comment.get("original_start_line") or 0)
+                if comment.get("original_start_line") and 0 < span < match["line"]:
+                    entry["new_start_line"] = match["line"] - span
+            entry["_body"] = comment["body"]
+            results.append(entry)
+        
+        counts = Counter(r["status"] for r in results)
+        repostable = [r for r in results if r["status"] == "applies" and r.get("commentable")]
+        planned, posted_review = [], None
+        if params.repost and repostable:
+            endpoint = f"/repos/{params.owner}/{params.repo}/pulls/{params.pr_number}/reviews"
+            comments = []
+            for r in repostable:
+                comment = {"path": r.get("new_path", r["path"]), "line": r["new_line"], "side": "RIGHT", "body": r["_body"]}
+                if "new_start_line" in r:
+                    comment.update({"start_line": r["new_start_line"], "start_side": "RIGHT"})
+                comments.append(comment)
+            review = {
+                "commit_id": new_sha,
+                "event": "COMMENT",
+                "body": f"Re-anchored {len(comments)} earlier comment{'s' if len(comments) != 1 else ''} "
+                        f"after the branch was force-pushed.\n\n{REVIEW_COMMENT_MARKER}",
+                "comments": comments,
+            }
+            planned.append(_planned_request("POST", endpoint, review))
+            if not _dry_run(params):
+                posted_review = await _github_api_request("POST", endpoint, review)
+                METRICS.inc("github_pr_mcp_comments_posted_total", {"tool": "github_pr_reanchor_comments"}, len(comments))
+            if params.resolve_orphaned:
+                for r in repostable:
+                    variables = {"threadId": r["thread_id"]}
+                    planned.append(_planned_request("POST", "/graphql", {"query": _RESOLVE_THREAD_MUTATION, "variables": variables}))
+                    if not _dry_run(params):
+                        await _github_graphql(_RESOLVE_THREAD_MUTATION, variables)
+                        r["old_thread_resolved"] = True
+        
+        for r in results:
+            r.pop("_body", None)
+        result = {
+            "success": True,
+            "pr_number": params.pr_number,
+            "old_sha": params.old_sha,
+            "new_sha": new_sha,
+            "counts": {status: counts.get(status, 0) for status in ("applies", "fixed", "indeterminate")},
+            "comments": results,
+        }
+        if params.repost:
+            if _dry_run(params):
+                result.update({"dry_run": True, "posted": False, "read_only": GITHUB_READ_ONLY, "planned_requests": planned})
+            else:
+                result["reposted"] = len(repostable)
+                if posted_review is not None:
+                    result["review_id"] = posted_review["id"]
+                    result["html_url"] = posted_review.get("html_url")
+        
+        if params.response_format == ResponseFormat.JSON:
+            return json.dumps(result, indent=2)
+        
+        markdown = f"# Re-anchored Comments for PR #{params.pr_number}\n\n"
+        markdown += f"{params.old_sha[:7]} → {new_sha[:7]}: " + ", ".join(
+            f"{n} {status}" for status, n in result["counts"].items()
+        ) + "\n\n"
+        icons = {"applies": "📌", "fixed": "✅", "indeterminate": "❓"}
+        for r in results:
+            where = f"{r['path']}:{r['old_line']}"
+            if r["status"] == "applies":
+                where += f" → {r.get('new_path', r['path'])}:{r['new_line']}"
+                if not r.get("commentable"):
+                    where += " (outside the diff)"
+            markdown += f"- {icons[r['status']]} {where}: {r['status']} — {r['reason']}\n"
+        if result.get("reposted"):
+            markdown += f"\nPosted {result['reposted']} comments again: {result.get('html_url')}\n"
+        if result.get("dry_run"):
+            markdown += f"\nDry run: {len(planned)} requests would be sent.\n"
+        return markdown
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_request_reviewers")
+async def request_reviewers(params: RequestReviewersInput) -> str:
+    """
+    Request reviews from users and teams, e.g. to hand a PR to humans.
+    
+    GitHub silently drops users without access to the repository, so the
+    result reports which reviewers were actually added.
+    """
+    try:
+        pr_data = await _fetch_pr(params.owner, params.repo, params.pr_number)
+        teams = await _validate_team_slugs(pr_data, params.team_reviewers)
+        reviewers = list(params.reviewers)
+        
+        if params.re_request_previous:
+            login = await _authenticated_login()
+            reviews = await _github_api_paginate(
+                f"/repos/{params.owner}/{params.repo}/pulls/{params.pr_number}/reviews"
+            )
+            # Reviews come oldest first, so each reviewer ends up with their latest one
+            latest = {}
+            for review in reviews:
+                reviewer = (review.get("user") or {}).get("login")
+                if reviewer and review.get("state") != "PENDING":
+                    latest[reviewer] = review
+            head_sha = pr_data["head"]["sha"]
+            for reviewer, review in latest.items():
+                if (reviewer not in (login, pr_data["user"]["login"])
+                        and review.get("commit_id") != head_sha and reviewer not in reviewers):
+                    reviewers.append(reviewer)
+        
+        if not (reviewers or teams):
+            return json.dumps({"success": True, "added_reviewers": [], "added_teams": [],
+                               "message": "No reviewers to request"}, indent=2)
+        
+        endpoint = f"/repos/{params.owner}/{params.repo}/pulls/{params.pr_number}/requested_reviewers"
+        if _dry_run(params):
+            return _dry_run_response([_planned_request("POST", endpoint, {"reviewers": reviewers, "team_reviewers": teams})])
+        result = await _github_api_request("POST", endpoint, {"reviewers": reviewers, "team_reviewers": teams})
+        requested_users = {u["login"].lower() for u in result.get("requested_reviewers", [])}
+        requested_teams = {t["slug"].lower() for t in result.get("requested_teams", [])}
+        added = [r for r in reviewers if r.lower() in requested_users]
+        added_teams = [t for t in teams if t.lower() in requested_teams]
+        
+        return json.dumps({
+            "success": True,
+            "added_reviewers": added,
+            "added_teams": added_teams,
+            "dropped_reviewers": [r for r in reviewers if r not in added],
+            "dropped_teams": [t for t in teams if t not in added_teams],
+        }, indent=2)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_remove_requested_reviewers")
+async def remove_requested_reviewers(params: RemoveRequestedReviewersInput) -> str:
+    """Withdraw pending review requests from users and teams."""
+    try:
+        pr_data = await _fetch_pr(params.owner, params.repo, params.pr_number)
+        teams = await _validate_team_slugs(pr_data, params.team_reviewers)
+        endpoint = f"/repos/{params.owner}/{params.repo}/pulls/{params.pr_number}/requested_reviewers"
+        if _dry_run(params):
+            return _dry_run_response(
+                [_planned_request("DELETE", endpoint, {"reviewers": params.reviewers, "team_reviewers": teams})]
+            )
+        result = await _github_api_request("DELETE", endpoint, {"reviewers": params.reviewers, "team_reviewers": teams})
+        return json.dumps({
+            "success": True,
+            "requested_reviewers": [u["login"] for u in result.get("requested_reviewers", [])],
+            "requested_teams": [t["slug"] for t in result.get("requested_teams", [])],
+        }, indent=2)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_suggest_owners")
+async def suggest_owners(params: SuggestOwnersInput) -> str:
+    """
+    Suggest owners for a PR's changed files from the base branch's CODEOWNERS.
+    
+    Returns each file's owners, an aggregate owner list ordered by the number
+    of files owned, and the files no rule covers.
+    """
+    try:
+        pr_data = await _fetch_pr(params.owner, params.repo, params.pr_number)
+        base_ref = pr_data["base"]["ref"]
+        found = await _fetch_codeowners(params.owner, params.repo, base_ref)
+        if found is None:
+            return json.dumps({
+                "error": f"No CODEOWNERS file on {base_ref} (looked in {', '.join(CODEOWNERS_PATHS)})",
+                "success": False
+            })
+        codeowners_path, text = found
+        rules = _parse_codeowners(text)
+        files = await _fetch_pr_files(params.owner, params.repo, params.pr_number)
+        
+        owners_by_file: Dict[str, List[str]] = {}
+        owner_counts: Dict[str, int] = {}
+        unowned = []
+        for f in files:
+            rule = _owners_for_path(rules, f["filename"])
+            # A matching rule with no owners explicitly clears ownership
+            if rule is None or not rule.owners:
+                unowned.append(f["filename"])
+                continue
+            owners_by_file[f["filename"]] = rule.owners
+            for o in rule.owners:
+                owner_counts[o] = owner_counts.get(o, 0) + 1
+        
+        return json.dumps({
+            "success": True,
+            "codeowners_path": codeowners_path,
+            "base_ref": base_ref,
+            "files": owners_by_file,
+            "owners": sorted(owner_counts, key=lambda o: (-owner_counts[o], o)),
+            "unowned_files": unowned,
+        }, indent=2)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_get_file_context")
+async def get_file_context(params: GetFileContextInput) -> str:
+    """
+    Return numbered lines of a file, for context beyond what the diff shows.
+    
+    The range is clamped to the file. Reads from the PR head unless a ref is
+    given; with fallback_to_base, files missing at that ref are read from the
+    PR base instead.
+    """
+    try:
+        pr_data = await _fetch_pr(params.owner, params.repo, params.pr_number)
+        head = _pr_head(pr_data, params.owner, params.repo)
+        ref = params.ref or head.sha
+        known: Optional[Dict[int, str]] = None
+        partial = False
+        try:
+            if ref != head.sha:
+                text = await _fetch_file_text(params.owner, params.repo, params.path, ref)
+            elif head.deleted:
+                diff = (await _fetch_file_diffs(params.owner, params.repo, params.pr_number)).get(params.path)
+                if diff is None:
+                    raise ValueError(
+                        f"The PR's head repository was deleted and {params.path} is not in the diff"
+                    )
+                known = _patch_new_lines(diff)
+                partial = diff.status != "added"
+            else:
+                text = await _fetch_head_file_text(params.owner, params.repo, head, params.path)
+        except httpx.HTTPStatusError as e:
+            if e.response.status_code != 404 or not params.fallback_to_base:
+                raise
+            ref = pr_data["base"]["sha"]
+            text = await _fetch_file_text(params.owner, params.repo, params.path, ref)
+        if known is None:
+            known = dict(enumerate(text.splitlines(), start=1))
+        
+        total = max(known, default=0)
+        start = min(params.start_line, max(total, 1))
+        end = min(params.end_line, total)
+        result = {
+            "path": params.path,
+            "ref": ref,
+            "total_lines": None if partial else total,
+            "start_line": start,
+            "end_line": end,
+            "lines": [{"line": n, "content": known[n]} for n in range(start, end + 1) if n in known],
+        }
+        if partial:
+            result["partial"] = True
+            result["note"] = "The PR's head repository was deleted; only lines shown in the diff are available"
+        
+        if params.response_format == ResponseFormat.JSON:
+            return json.dumps(result, indent=2)
+        
+        width = len(str(end)) if end else 1
+        markdown = f"# `{params.path}` lines {start}-{end} of {total}{' (diff only)' if partial else ''} (at {ref[:12]})\n\n```\n"
+        markdown += "".join(f"{item['line']:>{width}} | {item['content']}\n" for item in result["lines"])
+        markdown += "```\n"
+        return markdown
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+async def _fetch_context_files(owner: str, repo: str, sha: str, paths: List[str]) -> Dict[str, Optional[str]]:
+    """
+    Read text files at a commit in one GraphQL query; missing and binary files map to None.
+    
+    If the query fails, each file is read with _fetch_file_text instead.
+    """
+    variables: Dict[str, Any] = {"owner": owner, "repo": repo}
+    fields = []
+    for index, path in enumerate(paths):
+        variables[f"e{index}"] = f"{sha}:{path}"
+        fields.append(f"f{index}: object(expression: $e{index}) {{ ... on Blob {{ text isBinary }} }}")
+    query = (
+        "query($owner: String!, $repo: String!, " + ", ".join(f"$e{i}: String!" for i in range(len(paths))) + ") {\n"
+        "  repository(owner: $owner, name: $repo) {\n    " + "\n    ".join(fields) + "\n  }\n}"
+    )
+    try:
+        repository = (await _github_graphql(query, variables))["repository"]
+    except (GitHubGraphQLError, httpx.HTTPStatusError) as e:
+        logger.warning("Could not read context files of %s/%s over GraphQL, using REST: %s", owner, repo, e)
+    else:
+        texts = {}
+        for index, path in enumerate(paths):
+            blob = repository.get(f"f{index}") or {}
+            texts[path] = None if blob.get("isBinary") else blob.get("text")
+        return texts
+    
+    async def read(path: str) -> Optional[str]:
+        try:
+            return await _fetch_file_text(owner, repo, path, sha)
+        except httpx.HTTPStatusError as e:
+            if e.response.status_code != 404:
+                raise
+        except ValueError:
+            # A directory, or a file too large to read
+            pass
+        return None
+    
+    return dict(zip(paths, await _map_bounded(read, paths)))
+
+
+@mcp.tool(name="github_pr_get_repo_context")
+async def get_repo_context(params: GetRepoContextInput, ctx: Context = None) -> str:
+    """
+    Read the project's README, contributing guide and style files from the PR's base, to review by its conventions.
+    
+    The files (paths, else REPO_CONTEXT_FILES) are fetched in one batch and
+    each is cut to a character budget; missing files are left out. Contents
+    are cached in the session per repository and base SHA, so later reviews
+    of the same base fetch only files not read before.
+    """
+    try:
+        pr_data = await _fetch_pr(params.owner, params.repo, params.pr_number)
+        base_sha = pr_data["base"]["sha"]
+        paths = list(dict.fromkeys(REPO_CONTEXT_FILES if params.paths is None else params.paths))
+        limit = params.max_chars_per_file or REPO_CONTEXT_MAX_CHARS
+        cache = _session_state(ctx).setdefault("repo_context", {}).setdefault((params.owner, params.repo, base_sha), {})
+        missing = [p for p in paths if p not in cache]
+        if missing:
+            cache.update(await _fetch_context_files(params.owner, params.repo, base_sha, missing))
+        files = [
+            {"path": path, "content": cache[path][:limit], "chars": len(cache[path]), "truncated": len(cache[path]) > limit}
+            for path in paths if cache[path] is not None
+        ]
+        
+        if params.response_format == ResponseFormat.JSON:
+            return json.dumps({
+                "success": True, "base_sha": base_sha, "files": files, "from_cache": not missing
+            }, indent=2)
+        
+        markdown = f"# Repository Context for {params.owner}/{params.repo} (at {base_sha[:12]})\n\n"
+        if not files:
+            return markdown + "None of the context files exist on the base branch."
+        for f in files:
+            note = f" (first {limit} of {f['chars']} characters)" if f["truncated"] else ""
+            markdown += f"## `{f['path']}`{note}\n\n````\n{f['content']}\n````\n\n"
+        return markdown
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_get_diff_chunks")
+async def get_diff_chunks(params: GetDiffChunksInput, ctx: Context = None) -> str:
+    """
+    Split a PR's diff into per-language chunks for multi-pass review.
+    
+    Returns the chunk index; fetch chunk contents one at a time with
+    github_pr_get_diff_chunk. The chunking is cached in the session for the
+    PR's head SHA so later fetches see the same chunks.
+    """
+    try:
+        pr_data = await _fetch_pr(params.owner, params.repo, params.pr_number)
+        head_sha = pr_data["head"]["sha"]
+        keep = _path_filter(params.include, params.exclude, params.path_scope)
+        files = [f for f in await _fetch_pr_files(params.owner, params.repo, params.pr_number) if keep(f["filename"])]
+        chunks = _build_diff_chunks(files, params.max_chunk_chars)
+        
+        cache = _session_state(ctx).setdefault("diff_chunks", {})
+        cache[(params.owner, params.repo, params.pr_number)] = {"head_sha": head_sha, "chunks": chunks}
+        _record_reviewed_head(ctx, params.owner, params.repo, params.pr_number, head_sha)
+        return json.dumps({
+            "success": True,
+            "head_sha": head_sha,
+            "chunks": [_chunk_index_entry(c) for c in chunks],
+        }, indent=2)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_get_diff_chunk")
+async def get_diff_chunk(params: GetDiffChunkInput, ctx: Context = None) -> str:
+    """
+    Return the patches in one chunk from github_pr_get_diff_chunks.
+    
+    Chunks of a diff that github_pr_get_diff streamed ("part-N") are read
+    back from the temporary file it was streamed into.
+    """
+    try:
+        key = (params.owner, params.repo, params.pr_number)
+        streamed_head = _session_state(ctx).get("diff_streams", {}).get(key)
+        if streamed_head is not None and _STREAMED_CHUNK_ID.fullmatch(params.chunk_id):
+            head_sha = await _streamed_diff_head(ctx, params.owner, params.repo, params.pr_number)
+            chunk = await _streamed_diff_chunk(params.owner, params.repo, params.pr_number, params.chunk_id, head_sha)
+            return json.dumps({"success": True, **chunk}, indent=2)
+        
+        cached = _session_state(ctx).get("diff_chunks", {}).get(key)
+        if cached is None:
+            return json.dumps({
+                "error": "No chunk index for this PR in this session; call github_pr_get_diff_chunks first",
+                "success": False
+            })
+        pr_data = await _fetch_pr(params.owner, params.repo, params.pr_number)
+        if pr_data["head"]["sha"] != cached["head_sha"]:
+            return json.dumps({
+                "error": f"The PR head moved from {cached['head_sha'][:12]} to {pr_data['head']['sha'][:12]}; "
+                         "call github_pr_get_diff_chunks again",
+                "success": False
+            })
+        chunk = next((c for c in cached["chunks"] if c["id"] == params.chunk_id), None)
+        if chunk is None:
+            return json.dumps({"error": f"Unknown chunk '{params.chunk_id}'", "success": False})
+        result = _chunk_index_entry(chunk)
+        result.update({"success": True, "diff": "".join(f["patch"] for f in chunk["files"])})
+        return json.dumps(result, indent=2)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_check_go_docs")
+async def check_go_docs(params: GoAnalyzerInput, ctx: Context = None) -> str:
+    """
+    Flag exported Go functions, types and package-level vars added without doc comments.
+    
+    Changed files are parsed at the PR head; only declarations on added lines
+    are reported, so existing undocumented code is not.
+    """
+    async def build() -> Dict[str, Any]:
+        policy = await _load_review_policy(params.owner, params.repo)
+        keep = _path_filter(params.include, params.exclude, params.path_scope)
+        diffs, sources, errors, skipped = await _fetch_changed_go_sources(
+            params.owner, params.repo, params.pr_number, keep, params
+        )
+        findings = []
+        for result in (await _run_go_ast("exported-decls", sources) if sources else []):
+            if result.get("error"):
+                errors.append({"path": result["path"], "error": result["error"]})
+                continue
+            findings.extend(_undocumented_exports(diffs[result["path"]], result.get("decls", [])))
+        return _analyzer_result(policy.apply(findings), errors, skipped)
+    
+    try:
+        return json.dumps(await _paginate_result(ctx, "check_go_docs", params, build, ANALYZER_PAGED_KEYS), indent=2)
+    except CursorError as e:
+        return _cursor_error_response(e)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_check_missing_tests")
+async def check_missing_tests(params: GoAnalyzerInput, ctx: Context = None) -> str:
+    """
+    Flag Go functions a PR changes without changing a test that references them.
+    
+    A function counts as tested when the PR adds or modifies a _test.go file
+    in the same directory and package (or its _test package) that uses the
+    function's name. Changes to comments or formatting alone, generated files
+    and package main's main are ignored.
+    """
+    async def build() -> Dict[str, Any]:
+        policy = await _load_review_policy(params.owner, params.repo)
+        keep = _path_filter(params.include, params.exclude, params.path_scope)
+        diffs, sources, errors, skipped = await _fetch_changed_go_sources(
+            params.owner, params.repo, params.pr_number, keep, params
+        )
+        if not sources:
+            return _analyzer_result(policy.apply([]), errors, skipped)
+        pr_data = await _fetch_pr(params.owner, params.repo, params.pr_number)
+        head, base_sha = _pr_head(pr_data, params.owner, params.repo), pr_data.get("base", {}).get("sha")
+        # Tests anywhere count, even under paths the caller filtered out
+        test_diffs = [
+            d for d in (await _fetch_file_diffs(params.owner, params.repo, params.pr_number)).values()
+            if d.path.endswith("_test.go") and d.reviewable
+        ]
+        
+        async def fetch_test(d: FileDiff) -> Dict[str, str]:
+            try:
+                return {"path": d.path, "source": await _fetch_head_file_text(params.owner, params.repo, head, d.path, d)}
+            except (ValueError, httpx.HTTPStatusError) as e:
+                return {"path": d.path, "error": str(e)}
+        
+        tests = [t for t in await _map_bounded(fetch_test, test_diffs) if "source" in t]
+        tested: Dict[Tuple[str, str], set] = {}
+        for result in (await _run_go_ast("refs", tests) if tests else []):
+            if not result.get("error"):
+                key = (os.path.dirname(result["path"]), result["package"].removesuffix("_test"))
+                tested.setdefault(key, set()).update(result.get("refs", []))
+        # Without a base version every changed function counts as a behavior change
+        base_funcs = await _base_go_funcs(params.owner, params.repo, base_sha, diffs)
+        findings = []
+        for result in await _run_go_ast("funcs", sources):
+            if result.get("error"):
+                errors.append({"path": result["path"], "error": result["error"]})
+                continue
+            path, package = result["path"], result["package"]
+            findings.extend(_untested_changes(
+                diffs[path], package, result.get("decls", []), base_funcs.get(path, []),
+                tested.get((os.path.dirname(path), package), set())
+            ))
+        return _analyzer_result(policy.apply(findings), errors, skipped)
+    
+    try:
+        return json.dumps(await _paginate_result(ctx, "check_missing_tests", params, build, ANALYZER_PAGED_KEYS), indent=2)
+    except CursorError as e:
+        return _cursor_error_response(e)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_check_go_security")
+async def check_go_security(params: GoAnalyzerInput, ctx: Context = None) -> str:
+    """
+    Flag risky Go patterns on the lines a PR adds.
+    
+    Changed files are parsed at the PR head, so code in comments and strings
+    never matches. The rules cover commands and SQL queries built from
+    non-constant strings, math/rand for secret-sounding values, plain
+    http.ListenAndServe, InsecureSkipVerify and package unsafe; each can be
+    regraded or turned off in the review policy as go-security/<rule>.
+    """
+    async def build() -> Dict[str, Any]:
+        policy = await _load_review_policy(params.owner, params.repo)
+        keep = _path_filter(params.include, params.exclude, params.path_scope)
+        diffs, sources, errors, skipped = await _fetch_changed_go_sources(
+            params.owner, params.repo, params.pr_number, keep, params
+        )
+        findings = []
+        for result in (await _run_go_ast("security", sources) if sources else []):
+            if result.get("error"):
+                errors.append({"path": result["path"], "error": result["error"]})
+                continue
+            findings.extend(_security_findings(diffs[result["path"]], result.get("issues", [])))
+        return _analyzer_result(policy.apply(findings), errors, skipped)
+    
+    try:
+        return json.dumps(await _paginate_result(ctx, "check_go_security", params, build, ANALYZER_PAGED_KEYS), indent=2)
+    except CursorError as e:
+        return _cursor_error_response(e)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_check_complexity")
+async def check_complexity(params: ComplexityInput, ctx: Context = None) -> str:
+    """
+    Flag Go functions a PR changes that are too complex or too long, or whose complexity the PR raised too much.
+    
+    Changed files are parsed at the head and base so each changed function's
+    cyclomatic complexity and length are reported with their change in this
+    PR ("complexity 19, +7 in this PR"). Thresholds default to
+    GO_MAX_COMPLEXITY, GO_MAX_FUNCTION_LINES and GO_MAX_COMPLEXITY_INCREASE.
+    """
+    async def build() -> Dict[str, Any]:
+        policy = await _load_review_policy(params.owner, params.repo)
+        keep = _path_filter(params.include, params.exclude, params.path_scope)
+        diffs, sources, errors, skipped = await _fetch_changed_go_sources(
+            params.owner, params.repo, params.pr_number, keep, params
+        )
+        if not sources:
+            return {**_analyzer_result(policy.apply([]), errors, skipped), "functions": []}
+        pr_data = await _fetch_pr(params.owner, params.repo, params.pr_number)
+        # Without a base version every changed function is measured as new
+        base_funcs = await _base_go_funcs(
+            params.owner, params.repo, pr_data.get("base", {}).get("sha"), diffs
+        )
+        limits = (
+            GO_MAX_COMPLEXITY if params.max_complexity is None else params.max_complexity,
+            GO_MAX_FUNCTION_LINES if params.max_function_lines is None else params.max_function_lines,
+            GO_MAX_COMPLEXITY_INCREASE if params.max_complexity_increase is None else params.max_complexity_increase,
+        )
+        findings, functions = [], []
+        for result in await _run_go_ast("funcs", sources):
+            if result.get("error"):
+                errors.append({"path": result["path"], "error": result["error"]})
+                continue
+            found, measured = _complexity_findings(
+                diffs[result["path"]], result.get("decls", []), base_funcs.get(result["path"], []), *limits
+            )
+            findings.extend(found)
+            functions.extend(measured)
+        return {**_analyzer_result(policy.apply(findings), errors, skipped), "functions": functions}
+    
+    try:
+        return json.dumps(await _paginate_result(ctx, "check_complexity", params, build, ANALYZER_PAGED_KEYS), indent=2)
+    except CursorError as e:
+        return _cursor_error_response(e)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_check_dependencies")
+async def check_dependencies(params: GoAnalyzerInput, ctx: Context = None) -> str:
+    """
+    Summarize the Go module dependency changes of a PR, per changed go.mod.
+    
+    Each go.mod is compared at the base and head: added, removed, upgraded
+    and downgraded requirements (with major version jumps marked), and
+    replace, exclude and go directive changes, returned as data and as a
+    markdown table for the summary comment. Downgrades, new replace
+    directives pointing at local directories, and requirements without a
+    matching go.sum update are reported as findings, as are added modules
+    whose license the review policy denies or that has none recognizable.
+    """
+    async def build() -> Dict[str, Any]:
+        policy = await _load_review_policy(params.owner, params.repo)
+        modules, findings, errors = await _dependency_report(
+            params.owner, params.repo, params.pr_number, _path_filter(params.include, params.exclude, params.path_scope),
+            policy.policy.licenses
+        )
+        return {
+            **_analyzer_result(policy.apply(findings), errors),
+            "modules": modules,
+            "markdown": _dependency_markdown(modules),
+        }
+    
+    try:
+        return json.dumps(await _paginate_result(ctx, "check_dependencies", params, build, ANALYZER_PAGED_KEYS), indent=2)
+    except CursorError as e:
+        return _cursor_error_response(e)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_check_api_compat")
+async def check_api_compat(params: GoAnalyzerInput, ctx: Context = None) -> str:
+    """
+    Flag backward-incompatible changes to the exported Go API of the packages a PR touches.
+    
+    Every non-test Go file of each touched package is parsed at the base and
+    head, and the exported declarations are compared by name: removed
+    functions, types, methods, fields and values, changed signatures and
+    field types, and methods added to interfaces. This is a syntactic
+    comparison without type checking, so a change that only renames
+    parameters or reorders fields is not reported. Packages under internal/,
+    testdata/ or vendor/ and package main are exempt.
+    """
+    async def build() -> Dict[str, Any]:
+        policy = await _load_review_policy(params.owner, params.repo)
+        pr_data = await _fetch_pr(params.owner, params.repo, params.pr_number)
+        head, base_sha = _pr_head(pr_data, params.owner, params.repo), pr_data.get("base", {}).get("sha")
+        diffs = [d for d in (await _fetch_file_diffs(params.owner, params.repo, params.pr_number)).values() if not d.is_submodule]
+        directories = _api_package_dirs(diffs, _path_filter(params.include, params.exclude, params.path_scope))
+        if not directories:
+            return {**_analyzer_result(policy.apply([]), []), "packages": []}
+        if head.deleted:
+            raise ValueError("The PR's head repository was deleted, so its packages cannot be downloaded")
+        (base_sources, base_errors), (head_sources, errors) = await asyncio.gather(
+            _fetch_go_package_files(params.owner, params.repo, directories, base_sha),
+            _fetch_go_package_files(head.owner, head.repo, directories, head.sha),
+        )
+        # A package whose base cannot be read in full would look like it lost declarations
+        unreadable = {os.path.dirname(e["path"]) for e in base_errors}
+        errors.extend(base_errors)
+        
+        async def surface(sources: List[Dict[str, str]]) -> Dict[str, Tuple[str, List[Dict[str, Any]]]]:
+            packages: Dict[str, Tuple[str, List[Dict[str, Any]]]] = {}
+            for result in (await _run_go_ast("api", sources) if sources else []):
+                if result.get("error"):
+                    errors.append({"path": result["path"], "error": result["error"]})
+                    unreadable.add(os.path.dirname(result["path"]))
+                    continue
+                _, decls = packages.setdefault(os.path.dirname(result["path"]), (result["package"], []))
+                decls.extend({**d, "path": result["path"]} for d in result.get("decls", []))
+            return packages
+        
+        before, after = await surface(base_sources), await surface(head_sources)
+        pr_paths = {d.old_path: d.path for d in diffs if d.old_path}
+        findings, checked = [], []
+        for directory in directories:
+            package = (after.get(directory) or before.get(directory) or (None, []))[0]
+            if package is None or package == "main" or directory in unreadable:
+                continue
+            checked.append(directory)
+            findings.extend(_api_breaks(
+                package, before.get(directory, (package, []))[1], after.get(directory, (package, []))[1], pr_paths
+            ))
+        return {**_analyzer_result(policy.apply(findings), errors), "packages": checked}
+    
+    try:
+        return json.dumps(await _paginate_result(ctx, "check_api_compat", params, build, ANALYZER_PAGED_KEYS), indent=2)
+    except CursorError as e:
+        return _cursor_error_response(e)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_run_go_toolchain")
+async def run_go_toolchain(params: GoToolchainInput, ctx: Context = None) -> str:
+    """
+    Run gofmt and go vet on the packages a PR changes and return their findings.
+    
+    The affected packages are downloaded at the PR head into a temporary
+    directory that is removed afterwards. Disabled unless the server is started
+    with GO_TOOLCHAIN_ANALYZERS=true, since it runs toolchain binaries on PR code.
+    """
+    if not GO_TOOLCHAIN_ANALYZERS:
+        return json.dumps({
+            "error": "Go toolchain analyzers are disabled; set GO_TOOLCHAIN_ANALYZERS=true to enable them",
+            "success": False
+        })
+    async def build() -> Dict[str, Any]:
+        policy = await _load_review_policy(params.owner, params.repo)
+        pr_data = await _fetch_pr(params.owner, params.repo, params.pr_number)
+        head = _pr_head(pr_data, params.owner, params.repo)
+        keep = _path_filter(params.include, params.exclude, params.path_scope)
+        # Generated files are still downloaded with their packages so vet can build them
+        kept, skipped = await _select_analyzed_files(params.owner, params.repo, [
+            d for d in (await _fetch_file_diffs(params.owner, params.repo, params.pr_number)).values()
+            if d.path.endswith(".go") and d.reviewable and keep(d.path)
+        ], pr_data.get("base", {}).get("sha"), head, params)
+        changed = sorted(d.path for d in kept)
+        if not changed:
+            return _analyzer_result(policy.apply([]), [], skipped)
+        if head.deleted:
+            raise ValueError("The PR's head repository was deleted, so its packages cannot be downloaded to vet")
+        directories = sorted({os.path.dirname(path) for path in changed})
+        # Fork PRs: the head commit and its packages live in the fork
+        sources, errors = await _fetch_package_sources(head.owner, head.repo, directories, head.sha)
+        
+        findings: List[AnalyzerFinding] = []
+        with tempfile.TemporaryDirectory(prefix="github-pr-go-") as workdir:
+            for path, text in sources.items():
+                target = Path(workdir) / path
+                target.parent.mkdir(parents=True, exist_ok=True)
+                target.write_text(text)
+            present = [path for path in changed if path in sources]
+            
+            await _report_progress(1, 3, f"running gofmt on {len(present)} files")
+            gofmt = await _run_command_async(["gofmt", "-l", "-d", *present], cwd=workdir, timeout=params.timeout_seconds)
+            if gofmt["returncode"] not in (0, 1) or "timed out" in gofmt["stderr"]:
+                errors.append({"path": "", "error": f"gofmt: {gofmt['stderr'].strip()}"})
+            findings.extend(_parse_gofmt_diff(gofmt["stdout"]))
+            
+            packages = [f"./{d}" if d else "." for d in directories]
+            await _report_progress(2, 3, f"running go vet on {len(packages)} packages")
+            vet = await _run_command_async(
+                ["go", "vet", *packages], cwd=workdir, timeout=params.timeout_seconds,
+                # Never download a different toolchain for untrusted code
+                env={"GOTOOLCHAIN": "local", "GOFLAGS": "-mod=mod"}
+            )
+            findings.extend(_parse_vet_output(vet["stderr"] + vet["stdout"], vet["returncode"], present))
+            await _report_progress(3, 3, f"found {len(findings)} problems")
+        return _analyzer_result(policy.apply(findings), errors, skipped)
+    
+    try:
+        return json.dumps(await _paginate_result(ctx, "run_go_toolchain", params, build, ANALYZER_PAGED_KEYS), indent=2)
+    except CursorError as e:
+        return _cursor_error_response(e)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_scan_secrets")
+async def scan_secrets(params: ScanSecretsInput, ctx: Context = None) -> str:
+    """
+    Scan the lines a PR adds for credentials such as AWS keys, GitHub tokens and private keys.
+    
+    Findings are blocking unless the repository's review policy grades them
+    otherwise, so github_pr_create_review posts them as REQUEST_CHANGES.
+    Snippets are redacted; the full secret is never returned.
+    """
+    async def build() -> Dict[str, Any]:
+        policy = await _load_review_policy(params.owner, params.repo)
+        keep = _path_filter(params.include, params.exclude, params.path_scope)
+        custom = {p.name: re.compile(p.regex) for p in params.custom_patterns}
+        # Generated and oversized files are scanned too: credentials end up in
+        # generated config and large fixtures as well, and the patch is already here
+        findings = []
+        for diff in (await _fetch_file_diffs(params.owner, params.repo, params.pr_number)).values():
+            # A symlink's added line is its target path and a submodule's a commit SHA, not content
+            if diff.hunks and keep(diff.path) and not diff.is_symlink and not diff.is_submodule:
+                findings.extend(_scan_diff_for_secrets(diff, custom))
+        return _analyzer_result(policy.apply(findings), [])
+    
+    try:
+        return json.dumps(await _paginate_result(ctx, "scan_secrets", params, build, ANALYZER_PAGED_KEYS), indent=2)
+    except CursorError as e:
+        return _cursor_error_response(e)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_check_config_files")
+async def check_config_files(params: ConfigFilesInput, ctx: Context = None) -> str:
+    """
+    Validate the YAML and JSON files a PR changes, as they are at its head.
+    
+    Syntax errors and duplicate keys are errors. With schemas, GitHub Actions
+    workflows and Compose files are also checked against trimmed copies of
+    their published schemas bundled with the server; those findings are
+    warnings. JSON files that allow comments, such as tsconfig.json, are
+    skipped.
+    """
+    async def build() -> Dict[str, Any]:
+        policy = await _load_review_policy(params.owner, params.repo)
+        pr_data = await _fetch_pr(params.owner, params.repo, params.pr_number)
+        head = _pr_head(pr_data, params.owner, params.repo)
+        keep = _path_filter(params.include, params.exclude, params.path_scope)
+        kept, skipped = await _select_analyzed_files(params.owner, params.repo, [
+            d for d in (await _fetch_file_diffs(params.owner, params.repo, params.pr_number)).values()
+            if d.path.lower().endswith(CONFIG_EXTENSIONS) and d.reviewable and keep(d.path)
+            and not any(_glob_match(g, d.path) for g in JSONC_PATHS)
+        ], pr_data.get("base", {}).get("sha"), head, params)
+        
+        async def fetch(d: FileDiff) -> Tuple[FileDiff, Optional[str], Optional[str]]:
+            try:
+                return d, await _fetch_head_file_text(params.owner, params.repo, head, d.path, d), None
+            except (ValueError, httpx.HTTPStatusError) as e:
+                return d, None, str(e)
+        
+        findings, errors = [], []
+        for d, text, error in await _map_bounded(fetch, kept, progress="config files"):
+            if error is not None:
+                errors.append({"path": d.path, "error": error})
+                continue
+            findings.extend(_config_file_findings(d, text, params.schemas))
+        return _analyzer_result(policy.apply(findings), errors, skipped)
+    
+    try:
+        return json.dumps(await _paginate_result(ctx, "check_config_files", params, build, ANALYZER_PAGED_KEYS), indent=2)
+    except CursorError as e:
+        return _cursor_error_response(e)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_check_docs")
+async def check_docs(params: DocsCheckInput, ctx: Context = None) -> str:
+    """
+    Spell-check the documentation lines a PR adds and check the links in them.
+    
+    Added lines of .md, .rst and .txt files are checked against a bundled
+    list of common misspellings (not a dictionary: unlisted words are never
+    reported), skipping code blocks, code spans and URLs; the policy's
+    spelling.words takes words off that list. Relative links in markdown
+    must point at a file or directory of the PR head. With
+    check_external_links, http(s) links on public hosts get a HEAD request,
+    at most DOC_LINK_MAX distinct links per call. Findings are info severity.
+    """
+    async def build() -> Dict[str, Any]:
+        loaded = await _load_review_policy(params.owner, params.repo)
+        accepted = {w.lower() for w in loaded.policy.spelling.words}
+        pr_data = await _fetch_pr(params.owner, params.repo, params.pr_number)
+        head = _pr_head(pr_data, params.owner, params.repo)
+        keep = _path_filter(params.include, params.exclude, params.path_scope)
+        kept, skipped = await _select_analyzed_files(params.owner, params.repo, [
+            d for d in (await _fetch_file_diffs(params.owner, params.repo, params.pr_number)).values()
+            if d.path.lower().endswith(DOC_EXTENSIONS) and d.reviewable and d.hunks and keep(d.path)
+        ], pr_data.get("base", {}).get("sha"), head, params)
+        
+        async def fetch(d: FileDiff) -> Tuple[FileDiff, Optional[str], Optional[str]]:
+            if d.path.lower().endswith(".txt"):
+                return d, "", None
+            try:
+                return d, await _fetch_head_file_text(params.owner, params.repo, head, d.path, d), None
+            except (ValueError, httpx.HTTPStatusError) as e:
+                return d, None, str(e)
+        
+        findings, errors = [], []
+        relative, external = [], {}
+        for d, text, error in await _map_bounded(fetch, kept, progress="documents"):
+            if error is not None:
+                errors.append({"path": d.path, "error": error})
+                continue
+            code = _doc_code_lines(d.path, text)
+            prose = [(ln.new_line, ln.content) for hunk in d.hunks for ln in hunk.lines
+                     if ln.kind == "+" and ln.new_line not in code]
+            findings.extend(_spelling_findings(d.path, prose, accepted))
+            if not d.path.lower().endswith((".md", ".markdown")):
+                continue
+            for number, content in prose:
+                for target in _doc_links(content):
+                    if target.lower().startswith(("http://", "https://")):
+                        external.setdefault(target, []).append((d.path, number))
+                    elif not _URL_SCHEME.match(target) and not target.startswith("//"):
+                        relative.append((d.path, number, target))
+        
+        unverified = []
+        if relative:
+            tree, truncated = (await _fetch_head_tree(head)) if not head.deleted else (set(), True)
+            for path, number, target in relative:
+                resolved = _resolve_doc_link(path, target)
+                if resolved is None or resolved == "." or resolved in tree:
+                    continue
+                if resolved != ".." and truncated:
+                    unverified.append({"path": path, "line": number, "link": target,
+                                       "reason": "the head tree is too large to list in full"})
+                    continue
+                problem = "points outside the repository" if resolved == ".." else f"points at `{resolved}`, which does not exist at the PR head"
+                findings.append(AnalyzerFinding(
+                    analyzer="docs", path=path, line=number, symbol=target, severity="info", rule="docs/broken-link",
+                    message=f"The link `{target}` {problem}.",
+                ))
+        
+        checked = list(external)[:DOC_LINK_MAX] if params.check_external_links else []
+        statuses = await _map_bounded(
+            lambda url: _external_link_status(url, params.link_timeout), checked, limit=DOC_LINK_CONCURRENCY,
+            progress="links"
+        )
+        for url, (status, reason) in zip(checked, statuses):
+            for path, number in external[url]:
+                if status == "broken":
+                    findings.append(AnalyzerFinding(
+                        analyzer="docs", path=path, line=number, symbol=url, severity="info",
+                        rule="docs/broken-external-link",
+                        message=f"The link {url} {reason}.",
+                    ))
+                elif status == "unverified":
+                    unverified.append({"path": path, "line": number, "link": url, "reason": reason})
+        if params.check_external_links:
+            unverified.extend(
+                {"path": path, "line": number, "link": url, "reason": f"over the {DOC_LINK_MAX} links checked per call"}
+                for url in list(external)[DOC_LINK_MAX:] for path, number in external[url]
+            )
+        
+        result = _analyzer_result(loaded.apply(findings), errors, skipped)
+        result["links"] = {
+            "relative": len(relative),
+            "external": len(external),
+            "external_checked": len(checked),
+            "unverified": unverified,
+        }
+        return result
+    
+    try:
+        return json.dumps(await _paginate_result(ctx, "check_docs", params, build, ANALYZER_PAGED_KEYS), indent=2)
+    except CursorError as e:
+        return _cursor_error_response(e)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_check_duplicates")
+async def check_duplicates(params: GoAnalyzerInput, ctx: Context = None) -> str:
+    """
+    Flag blocks of added code that duplicate other added blocks, in another file or far apart in one file.
+    
+    Only the PR's added lines of source files are compared, normalized
+    without comments and whitespace; the block size, similarity threshold
+    and same-file distance come from the policy's duplicates section. At
+    most DUPLICATE_MAX_COMPARISONS window pairs are compared, and the
+    result says when that cut the search short. Findings are info severity,
+    placed on the later block and naming the earlier one.
+    """
+    async def build() -> Dict[str, Any]:
+        loaded = await _load_review_policy(params.owner, params.repo)
+        pr_data = await _fetch_pr(params.owner, params.repo, params.pr_number)
+        keep = _path_filter(params.include, params.exclude, params.path_scope)
+        kept, skipped = await _select_analyzed_files(params.owner, params.repo, [
+            d for d in (await _fetch_file_diffs(params.owner, params.repo, params.pr_number)).values()
+            if d.reviewable and d.hunks and keep(d.path) and _detect_language(d.path) in SOURCE_LANGUAGES
+        ], pr_data.get("base", {}).get("sha"), _pr_head(pr_data, params.owner, params.repo), params)
+        pairs, comparisons, truncated = _duplicate_blocks(
+            {d.path: _normalized_added_runs(d) for d in kept}, loaded.policy.duplicates, DUPLICATE_MAX_COMPARISONS
+        )
+        result = _analyzer_result(loaded.apply([_duplicate_finding(p) for p in pairs]), [], skipped)
+        result.update(duplicates=pairs, comparisons=comparisons, truncated=truncated)
+        if truncated:
+            result["truncated_reason"] = (
+                f"Stopped after {DUPLICATE_MAX_COMPARISONS} comparisons; some duplicates may not be reported"
+            )
+        return result
+    
+    try:
+        return json.dumps(await _paginate_result(ctx, "check_duplicates", params, build, ANALYZER_PAGED_KEYS), indent=2)
+    except CursorError as e:
+        return _cursor_error_response(e)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_check_comment_markers")
+async def check_comment_markers(params: CommentMarkersInput, ctx: Context = None) -> str:
+    """
+    Flag TODO, FIXME, XXX and HACK markers added without an issue reference, and added blocks of commented-out code.
+    
+    Only added lines of files whose comment syntax is known are checked
+    (// and /* */ for Go and C-like languages, # for YAML, shell and
+    similar). Markers and blocks that the patch removes elsewhere in the same
+    file were moved, not added, and are skipped. Findings are info severity.
+    """
+    async def build() -> Dict[str, Any]:
+        policy = await _load_review_policy(params.owner, params.repo)
+        pr_data = await _fetch_pr(params.owner, params.repo, params.pr_number)
+        keep = _path_filter(params.include, params.exclude, params.path_scope)
+        kept, skipped = await _select_analyzed_files(params.owner, params.repo, [
+            d for d in (await _fetch_file_diffs(params.owner, params.repo, params.pr_number)).values()
+            if d.reviewable and d.hunks and keep(d.path) and _detect_language(d.path) in COMMENT_SYNTAX
+        ], pr_data.get("base", {}).get("sha"), _pr_head(pr_data, params.owner, params.repo), params)
+        markers = REVIEW_MARKERS if params.markers is None else params.markers
+        min_lines = COMMENTED_CODE_MIN_LINES if params.min_commented_code_lines is None else params.min_commented_code_lines
+        findings = [f for d in kept for f in _comment_marker_findings(d, markers, min_lines)]
+        return _analyzer_result(policy.apply(findings), [], skipped)
+    
+    try:
+        return json.dumps(await _paginate_result(ctx, "check_comment_markers", params, build, ANALYZER_PAGED_KEYS), indent=2)
+    except CursorError as e:
+        return _cursor_error_response(e)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+async def _classify_pr(
+    owner: str, repo: str, pr_number: int, trivial_paths: List[str], max_changed_lines: int
+) -> Dict[str, Any]:
+    """
+    Decide whether a PR is trivial: small, and every file trivial by path or changed only in comments.
+    
+    Each file records the rule that made it trivial ("path:<glob>" or
+    "comment-only") or why it is not. Contents are only downloaded for the
+    comment check once every other file has turned out trivial.
+    """
+    snapshot = await _job_snapshot(owner, repo, pr_number)
+    pr_data = snapshot.pr if snapshot else await _fetch_pr(owner, repo, pr_number)
+    diffs = list((await _fetch_file_diffs(owner, repo, pr_number)).values())
+    changed = sum(d.changes for d in diffs)
+    result: Dict[str, Any] = {
+        "pr_number": pr_number,
+        "head_sha": pr_data["head"]["sha"],
+        "trivial": False,
+        "changed_lines": changed,
+        "max_changed_lines": max_changed_lines,
+        "files": [],
+    }
+    if not diffs:
+        return {**result, "rule": "no-files", "reason": "The PR changes no files"}
+    if max_changed_lines and changed > max_changed_lines:
+        return {**result, "rule": "max-changed-lines",
+                "reason": f"{changed} changed lines, over the limit of {max_changed_lines}"}
+    
+    files: Dict[str, Dict[str, Any]] = {}
+    candidates: List[FileDiff] = []
+    for d in diffs:
+        paths = [d.path] + ([d.old_path] if d.old_path else [])
+        glob = next((g for g in trivial_paths if all(_glob_match(g, p) for p in paths)), None)
+        if glob:
+            files[d.path] = {"path": d.path, "trivial": True, "rule": f"path:{glob}"}
+        elif (d.status in (FileStatus.MODIFIED, FileStatus.RENAMED) and d.hunks and d.reviewable
+              and _detect_language(d.path) in COMMENT_SYNTAX):
+            candidates.append(d)
+            files[d.path] = {"path": d.path, "trivial": None, "reason": "comment check skipped"}
+        else:
+            files[d.path] = {"path": d.path, "trivial": False, "reason": f"{d.status.value} file outside the trivial paths"}
+    
+    if candidates and all(f["trivial"] for f in files.values() if f["trivial"] is not None):
+        head = _pr_head(pr_data, owner, repo)
+        base_sha = pr_data["base"]["sha"]
+        
+        async def comment_only(d: FileDiff) -> Dict[str, Any]:
+            try:
+                old = await _fetch_file_text(owner, repo, d.old_path or d.path, base_sha)
+                new = await _fetch_head_file_text(owner, repo, head, d.path, d)
+            except (ValueError, httpx.HTTPStatusError) as e:
+                return {"path": d.path, "trivial": False, "reason": f"could not compare contents: {e}"}
+            language = _detect_language(d.path)
+            if _code_tokens(old, language) == _code_tokens(new, language):
+                return {"path": d.path, "trivial": True, "rule": "comment-only"}
+            return {"path": d.path, "trivial": False, "reason": "code changes outside comments"}
+        
+        for checked in await _map_bounded(comment_only, candidates, progress="files"):
+            files[checked["path"]] = checked
+    
+    result["files"] = list(files.values())
+    blocking = [f for f in result["files"] if not f["trivial"]]
+    if blocking:
+        first = next(f for f in blocking if f["trivial"] is False)
+        return {**result, "rule": "non-trivial-file", "reason": f"{first['path']}: {first['reason']}"}
+    rules = Counter(f["rule"] for f in result["files"])
+    return {**result, "trivial": True, "rule": "trivial-files",
+            "reason": "Every file is trivial (" + ", ".join(f"{n} {r}" for r, n in rules.items()) + ")"}
+
+
+def _classification_markdown(result: Dict[str, Any]) -> str:
+    """Render a classification with the rule each file matched, for the tool and auto-approvals."""
+    verdict = "✅ Trivial" if result["trivial"] else "🔍 Needs review"
+    markdown = f"**{verdict}** — {result['reason']} (`{result['rule']}`)\n\n"
+    limit = result["max_changed_lines"]
+    markdown += f"Changed lines: {result['changed_lines']}" + (f" of at most {limit}" if limit else "") + "\n"
+    if result["files"]:
+        markdown += "\n| File | Trivial | Rule |\n|------|---------|------|\n"
+        for f in result["files"]:
+            state = {True: "yes", False: "no", None: "not checked"}[f["trivial"]]
+            markdown += f"| `{f['path']}` | {state} | {f.get('rule') or f['reason']} |\n"
+    return markdown
+
+
+# Analyzers github_pr_sweep_resolved_findings re-runs on one file, by the rule prefix of their findings
+SWEEP_ANALYZERS: Dict[str, Tuple[Callable[..., Any], type]] = {
+    "go-doc": (check_go_docs, GoAnalyzerInput),
+    "missing-tests": (check_missing_tests, GoAnalyzerInput),
+    "go-security": (check_go_security, GoAnalyzerInput),
+    "complexity": (check_complexity, ComplexityInput),
+    "dependencies": (check_dependencies, GoAnalyzerInput),
+    "api-compat": (check_api_compat, GoAnalyzerInput),
+    "gofmt": (run_go_toolchain, GoToolchainInput),
+    "go-vet": (run_go_toolchain, GoToolchainInput),
+    "secrets": (scan_secrets, ScanSecretsInput),
+    "config": (check_config_files, ConfigFilesInput),
+    "markers": (check_comment_markers, CommentMarkersInput),
+    "docs": (check_docs, DocsCheckInput),
+}
+
+
+def _sweep_skip_reason(rule: Optional[str]) -> Optional[str]:
+    """Why a thread's finding cannot be re-checked automatically, or None when it can."""
+    analyzer = (rule or "").split("/", 1)[0]
+    # A re-run on one file cannot see the other copy
+    if analyzer == "duplicates":
+        return "compares files with each other; confirm the fix manually"
+    if analyzer not in SWEEP_ANALYZERS:
+        return "not from a built-in analyzer; confirm the fix manually"
+    detector = rule.split("/", 1)[1] if "/" in rule else None
+    # Custom detectors are passed per call, so a re-run without them would never find the secret
+    if analyzer == "secrets" and detector not in SECRET_DETECTORS and detector != "high-entropy-secret":
+        return "from a custom secret pattern; confirm the fix manually"
+    # Sweeps make no requests outside GitHub
+    if rule == "docs/broken-external-link":
+        return "from an external link check; confirm the fix manually"
+    return None
+
+
+@mcp.tool(name="github_pr_sweep_resolved_findings")
+async def sweep_resolved_findings(params: SweepResolvedFindingsInput) -> str:
+    """
+    Resolve the bot's open review threads whose findings no longer fire at the PR head.
+    
+    The rule in each thread's hidden finding marker names the analyzer that
+    reported it, which is re-run on the thread's file alone with its default
+    settings. When no finding of that rule is within line_drift lines of the
+    thread's line (anywhere in the file, for a thread outdated by later
+    pushes), the thread gets a reply (from the sweep_reply template unless
+    message is given) and is resolved. Findings from the model rather than
+    an analyzer, and files the analyzer could not read, are skipped for a
+    person to confirm.
+    """
+    try:
+        pr_data = await _fetch_pr(params.owner, params.repo, params.pr_number)
+        head_sha = pr_data["head"]["sha"]
+        login = await _authenticated_login()
+        threads = await _fetch_review_threads(params.owner, params.repo, params.pr_number)
+        rest_comments = {
+            c["id"]: c for c in await _github_api_paginate(f"/repos/{params.owner}/{params.repo}/pulls/{params.pr_number}/comments")
+        }
+        renamed = {
+            d.old_path: d.path for d in (await _fetch_file_diffs(params.owner, params.repo, params.pr_number)).values()
+            if d.old_path
+        }
+        runs: Dict[Tuple[str, str], Dict[str, Any]] = {}
+        
+        async def analyze(analyzer: str, path: str) -> Dict[str, Any]:
+            """The analyzer's result for one file, run once per analyzer and file."""
+            tool, model = SWEEP_ANALYZERS[analyzer]
+            key = (tool.__name__, path)
+            if key not in runs:
+                runs[key] = json.loads(await tool(model(
+                    owner=params.owner, repo=params.repo, pr_number=params.pr_number, include=[path], page_size=1000
+                )))
+            return runs[key]
+        
+        results = []
+        for thread in threads:
+            nodes = thread["comments"]["nodes"]
+            if thread["isResolved"] or not nodes:
+                continue
+            first = nodes[0]
+            if REVIEW_COMMENT_MARKER not in first["body"] or not _login_matches(first.get("author"), login):
+                continue
+            comment = rest_comments.get(first["databaseId"], {})
+            rule = (_parse_data_marker(first["body"], FINDING_DATA_MARKER) or {}).get("rule")
+            path = renamed.get(thread["path"], thread["path"])
+            line = comment.get("line")
+            entry = {"thread_id": thread["id"], "comment_id": first["databaseId"], "path": path, "line": line,
+                     "rule": rule, "html_url": comment.get("html_url")}
+            reason = _sweep_skip_reason(rule)
+            if reason is None and comment.get("side") == "LEFT":
+                reason = "on a removed line; confirm the fix manually"
+            if reason is not None:
+                results.append({**entry, "status": "skipped", "reason": reason})
+                continue
+            
+            result = await analyze(rule.split("/", 1)[0], path)
+            unread = [e["error"] for e in result.get("errors", []) if e.get("path") in (path, "")]
+            unread += [
+                f"the file was skipped as {kind.replace('_', ' ')}"
+                for kind in ("skipped_large_files", "generated_files")
+                if any(f.get("filename") == path for f in result.get(kind, []))
+            ]
+            if not result.get("success") or unread:
+                results.append({**entry, "status": "skipped", "reason": result.get("error") or unread[0]})
+                continue
+            firing = [
+                f["line"] for f in result["findings"]
+                if (f.get("rule") or f["analyzer"]) == rule and f["path"] == path
+                and (line is None or abs(f["line"] - line) <= params.line_drift)
+            ]
+            if firing:
+                results.append({**entry, "status": "still_open", "reason": f"{rule} still fires on line {firing[0]}"})
+            else:
+                results.append({**entry, "status": "resolved", "reason": f"{rule} no longer fires"})
+        
+        templates = policy = None
+        if params.message is None:
+            templates = await _load_review_templates(params.owner, params.repo)
+            policy = _template_policy(await _load_review_policy(params.owner, params.repo))
+        run = _template_run(params.owner, params.repo, params.pr_number, head_sha)
+        endpoint = f"/repos/{params.owner}/{params.repo}/pulls/{params.pr_number}/comments"
+        planned = []
+        for r in results:
+            if r["status"] != "resolved":
+                continue
+            if templates is None:
+                text = params.message.replace("{sha}", head_sha[:7])
+            else:
+                text = templates.render("sweep_reply", {
+                    "Run": run, "Policy": policy,
+                    "Finding": _template_finding(Path=r["path"], Line=r["line"] or 0, Rule=r["rule"] or ""),
+                })
+            reply = {"body": f"{text}\n\n{REVIEW_COMMENT_MARKER}", "in_reply_to": r["comment_id"]}
+            variables = {"threadId": r["thread_id"]}
+            planned.append(_planned_request("POST", endpoint, reply))
+            planned.append(_planned_request("POST", "/graphql", {"query": _RESOLVE_THREAD_MUTATION, "variables": variables}))
+            if not _dry_run(params):
+                await _github_api_request("POST", endpoint, reply)
+                METRICS.inc("github_pr_mcp_comments_posted_total", {"tool": "github_pr_sweep_resolved_findings"})
+                await _github_graphql(_RESOLVE_THREAD_MUTATION, variables)
+        
+        counts = Counter(r["status"] for r in results)
+        summary = {
+            "success": True,
+            "pr_number": params.pr_number,
+            "head_sha": head_sha,
+            "counts": {status: counts.get(status, 0) for status in ("resolved", "still_open", "skipped")},
+            "threads": results,
+        }
+        if templates is not None and templates.errors:
+            summary["template_errors"] = templates.errors
+        if _dry_run(params):
+            summary.update({"dry_run": True, "posted": False, "read_only": GITHUB_READ_ONLY, "planned_requests": planned})
+        if params.response_format == ResponseFormat.JSON:
+            return json.dumps(summary, indent=2)
+        
+        markdown = f"# Finding Sweep for PR #{params.pr_number}\n\n"
+        markdown += f"At {head_sha[:7]}: " + ", ".join(
+            f"{n} {status.replace('_', ' ')}" for status, n in summary["counts"].items()
+        ) + "\n\n"
+        icons = {"resolved": "✅", "still_open": "📌", "skipped": "❓"}
+        for r in results:
+            where = f"{r['path']}:{r['line']}" if r["line"] else f"{r['path']} (outdated)"
+            markdown += f"- {icons[r['status']]} {where} `{r['rule'] or 'no rule'}`: {r['reason']}\n"
+        if summary.get("dry_run"):
+            markdown += f"\nDry run: {len(planned)} requests would be sent.\n"
+        return markdown
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_classify_pr")
+async def classify_pr(params: ClassifyPRInput) -> str:
+    """
+    Label a PR trivial when it is small and every file is docs-like or changes only comments.
+    
+    A file is trivial when its path matches one of the trivial globs
+    (markdown, text and images under docs/ by default) or when its tokens,
+    with comments and whitespace removed, are the same before and after the
+    PR. The result names the rule behind the verdict and each file's rule.
+    """
+    try:
+        trivial_paths = TRIVIAL_PATHS if params.trivial_paths is None else params.trivial_paths
+        max_lines = TRIVIAL_MAX_CHANGED_LINES if params.max_changed_lines is None else params.max_changed_lines
+        result = await _classify_pr(params.owner, params.repo, params.pr_number, trivial_paths, max_lines)
+        if params.response_format == ResponseFormat.JSON:
+            return json.dumps({"success": True, **result}, indent=2)
+        return f"# Classification of PR #{params.pr_number}\n\n" + _classification_markdown(result)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_get_checks")
+async def get_checks(params: GetChecksInput) -> str:
+    """
+    Report CI results (check runs and commit statuses) for the PR's head commit.
+    
+    Reruns are collapsed to the latest attempt per check name, and failed runs
+    include their summary and annotations so the review can defer to CI.
+    """
+    try:
+        pr_data = await _fetch_pr(params.owner, params.repo, params.pr_number)
+        result = await _fetch_checks(params.owner, params.repo, pr_data["head"]["sha"], params.max_output_chars)
+        
+        if params.response_format == ResponseFormat.JSON:
+            return json.dumps(result, indent=2)
+        
+        icons = {"success": "✅", "failure": "❌", "pending": "⏳", "none": "➖"}
+        markdown = f"# CI for PR #{params.pr_number} ({result['sha'][:12]})\n"
+        markdown += f"**Overall:** {icons[result['state']]} {result['state']}\n\n"
+        for check in result["checks"]:
+            outcome = check["conclusion"] or check["status"]
+            markdown += f"- **{check['name']}**: {outcome}"
+            markdown += f" ([details]({check['details_url']}))\n" if check["details_url"] else "\n"
+            if check.get("summary"):
+                markdown += f"  > {check['summary']}\n"
+            for a in check.get("annotations", []):
+                markdown += f"  - `{a['path']}:{a['line']}` {a['level']}: {a['message']}\n"
+        return markdown
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_set_commit_status")
+async def set_commit_status(params: SetCommitStatusInput, ctx: Context = None) -> str:
+    """
+    Post a commit status (e.g. the review verdict) on the PR head reviewed in this session.
+    
+    Refuses with error_code "head_moved" if the PR has new commits since its
+    diff was fetched, so a verdict is never stamped on unreviewed code.
+    """
+    try:
+        key = (params.owner, params.repo, params.pr_number)
+        reviewed_sha = _session_state(ctx).get("reviewed_heads", {}).get(key)
+        if reviewed_sha is None:
+            return json.dumps({
+                "error": "This session has not fetched the PR diff yet; call github_pr_get_diff first",
+                "error_code": "not_reviewed",
+                "success": False
+            })
+        pr_data = await _fetch_pr(params.owner, params.repo, params.pr_number)
+        current_sha = pr_data["head"]["sha"]
+        if current_sha != reviewed_sha:
+            return json.dumps({
+                "error": f"The PR head moved from {reviewed_sha[:12]} to {current_sha[:12]} since the diff was "
+                         "fetched; review the new commits and try again",
+                "error_code": "head_moved",
+                "reviewed_sha": reviewed_sha,
+                "current_sha": current_sha,
+                "success": False
+            })
+        
+        status = {"state": params.state, "context": params.context}
+        if params.description:
+            description = params.description
+            if len(description) > GITHUB_STATUS_DESCRIPTION_LIMIT:
+                description = description[:GITHUB_STATUS_DESCRIPTION_LIMIT - 1] + "…"
+            status["description"] = description
+        if params.target_url:
+            status["target_url"] = params.target_url
+        endpoint = f"/repos/{params.owner}/{params.repo}/statuses/{current_sha}"
+        if _dry_run(params):
+            return _dry_run_response([_planned_request("POST", endpoint, status)], sha=current_sha)
+        result = await _github_api_request("POST", endpoint, status)
+        return json.dumps({"success": True, "sha": current_sha, "state": result["state"], "context": result["context"]}, indent=2)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_list_commits")
+async def list_pr_commits(params: ListPRCommitsInput) -> str:
+    """
+    List a PR's commits with author, message and file stats, for commit-by-commit review.
+    
+    Merge commits are flagged with is_merge so they can be skipped.
+    """
+    try:
+        commits = await _fetch_pr_commits(params.owner, params.repo, params.pr_number)
+        result = []
+        for commit in commits:
+            # The list endpoint has no stats; the single-commit endpoint does
+            detail = await _github_api_request("GET", f"/repos/{params.owner}/{params.repo}/commits/{commit['sha']}")
+            author = commit["commit"]["author"]
+            entry = {
+                "sha": commit["sha"],
+                "author": (commit.get("author") or {}).get("login") or author.get("name"),
+                "date": author.get("date"),
+                "message": commit["commit"]["message"],
+                "is_merge": len(commit.get("parents", [])) > 1,
+                "stats": {
+                    "files": len(detail.get("files", [])),
+                    "additions": detail.get("stats", {}).get("additions", 0),
+                    "deletions": detail.get("stats", {}).get("deletions", 0),
+                },
+            }
+            if params.check_conventional_commits and not entry["is_merge"]:
+                entry["convention_issue"] = _conventional_commit_issue(entry["message"])
+            result.append(entry)
+        return json.dumps({"success": True, "commits": result}, indent=2)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_check_commit_messages")
+async def check_commit_messages(params: CommitMessagesInput, ctx: Context = None) -> str:
+    """
+    Check a PR's commit messages, and optionally its title, against Conventional Commits.
+    
+    The type, scope, subject length, imperative mood and body line length are
+    checked as the commit_messages section of the review policy configures
+    them. Merge commits and fixup!, squash! and amend! commits are skipped.
+    Findings are anchored to a commit rather than a line, so
+    github_pr_create_review lists them in the review summary; a title
+    finding is anchored to the PR head.
+    """
+    async def build() -> Dict[str, Any]:
+        policy = await _load_review_policy(params.owner, params.repo)
+        rules = policy.policy.commit_messages
+        findings, skipped = [], []
+        for commit in await _fetch_pr_commits(params.owner, params.repo, params.pr_number):
+            message = commit["commit"]["message"]
+            if len(commit.get("parents", [])) > 1:
+                skipped.append({"sha": commit["sha"], "reason": "merge commit"})
+            elif message.startswith(_AUTOSQUASH_PREFIXES):
+                skipped.append({"sha": commit["sha"], "reason": f"{message.split()[0]} commit"})
+            else:
+                findings.extend(_commit_message_findings(message, commit["sha"], rules))
+        if rules.check_pr_title if params.include_title is None else params.include_title:
+            pr_data = await _fetch_pr(params.owner, params.repo, params.pr_number)
+            findings.extend(_commit_message_findings(pr_data["title"], pr_data["head"]["sha"], rules, title=True))
+        return _analyzer_result(policy.apply(findings), [], {"skipped_commits": skipped})
+    
+    try:
+        return json.dumps(await _paginate_result(ctx, "check_commit_messages", params, build, ANALYZER_PAGED_KEYS), indent=2)
+    except CursorError as e:
+        return _cursor_error_response(e)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_get_pr_stack")
+async def get_pr_stack(params: GetPRStackInput) -> str:
+    """
+    List the chain of stacked PRs a PR belongs to, from the one targeting the real base branch upwards.
+    
+    A PR is stacked when its base branch is the head branch of another open
+    PR. Its diff is always against that branch, so the parent's changes are
+    not part of it; use the chain to link related PRs in a summary.
+    """
+    try:
+        pr_data = await _fetch_pr(params.owner, params.repo, params.pr_number)
+        stack = await _pr_stack(params.owner, params.repo, params.pr_number, pr_data)
+        if params.response_format == ResponseFormat.JSON:
+            return json.dumps({"success": True, "pr_number": params.pr_number, **stack}, indent=2)
+        markdown = f"# Stack of PR #{params.pr_number}\n\n"
+        if not stack["stacked"]:
+            return markdown + f"Not stacked: the PR targets `{stack['root_base']}` and no open PR targets its branch.\n"
+        return markdown + _stack_markdown(stack, params.pr_number)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+def _parse_timestamp(value: str) -> datetime:
+    return datetime.fromisoformat(value.replace("Z", "+00:00"))
+
+
+@mcp.tool(name="github_pr_list_open_prs")
+async def list_open_prs(params: ListOpenPRsInput, ctx: Context = None) -> str:
+    """
+    List a repository's open PRs with the head this server last reviewed, to pick the ones needing a review.
+    
+    review_needed is true when the account has no submitted review of the
+    PR or reviewed an older head. Drafts are left out unless include_drafts
+    is set. PRs are returned most recently updated first, page_size at a time.
+    """
+    async def build() -> Dict[str, Any]:
+        query = {"state": "open", "sort": "updated", "direction": "desc"}
+        if params.base:
+            query["base"] = params.base
+        since = _parse_timestamp(params.updated_since) if params.updated_since else None
+        wanted = set(params.labels)
+        prs = [
+            pr for pr in await _github_api_paginate(f"/repos/{params.owner}/{params.repo}/pulls", query)
+            if (params.include_drafts or not pr.get("draft"))
+            and wanted <= {label["name"] for label in pr.get("labels", [])}
+            and (since is None or _parse_timestamp(pr["updated_at"]) >= since)
+        ]
+        
+        async def describe(pr: Dict[str, Any]) -> Dict[str, Any]:
+            reviewed = await _last_reviewed_sha(params.owner, params.repo, pr["number"])
+            return {
+                "number": pr["number"],
+                "title": pr.get("title"),
+                "author": (pr.get("user") or {}).get("login"),
+                "base_ref": pr["base"]["ref"],
+                "head_sha": pr["head"]["sha"],
+                "draft": pr.get("draft", False),
+                "labels": [label["name"] for label in pr.get("labels", [])],
+                "updated_at": pr.get("updated_at"),
+                "last_reviewed_sha": reviewed,
+                "review_needed": reviewed != pr["head"]["sha"],
+            }
+        
+        return {"pull_requests": await _map_bounded(describe, prs, progress="pull requests")}
+    
+    try:
+        result = await _paginate_result(ctx, "list_open_prs", params, build, ("pull_requests",))
+        
+        if params.response_format == ResponseFormat.JSON:
+            return json.dumps(result, indent=2)
+        
+        markdown = f"# Open PRs in {params.owner}/{params.repo}\n\n"
+        if not result["pull_requests"]:
+            return markdown + "No open PRs match."
+        for pr in result["pull_requests"]:
+            state = "🔍 review needed" if pr["review_needed"] else "✅ reviewed at head"
+            markdown += f"- #{pr['number']} {pr['title']} (`{pr['head_sha'][:7]}`, {state}, updated {pr['updated_at']})\n"
+        return markdown + _next_page_note(result)
+    except CursorError as e:
+        return _cursor_error_response(e)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+def _search_qualifier(name: str, value: str) -> str:
+    """Render a search qualifier, quoting values with spaces."""
+    return f'{name}:"{value}"' if re.search(r"\s", value) else f"{name}:{value}"
+
+
+def _search_terms(params: SearchInput) -> List[Tuple[str, str]]:
+    """The (input field, search term) pairs making up the search query."""
+    terms = []
+    if params.query:
+        terms.append(("query", params.query))
+    if params.owner and params.repo:
+        terms.append(("repo", _search_qualifier("repo", f"{params.owner}/{params.repo}")))
+    elif params.owner:
+        terms.append(("owner", _search_qualifier("user", params.owner)))
+    if params.type != "any" or params.state == "merged":
+        terms.append(("type", "is:issue" if params.type == "issue" else "is:pr"))
+    if params.state == "merged":
+        terms.append(("state", "is:merged"))
+    elif params.state:
+        terms.append(("state", f"state:{params.state}"))
+    if params.author:
+        terms.append(("author", _search_qualifier("author", params.author)))
+    terms.extend(("labels", _search_qualifier("label", label)) for label in params.labels)
+    return terms
+
+
+def _search_rejection(error: httpx.HTTPStatusError, terms: List[Tuple[str, str]]) -> Dict[str, Any]:
+    """
+    Turn GitHub's 422 for a search query into a validation error naming the input at fault.
+    
+    The input whose value GitHub's message quotes is blamed; for queries that
+    are too long or too complex, the longest term is.
+    """
+    try:
+        body = error.response.json()
+    except ValueError:
+        body = {}
+    messages = [e.get("message", "") for e in body.get("errors", []) if isinstance(e, dict)]
+    message = "; ".join(m for m in messages if m) or _github_error_message(error)
+    
+    def quoted(term: str) -> bool:
+        value = re.escape(term.split(":", 1)[1].strip('"'))
+        return re.search(rf"(?<![\w/-]){value}(?![\w/-])", message) is not None
+    
+    field = next(
+        (name for name, term in terms if name in ("owner", "repo", "author", "labels") and quoted(term)),
+        max(terms, key=lambda t: len(t[1]))[0] if terms else None
+    )
+    return {
+        "error": f"GitHub rejected the search ({field}): {message}",
+        "validation_error": True,
+        "field": field,
+        "query": " ".join(term for _, term in terms),
+        "success": False,
+    }
+
+
+def _search_item(item: Dict[str, Any]) -> Dict[str, Any]:
+    """Summarize an issue or PR search result."""
+    pr = item.get("pull_request")
+    matches = [m["fragment"] for m in item.get("text_matches", []) if m.get("fragment")]
+    body = " ".join((item.get("body") or "").split())
+    if matches:
+        snippet = " ".join(matches[0].split())
+    elif len(body) > SEARCH_SNIPPET_LENGTH:
+        snippet = body[:SEARCH_SNIPPET_LENGTH].rstrip() + "…"
+    else:
+        snippet = body
+    return {
+        "number": item["number"],
+        "title": item.get("title"),
+        "type": "pr" if pr is not None else "issue",
+        "state": "merged" if pr and pr.get("merged_at") else item.get("state"),
+        "repository": "/".join(item.get("repository_url", "").split("/")[-2:]),
+        "author": (item.get("user") or {}).get("login"),
+        "updated_at": item.get("updated_at"),
+        "html_url": item.get("html_url"),
+        "snippet": snippet,
+    }
+
+
+@mcp.tool(name="github_pr_search")
+async def search(params: SearchInput, ctx: Context = None) -> str:
+    """
+    Search issues and pull requests, with the common qualifiers as structured inputs.
+    
+    The inputs are combined into one GitHub search query, returned as query.
+    Up to max_results matches are fetched and returned page_size at a time,
+    each with a snippet of the text that matched. Search requests have their
+    own, lower rate limit and wait up to GITHUB_SEARCH_RATE_LIMIT_MAX_WAIT.
+    """
+    terms = _search_terms(params)
+    query = " ".join(term for _, term in terms)
+    
+    async def build() -> Dict[str, Any]:
+        items: List[Dict[str, Any]] = []
+        per_page = min(100, params.max_results)
+        page = 1
+        while True:
+            request = {"q": query, "per_page": per_page, "page": page}
+            if params.sort:
+                request["sort"] = params.sort
+            response = await _github_api_response(
+                "GET", "/search/issues", params=request,
+                headers={"Accept": "application/vnd.github.text-match+json"}
+            )
+            data = response.json()
+            batch = data.get("items", [])
+            items.extend(batch)
+            if len(batch) < per_page or len(items) >= min(params.max_results, data.get("total_count", 0)):
+                break
+            page += 1
+        return {
+            "query": query,
+            "total_count": data.get("total_count", 0),
+            "incomplete_results": data.get("incomplete_results", False),
+            "results": [_search_item(item) for item in items[:params.max_results]],
+        }
+    
+    try:
+        result = await _paginate_result(ctx, "search", params, build, ("results",))
+        
+        if params.response_format == ResponseFormat.JSON:
+            return json.dumps(result, indent=2)
+        
+        markdown = f"# Search: `{query}`\n\n**Matches:** {result['total_count']}\n"
+        if result["incomplete_results"]:
+            markdown += "\n> ⚠️ GitHub timed out before finding every match; the results may be incomplete.\n"
+        if not result["results"]:
+            return markdown + "\nNothing matches."
+        markdown += "\n"
+        for item in result["results"]:
+            kind = "PR" if item["type"] == "pr" else "Issue"
+            markdown += f"- **{item['repository']}#{item['number']}** {item['title']} ({kind}, {item['state']}, by {item['author']})\n"
+            if item["snippet"]:
+                markdown += f"  > {item['snippet']}\n"
+        return markdown + _next_page_note(result)
+    except CursorError as e:
+        return _cursor_error_response(e)
+    except httpx.HTTPStatusError as e:
+        if e.response.status_code == 422:
+            return json.dumps(_search_rejection(e, terms), indent=2)
+        return json.dumps({"error": str(e), "success": False})
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_get_rate_limit")
+async def get_rate_limit(params: GetRateLimitInput) -> str:
+    """
+    Report the GitHub API quota left for the core REST, search and GraphQL limits, and when each resets.
+    
+    Checking does not count against the quota. Expensive tools refuse to
+    start a multi-page fetch below GITHUB_RATE_LIMIT_FLOOR requests and
+    return error_code "quota_low" with retry_after instead. Each
+    GITHUB_ACCOUNTS entry has its own quota; owner picks the one reported.
+    """
+    try:
+        client = _get_github_client()
+        data = await _github_api_request("GET", "/rate_limit")
+        now = time.time()
+        resources = {}
+        for name in ("core", "search", "graphql"):
+            status = data.get("resources", {}).get(name)
+            if status is None:
+                continue
+            client.rate_limits[name] = {k: status[k] for k in ("limit", "remaining", "reset")}
+            resources[name] = {
+                "limit": status["limit"],
+                "remaining": status["remaining"],
+                "used": status.get("used", status["limit"] - status["remaining"]),
+                "reset_at": datetime.fromtimestamp(status["reset"], timezone.utc).isoformat(),
+                "reset_in_seconds": max(0, math.ceil(status["reset"] - now)),
+            }
+        result = {"success": True, "account": client.account, "floor": GITHUB_RATE_LIMIT_FLOOR, "resources": resources}
+        
+        if params.response_format == ResponseFormat.JSON:
+            return json.dumps(result, indent=2)
+        
+        markdown = "# GitHub API Rate Limits\n\n"
+        if client.account != DEFAULT_ACCOUNT:
+            markdown += f"Account: **{client.account}**\n\n"
+        for name, status in resources.items():
+            low = " ⚠️ below the floor" if status["remaining"] < GITHUB_RATE_LIMIT_FLOOR else ""
+            markdown += (
+                f"- **{name}**: {status['remaining']}/{status['limit']} left, "
+                f"resets in {status['reset_in_seconds']}s ({status['reset_at']}){low}\n"
+            )
+        return markdown
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+PERMISSION_SOURCES = {
+    "installation": "GitHub App installation permissions",
+    "token_scopes": "the token's OAuth scopes and the user's role on the repository",
+    "probe": "probe requests (fine-grained token)",
+}
+
+
+@mcp.tool(name="github_pr_check_permissions")
+async def check_permissions(params: CheckPermissionsInput) -> str:
+    """
+    Check what the GitHub credentials may do in a repository before reviewing it.
+    
+    Reports the level granted for each permission the review tools use:
+    contents and checks read, pull_requests and statuses write. An App
+    installation's own permission list is used when there is one, a classic
+    token's OAuth scopes otherwise, and for fine-grained tokens cheap probe
+    requests (write probes send bodies GitHub rejects, so they create
+    nothing, and are skipped in read-only mode). The result is cached per repository for
+    PERMISSIONS_CACHE_TTL seconds. Write tools check it before they run and
+    fail fast with error_code "missing_permission"; read-only analysis is
+    never refused.
+    """
+    try:
+        permissions = await _repo_permissions(params.owner, params.repo, params.refresh)
+        result = {
+            "success": True,
+            "owner": params.owner,
+            "repo": params.repo,
+            "source": permissions.source,
+            "permissions": [
+                {"permission": name, "required": level,
+                 "granted": "unchecked" if name in permissions.unchecked else permissions.levels.get(name, "unknown"),
+                 "ok": permissions.grants(name, level)}
+                for name, level in REVIEW_PERMISSIONS
+            ],
+            "missing": permissions.missing(),
+            "unchecked": list(permissions.unchecked),
+        }
+        
+        if params.response_format == ResponseFormat.JSON:
+            return json.dumps(result, indent=2)
+        
+        markdown = f"# Permissions on {params.owner}/{params.repo}\n\n"
+        markdown += f"Checked with {PERMISSION_SOURCES[permissions.source]}.\n\n"
+        markdown += "| Permission | Needed | Granted |\n|---|---|---|\n"
+        for entry in result["permissions"]:
+            markdown += f"| {entry['permission']} | {entry['required']} | {'✅' if entry['ok'] else '❌'} {entry['granted']} |\n"
+        if result["missing"]:
+            markdown += (
+                f"\nMissing {', '.join(result['missing'])}: tools needing it are refused, and "
+                "github_pr_create_review can return its review instead with fallback_to_output.\n"
+            )
+        if result["unchecked"]:
+            markdown += (
+                f"\nNot checked in read-only mode: {', '.join(result['unchecked'])}, "
+                "since probing them means posting to the repository.\n"
+            )
+        return markdown
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+# Sign-in started by github_pr_login: the device codes and the task polling for the token
+_device_login: Dict[str, Any] = {}
+
+
+def _signed_in() -> None:
+    """Make the client use the new token and account from the next request on."""
+    if _github_client is not None:
+        _github_client._cached_token = None
+        _github_client._login = None
+        _github_client.repo_permissions.clear()
+
+
+async def _complete_device_login(flow: DeviceFlowAuth, device: Dict[str, Any]) -> Dict[str, Any]:
+    saved = await flow.poll(device)
+    _signed_in()
+    return saved
+
+
+@mcp.tool(name="github_pr_login")
+async def login(params: LoginInput) -> str:
+    """
+    Sign in to GitHub with the OAuth device flow when GITHUB_OAUTH_CLIENT_ID is configured.
+    
+    The first call returns a verification URL and user code to show the
+    user, and waits for authorization in the background. Call it again to
+    see whether sign-in finished; the token is saved for later runs.
+    """
+    try:
+        flow = _get_device_flow()
+        if flow is None:
+            return json.dumps({"error": "Device flow sign-in needs GITHUB_OAUTH_CLIENT_ID", "success": False})
+        
+        task = _device_login.get("task")
+        if task is not None and task.done() and not params.force:
+            _device_login.clear()
+            if task.exception() is not None:
+                return json.dumps({"error": str(task.exception()), "status": "failed", "success": False})
+            return json.dumps({"success": True, "status": "signed_in", "token_path": str(flow.token_path)})
+        if task is not None and not task.done() and not params.force:
+            device = _device_login["device"]
+            return json.dumps({
+                "success": True,
+                "status": "pending",
+                "verification_uri": device["verification_uri"],
+                "user_code": device["user_code"],
+                "expires_at": _device_login["expires_at"],
+            })
+        if task is None and not params.force and flow.load() is not None:
+            return json.dumps({"success": True, "status": "signed_in", "token_path": str(flow.token_path)})
+        
+        if task is not None:
+            task.cancel()
+        device = await flow.start()
+        expires_at = datetime.now(timezone.utc) + timedelta(seconds=int(device.get("expires_in", 900)))
+        _device_login.clear()
+        _device_login.update({
+            "device": device,
+            "expires_at": expires_at.isoformat(),
+            "task": asyncio.create_task(_complete_device_login(flow, device)),
+        })
+        return json.dumps({
+            "success": True,
+            "status": "pending",
+            "verification_uri": device["verification_uri"],
+            "user_code": device["user_code"],
+            "expires_at": _device_login["expires_at"],
+            "message": (
+                f"Open {device['verification_uri']} and enter the code {device['user_code']}, "
+                "then call github_pr_login again to confirm"
+            ),
+        })
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_queue_reviews")
+async def queue_reviews(params: QueueReviewsInput) -> str:
+    """
+    Queue background reviews of several PRs, run by the GITHUB_WEBHOOK_BACKEND at most --webhook-concurrency at a time.
+    
+    Only available when the server runs over HTTP, where it outlives the
+    call. Closed PRs, PRs whose head was already reviewed (unless force is
+    set) and heads that are already queued are skipped with a reason.
+    """
+    try:
+        if _review_queue is None:
+            return json.dumps({
+                "error": "Batch reviews need the server running with --transport http or sse", "success": False
+            })
+        
+        async def check(number: int) -> Dict[str, Any]:
+            # One bulk fetch gives both the head and the reviews to compare it with
+            snapshot = await _fetch_pr_snapshot(params.owner, params.repo, number)
+            head_sha = snapshot.pr["head"]["sha"]
+            if snapshot.pr.get("state") != "open":
+                return {"number": number, "skipped": "not open"}
+            if _review_queue.is_queued(params.owner, params.repo, number, head_sha):
+                return {"number": number, "skipped": "already queued"}
+            reviewed = await _last_reviewed_sha(params.owner, params.repo, number, snapshot.reviews)
+            if not params.force and reviewed == head_sha:
+                return {"number": number, "skipped": "head already reviewed"}
+            return {"number": number, "head_sha": head_sha}
+        
+        checked = await _map_bounded(check, sorted(set(params.pr_numbers)), progress="pull requests")
+        batch = f"batch-{uuid.uuid4().hex[:12]}"
+        queued = [c for c in checked if "head_sha" in c]
+        if _dry_run(params):
+            return _dry_run_response([], would_queue=queued, skipped=[c for c in checked if "skipped" in c])
+        for c in queued:
+            _review_queue.submit(ReviewJob(
+                delivery_id=batch, action="batch", owner=params.owner, repo=params.repo,
+                pr_number=c["number"], head_sha=c["head_sha"]
+            ))
+        return json.dumps({
+            "success": True,
+            "batch_id": batch,
+            "queued": queued,
+            "skipped": [c for c in checked if "skipped" in c],
+            "pending_reviews": _review_queue.pending,
+        }, indent=2)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_get_blame")
+async def get_blame(params: GetBlameInput) -> str:
+    """
+    Attribute lines of a changed file, as they are on the PR base, to the commits that last changed them.
+    
+    Each requested range lists the commits covering it; commit details
+    (author, date, age, message, and whether the PR author wrote it) are given
+    once per SHA. Without ranges, the lines the PR modifies or deletes are used.
+    """
+    try:
+        pr_data = await _fetch_pr(params.owner, params.repo, params.pr_number)
+        base_sha = pr_data["base"]["sha"]
+        diff = (await _fetch_file_diffs(params.owner, params.repo, params.pr_number)).get(params.path)
+        # A renamed file has its history under the old name
+        base_path = diff.old_path if diff and diff.old_path else params.path
+        result: Dict[str, Any] = {"success": True, "path": params.path, "base_path": base_path, "ref": base_sha}
+        
+        if params.ranges:
+            ranges = [(r.start, r.end) for r in params.ranges]
+        elif diff is None:
+            return json.dumps({
+                "error": f"{params.path} is not changed by PR #{params.pr_number}; pass ranges to blame it",
+                "success": False
+            })
+        else:
+            ranges = _modified_line_ranges(diff)
+        
+        blame = None if diff is not None and diff.status == "added" else await _fetch_blame(
+            params.owner, params.repo, base_sha, base_path
+        )
+        if blame is None:
+            result.update({"exists": False, "ranges": [], "commits": {},
+                           "note": f"{base_path} does not exist at the base commit, so every line is new"})
+            return json.dumps(result, indent=2)
+        
+        line_count = max((entry["endingLine"] for entry in blame), default=0)
+        blamed = []
+        for start, end in ranges:
+            entry: Dict[str, Any] = {"start": start, "end": end}
+            if start > line_count:
+                entry.update({"beyond_eof": True, "blame": []})
+            else:
+                if end > line_count:
+                    entry["clipped_to"] = line_count
+                entry["blame"] = _blame_for_range(blame, start, min(end, line_count))
+            blamed.append(entry)
+        
+        used = {span["sha"] for entry in blamed for span in entry["blame"]}
+        now = datetime.now(timezone.utc)
+        pr_author = (pr_data.get("user") or {}).get("login")
+        commits = {}
+        for entry in blame:
+            sha = entry["commit"]["oid"]
+            if sha in used and sha not in commits:
+                commits[sha] = _blame_commit(entry["commit"], pr_author, now)
+        result.update({"exists": True, "line_count": line_count, "ranges": blamed, "commits": commits})
+        return json.dumps(result, indent=2)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_get_file_history")
+async def get_file_history(params: GetFileHistoryInput) -> str:
+    """
+    List the most recent commits that touched a file before the PR, with per-file line stats.
+    
+    History is read from the PR base and follows renames GitHub reports, so a
+    file's commits under earlier names are included (see renamed_from).
+    """
+    try:
+        pr_data = await _fetch_pr(params.owner, params.repo, params.pr_number)
+        diff = (await _fetch_file_diffs(params.owner, params.repo, params.pr_number)).get(params.path)
+        base_path = diff.old_path if diff and diff.old_path else params.path
+        entries = await _path_commits(
+            params.owner, params.repo, base_path, pr_data["base"]["sha"], params.max_commits
+        )
+        commits = []
+        for entry in entries:
+            commit = entry["commit"]
+            detail = entry["detail"] or await _github_api_request(
+                "GET", f"/repos/{params.owner}/{params.repo}/commits/{commit['sha']}"
+            )
+            change = next((f for f in detail.get("files", []) if f["filename"] == entry["path"]), {})
+            author = commit["commit"]["author"]
+            item = {
+                "sha": commit["sha"],
+                "author": (commit.get("author") or {}).get("login") or author.get("name"),
+                "date": author.get("date"),
+                "message": commit["commit"]["message"],
+                "path": entry["path"],
+                "additions": change.get("additions", 0),
+                "deletions": change.get("deletions", 0),
+            }
+            if change.get("status") == "renamed":
+                item["renamed_from"] = change.get("previous_filename")
+            commits.append(item)
+        return json.dumps({
+            "success": True,
+            "path": params.path,
+            "base_path": base_path,
+            "ref": pr_data["base"]["sha"],
+            "commits": commits,
+        }, indent=2)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_get_churn")
+async def get_churn(params: GetChurnInput) -> str:
+    """
+    Count how often each file a PR changes was modified recently, to flag hot spots.
+    
+    Files changed at least hot_threshold times in the window get a callout
+    sentence ready for the review summary. Renames are followed; files the PR
+    adds have no history and are skipped.
+    """
+    try:
+        pr_data = await _fetch_pr(params.owner, params.repo, params.pr_number)
+        base_sha = pr_data["base"]["sha"]
+        diffs = [
+            d for d in (await _fetch_file_diffs(params.owner, params.repo, params.pr_number)).values()
+            if d.status != "added"
+        ]
+        checked, skipped = diffs[:params.max_files], diffs[params.max_files:]
+        since = (datetime.now(timezone.utc) - timedelta(days=params.days)).strftime("%Y-%m-%dT%H:%M:%SZ")
+        
+        files = []
+        for diff in checked:
+            entries = await _path_commits(
+                params.owner, params.repo, diff.old_path or diff.path, base_sha, CHURN_MAX_COMMITS, since
+            )
+            files.append({
+                "path": diff.path,
+                "commits": len(entries),
+                "capped": len(entries) >= CHURN_MAX_COMMITS,
+                "last_changed": entries[0]["commit"]["commit"]["author"].get("date") if entries else None,
+                "authors": len({
+                    (e["commit"].get("author") or {}).get("login") or e["commit"]["commit"]["author"].get("name")
+                    for e in entries
+                }),
+            })
+        files.sort(key=lambda f: (-f["commits"], f["path"]))
+        hot = [f for f in files if f["commits"] >= params.hot_threshold]
+        return json.dumps({
+            "success": True,
+            "days": params.days,
+            "since": since,
+            "files": files,
+            "hot_files": [f["path"] for f in hot],
+            "callouts": [
+                f"{f['path']} has changed {f['commits']}{'+' if f['capped'] else ''} times in the last {params.days} days"
+                for f in hot
+            ],
+            "files_skipped": [d.path for d in skipped],
+        }, indent=2)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_get_stats")
+async def get_pr_stats(params: GetStatsInput) -> str:
+    """
+    Summarize a PR's size and shape and score its risk, without fetching the diff.
+    
+    The score weighs the size of the change, hot paths it touches, how much
+    of it is tests and how often the modified files changed recently, with
+    weights and hot paths from the review policy's risk section. Each
+    factor's contribution is included so the summary can say why a PR is
+    risky.
+    """
+    try:
+        pr_data = await _fetch_pr(params.owner, params.repo, params.pr_number)
+        keep = _path_filter([], [])
+        files = [f for f in await _fetch_pr_files(params.owner, params.repo, params.pr_number) if keep(f["filename"])]
+        entries = _file_stats(files)
+        loaded = await _load_review_policy(params.owner, params.repo)
+        risk = loaded.policy.risk
+        
+        churn = None
+        if params.include_churn and risk.weights.churn:
+            base_sha = pr_data["base"]["sha"]
+            since = (datetime.now(timezone.utc) - timedelta(days=risk.churn_days)).strftime("%Y-%m-%dT%H:%M:%SZ")
+            modified = [e for e in entries if e["status"] not in ("added", "copied") and e["kind"] != "generated"]
+            
+            async def commits(entry: Dict[str, Any]) -> Tuple[str, Optional[int]]:
+                try:
+                    found = await _path_commits(
+                        params.owner, params.repo, entry["previous_path"] or entry["path"], base_sha,
+                        risk.churn_commits, since
+                    )
+                except httpx.HTTPStatusError:
+                    return entry["path"], None
+                return entry["path"], len(found)
+            
+            counts = await _map_bounded(commits, modified[:params.churn_max_files], progress="file histories")
+            churn = {path: count for path, count in counts if count is not None}
+        
+        result = {
+            "success": True,
+            "pr_number": params.pr_number,
+            "head_sha": pr_data["head"]["sha"],
+            "stats": _pr_stats(entries, params.top_files),
+            "risk": _risk_score(entries, risk, churn),
+            "policy_source": loaded.source,
+        }
+        if params.response_format == ResponseFormat.JSON:
+            return json.dumps(result, indent=2)
+        return _stats_markdown(result)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_get_commit_diff")
+async def get_commit_diff(params: GetCommitDiffInput) -> str:
+    """Return one commit's diff in the same structure as github_pr_get_diff."""
+    try:
+        commits = await _fetch_pr_commits(params.owner, params.repo, params.pr_number)
+        commit = next((c for c in commits if c["sha"].startswith(params.sha)), None)
+        if commit is None:
+            raise ValueError(f"Commit {params.sha} is not part of PR #{params.pr_number}")
+        sha = commit["sha"]
+        endpoint = f"/repos/{params.owner}/{params.repo}/commits/{sha}"
+        
+        diff_response = await _github_api_response("GET", endpoint, headers={"Accept": "application/vnd.github.v3.diff"})
+        keep = _path_filter(params.include, params.exclude, params.path_scope)
+        sections = [
+            section for section in _split_diff_sections(_strip_binary_sections(diff_response.text))
+            if keep(section[0])
+        ]
+        sections, omitted_paths = _fit_diff_to_budget(sections, GITHUB_DIFF_MAX_CHARS, [])
+        
+        files = await _github_api_paginate(endpoint, items_key="files")
+        kept = [f for f in files if keep(f["filename"])]
+        parents = commit.get("parents", [])
+        result = {
+            "sha": sha,
+            "message": commit["commit"]["message"],
+            "is_merge": len(parents) > 1,
+            **await _describe_changed_files(
+                params.owner, params.repo, kept, omitted_paths, parents[0]["sha"] if parents else None, sha,
+                modes=_diff_modes(diff_response.text)
+            ),
+            "total_files_count": len(files),
+            "filtered_out_count": len(files) - len(kept),
+            "diff": "".join(text for _, text in sections),
+        }
+        return json.dumps(result, indent=2)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
 
-@mcp.tool(name="github_pr_analyze_code")
-async def analyze_code(params: AnalyzeCodeInput) -> str:
-    """Analyze Go code for quality issues using static analysis tools."""
-    file_path = Path(params.file_path)
+
+def _issue_comment_summary(comment: Dict[str, Any]) -> Dict[str, Any]:
+    """Reduce an issue comment to the fields the model needs."""
+    return {
+        "id": comment["id"],
+        "author": (comment.get("user") or {}).get("login"),
+        "author_association": comment.get("author_association"),
+        "created_at": comment.get("created_at"),
+        "updated_at": comment.get("updated_at"),
+        "body": comment.get("body", ""),
+        "html_url": comment.get("html_url"),
+    }
+
+
+@mcp.tool(name="github_pr_list_issue_comments")
+async def list_issue_comments(params: ListIssueCommentsInput, ctx: Context = None) -> str:
+    """
+    List the PR's general conversation comments, where authors often answer the bot.
     
-    if not file_path.exists():
-        return json.dumps({"error": f"Path not found: {params.file_path}", "success": False})
+    Each comment carries author_association so maintainer replies (OWNER,
+    MEMBER, COLLABORATOR) can be weighed more heavily. Comments are returned
+    page_size at a time; pass next_cursor to continue.
+    """
+    async def build() -> Dict[str, Any]:
+        query = {"since": params.since} if params.since else {}
+        comments = await _github_api_paginate(
+            f"/repos/{params.owner}/{params.repo}/issues/{params.pr_number}/comments", query
+        )
+        return {"pr_number": params.pr_number, "comments": [_issue_comment_summary(c) for c in comments]}
     
-    results = {}
+    try:
+        result = await _paginate_result(ctx, "list_issue_comments", params, build, ("comments",))
+        
+        if params.response_format == ResponseFormat.JSON:
+            return json.dumps(result, indent=2)
+        
+        markdown = f"# Conversation on PR #{params.pr_number}\n\n"
+        if not result["comments"]:
+            return markdown + "No comments."
+        for c in result["comments"]:
+            markdown += f"### {c['author']} ({c['author_association']}) — {c['created_at']}\n{c['body']}\n\n"
+        return markdown + _next_page_note(result)
+    except CursorError as e:
+        return _cursor_error_response(e)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_create_issue_comment")
+async def create_issue_comment(params: CreateIssueCommentInput) -> str:
+    """Post a comment on the PR's general conversation rather than on a line."""
+    try:
+        endpoint = f"/repos/{params.owner}/{params.repo}/issues/{params.pr_number}/comments"
+        if _dry_run(params):
+            return _dry_run_response([_planned_request("POST", endpoint, {"body": params.body})])
+        result = await _github_api_request("POST", endpoint, {"body": params.body})
+        METRICS.inc("github_pr_mcp_comments_posted_total", {"tool": "github_pr_create_issue_comment"})
+        return json.dumps({"success": True, "comment_id": result["id"], "html_url": result["html_url"]}, indent=2)
+    except RetryableError as e:
+        return _retryable_error_response(e)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_reply_to_review_comment")
+async def reply_to_review_comment(params: ReplyToReviewCommentInput) -> str:
+    """Reply within an inline review thread so the conversation stays in one place."""
+    try:
+        base = f"/repos/{params.owner}/{params.repo}/pulls"
+        comment = await _github_api_request("GET", f"{base}/comments/{params.comment_id}")
+        if not comment.get("pull_request_url", "").endswith(f"/pulls/{params.pr_number}"):
+            raise ValueError(f"Review comment {params.comment_id} does not belong to PR #{params.pr_number}")
+        # GitHub only accepts replies to a thread's first comment
+        in_reply_to = comment.get("in_reply_to_id") or comment["id"]
+        reply = {"body": params.body, "in_reply_to": in_reply_to}
+        if _dry_run(params):
+            return _dry_run_response([_planned_request("POST", f"{base}/{params.pr_number}/comments", reply)])
+        result = await _github_api_request("POST", f"{base}/{params.pr_number}/comments", reply)
+        METRICS.inc("github_pr_mcp_comments_posted_total", {"tool": "github_pr_reply_to_review_comment"})
+        return json.dumps({
+            "success": True,
+            "comment_id": result["id"],
+            "in_reply_to": in_reply_to,
+            "html_url": result["html_url"],
+        }, indent=2)
+    except RetryableError as e:
+        return _retryable_error_response(e)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_upsert_summary_comment")
+async def upsert_summary_comment(params: UpsertSummaryCommentInput) -> str:
+    """
+    Post the review summary as a single PR comment, editing it on later runs.
     
-    if params.analysis_type in ["lint", "all"]:
-        results["lint"] = _run_command(
-            ["golangci-lint", "run", "--out-format", "colored-line-number", str(file_path)],
-            cwd=str(file_path.parent) if file_path.is_file() else str(file_path)
+    The comment is found by a hidden marker and the bot's login, so re-reviews
+    replace the old summary instead of adding another one. If the comment was
+    deleted, a new one is created.
+    """
+    try:
+        result = await _upsert_summary_comment(
+            params.owner, params.repo, params.pr_number, params.body, params.history_limit, params.head_sha,
+            _dry_run(params)
         )
+        if "planned_request" in result:
+            return _dry_run_response([result.pop("planned_request")], **result)
+        METRICS.inc("github_pr_mcp_comments_posted_total", {"tool": "github_pr_upsert_summary_comment"})
+        return json.dumps({"success": True, **result}, indent=2)
+    except RetryableError as e:
+        return _retryable_error_response(e)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+def _strip_markers(body: Optional[str]) -> str:
+    """Remove the hidden review markers from a comment body."""
+    return _DATA_MARKER.sub("", (body or "").replace(REVIEW_COMMENT_MARKER, "")).strip()
+
+
+def _history_finding(comment: Dict[str, Any]) -> Dict[str, Any]:
+    """Recover a finding from one of the bot's inline comments."""
+    data = _parse_data_marker(comment.get("body"), FINDING_DATA_MARKER)
+    return {
+        "path": comment.get("path"),
+        "line": comment.get("line") or comment.get("original_line"),
+        "severity": (data or {}).get("severity"),
+        "category": (data or {}).get("category"),
+        "rule": (data or {}).get("rule"),
+        "structured": data is not None,
+        "body": _strip_markers(comment.get("body")),
+        "html_url": comment.get("html_url"),
+    }
+
+
+def _summary_runs(comment: Dict[str, Any]) -> List[Dict[str, Any]]:
+    """Split the bot's summary comment into one run for the current summary and one per kept earlier run."""
+    current, history = _parse_summary_comment(comment.get("body") or "")
+    texts = [(comment.get("updated_at") or comment.get("created_at"), current)]
+    for run in history:
+        # Earlier runs are stamped "**<timestamp>**" when they are moved into the history
+        stamp = re.match(r"\*\*(.+?)\*\*\s*", run)
+        texts.append((stamp.group(1), run[stamp.end():]) if stamp else (None, run))
+    return [
+        {
+            "kind": "summary",
+            "at": at,
+            "head_sha": (_parse_data_marker(text, SUMMARY_HEAD_MARKER) or {}).get("head_sha"),
+            "verdict": None,
+            "structured": True,
+            "comment_id": comment["id"],
+            "html_url": comment.get("html_url"),
+            "text": _strip_markers(text),
+        }
+        for at, text in texts
+    ]
+
+
+async def _review_history(owner: str, repo: str, pr_number: int) -> List[Dict[str, Any]]:
+    """
+    Collect the authenticated account's reviews, inline comments and summary comments on a PR as runs, oldest first.
     
-    if params.analysis_type in ["fmt", "all"]:
-        results["fmt"] = _run_command(["gofmt", "-l", str(file_path)])
+    Reviews carry their verdict and findings, recovered from the hidden
+    markers. A review posted without REVIEW_DATA_MARKER (by an older version,
+    or by hand) counts its findings from the inline comments instead, and
+    conversation comments without the summary marker are listed as
+    unstructured "comment" runs.
+    """
+    login = await _authenticated_login()
+    base = f"/repos/{owner}/{repo}"
+    reviews, review_comments, issue_comments = await asyncio.gather(
+        _github_api_paginate(f"{base}/pulls/{pr_number}/reviews"),
+        _github_api_paginate(f"{base}/pulls/{pr_number}/comments"),
+        _github_api_paginate(f"{base}/issues/{pr_number}/comments"),
+    )
+    comments_by_review: Dict[int, List[Dict[str, Any]]] = {}
+    for comment in review_comments:
+        if _login_matches(comment.get("user"), login):
+            comments_by_review.setdefault(comment.get("pull_request_review_id"), []).append(comment)
     
-    if params.analysis_type in ["vet", "all"]:
-        results["vet"] = _run_command(
-            ["go", "vet", str(file_path)],
-            cwd=str(file_path.parent) if file_path.is_file() else str(file_path)
+    runs: List[Dict[str, Any]] = []
+    for review in reviews:
+        if not _login_matches(review.get("user"), login) or review.get("state") == "PENDING":
+            continue
+        data = _parse_data_marker(review.get("body"), REVIEW_DATA_MARKER)
+        findings = [_history_finding(c) for c in comments_by_review.get(review["id"], [])]
+        # The marker also counts findings that were duplicates or only listed in the body
+        counts = data["findings"] if data else dict(Counter(f["severity"] or "unknown" for f in findings))
+        runs.append({
+            "kind": "review",
+            "at": review.get("submitted_at"),
+            "head_sha": (data or {}).get("head_sha") or review.get("commit_id"),
+            "verdict": review.get("state"),
+            "structured": data is not None,
+            "review_id": review["id"],
+            "html_url": review.get("html_url"),
+            "finding_counts": counts,
+            "findings": findings,
+            "text": _strip_markers(review.get("body")),
+        })
+    for comment in issue_comments:
+        if not _login_matches(comment.get("user"), login):
+            continue
+        if SUMMARY_COMMENT_MARKER in (comment.get("body") or ""):
+            runs.extend(_summary_runs(comment))
+        else:
+            runs.append({
+                "kind": "comment",
+                "at": comment.get("created_at"),
+                "head_sha": None,
+                "verdict": None,
+                "structured": False,
+                "comment_id": comment["id"],
+                "html_url": comment.get("html_url"),
+                "text": _strip_markers(comment.get("body")),
+            })
+    return sorted(runs, key=lambda run: run["at"] or "")
+
+
+def _history_run_markdown(run: Dict[str, Any]) -> str:
+    """Render one run of a PR's review history."""
+    heading = f"### {run['at'] or 'unknown time'} — {run['kind']}"
+    if run["verdict"]:
+        heading += f", {run['verdict']}"
+    if run["head_sha"]:
+        heading += f" at `{run['head_sha'][:7]}`"
+    markdown = heading + "\n\n"
+    if not run["structured"]:
+        markdown += "_Posted without markers; shown as is._\n\n"
+    if run["kind"] == "review":
+        counts = ", ".join(f"{n} {severity}" for severity, n in sorted(run["finding_counts"].items()))
+        markdown += f"**Findings:** {counts or 'none'}\n"
+        for f in run["findings"]:
+            severity = f"[{f['severity']}] " if f["severity"] else ""
+            markdown += f"- `{f['path']}:{f['line']}` {severity}{f['body'].splitlines()[0] if f['body'] else ''}\n"
+        return markdown
+    first = run["text"].splitlines()[0] if run["text"] else ""
+    return markdown + f"> {first}\n"
+
+
+@mcp.tool(name="github_pr_get_review_history")
+async def get_review_history(params: GetReviewHistoryInput, ctx: Context = None) -> str:
+    """
+    List everything the authenticated account posted on a PR, as runs in chronological order.
+    
+    Each review run gives its verdict, reviewed head SHA, finding counts by
+    severity and the inline findings with severity and rule. Summary comment
+    runs include the earlier summaries kept in its history. Comments posted
+    without markers are included with structured set to false.
+    """
+    async def build() -> Dict[str, Any]:
+        return {
+            "pr_number": params.pr_number,
+            "runs": await _review_history(params.owner, params.repo, params.pr_number),
+        }
+    
+    try:
+        result = await _paginate_result(ctx, "get_review_history", params, build, ("runs",))
+        
+        if params.response_format == ResponseFormat.JSON:
+            return json.dumps(result, indent=2)
+        
+        markdown = f"# Review History for PR #{params.pr_number}\n\n"
+        if not result["runs"]:
+            return markdown + "Nothing posted by this account."
+        return markdown + "\n".join(_history_run_markdown(run) for run in result["runs"]) + _next_page_note(result)
+    except CursorError as e:
+        return _cursor_error_response(e)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+def _reaction_feedback(comments: List[Dict[str, Any]], login: str) -> List[Dict[str, Any]]:
+    """
+    Tally 👍 and 👎 on the bot's finding comments per rule, most disliked first.
+    
+    Only thread-opening comments with REVIEW_COMMENT_MARKER count; the rule
+    comes from the finding marker and is None for comments posted without one.
+    """
+    tally: Dict[Optional[str], Dict[str, Any]] = {}
+    for comment in comments:
+        body = comment.get("body") or ""
+        if comment.get("in_reply_to_id") or REVIEW_COMMENT_MARKER not in body or not _login_matches(comment.get("user"), login):
+            continue
+        rule = (_parse_data_marker(body, FINDING_DATA_MARKER) or {}).get("rule")
+        entry = tally.setdefault(rule, {"rule": rule, "comments": 0, "up": 0, "down": 0})
+        reactions = comment.get("reactions") or {}
+        entry["comments"] += 1
+        entry["up"] += reactions.get("+1", 0)
+        entry["down"] += reactions.get("-1", 0)
+    return sorted(tally.values(), key=lambda e: (-e["down"], e["rule"] or ""))
+
+
+@mcp.tool(name="github_pr_get_comment_reactions")
+async def get_comment_reactions(params: GetCommentReactionsInput) -> str:
+    """
+    Tally the 👍 and 👎 reactions to the bot's review comments on a PR, per rule.
+    
+    Each rule gets its comment count and up and down votes, for tuning which
+    rules are worth reporting. The counts include everyone's reactions, read
+    from each comment's reaction rollup.
+    """
+    try:
+        login = await _authenticated_login()
+        comments = await _github_api_paginate(f"/repos/{params.owner}/{params.repo}/pulls/{params.pr_number}/comments")
+        rules = _reaction_feedback(comments, login)
+        totals = {key: sum(r[key] for r in rules) for key in ("comments", "up", "down")}
+        if params.response_format == ResponseFormat.JSON:
+            return json.dumps({"success": True, "pr_number": params.pr_number, "rules": rules, "totals": totals}, indent=2)
+        
+        markdown = f"# Reactions to Review Comments on PR #{params.pr_number}\n\n"
+        if not rules:
+            return markdown + "No review comments by this account."
+        markdown += "| Rule | Comments | 👍 | 👎 |\n|------|----------|----|----|\n"
+        for r in rules:
+            rule = f"`{r['rule']}`" if r["rule"] else "_no rule_"
+            markdown += f"| {rule} | {r['comments']} | {r['up']} | {r['down']} |\n"
+        return markdown + f"\n**Total:** {totals['comments']} comments, {totals['up']} 👍, {totals['down']} 👎\n"
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_add_reaction")
+async def add_reaction(params: AddReactionInput) -> str:
+    """
+    React to a review or conversation comment on a PR.
+    
+    Acknowledging an author's reply with 👍 spares everyone an
+    "acknowledged" comment. Adding a reaction the account already left
+    changes nothing and reports already_reacted.
+    """
+    try:
+        base = f"/repos/{params.owner}/{params.repo}"
+        if params.comment_type == "review":
+            endpoint, parent, suffix = f"{base}/pulls/comments/{params.comment_id}", "pull_request_url", "pulls"
+        else:
+            endpoint, parent, suffix = f"{base}/issues/comments/{params.comment_id}", "issue_url", "issues"
+        comment = await _github_api_request("GET", endpoint)
+        if not comment.get(parent, "").endswith(f"/{suffix}/{params.pr_number}"):
+            raise ValueError(f"Comment {params.comment_id} does not belong to PR #{params.pr_number}")
+        reaction = {"content": params.content}
+        if _dry_run(params):
+            return _dry_run_response([_planned_request("POST", f"{endpoint}/reactions", reaction)])
+        response = await _github_api_response("POST", f"{endpoint}/reactions", reaction)
+        result = response.json()
+        return json.dumps({
+            "success": True,
+            "reaction_id": result["id"],
+            "content": result["content"],
+            # GitHub answers 200 instead of 201 when the reaction was already there
+            "already_reacted": response.status_code == 200,
+        }, indent=2)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+def _label_summary(label: Dict[str, Any]) -> Dict[str, Any]:
+    """Reduce a label object to the fields the model needs."""
+    return {"name": label["name"], "color": label.get("color"), "description": label.get("description")}
+
+
+@mcp.tool(name="github_pr_list_labels")
+async def list_labels(params: ListLabelsInput) -> str:
+    """List the labels currently applied to a PR."""
+    try:
+        labels = await _github_api_paginate(
+            f"/repos/{params.owner}/{params.repo}/issues/{params.pr_number}/labels"
         )
+        return json.dumps({"success": True, "labels": [_label_summary(l) for l in labels]}, indent=2)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_add_labels")
+async def add_labels(params: AddLabelsInput) -> str:
+    """
+    Add labels to a PR, optionally creating any the repository lacks.
     
-    if params.response_format == ResponseFormat.JSON:
-        return json.dumps(results, indent=2)
-    return _format_markdown_analysis(results)
+    Labels are looked up first so that a typo fails loudly instead of
+    GitHub silently creating a stray label with a default color.
+    """
+    try:
+        repo_endpoint = f"/repos/{params.owner}/{params.repo}"
+        missing = []
+        for name in params.labels:
+            try:
+                await _github_api_request("GET", f"{repo_endpoint}/labels/{quote(name, safe='')}")
+            except httpx.HTTPStatusError as e:
+                if e.response.status_code != 404:
+                    raise
+                missing.append(name)
+        if missing and not params.create_if_missing:
+            raise ValueError(
+                f"Labels do not exist in {params.owner}/{params.repo}: {', '.join(missing)}; "
+                "set create_if_missing to create them"
+            )
+        planned = []
+        for name in missing:
+            label = {"name": name, "color": params.color.lower()}
+            if params.description:
+                label["description"] = params.description
+            planned.append(_planned_request("POST", f"{repo_endpoint}/labels", label))
+        planned.append(_planned_request("POST", f"{repo_endpoint}/issues/{params.pr_number}/labels", {"labels": params.labels}))
+        if _dry_run(params):
+            return _dry_run_response(planned, created=missing)
+        
+        for request in planned[:-1]:
+            await _github_api_request(request["method"], request["endpoint"], request["body"])
+        labels = await _github_api_request(planned[-1]["method"], planned[-1]["endpoint"], planned[-1]["body"])
+        return json.dumps({
+            "success": True,
+            "created": missing,
+            "labels": [_label_summary(l) for l in labels],
+        }, indent=2)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_remove_labels")
+async def remove_labels(params: RemoveLabelsInput) -> str:
+    """Remove labels from a PR; labels that are not applied are skipped."""
+    try:
+        endpoint = f"/repos/{params.owner}/{params.repo}/issues/{params.pr_number}/labels"
+        if _dry_run(params):
+            # Unlike a real removal, labels that are not applied are only found by looking
+            applied = {label["name"] for label in await _github_api_paginate(endpoint)}
+            return _dry_run_response(
+                [_planned_request("DELETE", f"{endpoint}/{quote(name, safe='')}") for name in params.labels if name in applied],
+                not_present=[name for name in params.labels if name not in applied]
+            )
+        removed, not_present = [], []
+        for name in params.labels:
+            try:
+                await _github_api_request("DELETE", f"{endpoint}/{quote(name, safe='')}")
+                removed.append(name)
+            except httpx.HTTPStatusError as e:
+                if e.response.status_code != 404:
+                    raise
+                not_present.append(name)
+        return json.dumps({"success": True, "removed": removed, "not_present": not_present}, indent=2)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+# Closing keywords GitHub recognizes in a PR body: "Fixes #12", "closes owner/repo#3" or an issue URL
+_CLOSING_KEYWORD = re.compile(
+    r"\b(?:close[sd]?|fix(?:e[sd])?|resolve[sd]?):?\s+"
+    r"(?:(?P<owner>[\w.-]+)/(?P<repo>[\w.-]+)#|https?://(?P<host>[^/\s]+)/(?P<url_owner>[\w.-]+)/(?P<url_repo>[\w.-]+)/issues/|#)"
+    r"(?P<number>\d+)\b",
+    re.IGNORECASE
+)
+
+_CLOSING_ISSUES_QUERY = """
+query($owner: String!, $repo: String!, $number: Int!, $first: Int!) {
+  repository(owner: $owner, name: $repo) {
+    pullRequest(number: $number) {
+      closingIssuesReferences(first: $first) {
+        nodes {
+          number title state body url
+          repository { name owner { login } }
+          labels(first: 20) { nodes { name } }
+        }
+      }
+    }
+  }
+}
+"""
+
+
+def _closing_references(body: Optional[str], owner: str, repo: str) -> List[Tuple[str, str, int]]:
+    """(owner, repo, number) of each issue a PR body closes with a keyword, in order and without repeats."""
+    references: List[Tuple[str, str, int]] = []
+    for match in _CLOSING_KEYWORD.finditer(body or ""):
+        if match.group("host") and match.group("host").lower() != _github_web_host():
+            continue
+        ref_owner = match.group("owner") or match.group("url_owner") or owner
+        ref_repo = match.group("repo") or match.group("url_repo") or repo
+        reference = (ref_owner, ref_repo, int(match.group("number")))
+        if reference not in references:
+            references.append(reference)
+    return references
+
+
+def _linked_issue_entry(
+    owner: str, repo: str, number: int, title: str, state: str, labels: List[str], body: Optional[str], url: str
+) -> Dict[str, Any]:
+    return {
+        "repository": f"{owner}/{repo}",
+        "number": number,
+        "title": title,
+        "state": state.lower(),
+        "labels": labels,
+        "body": _truncate(body or "", LINKED_ISSUE_BODY_CHARS),
+        "html_url": url,
+        "sources": [],
+    }
+
+
+async def _linked_issues(owner: str, repo: str, pr_number: int, body: Optional[str]) -> List[Dict[str, Any]]:
+    """
+    The issues a PR says it resolves, with their titles, labels and descriptions.
+    
+    They come from GitHub's closingIssuesReferences, which also has issues
+    linked by hand in the sidebar ("linked" in sources), and from closing
+    keywords in the body ("keyword"), which can name issues GitHub will
+    not close, such as ones in other repositories when the PR does not
+    target the default branch. Without GraphQL access only the body is used.
+    """
+    found: Dict[Tuple[str, str, int], Dict[str, Any]] = {}
+    try:
+        data = await _github_graphql(
+            _CLOSING_ISSUES_QUERY, {"owner": owner, "repo": repo, "number": pr_number, "first": LINKED_ISSUES_MAX}
+        )
+        for node in data["repository"]["pullRequest"]["closingIssuesReferences"]["nodes"]:
+            issue_owner, issue_repo = node["repository"]["owner"]["login"], node["repository"]["name"]
+            entry = _linked_issue_entry(
+                issue_owner, issue_repo, node["number"], node["title"], node["state"],
+                [label["name"] for label in node["labels"]["nodes"]], node.get("body"), node["url"]
+            )
+            entry["sources"].append("linked")
+            found[(issue_owner.lower(), issue_repo.lower(), node["number"])] = entry
+    except (GitHubGraphQLError, httpx.HTTPStatusError) as e:
+        logger.warning("Could not read the linked issues of %s/%s#%d over GraphQL: %s", owner, repo, pr_number, e)
+    
+    for ref_owner, ref_repo, number in _closing_references(body, owner, repo)[:LINKED_ISSUES_MAX]:
+        key = (ref_owner.lower(), ref_repo.lower(), number)
+        if key not in found:
+            try:
+                issue = await _github_api_request("GET", f"/repos/{ref_owner}/{ref_repo}/issues/{number}")
+            except httpx.HTTPStatusError as e:
+                if e.response.status_code not in (403, 404, 410):
+                    raise
+                found[key] = {"repository": f"{ref_owner}/{ref_repo}", "number": number,
+                              "error": _github_error_message(e), "sources": []}
+            else:
+                # Closing keywords only close issues; a PR named this way is left alone
+                if "pull_request" in issue:
+                    continue
+                found[key] = _linked_issue_entry(
+                    ref_owner, ref_repo, number, issue["title"], issue["state"],
+                    [label["name"] for label in issue.get("labels", [])], issue.get("body"), issue["html_url"]
+                )
+        found[key]["sources"].append("keyword")
+    return list(found.values())
+
+
+def _pr_context_markdown(result: Dict[str, Any]) -> str:
+    """The milestone, assignees and linked issues lines under a PR heading, each left out when empty."""
+    markdown = ""
+    milestone = result["milestone"]
+    if milestone:
+        state = f" ({milestone['state']})" if milestone.get("state") else ""
+        markdown += f"**Milestone:** {milestone['title']}{state}\n"
+    if result["assignees"]:
+        markdown += f"**Assignees:** {', '.join(result['assignees'])}\n"
+    issues = [
+        f"{issue['repository']}#{issue['number']}" + (f" {issue['title']} ({issue['state']})" if "title" in issue else "")
+        for issue in result["linked_issues"]
+    ]
+    if issues:
+        markdown += f"**Linked issues:** {'; '.join(issues)}\n"
+    return markdown
+
+
+def _milestone_summary(milestone: Optional[Dict[str, Any]]) -> Optional[Dict[str, Any]]:
+    """Reduce a milestone object to the fields the model needs."""
+    if not milestone:
+        return None
+    return {
+        "number": milestone["number"],
+        "title": milestone["title"],
+        "state": milestone.get("state"),
+        "due_on": milestone.get("due_on"),
+        "html_url": milestone.get("html_url"),
+    }
+
+
+@mcp.tool(name="github_pr_set_milestone")
+async def set_milestone(params: SetMilestoneInput) -> str:
+    """
+    Put a PR in a milestone, or take it out of its milestone.
+    
+    The milestone is looked up first; an unknown number fails with the
+    repository's open milestones, so the right one can be picked.
+    """
+    try:
+        repo_endpoint = f"/repos/{params.owner}/{params.repo}"
+        if params.milestone is not None:
+            try:
+                await _github_api_request("GET", f"{repo_endpoint}/milestones/{params.milestone}")
+            except httpx.HTTPStatusError as e:
+                if e.response.status_code != 404:
+                    raise
+                milestones = await _github_api_paginate(f"{repo_endpoint}/milestones", {"state": "open"})
+                listing = ", ".join(f"{m['number']} ({m['title']})" for m in milestones) or "none"
+                return json.dumps({
+                    "error": f"Milestone {params.milestone} does not exist in {params.owner}/{params.repo}; "
+                             f"open milestones: {listing}",
+                    "milestones": [_milestone_summary(m) for m in milestones],
+                    "success": False
+                }, indent=2)
+        planned = _planned_request("PATCH", f"{repo_endpoint}/issues/{params.pr_number}", {"milestone": params.milestone})
+        if _dry_run(params):
+            return _dry_run_response([planned])
+        
+        issue = await _github_api_request(planned["method"], planned["endpoint"], planned["body"])
+        return json.dumps({"success": True, "milestone": _milestone_summary(issue.get("milestone"))}, indent=2)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_add_assignees")
+async def add_assignees(params: AddAssigneesInput) -> str:
+    """
+    Assign users to a PR, keeping its current assignees.
+    
+    GitHub skips users who cannot be assigned (without access to the
+    repository) instead of failing, so they are reported in not_assigned.
+    """
+    try:
+        endpoint = f"/repos/{params.owner}/{params.repo}/issues/{params.pr_number}/assignees"
+        planned = _planned_request("POST", endpoint, {"assignees": params.assignees})
+        if _dry_run(params):
+            return _dry_run_response([planned])
+        
+        issue = await _github_api_request(planned["method"], planned["endpoint"], planned["body"])
+        assigned = [a["login"] for a in issue.get("assignees", [])]
+        lowered = {login.lower() for login in assigned}
+        return json.dumps({
+            "success": True,
+            "assignees": assigned,
+            "not_assigned": [login for login in params.assignees if login.lower() not in lowered],
+        }, indent=2)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+_BRANCH_PROTECTION_MESSAGE = re.compile(
+    r"required|protected branch|rule violation|approving review|status check", re.IGNORECASE
+)
+
+
+def _merge_error_code(error: httpx.HTTPStatusError) -> Optional[str]:
+    """Classify a failed merge so the client can retry, re-review or give up."""
+    status, message = error.response.status_code, _github_error_message(error)
+    if status == 409:
+        return "head_mismatch"
+    if status == 405:
+        if "base branch was modified" in message.lower():
+            return "base_modified"
+        if _BRANCH_PROTECTION_MESSAGE.search(message):
+            return "branch_protection"
+        return "not_mergeable"
+    if status == 403:
+        return "forbidden"
+    if status == 422:
+        return "invalid_request"
+    return None
+
+
+@mcp.tool(name="github_pr_merge")
+async def merge_pr(params: MergePRInput) -> str:
+    """
+    Merge a PR, but only at the head SHA that was reviewed.
+    
+    Failures carry an error_code: "head_mismatch" (new commits; re-review),
+    "base_modified" (retry), "branch_protection" (checks or approvals
+    missing), "not_mergeable" (e.g. conflicts), "forbidden" or
+    "invalid_request" (e.g. the merge method is disabled).
+    """
+    try:
+        merge = {"merge_method": params.merge_method, "sha": params.expected_head_sha}
+        if params.commit_title:
+            merge["commit_title"] = params.commit_title
+        if params.commit_message:
+            merge["commit_message"] = params.commit_message
+        endpoint = f"/repos/{params.owner}/{params.repo}/pulls/{params.pr_number}/merge"
+        if _dry_run(params):
+            return _dry_run_response([_planned_request("PUT", endpoint, merge)])
+        try:
+            result = await _github_api_request("PUT", endpoint, merge)
+        except httpx.HTTPStatusError as e:
+            code = _merge_error_code(e)
+            if code is None:
+                raise
+            return json.dumps({
+                "error": _github_error_message(e),
+                "error_code": code,
+                "status_code": e.response.status_code,
+                "success": False
+            }, indent=2)
+        return json.dumps({
+            "success": True,
+            "merged": result.get("merged", False),
+            "sha": result.get("sha"),
+            "message": result.get("message"),
+        }, indent=2)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_update_branch")
+async def update_branch(params: UpdateBranchInput) -> str:
+    """
+    Merge the base branch into the PR branch and return the new head SHA.
+    
+    On a merge conflict nothing changes; the result has error_code
+    "merge_conflict" and the files changed on both sides.
+    """
+    try:
+        pr_data = await _fetch_pr(params.owner, params.repo, params.pr_number)
+        previous_sha = pr_data["head"]["sha"]
+        endpoint = f"/repos/{params.owner}/{params.repo}/pulls/{params.pr_number}/update-branch"
+        update = {"expected_head_sha": params.expected_head_sha or previous_sha}
+        if _dry_run(params):
+            return _dry_run_response([_planned_request("PUT", endpoint, update)], previous_sha=previous_sha)
+        try:
+            await _github_api_request("PUT", endpoint, update)
+        except httpx.HTTPStatusError as e:
+            if e.response.status_code != 422:
+                raise
+            message = _github_error_message(e)
+            if "conflict" in message.lower():
+                return json.dumps({
+                    "error": message,
+                    "error_code": "merge_conflict",
+                    "conflicting_files": await _conflicting_files(
+                        params.owner, params.repo, pr_data["base"]["ref"], previous_sha
+                    ),
+                    "success": False
+                }, indent=2)
+            if "expected head sha" in message.lower():
+                return json.dumps({"error": message, "error_code": "head_mismatch", "success": False}, indent=2)
+            raise
+        
+        # The endpoint only schedules the merge (202 Accepted)
+        pr_data, updated = await _poll_pr(
+            params.owner, params.repo, params.pr_number,
+            lambda pr: pr["head"]["sha"] != previous_sha, params.timeout_seconds
+        )
+        result = {
+            "success": True,
+            "updated": updated,
+            "previous_sha": previous_sha,
+            "head_sha": pr_data["head"]["sha"],
+        }
+        if not updated:
+            result["note"] = (
+                f"GitHub accepted the update but the head had not moved after {params.timeout_seconds:g} "
+                "seconds; fetch the PR again before reviewing"
+            )
+        return json.dumps(result, indent=2)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_get_mergeability")
+async def get_mergeability(params: GetMergeabilityInput) -> str:
+    """
+    Report whether a PR merges cleanly, waiting for GitHub to compute it.
+    
+    GitHub fills in mergeable lazily, so the PR is polled until
+    mergeable_state is known. For "dirty" PRs the conflicting files are
+    listed, so the review can start with what to resolve.
+    """
+    try:
+        pr_data, known = await _poll_pr(
+            params.owner, params.repo, params.pr_number,
+            lambda pr: pr.get("mergeable") is not None and pr.get("mergeable_state") not in (None, "unknown"),
+            params.timeout_seconds
+        )
+        base_ref, head_sha = pr_data["base"]["ref"], pr_data["head"]["sha"]
+        comparison = await _github_api_request(
+            "GET", f"/repos/{params.owner}/{params.repo}/compare/{base_ref}...{head_sha}"
+        )
+        result = {
+            "success": True,
+            "mergeable": pr_data.get("mergeable"),
+            "mergeable_state": pr_data.get("mergeable_state") or "unknown",
+            "ahead_by": comparison.get("ahead_by", 0),
+            "behind_by": comparison.get("behind_by", 0),
+            "conflicting_files": [],
+        }
+        if result["mergeable_state"] == "dirty":
+            result["conflicting_files"] = await _conflicting_files(
+                params.owner, params.repo, base_ref, head_sha, comparison
+            )
+        if not known:
+            result["note"] = (
+                f"GitHub had not finished computing mergeability after {params.timeout_seconds:g} seconds"
+            )
+        return json.dumps(result, indent=2)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_get_branch_protection")
+async def get_branch_protection(params: GetBranchProtectionInput) -> str:
+    """
+    Report the protection rules of a PR's base branch: required checks and reviews, and history settings.
+    
+    Reading the rules needs admin access to the repository; without it the
+    result has protected null and says so, rather than failing.
+    """
+    try:
+        pr_data = await _fetch_pr(params.owner, params.repo, params.pr_number)
+        protection = await _branch_protection(params.owner, params.repo, pr_data["base"]["ref"])
+        if params.response_format == ResponseFormat.JSON:
+            return json.dumps({"success": True, **protection}, indent=2)
+        return f"# Branch Protection for PR #{params.pr_number}\n\n" + _protection_markdown(protection)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_get_merge_readiness")
+async def get_merge_readiness(params: GetMergeReadinessInput) -> str:
+    """
+    Report which of the base branch's merge requirements a PR meets and which it does not.
+    
+    Required checks, approvals, change requests, code owner review,
+    conversation resolution and being up to date come from the branch
+    protection; conflicts and draft state apply to every PR. ready is null
+    when some requirement cannot be told, e.g. because the protection rules
+    are not readable. Failing checks that are not required are listed in
+    optional_failing_checks.
+    """
+    try:
+        pr_data, _ = await _poll_pr(
+            params.owner, params.repo, params.pr_number,
+            lambda pr: pr.get("mergeable") is not None and pr.get("mergeable_state") not in (None, "unknown"),
+            params.timeout_seconds
+        )
+        protection = await _branch_protection(params.owner, params.repo, pr_data["base"]["ref"])
+        checks = await _fetch_checks(params.owner, params.repo, pr_data["head"]["sha"], DEFAULT_CHECK_OUTPUT_CHARS)
+        reviews = _reviewer_states(
+            await _github_api_paginate(f"/repos/{params.owner}/{params.repo}/pulls/{params.pr_number}/reviews")
+        )
+        review_decision = None
+        if protection.get("required_reviews") and protection["required_reviews"]["code_owner_reviews"]:
+            try:
+                review_decision = (await _github_graphql(_REVIEW_DECISION_QUERY, {
+                    "owner": params.owner, "repo": params.repo, "number": params.pr_number
+                }))["repository"]["pullRequest"]["reviewDecision"]
+            except (GitHubGraphQLError, httpx.HTTPStatusError) as e:
+                logger.warning(
+                    "Could not read the review decision of %s/%s#%d: %s", params.owner, params.repo, params.pr_number, e
+                )
+        unresolved = None
+        if protection.get("required_conversation_resolution"):
+            threads = await _fetch_review_threads(params.owner, params.repo, params.pr_number)
+            unresolved = sum(1 for t in threads if not t["isResolved"])
+        
+        requirements = _merge_requirements(pr_data, protection, checks, reviews, review_decision, unresolved)
+        unmet = [r for r in requirements if r["met"] is False]
+        ready = False if unmet else None if any(r["met"] is None for r in requirements) else True
+        required = set((protection.get("required_status_checks") or {}).get("contexts", []))
+        optional_failing = [
+            c["name"] for c in checks["checks"] if c["conclusion"] in FAILED_CONCLUSIONS and c["name"] not in required
+        ]
+        result = {
+            "success": True,
+            "pr_number": params.pr_number,
+            "head_sha": pr_data["head"]["sha"],
+            "ready": ready,
+            "unmet": [r["requirement"] for r in unmet],
+            "requirements": requirements,
+            "optional_failing_checks": optional_failing,
+            "branch_protection": protection,
+        }
+        if params.response_format == ResponseFormat.JSON:
+            return json.dumps(result, indent=2)
+        
+        verdict = {True: "✅ ready to merge", False: "❌ not ready", None: "❔ unknown"}[ready]
+        markdown = f"# Merge Readiness for PR #{params.pr_number}\n\n**{verdict}**\n\n"
+        for r in requirements:
+            icon = {True: "✅", False: "❌", None: "❔"}[r["met"]]
+            markdown += f"- {icon} `{r['requirement']}`: {r['detail']}\n"
+        if optional_failing:
+            markdown += f"\nFailing but not required: {', '.join(f'`{n}`' for n in optional_failing)}\n"
+        return markdown
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+def _reviewer_states(reviews: List[Dict[str, Any]]) -> Dict[str, str]:
+    """Each reviewer's standing verdict; a later plain comment does not withdraw an approval or change request."""
+    states: Dict[str, str] = {}
+    for review in reviews:
+        login = (review.get("user") or {}).get("login")
+        if not login or review["state"] == "PENDING":
+            continue
+        if review["state"] != "COMMENTED" or states.get(login, "COMMENTED") == "COMMENTED":
+            states[login] = review["state"]
+    return states
+
+
+def _overview_markdown(overview: Dict[str, Any]) -> str:
+    markdown = f"# PR #{overview['pr_number']}: {overview['title']}\n\n"
+    draft = " (draft)" if overview["draft"] else ""
+    markdown += f"**State**: {overview['state']}{draft} · **Head**: `{overview['head_sha'][:7]}`\n"
+    if overview["labels"]:
+        markdown += f"**Labels**: {', '.join(overview['labels'])}\n"
+    markdown += "\n## Reviews\n\n"
+    if not overview["reviews"]:
+        markdown += "No reviews yet.\n"
+    for login, state in overview["reviews"].items():
+        markdown += f"- {login}: {state.lower().replace('_', ' ')}\n"
+    threads = overview["review_threads"]
+    markdown += f"\n## Threads\n\n{threads['unresolved']} of {threads['total']} unresolved"
+    markdown += f" ({threads['outdated']} outdated)\n" if threads["outdated"] else "\n"
+    checks = overview["checks"]
+    markdown += f"\n## Checks: {checks['state']}\n\n"
+    for name in checks["failing"]:
+        markdown += f"- ❌ {name}\n"
+    for name in checks["pending"]:
+        markdown += f"- ⏳ {name}\n"
+    return markdown
+
+
+@mcp.tool(name="github_pr_get_overview")
+async def get_overview(params: GetOverviewInput) -> str:
+    """
+    Summarize where a PR stands: reviewer verdicts, unresolved threads, labels and check runs.
+    
+    Everything comes from one PR snapshot, a single GraphQL request for
+    most PRs (see GITHUB_BULK_FETCH), so it suits checking many PRs in a
+    batch before deciding which to review.
+    """
+    try:
+        snapshot = await _fetch_pr_snapshot(params.owner, params.repo, params.pr_number)
+        pr_data, runs = snapshot.pr, snapshot.check_runs
+        threads = snapshot.review_threads
+        unresolved = [t for t in threads if not t["isResolved"]]
+        failing = [r["name"] for r in runs if r.get("conclusion") in FAILED_CONCLUSIONS]
+        pending = [r["name"] for r in runs if r["status"] != "completed"]
+        overview = {
+            "success": True,
+            "pr_number": params.pr_number,
+            "title": pr_data.get("title"),
+            "state": "merged" if pr_data.get("merged") else pr_data.get("state"),
+            "draft": pr_data.get("draft", False),
+            "author": (pr_data.get("user") or {}).get("login"),
+            "head_sha": pr_data["head"]["sha"],
+            "base_ref": pr_data["base"]["ref"],
+            "labels": [label["name"] for label in snapshot.labels],
+            "reviews": _reviewer_states(snapshot.reviews),
+            "review_threads": {
+                "total": len(threads),
+                "unresolved": len(unresolved),
+                "outdated": sum(1 for t in unresolved if t["isOutdated"]),
+            },
+            "checks": {
+                "state": "failure" if failing else "pending" if pending else "success" if runs else "none",
+                "total": len(runs),
+                "failing": failing,
+                "pending": pending,
+            },
+            "fetched_via": snapshot.fetched_via,
+        }
+        if params.response_format == ResponseFormat.JSON:
+            return json.dumps(overview, indent=2)
+        return _overview_markdown(overview)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
 
 
-@mcp.tool(name="github_pr_run_tests")
-async def run_tests(params: RunTestsInput) -> str:
-    """Run Go tests with optional coverage analysis."""
-    cmd = ["go", "test"]
-    if params.verbose:
-        cmd.append("-v")
-    if params.coverage:
-        cmd.extend(["-coverprofile=coverage.out", "-covermode=atomic"])
-    cmd.append(params.package_path)
+@mcp.tool(name="github_pr_update_description")
+async def update_pr_description(params: UpdatePRDescriptionInput) -> str:
+    """
+    Write a generated summary into the PR description.
     
-    test_result = _run_command(cmd)
+    In "section" mode only the text between the pr-reviewer:summary markers
+    is touched, so repeated runs update the same section in place.
+    """
+    try:
+        pr_data = await _fetch_pr(params.owner, params.repo, params.pr_number)
+        current = pr_data.get("body") or ""
+        if params.mode == "replace":
+            body = params.content
+        else:
+            body = _upsert_summary_section(current, params.content)
+        if body == current:
+            return json.dumps({"success": True, "changed": False, "html_url": pr_data.get("html_url")}, indent=2)
+        
+        endpoint = f"/repos/{params.owner}/{params.repo}/pulls/{params.pr_number}"
+        if _dry_run(params):
+            return _dry_run_response([_planned_request("PATCH", endpoint, {"body": body})], changed=True)
+        result = await _github_api_request("PATCH", endpoint, {"body": body})
+        return json.dumps({"success": True, "changed": True, "html_url": result.get("html_url")}, indent=2)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_export_sarif")
+async def export_sarif(params: ExportSarifInput) -> str:
+    """Convert findings to SARIF 2.1.0 and optionally upload them to GitHub code scanning."""
+    try:
+        document = _build_sarif(params.findings, params.tool_name)
+        result: Dict[str, Any] = {"success": True, "sarif": document}
+        if params.upload:
+            commit_sha = params.commit_sha
+            if not commit_sha:
+                pr_data = await _fetch_pr(params.owner, params.repo, params.pr_number)
+                commit_sha = pr_data["head"]["sha"]
+            endpoint = f"/repos/{params.owner}/{params.repo}/code-scanning/sarifs"
+            sarif_upload = {
+                "commit_sha": commit_sha,
+                "ref": params.ref or f"refs/pull/{params.pr_number}/head",
+                "sarif": _encode_sarif(document),
+                "tool_name": params.tool_name,
+            }
+            if _dry_run(params):
+                return _dry_run_response([_planned_request("POST", endpoint, sarif_upload)], sarif=document)
+            upload = await _github_api_request("POST", endpoint, sarif_upload)
+            result["upload"] = {"id": upload.get("id"), "url": upload.get("url"), "commit_sha": commit_sha}
+        return json.dumps(result, indent=2)
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_get_review_policy")
+async def get_review_policy(params: GetReviewPolicyInput) -> str:
+    """
+    Show the review policy in effect for a repository: excluded paths, rules and review events.
     
-    if params.coverage and test_result["success"]:
-        coverage_result = _run_command(["go", "tool", "cover", "-func=coverage.out"])
-        test_result["coverage"] = coverage_result["stdout"]
+    The policy comes from .github/pr-reviewer.yml on the default branch, or the
+    server default. With a pr_number, the PR is also checked against the size
+    limit and test requirements.
+    """
+    try:
+        loaded = await _load_review_policy(params.owner, params.repo)
+        result: Dict[str, Any] = {
+            "success": True,
+            "source": loaded.source,
+            "path": loaded.path,
+            "ref": loaded.ref,
+            "policy": loaded.policy.model_dump(exclude_none=True),
+            "warnings": [w.to_review_finding() for w in loaded.warnings],
+        }
+        if params.pr_number is not None:
+            diffs = await _fetch_file_diffs(params.owner, params.repo, params.pr_number)
+            violations = _policy_violations(loaded.policy, list(diffs.values()))
+            result["violations"] = violations
+            result["review_event"] = loaded.policy.review_event([v["severity"] for v in violations])
+        if params.response_format == ResponseFormat.JSON:
+            return json.dumps(result, indent=2)
+        
+        policy = loaded.policy
+        where = f"`{loaded.path}`" + (f" on `{loaded.ref}`" if loaded.ref else "") if loaded.path else "no policy file"
+        markdown = f"# Review Policy for {params.owner}/{params.repo}\n\nSource: {loaded.source} ({where})\n\n"
+        for warning in loaded.warnings:
+            markdown += f"⚠️ {warning.message}\n\n"
+        if policy.exclude:
+            markdown += "**Excluded:** " + ", ".join(f"`{p}`" for p in policy.exclude) + "\n\n"
+        if policy.rules:
+            markdown += "## Rules (last match wins)\n\n"
+            for rule in policy.rules:
+                parts = [f"`{', '.join(rule.paths)}`"]
+                if rule.findings:
+                    parts.append(f"findings {', '.join(rule.findings)}")
+                if rule.severity:
+                    parts.append(f"severity **{rule.severity}**")
+                if rule.require_tests:
+                    parts.append("requires tests")
+                markdown += "- " + ", ".join(parts) + (f" — {rule.description}" if rule.description else "") + "\n"
+            markdown += "\n"
+        if policy.max_pr_size:
+            limit = policy.max_pr_size
+            bounds = [f"{limit.files} files" if limit.files else None,
+                      f"{limit.changed_lines} changed lines" if limit.changed_lines else None]
+            markdown += f"**Max PR size:** {', '.join(b for b in bounds if b)} ({limit.severity})\n\n"
+        if policy.risk.hot_paths:
+            markdown += f"**Hot paths:** {', '.join(f'`{g}`' for g in policy.risk.hot_paths)}\n\n"
+        if policy.spelling.words:
+            markdown += f"**Spelling dictionary:** {_plural(len(policy.spelling.words), 'word')}\n\n"
+        if policy.licenses.allow or policy.licenses.deny:
+            bounds = [f"allow {', '.join(f'`{p}`' for p in policy.licenses.allow)}" if policy.licenses.allow else None,
+                      f"deny {', '.join(f'`{p}`' for p in policy.licenses.deny)}" if policy.licenses.deny else None]
+            markdown += f"**Dependency licenses:** {'; '.join(b for b in bounds if b)}\n\n"
+        if policy.lightweight_authors:
+            markdown += f"**Lightweight review for:** {', '.join(f'`{a}`' for a in policy.lightweight_authors)}\n\n"
+        markdown += "**Review events:** " + ", ".join(
+            f"{level} → {event}" for level, event in policy.review_events.items()
+        ) + "\n"
+        if "violations" in result:
+            markdown += f"\n## PR #{params.pr_number}\n\n"
+            if not result["violations"]:
+                markdown += "No policy violations.\n"
+            for v in result["violations"]:
+                markdown += f"- **{v['severity']}** `{v['rule']}`: {v['message']}\n"
+        return markdown
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
+
+
+@mcp.tool(name="github_pr_render_preview")
+async def render_preview(params: RenderPreviewInput) -> str:
+    """
+    Render the comment templates against sample data, without posting anything.
     
-    if params.response_format == ResponseFormat.JSON:
-        return json.dumps(test_result, indent=2)
-    return _format_test_results_markdown(test_result, params.coverage)
+    The templates are the server's, overlaid with the repository's from
+    .github/pr-reviewer/templates/ when owner and repo are given, then with
+    any passed in templates, so a team can iterate on a template before
+    committing it. Problems are reported by file and line. The hidden
+    markers the server adds to what it posts are not shown.
+    """
+    try:
+        if params.owner is not None:
+            templates = await _load_review_templates(params.owner, params.repo)
+            loaded = await _load_review_policy(params.owner, params.repo)
+        else:
+            templates, loaded = _server_template_set(), _server_default_policy()
+        if params.templates:
+            templates = templates.overlay(
+                {f"{name}{REVIEW_TEMPLATE_SUFFIX}": text for name, text in params.templates.items()}
+            )
+        names = [params.name] if params.name else [
+            "summary", templates.review_template(params.event), "inline_comment", "suggestion", "sweep_reply"
+        ]
+        rendered = []
+        for name in names:
+            if name not in templates.templates:
+                templates.errors.append(f"{name}{REVIEW_TEMPLATE_SUFFIX}: not defined; review is used instead")
+                continue
+            data = _sample_template_data(name, _template_policy(loaded))
+            if name.startswith("review"):
+                data["Run"]["Event"] = params.event
+            try:
+                text = templates.render(name, data)
+            except TemplateError as e:
+                templates.errors.append(str(e))
+                continue
+            rendered.append({"name": name, "source": templates.templates[name].source, "text": text})
+        result = {"success": True, "rendered": rendered, "errors": templates.errors}
+        if params.response_format == ResponseFormat.JSON:
+            return json.dumps(result, indent=2)
+        
+        markdown = "# Template Preview\n\nRendered against sample data; nothing was posted.\n"
+        for r in rendered:
+            # Four backticks, so the suggestion fence inside shows as text
+            markdown += f"\n## {r['name']} ({r['source']})\n\n````markdown\n{r['text']}\n````\n"
+        if result["errors"]:
+            markdown += "\n## Errors\n\n" + "".join(f"- {e}\n" for e in result["errors"])
+        return markdown
+    except Exception as e:
+        return json.dumps({"error": str(e), "success": False})
 
 
-@mcp.tool(name="github_pr_get_diff")
-async def get_pr_diff(params: GetPRDiffInput) -> str:
-    """Fetch the diff for a GitHub pull request."""
+@mcp.tool(name="github_pr_compare_refs")
+async def compare_refs(params: CompareRefsInput) -> str:
+    """
+    Diff two refs (branches, tags or SHAs), e.g. everything between v1.4.0 and main.
+    
+    The result has the same diff and file structure as github_pr_get_diff, so
+    the same analysis applies. There is no pull request behind it, so it is
+    marked comment_addressable: false and review comment tools reject it.
+    """
     try:
-        endpoint = f"/repos/{params.owner}/{params.repo}/pulls/{params.pr_number}"
-        pr_data = await _github_api_request("GET", endpoint)
+        comparison = await _fetch_comparison(params.owner, params.repo, params.base, params.head)
+        merge_base = comparison.get("merge_base_commit", {}).get("sha")
+        head_sha = comparison["commits"][-1]["sha"] if comparison.get("commits") else merge_base
         
-        async with httpx.AsyncClient(follow_redirects=True) as client:
-            diff_response = await client.get(
-                pr_data["diff_url"],
-                headers={"Accept": "application/vnd.github.v3.diff"}
-            )
-            diff_response.raise_for_status()
-            diff_content = diff_response.text
+        diff_response = await _github_api_response(
+            "GET", _compare_endpoint(params.owner, params.repo, params.base, params.head),
+            headers={"Accept": "application/vnd.github.v3.diff"}
+        )
+        keep = _path_filter(params.include, params.exclude, params.path_scope)
+        sections = [
+            section for section in _split_diff_sections(_strip_binary_sections(diff_response.text))
+            if keep(section[0])
+        ]
+        budget = GITHUB_DIFF_MAX_CHARS if params.max_diff_chars is None else params.max_diff_chars
+        sections, omitted_paths = _fit_diff_to_budget(sections, budget, params.prioritize)
         
-        go_files = _parse_diff_for_go_files(diff_content)
+        files = comparison.get("files", [])
+        kept = [f for f in files if keep(f["filename"])]
         result = {
-            "pr_number": params.pr_number,
-            "title": pr_data["title"],
-            "state": pr_data["state"],
-            "go_files_changed": go_files,
-            "diff": diff_content
+            "base": params.base,
+            "head": params.head,
+            "merge_base_sha": merge_base,
+            "head_sha": head_sha,
+            "status": comparison.get("status"),
+            "ahead_by": comparison.get("ahead_by", 0),
+            "behind_by": comparison.get("behind_by", 0),
+            "total_commits": comparison.get("total_commits", 0),
+            "commits": [
+                {
+                    "sha": c["sha"],
+                    "author": (c.get("author") or {}).get("login") or c["commit"]["author"].get("name"),
+                    "subject": c["commit"]["message"].split("\n", 1)[0],
+                }
+                for c in comparison.get("commits", [])
+            ],
+            "comment_addressable": False,
+            **await _describe_changed_files(
+                params.owner, params.repo, kept, omitted_paths, merge_base, head_sha, modes=_diff_modes(diff_response.text)
+            ),
+            "total_files_count": len(files),
+            "files_truncated": len(files) >= GITHUB_COMPARE_FILES_LIMIT,
+            "filtered_out_count": len(files) - len(kept),
+            "diff": "".join(text for _, text in sections),
         }
-        
         if params.response_format == ResponseFormat.JSON:
             return json.dumps(result, indent=2)
-            
-        markdown = f"# PR #{params.pr_number}: {result['title']}\n"
-        markdown += f"**Status:** {result['state']}\n\n"
-        markdown += "## Go Files Changed\n"
+        
+        markdown = f"# {params.base}...{params.head}\n"
+        markdown += (
+            f"**Status:** {result['status']} ({result['ahead_by']} ahead, {result['behind_by']} behind), "
+            f"{result['total_commits']} commits, {len(files)} files\n"
+        )
+        markdown += "ℹ️ Ref comparison: there is no pull request, so findings cannot be posted as review comments.\n"
+        markdown += "\n## Go Files Changed\n"
+        go_files = result["go_files_changed"]
         markdown += "\n".join(f"- {f}" for f in go_files) if go_files else "No Go files changed"
+        if omitted_paths:
+            markdown += f"\n\n⚠️ {len(omitted_paths)} files were left out of the diff to stay within the size budget.\n"
+            markdown += "\n".join(f"- `{f['filename']}` ({f['changes']} changes)" for f in result["omitted_files"])
+        if result["files_truncated"]:
+            markdown += f"\n\n⚠️ GitHub lists at most {GITHUB_COMPARE_FILES_LIMIT} files for a comparison."
         return markdown
-            
     except Exception as e:
         return json.dumps({"error": str(e), "success": False})
 
 
-@mcp.tool(name="github_pr_post_review")
-async def post_review_comment(params: PostReviewCommentInput) -> str:
-    """Post a review comment to a GitHub pull request."""
-    try:
-        endpoint = f"/repos/{params.owner}/{params.repo}/pulls/{params.pr_number}/reviews"
-        review_data = {"body": params.body, "event": params.event}
-        if params.commit_id:
-            review_data["commit_id"] = params.commit_id
-        
-        result = await _github_api_request("POST", endpoint, review_data)
-        return json.dumps({"success": True, "html_url": result["html_url"]}, indent=2)
-    except Exception as e:
-        return json.dumps({"error": str(e), "success": False})
+def _summary_data(
+    params: AnalyzePRInput, loaded: LoadedPolicy, sections: List[Dict[str, Any]],
+    findings: Optional[List[AnalyzerFinding]] = None, head_sha: Optional[str] = None, draft: bool = False
+) -> Dict[str, Any]:
+    """The template data of a summary comment."""
+    return {
+        "Run": _template_run(params.owner, params.repo, params.pr_number, head_sha, draft=draft),
+        "Policy": _template_policy(loaded),
+        "Sections": sections,
+        "Findings": [_template_finding(f) for f in findings or []],
+    }
+
+
+async def _lightweight_review(
+    params: AnalyzePRInput, loaded: LoadedPolicy, author: str, head_sha: Optional[str] = None
+) -> str:
+    """Review a PR by an author in the policy's lightweight_authors with the dependency check alone."""
+    sections = [_template_section("note", (
+        f"> Lightweight review: the review policy lists `{author}` under `lightweight_authors`, "
+        "so only the dependency changes were checked."
+    ))]
+    modules, findings, errors = await _dependency_report(
+        params.owner, params.repo, params.pr_number, _path_filter(params.include, params.exclude, params.path_scope),
+        loaded.policy.licenses
+    )
+    sections.append(_template_section(
+        "dependencies", _dependency_markdown(modules) if modules else "No requirement changes.", "Dependencies"
+    ))
+    sections.extend(
+        _template_section("note", f"⚠️ Could not compare `{error['path']}`: {error['error']}") for error in errors
+    )
+    templates = await _load_review_templates(params.owner, params.repo)
+    summary = templates.render("summary", _summary_data(params, loaded, sections, loaded.apply(findings), head_sha))
+    if params.post_comments:
+        summary = await _post_analysis_summary(params, summary)
+    return summary
+
+
+async def _post_analysis_summary(params: AnalyzePRInput, summary: str) -> str:
+    """
+    Post an analysis as the PR's summary comment, returning the summary with a note when it was not posted.
+    
+    There is one summary comment per PR, edited on every re-review. Without
+    permission to write it, the analysis is still returned.
+    """
+    if not _dry_run(params):
+        missing = await _missing_permission(params.owner, params.repo, "pull_requests", "write")
+        if missing is not None:
+            return summary + f"\n\n> 🔒 The summary comment was not posted: {missing}.\n"
+    snapshot = await _job_snapshot(params.owner, params.repo, params.pr_number)
+    pr_data = snapshot.pr if snapshot else await _fetch_pr(params.owner, params.repo, params.pr_number)
+    posted = await _upsert_summary_comment(
+        params.owner, params.repo, params.pr_number, summary, params.summary_history, pr_data["head"]["sha"],
+        _dry_run(params)
+    )
+    if "planned_request" in posted:
+        summary += f"\n\n> 🧪 Dry run: the summary comment was not posted (it would {posted['action']} it).\n"
+    return summary
 
 
 @mcp.tool(name="github_pr_comprehensive_review")
 async def analyze_pr(params: AnalyzePRInput) -> str:
-    """Perform comprehensive automated review of a GitHub pull request."""
+    """
+    Perform comprehensive automated review of a GitHub pull request.
+    
+    PRs by authors the review policy lists under lightweight_authors, such
+    as dependency bots, only get the dependency check.
+    """
     try:
         # Step 1: Get Diff
         diff_params = GetPRDiffInput(
             owner=params.owner, repo=params.repo, 
-            pr_number=params.pr_number, response_format=ResponseFormat.JSON
+            pr_number=params.pr_number, include=params.include, exclude=params.exclude,
+            path_scope=params.path_scope, include_large_files=params.include_large_files,
+            include_generated=params.include_generated, response_format=ResponseFormat.JSON
         )
         diff_res_str = await get_pr_diff(diff_params)
         diff_result = json.loads(diff_res_str)
         
         if "error" in diff_result:
             return f"Error fetching diff: {diff_result['error']}"
+        loaded = await _load_review_policy(params.owner, params.repo)
+        if loaded.policy.lightweight_author(diff_result.get("author")):
+            return await _lightweight_review(params, loaded, diff_result["author"], diff_result.get("head_sha"))
 
         go_files = diff_result.get("go_files_changed", [])
+        templates = await _load_review_templates(params.owner, params.repo)
+        draft = bool(diff_result.get("draft"))
         
         # Step 2: Analysis & Tests
-        summary = f"## 🤖 Automated Review for PR #{params.pr_number}\n\n"
+        sections = []
+        if draft:
+            sections.append(_template_section("note", DRAFT_STAGE_NOTE))
+        if diff_result.get("path_scope"):
+            if not diff_result["in_scope_count"]:
+                # Nothing is posted, so authors of out-of-scope PRs hear nothing from this instance
+                sections.append(_template_section("note", "Nothing in scope: the PR changes no files under " + ", ".join(
+                    f"`{e}`" for e in diff_result["path_scope"]) + "."))
+                return templates.render("summary", _summary_data(params, loaded, sections, draft=draft))
+            sections.append(_template_section("note", _scope_note(diff_result["path_scope"])))
+        if diff_result.get("binary_files"):
+            sections.append(_template_section("note", _binary_files_note(diff_result["binary_files"])))
+        if diff_result.get("generated_files"):
+            sections.append(_template_section("note", _generated_files_note(diff_result["generated_files"])))
+        if diff_result.get("skipped_large_files"):
+            sections.append(_template_section("note", _large_files_note(diff_result["skipped_large_files"])))
+        if diff_result.get("submodules"):
+            sections.append(_template_section(
+                "submodules", "\n".join(_submodule_markdown(m) for m in diff_result["submodules"]), "Submodules"
+            ))
+        modules, _, _ = await _dependency_report(
+            params.owner, params.repo, params.pr_number, _path_filter(params.include, params.exclude, params.path_scope),
+            loaded.policy.licenses
+        )
+        if modules:
+            sections.append(_template_section("dependencies", _dependency_markdown(modules), "Dependencies"))
+        if diff_result.get("filtered_out_count"):
+            sections.append(_template_section(
+                "note", f"{diff_result['filtered_out_count']} files excluded by path filters."
+            ))
         
         if params.local_path and go_files:
-            summary += "### 🔍 Static Analysis\n"
+            analyses = ""
             for f in go_files:
                 f_path = Path(params.local_path) / f
                 if f_path.exists():
                     analysis = await analyze_code(AnalyzeCodeInput(file_path=str(f_path)))
-                    summary += f"#### File: `{f}`\n{analysis}\n"
+                    analyses += f"#### File: `{f}`\n{analysis}\n"
+            sections.append(_template_section("static_analysis", analyses, "Static Analysis"))
             
             if params.run_tests:
-                summary += "### 🧪 Test Results\n"
                 test_res = await run_tests(RunTestsInput(package_path="./..."))
-                summary += test_res
+                sections.append(_template_section("tests", test_res, "Test Results"))
 
+        summary = templates.render("summary", _summary_data(
+            params, loaded, sections, head_sha=diff_result.get("head_sha"), draft=draft
+        ))
         if params.post_comments:
-            await post_review_comment(PostReviewCommentInput(
-                owner=params.owner, repo=params.repo, 
-                pr_number=params.pr_number, body=summary
-            ))
+            summary = await _post_analysis_summary(params, summary)
             
         return summary
     except Exception as e:
         return f"Comprehensive review failed: {str(e)}"
 
 
+# ============================================================================
+# MCP Resources
+# ============================================================================
+
+# Read-only PR data under pr://{owner}/{repo}/{number}/<kind>, served by the
+# same fetchers as the tools so clients can prefetch and cache it
+PR_RESOURCE_KINDS = ("diff", "files", "comments", "metadata")
+
+# Sessions that have read some resource of a PR, keyed by (owner, repo, number);
+# they are sent notifications/resources/updated when its head moves
+_pr_resource_readers: Dict[Tuple[str, str, int], "weakref.WeakSet[Any]"] = {}
+
+
+def _pr_resource_uri(owner: str, repo: str, pr_number: int, kind: str) -> str:
+    return f"pr://{owner}/{repo}/{pr_number}/{kind}"
+
+
+def _resource_context() -> Optional[Context]:
+    """
+    The context of the request reading a resource, None outside a request (e.g. directly in tests).
+    
+    FastMCP only accepts resource functions whose parameters are exactly the
+    URI template's, so resources ask mcp.get_context() for it.
+    """
+    ctx = mcp.get_context()
+    try:
+        ctx.session
+    except ValueError:
+        return None
+    return ctx
+
+
+def _watch_pr_resources(owner: str, repo: str, pr_number: int) -> None:
+    """Remember that the caller's session reads this PR's resources."""
+    ctx = _resource_context()
+    if ctx is not None:
+        _pr_resource_readers.setdefault((owner, repo, pr_number), weakref.WeakSet()).add(ctx.session)
+
+
+async def _notify_pr_resources_updated(owner: str, repo: str, pr_number: int) -> None:
+    """Tell every session that read this PR's resources that they changed."""
+    for session in list(_pr_resource_readers.get((owner, repo, pr_number), ())):
+        for kind in PR_RESOURCE_KINDS:
+            try:
+                await session.send_resource_updated(AnyUrl(_pr_resource_uri(owner, repo, pr_number, kind)))
+            except Exception:
+                # A closed session just stops hearing about updates
+                logger.debug("Could not notify a session about %s/%s#%d", owner, repo, pr_number, exc_info=True)
+                break
+
+
+@mcp.resource("pr://{owner}/{repo}/{number}/diff", name="pr_diff", mime_type="text/x-diff")
+async def pr_diff_resource(owner: str, repo: str, number: str) -> str:
+    """Unified diff of a pull request, without binary file sections."""
+    pr_number = int(number)
+    await _fetch_pr(owner, repo, pr_number)
+    _watch_pr_resources(owner, repo, pr_number)
+    response = await _github_api_response(
+        "GET", f"/repos/{owner}/{repo}/pulls/{pr_number}", headers={"Accept": "application/vnd.github.v3.diff"}
+    )
+    return _strip_binary_sections(response.text)
+
+
+@mcp.resource("pr://{owner}/{repo}/{number}/diff/{chunk}", name="pr_diff_chunk", mime_type="text/x-diff")
+async def pr_diff_chunk_resource(owner: str, repo: str, number: str, chunk: str) -> str:
+    """One chunk ("part-N") of a pull request's diff, as listed by a streamed github_pr_get_diff."""
+    pr_number = int(number)
+    head_sha = await _streamed_diff_head(_resource_context(), owner, repo, pr_number)
+    _watch_pr_resources(owner, repo, pr_number)
+    return (await _streamed_diff_chunk(owner, repo, pr_number, chunk, head_sha))["diff"]
+
+
+@mcp.resource("pr://{owner}/{repo}/{number}/files", name="pr_files", mime_type="application/json")
+async def pr_files_resource(owner: str, repo: str, number: str) -> str:
+    """Files changed in a pull request, as returned by github_pr_list_files."""
+    pr_number = int(number)
+    pr_data = await _fetch_pr(owner, repo, pr_number)
+    _watch_pr_resources(owner, repo, pr_number)
+    files = await _fetch_pr_files(owner, repo, pr_number)
+    return json.dumps(
+        {"pr_number": pr_number, **_summarize_pr_files(files, pr_data.get("changed_files", len(files)))}, indent=2
+    )
+
+
+@mcp.resource("pr://{owner}/{repo}/{number}/comments", name="pr_comments", mime_type="application/json")
+async def pr_comments_resource(owner: str, repo: str, number: str) -> str:
+    """Conversation comments and line comments of a pull request."""
+    pr_number = int(number)
+    await _fetch_pr(owner, repo, pr_number)
+    _watch_pr_resources(owner, repo, pr_number)
+    comments = await _github_api_paginate(f"/repos/{owner}/{repo}/issues/{pr_number}/comments")
+    review_comments = await _github_api_paginate(f"/repos/{owner}/{repo}/pulls/{pr_number}/comments")
+    return json.dumps({
+        "pr_number": pr_number,
+        "comments": [_issue_comment_summary(c) for c in comments],
+        "review_comments": [
+            {
+                "id": c["id"],
+                "in_reply_to_id": c.get("in_reply_to_id"),
+                "author": (c.get("user") or {}).get("login"),
+                "path": c.get("path"),
+                "line": c.get("line"),
+                "commit_id": c.get("commit_id"),
+                "body": c.get("body", ""),
+            }
+            for c in review_comments
+        ],
+    }, indent=2)
+
+
+@mcp.resource("pr://{owner}/{repo}/{number}/metadata", name="pr_metadata", mime_type="application/json")
+async def pr_metadata_resource(owner: str, repo: str, number: str) -> str:
+    """Title, state, author, refs, size, milestone, assignees and linked issues of a pull request."""
+    pr_number = int(number)
+    pr_data = await _fetch_pr(owner, repo, pr_number)
+    _watch_pr_resources(owner, repo, pr_number)
+    head = _pr_head(pr_data, owner, repo)
+    return json.dumps({
+        "pr_number": pr_number,
+        "title": pr_data.get("title"),
+        "state": pr_data.get("state"),
+        "draft": pr_data.get("draft", False),
+        "author": (pr_data.get("user") or {}).get("login"),
+        "author_context": await _author_context(owner, repo, pr_data),
+        "body": pr_data.get("body") or "",
+        "base_ref": pr_data.get("base", {}).get("ref"),
+        "base_sha": pr_data.get("base", {}).get("sha"),
+        "head_ref": pr_data.get("head", {}).get("ref"),
+        "head_sha": head.sha,
+        "head_repo": None if head.deleted else f"{head.owner}/{head.repo}",
+        "is_fork": head.is_fork,
+        "mergeable": pr_data.get("mergeable"),
+        "labels": [label.get("name") for label in pr_data.get("labels", [])],
+        "milestone": _milestone_summary(pr_data.get("milestone")),
+        "assignees": [a["login"] for a in pr_data.get("assignees") or []],
+        "linked_issues": await _linked_issues(owner, repo, pr_number, pr_data.get("body")),
+        "stack": await _pr_stack(owner, repo, pr_number, pr_data),
+        "changed_files": pr_data.get("changed_files"),
+        "additions": pr_data.get("additions"),
+        "deletions": pr_data.get("deletions"),
+        "created_at": pr_data.get("created_at"),
+        "updated_at": pr_data.get("updated_at"),
+        "html_url": pr_data.get("html_url"),
+    }, indent=2)
+
+
+# ============================================================================
+# MCP Prompts
+# ============================================================================
+
+# Placeholders a prompt template may use, in str.format syntax ({diff}; {{ for a brace)
+PROMPT_VARIABLES = ("owner", "repo", "number", "title", "state", "author", "go_files", "omitted_files", "diff")
+
+# Template files in the prompts directory, named <prompt name><suffix>
+PROMPT_FILE_SUFFIXES = (".md", ".txt")
+
+
+@dataclass
+class PromptTemplate:
+    """A review prompt served through prompts/list and prompts/get."""
+    name: str
+    description: str
+    text: str
+    source: str = "built-in"
+
+
+_PROMPT_DIFF_SECTION = """
+First call github_pr_get_repo_context (owner "{owner}", repo "{repo}", pr_number {number}) to read the project's
+README, contributing guide and style files, and hold the change to the conventions they set.
+
+Pull request {owner}/{repo}#{number}: {title} ({state})
+Author: {author}
+Go files changed: {go_files}
+{omitted_files}
+```diff
+{diff}
+```"""
+
+BUILTIN_PROMPTS = [
+    PromptTemplate(
+        name="security_review",
+        description="Thorough security review of a PR's diff",
+        text=(
+            "Review this pull request for security problems. Look for injection (SQL, shell, path), "
+            "missing authentication or authorization checks, secrets or credentials in code, unsafe "
+            "deserialization, weak cryptography, unchecked input reaching file or network APIs, and "
+            "error messages that leak internals. For each problem give the file and line, explain how "
+            "it could be exploited, and suggest a fix. Say plainly if you find nothing.\n" + _PROMPT_DIFF_SECTION
+        ),
+    ),
+    PromptTemplate(
+        name="quick_sanity_pass",
+        description="Fast check of a PR for obvious bugs",
+        text=(
+            "Give this pull request a quick sanity pass. Only report problems that would break the build, "
+            "crash at runtime, or clearly do the wrong thing: typos in identifiers, inverted conditions, "
+            "unhandled errors, missing nil checks, leftover debug code. Skip style. Keep the answer to "
+            "a short list.\n" + _PROMPT_DIFF_SECTION
+        ),
+    ),
+    PromptTemplate(
+        name="go_idioms_review",
+        description="Review a PR's Go code against Effective Go and common idioms",
+        text=(
+            "Review the Go code in this pull request for idiomatic style. Check error handling "
+            "(wrapping with %w, no ignored errors), naming, doc comments on exported identifiers, "
+            "interface size, context propagation, goroutine and channel lifetimes, defer use, and "
+            "needless allocations. Point to the line and show the idiomatic version.\n" + _PROMPT_DIFF_SECTION
+        ),
+    ),
+    PromptTemplate(
+        name="breaking_change_audit",
+        description="Audit a PR for changes that break its users",
+        text=(
+            "Audit this pull request for breaking changes. List every change to exported APIs, "
+            "function signatures, struct fields, wire or file formats, configuration keys, CLI flags "
+            "and default values, and say who is affected and how. Note whether each one is called out "
+            "in the PR and suggest a compatible alternative where there is one.\n" + _PROMPT_DIFF_SECTION
+        ),
+    ),
+]
+
+
+def _check_prompt_template(template: PromptTemplate) -> None:
+    """Raise ValueError if the template has unknown placeholders or does not render."""
+    try:
+        for _, field_name, _, _ in string.Formatter().parse(template.text):
+            if field_name is not None and field_name not in PROMPT_VARIABLES:
+                raise ValueError(
+                    f"unknown placeholder {{{field_name}}}; use one of {', '.join(PROMPT_VARIABLES)}"
+                )
+        template.text.format(**{name: "" for name in PROMPT_VARIABLES})
+    except (ValueError, IndexError, KeyError) as e:
+        raise ValueError(f"Prompt template {template.source}: {e}") from None
+
+
+def _load_prompt_templates(directory: str) -> Dict[str, PromptTemplate]:
+    """
+    Return the built-in prompts overlaid with the template files in directory.
+    
+    A file replaces the built-in prompt of the same name or adds a new one; a
+    first line of the form "description: ..." sets its description. Every
+    template is checked here, so mistakes stop the server from starting
+    instead of failing a prompts/get later.
+    
+    Args:
+        directory (str): Directory of template files; empty for built-ins only
+    
+    Returns:
+        Dict[str, PromptTemplate]: Templates by prompt name
+    
+    Raises:
+        ValueError: If the directory is missing or any template is invalid
+    """
+    templates = {template.name: template for template in BUILTIN_PROMPTS}
+    if not directory:
+        return templates
+    root = Path(directory)
+    if not root.is_dir():
+        raise ValueError(f"Prompt template directory {directory} does not exist")
+    errors = []
+    for path in sorted(root.iterdir()):
+        if path.suffix not in PROMPT_FILE_SUFFIXES or not path.is_file():
+            continue
+        text = path.read_text(encoding="utf-8")
+        description = f"Custom review prompt from {path.name}"
+        first, _, rest = text.partition("\n")
+        if first.lower().startswith("description:"):
+            description, text = first.split(":", 1)[1].strip(), rest
+        template = PromptTemplate(name=path.stem, description=description, text=text, source=str(path))
+        try:
+            _check_prompt_template(template)
+        except ValueError as e:
+            errors.append(str(e))
+            continue
+        templates[template.name] = template
+    if errors:
+        raise ValueError("\n".join(errors))
+    return templates
+
+
+async def _render_prompt(template: PromptTemplate, owner: str, repo: str, pr_number: int) -> str:
+    """Expand a template with the PR's diff, cut to the diff size budget."""
+    diff_result = json.loads(await get_pr_diff(GetPRDiffInput(
+        owner=owner, repo=repo, pr_number=pr_number, response_format=ResponseFormat.JSON
+    )))
+    if "error" in diff_result:
+        raise ValueError(f"Could not fetch the diff of {owner}/{repo}#{pr_number}: {diff_result['error']}")
+    omitted = [f["filename"] for f in diff_result["omitted_files"]]
+    omitted_note = (
+        f"Left out of the diff to stay within the size budget (fetch with github_pr_get_diff and path): "
+        f"{', '.join(omitted)}\n" if omitted else ""
+    )
+    return template.text.format(
+        owner=owner,
+        repo=repo,
+        number=pr_number,
+        title=diff_result["title"],
+        state=diff_result["state"],
+        author=_author_note(diff_result["author_context"]),
+        go_files=", ".join(diff_result["go_files_changed"]) or "none",
+        omitted_files=omitted_note,
+        diff=diff_result["diff"],
+    )
+
+
+def _prompt_handler(template: PromptTemplate) -> Callable[..., Any]:
+    """Build the prompts/get handler of a template; its signature defines the prompt's arguments."""
+    async def render(owner: str, repo: str, number: str) -> str:
+        return await _render_prompt(template, owner, repo, int(number))
+    return render
+
+
+def _register_prompts(templates: Dict[str, PromptTemplate]) -> None:
+    """Register each template as an MCP prompt taking owner, repo and number."""
+    for template in templates.values():
+        mcp.prompt(name=template.name, description=template.description)(_prompt_handler(template))
+
+
+# ============================================================================
+# Webhook Listener
+# ============================================================================
+
+# pull_request actions that mean there is new code to review
+WEBHOOK_REVIEW_ACTIONS = ("opened", "synchronize", "ready_for_review")
+
+
+@dataclass
+class ReviewJob:
+    """A review triggered by a pull_request webhook delivery."""
+    delivery_id: str
+    action: str
+    owner: str
+    repo: str
+    pr_number: int
+    head_sha: str
+
+
+def _verify_webhook_signature(secret: str, body: bytes, signature: Optional[str]) -> bool:
+    """Check an X-Hub-Signature-256 header against the HMAC-SHA256 of the raw body."""
+    if not secret or not signature or not signature.startswith("sha256="):
+        return False
+    expected = "sha256=" + hmac.new(secret.encode(), body, hashlib.sha256).hexdigest()
+    return hmac.compare_digest(expected, signature)
+
+
+async def _comprehensive_review_backend(job: ReviewJob) -> None:
+    """Review with the built-in pipeline and post the summary to the PR."""
+    await analyze_pr(AnalyzePRInput(
+        owner=job.owner, repo=job.repo, pr_number=job.pr_number, run_tests=False, post_comments=True
+    ))
+
+
+def _trivial_approval_backend(backend: Callable[[ReviewJob], Any]) -> Callable[[ReviewJob], Any]:
+    """Approve and label PRs that _classify_pr finds trivial, passing every other PR to backend."""
+    async def run(job: ReviewJob) -> None:
+        result = await _classify_pr(job.owner, job.repo, job.pr_number, TRIVIAL_PATHS, TRIVIAL_MAX_CHANGED_LINES)
+        if not result["trivial"]:
+            await backend(job)
+            return
+        logger.info("Approving trivial %s/%s#%d (%s)", job.owner, job.repo, job.pr_number, result["reason"])
+        review = json.loads(await create_review(CreateReviewInput(
+            owner=job.owner, repo=job.repo, pr_number=job.pr_number, event="APPROVE", commit_id=result["head_sha"],
+            summary="Approved without a full review: this PR is trivial.\n\n" + _classification_markdown(result)
+        )))
+        if not review["success"]:
+            raise RuntimeError(f"Could not approve trivial PR: {review['error']}")
+        labeled = json.loads(await add_labels(AddLabelsInput(
+            owner=job.owner, repo=job.repo, pr_number=job.pr_number, labels=[TRIVIAL_LABEL], create_if_missing=True
+        )))
+        if not labeled["success"]:
+            raise RuntimeError(f"Could not label trivial PR: {labeled['error']}")
+    return run
+
+
+def _command_review_backend(command: str, prompt: str, timeout: float) -> Callable[[ReviewJob], Any]:
+    """Review by running an external command (e.g. an agent CLI) with the prompt on stdin."""
+    async def run(job: ReviewJob) -> None:
+        rendered = prompt.format(**asdict(job))
+        env = {"PR_OWNER": job.owner, "PR_REPO": job.repo, "PR_NUMBER": str(job.pr_number), "PR_HEAD_SHA": job.head_sha}
+        if GITHUB_READ_ONLY:
+            # A server the command starts stays read-only too
+            env["GITHUB_READ_ONLY"] = "true"
+        result = await _run_command_async(shlex.split(command), input_text=rendered, timeout=timeout, env=env)
+        if not result["success"]:
+            raise RuntimeError(f"Review command exited with {result['returncode']}: {result['stderr'].strip()[-500:]}")
+    return run
+
+
+class ReviewQueue:
+    """
+    Run review jobs in background tasks, at most concurrency at a time.
+    
+    The webhook receiver and, over HTTP, github_pr_queue_reviews each feed
+    one, so a batch of fifty PRs waits its turn instead of running at once.
+    Jobs are serialized per PR. A new job replaces one still waiting for the
+    same PR and cancels a running review of an older head, then waits
+    debounce seconds, so a burst of pushes gets one review of the last head.
+    A job for the head a running review already covers is dropped.
+    """
+    
+    def __init__(
+        self,
+        backend: Callable[[ReviewJob], Any],
+        concurrency: int = DEFAULT_WEBHOOK_CONCURRENCY,
+        debounce: float = 0.0,
+        sleep: Callable[[float], Awaitable[Any]] = asyncio.sleep
+    ):
+        self._backend = backend
+        self._slots = asyncio.Semaphore(concurrency)
+        self._debounce = debounce
+        self._sleep = sleep
+        self._tasks: set = set()
+        # (owner, repo, pr_number, head_sha) of jobs waiting or running
+        self._active: Counter = Counter()
+        # (owner, repo, pr_number) -> (job, task) of the one job waiting and the one running per PR
+        self._waiting: Dict[Tuple[str, str, int], Tuple[ReviewJob, asyncio.Task]] = {}
+        self._running: Dict[Tuple[str, str, int], Tuple[ReviewJob, asyncio.Task]] = {}
+        # Running tasks already cancelled, which stay in _running until they unwind
+        self._cancelled: set = set()
+    
+    @property
+    def pending(self) -> int:
+        """Jobs waiting or running."""
+        return len(self._tasks)
+    
+    def is_queued(self, owner: str, repo: str, pr_number: int, head_sha: str) -> bool:
+        return self._active[(owner, repo, pr_number, head_sha)] > 0
+    
+    def submit(self, job: ReviewJob) -> Optional[int]:
+        """
+        Queue job, returning how many older jobs for the same PR it superseded.
+        
+        Returns None without queueing anything when a review of the same head
+        is running, e.g. for a ready_for_review delivery arriving while the
+        opened one is reviewed; a second review would post the same output.
+        """
+        pr = (job.owner, job.repo, job.pr_number)
+        running = self._running.get(pr)
+        if running is not None and running[0].head_sha == job.head_sha and running[1] not in self._cancelled:
+            logger.info("Review of %s/%s#%d at %s already running; dropping delivery %s", job.owner, job.repo,
+                        job.pr_number, job.head_sha[:12], job.delivery_id)
+            return None
+        superseded = 0
+        waiting = self._waiting.pop(pr, None)
+        if waiting is not None:
+            waiting[1].cancel()
+            superseded += 1
+            METRICS.inc("github_pr_mcp_reviews_superseded_total", {"stage": "waiting"})
+        if running is not None and running[0].head_sha != job.head_sha and running[1] not in self._cancelled:
+            logger.info("Cancelling review of %s/%s#%d at %s, superseded by %s", job.owner, job.repo,
+                        job.pr_number, running[0].head_sha[:12], job.head_sha[:12])
+            running[1].cancel()
+            self._cancelled.add(running[1])
+            superseded += 1
+            METRICS.inc("github_pr_mcp_reviews_superseded_total", {"stage": "running"})
+        key = (job.owner, job.repo, job.pr_number, job.head_sha)
+        self._active[key] += 1
+        task = asyncio.create_task(self._run(job, pr))
+        self._waiting[pr] = (job, task)
+        self._tasks.add(task)
+        task.add_done_callback(lambda done: self._finished(key, pr, done))
+        METRICS.set("github_pr_mcp_review_queue_depth", None, len(self._waiting))
+        return superseded
+    
+    def _finished(self, key: Tuple[str, str, int, str], pr: Tuple[str, str, int], task: asyncio.Task) -> None:
+        # A task cancelled before it first ran never reaches _run's cleanup, so it all happens here
+        self._tasks.discard(task)
+        self._cancelled.discard(task)
+        self._active[key] -= 1
+        if not self._active[key]:
+            del self._active[key]
+        for slots in (self._waiting, self._running):
+            if pr in slots and slots[pr][1] is task:
+                del slots[pr]
+        METRICS.set("github_pr_mcp_review_queue_depth", None, len(self._waiting))
+    
+    async def _run(self, job: ReviewJob, pr: Tuple[str, str, int]) -> None:
+        # The task runs in a copy of the submitter's context, so these stay with the job
+        _call_account.set(job.owner)
+        _job_snapshots.set({})
+        if self._debounce > 0:
+            # A push within the quiet period cancels this task and queues its own
+            await self._sleep(self._debounce)
+        # Let a cancelled review of an older head unwind first, so one review per PR runs at a time
+        while pr in self._running:
+            await asyncio.wait([self._running[pr][1]])
+        async with self._slots:
+            del self._waiting[pr]
+            self._running[pr] = (job, asyncio.current_task())
+            METRICS.set("github_pr_mcp_review_queue_depth", None, len(self._waiting))
+            logger.info("Reviewing %s/%s#%d at %s (delivery %s)", job.owner, job.repo, job.pr_number,
+                        job.head_sha[:12], job.delivery_id)
+            started = time.monotonic()
+            try:
+                # Cancellation interrupts the backend at its next await, before it posts anything more
+                await self._backend(job)
+                mode = "batch" if job.action == "batch" else "webhook"
+                METRICS.observe("github_pr_mcp_review_duration_seconds", {"mode": mode}, time.monotonic() - started)
+            except Exception:
+                logger.exception("Review of %s/%s#%d failed (delivery %s)", job.owner, job.repo,
+                                 job.pr_number, job.delivery_id)
+    
+    async def drain(self) -> None:
+        """Wait for queued and running reviews, e.g. in tests or on shutdown."""
+        while self._tasks:
+            # Superseded jobs end cancelled
+            await asyncio.gather(*list(self._tasks), return_exceptions=True)
+
+
+# The queue behind github_pr_queue_reviews; set when the server serves MCP over HTTP
+_review_queue: Optional[ReviewQueue] = None
+# Set when serving over HTTP, where github_pr_get_diff answers large diffs with a chunk manifest
+_stream_large_diffs = False
+
+
+class WebhookReviewer:
+    """
+    Turn pull_request webhook deliveries into background review jobs.
+    
+    handle() answers as soon as a job is queued on a ReviewQueue, which
+    limits how many reviews run at once. Redeliveries of the same delivery
+    ID are acknowledged without starting a second review. Draft PRs are
+    skipped unless review_drafts is set; their ready_for_review event
+    starts the first review. A push supersedes the PR's queued or running
+    review, which starts again once debounce seconds pass without pushes.
+    """
+    
+    def __init__(
+        self,
+        secret: str,
+        backend: Callable[[ReviewJob], Any],
+        concurrency: int = DEFAULT_WEBHOOK_CONCURRENCY,
+        review_drafts: bool = GITHUB_WEBHOOK_REVIEW_DRAFTS,
+        debounce: float = 0.0
+    ):
+        if not secret:
+            raise ValueError("Webhook mode requires GITHUB_WEBHOOK_SECRET")
+        self._secret = secret
+        self._review_drafts = review_drafts
+        self._queue = ReviewQueue(backend, concurrency, debounce)
+        self._deliveries: "OrderedDict[str, None]" = OrderedDict()
+    
+    def _seen(self, delivery_id: str) -> bool:
+        if delivery_id in self._deliveries:
+            return True
+        self._deliveries[delivery_id] = None
+        if len(self._deliveries) > WEBHOOK_DELIVERY_CACHE_SIZE:
+            self._deliveries.popitem(last=False)
+        return False
+    
+    async def handle(self, headers: Dict[str, str], body: bytes) -> Tuple[int, Dict[str, Any]]:
+        """Validate and filter one delivery, queueing a review; returns (HTTP status, JSON body)."""
+        headers = {k.lower(): v for k, v in headers.items()}
+        # The delivery ID doubles as the correlation ID, so logs match GitHub's delivery history;
+        # the review task started below inherits it
+        _correlation_id.set(headers.get("x-github-delivery") or _new_correlation_id())
+        if not _verify_webhook_signature(self._secret, body, headers.get("x-hub-signature-256")):
+            return 401, {"error": "invalid signature"}
+        event = headers.get("x-github-event", "")
+        if event == "ping":
+            return 200, {"status": "pong"}
+        if event != "pull_request":
+            return 200, {"status": "ignored", "reason": f"event {event}"}
+        delivery_id = headers.get("x-github-delivery", "")
+        try:
+            payload = json.loads(body)
+        except ValueError:
+            return 400, {"error": "body is not JSON"}
+        if not isinstance(payload, dict):
+            return 400, {"error": "body is not a JSON object"}
+        action = payload.get("action")
+        owner = _payload_field(payload, "repository", "owner", "login")
+        repo = _payload_field(payload, "repository", "name")
+        if not isinstance(owner, str) or not isinstance(repo, str):
+            return 400, {"error": "payload has no repository owner login and name"}
+        number = _payload_field(payload, "pull_request", "number")
+        head_sha = _payload_field(payload, "pull_request", "head", "sha")
+        if not isinstance(number, int) or not isinstance(head_sha, str):
+            return 400, {"error": "payload has no pull request number and head SHA"}
+        unknown = _unknown_account(owner)
+        if unknown is not None:
+            return 200, {"status": "ignored", "reason": str(unknown)}
+        if action == "synchronize":
+            # New commits change every PR resource, drafts included
+            _get_github_client(owner).track_pr_head(owner, repo, number, head_sha)
+            await _notify_pr_resources_updated(owner, repo, number)
+        if action not in WEBHOOK_REVIEW_ACTIONS:
+            return 200, {"status": "ignored", "reason": f"action {action}"}
+        if _payload_field(payload, "pull_request", "draft") and not self._review_drafts:
+            return 200, {"status": "ignored", "reason": "draft pull request"}
+        if delivery_id and self._seen(delivery_id):
+            return 200, {"status": "duplicate", "delivery_id": delivery_id}
+        
+        job = ReviewJob(
+            delivery_id=delivery_id,
+            action=action,
+            owner=owner,
+            repo=repo,
+            pr_number=number,
+            head_sha=head_sha,
+        )
+        superseded = self._queue.submit(job)
+        if superseded is None:
+            return 200, {"status": "ignored", "reason": "a review of this head is already running",
+                         "delivery_id": delivery_id}
+        response = {"status": "queued", "delivery_id": delivery_id}
+        if superseded:
+            response["superseded"] = superseded
+        return 200, response
+    
+    async def drain(self) -> None:
+        """Wait for queued and running reviews, e.g. in tests or on shutdown."""
+        await self._queue.drain()
+
+
+def _payload_field(payload: Dict[str, Any], *keys: str) -> Any:
+    """The value under keys in a webhook payload, or None when a level is missing or not an object."""
+    value: Any = payload
+    for key in keys:
+        if not isinstance(value, dict):
+            return None
+        value = value.get(key)
+    return value
+
+
+def _webhook_backend() -> Callable[[ReviewJob], Any]:
+    """Build the review backend selected by GITHUB_WEBHOOK_BACKEND, approving trivial PRs first if enabled."""
+    if GITHUB_WEBHOOK_BACKEND == "comprehensive":
+        backend = _comprehensive_review_backend
+    elif GITHUB_WEBHOOK_BACKEND == "command":
+        if not GITHUB_WEBHOOK_COMMAND:
+            raise ValueError("GITHUB_WEBHOOK_BACKEND=command requires GITHUB_WEBHOOK_COMMAND")
+        backend = _command_review_backend(GITHUB_WEBHOOK_COMMAND, GITHUB_WEBHOOK_PROMPT, GITHUB_WEBHOOK_COMMAND_TIMEOUT)
+    else:
+        raise ValueError(f"Unknown GITHUB_WEBHOOK_BACKEND {GITHUB_WEBHOOK_BACKEND!r}")
+    return _trivial_approval_backend(backend) if GITHUB_WEBHOOK_AUTO_APPROVE_TRIVIAL else backend
+
+
+def _webhook_app(reviewer: WebhookReviewer, path: str):
+    """Build the ASGI app serving the webhook endpoint."""
+    from starlette.applications import Starlette
+    from starlette.requests import Request
+    from starlette.responses import JSONResponse
+    from starlette.routing import Route
+    
+    async def receive(request: Request) -> JSONResponse:
+        status, body = await reviewer.handle(dict(request.headers), await request.body())
+        return JSONResponse(body, status_code=status)
+    
+    return Starlette(routes=[Route(path, receive, methods=["POST"])])
+
+
+def _parse_args(argv: Optional[List[str]] = None) -> argparse.Namespace:
+    """Parse the server's command line options."""
+    parser = argparse.ArgumentParser(description="GitHub PR Review MCP Server")
+    parser.add_argument(
+        "--transport",
+        choices=["stdio", "http", "sse"],
+        default="stdio",
+        help="MCP transport: stdio (default), streamable HTTP, or legacy SSE"
+    )
+    parser.add_argument("--host", default=DEFAULT_HTTP_HOST, help="Bind address for HTTP transports")
+    parser.add_argument("--port", type=int, default=DEFAULT_HTTP_PORT, help="Port for HTTP transports")
+    parser.add_argument(
+        "--shutdown-timeout",
+        type=float,
+        default=DEFAULT_SHUTDOWN_TIMEOUT,
+        help="Seconds to drain in-flight tool calls on SIGTERM (HTTP transports)"
+    )
+    parser.add_argument(
+        "--webhook",
+        action="store_true",
+        help="Serve a GitHub webhook endpoint that reviews PRs on pull_request events instead of MCP"
+    )
+    parser.add_argument("--webhook-path", default="/webhook", help="URL path of the webhook endpoint")
+    parser.add_argument(
+        "--metrics-port",
+        type=int,
+        default=0,
+        help="Serve Prometheus metrics at /metrics on this port (disabled by default)"
+    )
+    parser.add_argument(
+        "--webhook-concurrency",
+        type=int,
+        default=DEFAULT_WEBHOOK_CONCURRENCY,
+        help="Reviews run at the same time in webhook mode and for github_pr_queue_reviews"
+    )
+    parser.add_argument(
+        "--webhook-debounce",
+        type=float,
+        default=GITHUB_WEBHOOK_DEBOUNCE,
+        help="Seconds without a new push before a PR's webhook review starts (default from GITHUB_WEBHOOK_DEBOUNCE, else 30)"
+    )
+    parser.add_argument(
+        "--tool-timeout",
+        type=float,
+        default=TOOL_CALL_TIMEOUT,
+        help="Seconds a tool call may run before it is cut off, 0 for no limit (default from TOOL_CALL_TIMEOUT, else 300)"
+    )
+    parser.add_argument(
+        "--github-timeout",
+        type=float,
+        default=GITHUB_REQUEST_TIMEOUT,
+        help="Seconds a single GitHub API request may take (default from GITHUB_REQUEST_TIMEOUT, else 30)"
+    )
+    parser.add_argument(
+        "--prompts-dir",
+        default=PR_REVIEWER_PROMPTS_DIR,
+        help="Directory of prompt templates adding to or replacing the built-in ones (default from PR_REVIEWER_PROMPTS_DIR)"
+    )
+    parser.add_argument(
+        "--templates-dir",
+        default=PR_REVIEWER_TEMPLATES_DIR,
+        help="Directory of .tmpl files replacing the built-in comment templates (default from PR_REVIEWER_TEMPLATES_DIR)"
+    )
+    parser.add_argument(
+        "--state-path",
+        default=PR_REVIEWER_STATE_PATH,
+        help="SQLite file keeping each PR's last reviewed head, posted findings and summary comment across restarts "
+             "(default from PR_REVIEWER_STATE_PATH; kept in memory when unset)"
+    )
+    parser.add_argument(
+        "--login",
+        action="store_true",
+        help="Sign in with the OAuth device flow (needs GITHUB_OAUTH_CLIENT_ID), save the token and exit"
+    )
+    parser.add_argument(
+        "--read-only",
+        action="store_true",
+        default=GITHUB_READ_ONLY,
+        help="Run every mutating tool as a dry run, returning what it would post (default from GITHUB_READ_ONLY)"
+    )
+    parser.add_argument(
+        "--log-level",
+        type=str.upper,
+        choices=["DEBUG", "INFO", "WARNING", "ERROR"],
+        default=LOG_LEVEL,
+        help="Minimum level of log records to emit (default from LOG_LEVEL, else INFO)"
+    )
+    parser.add_argument(
+        "--log-format",
+        choices=["text", "json"],
+        default=LOG_FORMAT,
+        help="Log line format (default from LOG_FORMAT, else text)"
+    )
+    return parser.parse_args(argv)
+
+
+def _serve_http(args: argparse.Namespace) -> None:
+    """Serve MCP (or the webhook endpoint) over HTTP, draining in-flight requests on shutdown."""
+    import uvicorn
+    global _review_queue, _stream_large_diffs
+    
+    backend = _webhook_backend()
+    if args.webhook:
+        reviewer = WebhookReviewer(
+            GITHUB_WEBHOOK_SECRET, backend, args.webhook_concurrency, debounce=args.webhook_debounce
+        )
+        app = _webhook_app(reviewer, args.webhook_path)
+    else:
+        # The server outlives tool calls here, so github_pr_queue_reviews can run reviews in the background
+        _review_queue = ReviewQueue(backend, args.webhook_concurrency)
+        _stream_large_diffs = True
+        app = mcp.sse_app() if args.transport == "sse" else mcp.streamable_http_app()
+    config = uvicorn.Config(
+        app,
+        host=args.host,
+        port=args.port,
+        # uvicorn stops accepting connections on SIGTERM/SIGINT and waits this
+        # long for running requests before cancelling them
+        timeout_graceful_shutdown=args.shutdown_timeout,
+        log_level=args.log_level.lower(),
+        # Keep uvicorn's loggers on the root handler, which redacts and adds correlation IDs
+        log_config=None
+    )
+    uvicorn.Server(config).run()
+
+
+async def _serve_stdio() -> None:
+    """
+    Serve MCP over stdio until the client disconnects or SIGINT/SIGTERM arrives.
+    
+    A signal cancels the server task, which cancels every in-flight tool
+    call and its GitHub requests and subprocesses, so shutdown is prompt.
+    """
+    loop = asyncio.get_running_loop()
+    task = asyncio.current_task()
+    for sig in (signal.SIGINT, signal.SIGTERM):
+        loop.add_signal_handler(sig, task.cancel)
+    try:
+        await mcp.run_stdio_async()
+    except asyncio.CancelledError:
+        logger.info("Shutting down")
+    finally:
+        for sig in (signal.SIGINT, signal.SIGTERM):
+            loop.remove_signal_handler(sig)
+
+
+async def _login_interactive(flow: DeviceFlowAuth) -> None:
+    """Run the device flow on the terminal; prompts go to stderr so stdout stays free for MCP."""
+    device = await flow.start()
+    print(
+        f"Open {device['verification_uri']} and enter the code {device['user_code']}",
+        file=sys.stderr, flush=True
+    )
+    await flow.poll(device)
+    print(f"Signed in; token saved to {flow.token_path}", file=sys.stderr)
+
+
+def main(argv: Optional[List[str]] = None) -> None:
+    """Run the MCP server on the selected transport."""
+    global TOOL_CALL_TIMEOUT, GITHUB_REQUEST_TIMEOUT, GITHUB_READ_ONLY, _server_templates, _review_store
+    args = _parse_args(argv)
+    TOOL_CALL_TIMEOUT, GITHUB_REQUEST_TIMEOUT = args.tool_timeout, args.github_timeout
+    GITHUB_READ_ONLY = args.read_only
+    _configure_logging(args.log_level, args.log_format)
+    try:
+        _github_accounts()
+    except ValueError as e:
+        sys.exit(f"GITHUB_ACCOUNTS: {e}")
+    if args.login:
+        flow = _get_device_flow()
+        if flow is None:
+            sys.exit("--login needs GITHUB_OAUTH_CLIENT_ID")
+        try:
+            asyncio.run(_login_interactive(flow))
+        except ValueError as e:
+            sys.exit(str(e))
+        return
+    _register_prompts(_load_prompt_templates(args.prompts_dir))
+    try:
+        _server_templates = _load_review_template_dir(args.templates_dir)
+    except ValueError as e:
+        sys.exit(f"Review templates:\n{e}")
+    if args.state_path:
+        try:
+            _review_store = SQLiteReviewStore(args.state_path)
+        except (OSError, sqlite3.Error) as e:
+            sys.exit(f"--state-path {args.state_path}: {e}")
+    if args.metrics_port:
+        _start_metrics_server(args.host, args.metrics_port)
+    if args.transport == "stdio" and not args.webhook:
+        asyncio.run(_serve_stdio())
+    else:
+        mcp.settings.host = args.host
+        mcp.settings.port = args.port
+        _serve_http(args)
+
+
 if __name__ == "__main__":
-    mcp.run()
\ No newline at end of file
+    main()
\ No newline at end of file